@@ -37,7 +37,7 @@ func addMigrations(ctx context.Context, node *core.IpfsNode, fetcher migrations.
 			if err != nil {
 				return err
 			}
-		case *migrations.HttpFetcher:
+		case *migrations.HttpFetcher, *migrations.FileFetcher:
 			// Add the downloaded migration files directly
 			if migrations.DownloadDirectory != "" {
 				var paths []string
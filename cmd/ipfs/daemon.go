@@ -27,10 +27,13 @@ import (
 	corehttp "github.com/ipfs/go-ipfs/core/corehttp"
 	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
 	libp2p "github.com/ipfs/go-ipfs/core/node/libp2p"
+	fuseMount "github.com/ipfs/go-ipfs/fuse/mount"
 	nodeMount "github.com/ipfs/go-ipfs/fuse/node"
+	plugin "github.com/ipfs/go-ipfs/plugin"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
 	"github.com/ipfs/go-ipfs/repo/fsrepo/migrations"
 	"github.com/ipfs/go-ipfs/repo/fsrepo/migrations/ipfsfetcher"
+	_ "github.com/ipfs/go-ipfs/repo/fsrepo/migrations/mg10" // compiled into the binary
 	sockets "github.com/libp2p/go-socket-activation"
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
@@ -51,7 +54,10 @@ const (
 	initProfileOptionKwd      = "init-profile"
 	ipfsMountKwd              = "mount-ipfs"
 	ipnsMountKwd              = "mount-ipns"
+	mfsMountKwd               = "mount-mfs"
 	migrateKwd                = "migrate"
+	migrateDryRunKwd          = "migrate-dry-run"
+	migrateNoBackupKwd        = "migrate-no-backup"
 	mountKwd                  = "mount"
 	offlineKwd                = "offline" // global option
 	routingOptionKwd          = "routing"
@@ -172,11 +178,14 @@ Headers.
 		cmds.BoolOption(writableKwd, "Enable writing objects (with POST, PUT and DELETE)"),
 		cmds.StringOption(ipfsMountKwd, "Path to the mountpoint for IPFS (if using --mount). Defaults to config setting."),
 		cmds.StringOption(ipnsMountKwd, "Path to the mountpoint for IPNS (if using --mount). Defaults to config setting."),
+		cmds.StringOption(mfsMountKwd, "Path to the mountpoint for the MFS root (if using --mount). Defaults to config setting, not mounted when empty."),
 		cmds.BoolOption(unrestrictedApiAccessKwd, "Allow API access to unlisted hashes"),
 		cmds.BoolOption(unencryptTransportKwd, "Disable transport encryption (for debugging protocols)"),
 		cmds.BoolOption(enableGCKwd, "Enable automatic periodic repo garbage collection"),
 		cmds.BoolOption(adjustFDLimitKwd, "Check and raise file descriptor limits if needed").WithDefault(true),
 		cmds.BoolOption(migrateKwd, "If true, assume yes at the migrate prompt. If false, assume no."),
+		cmds.BoolOption(migrateDryRunKwd, "Log the migrations of the repo and the changes they would make, without making them, then exit."),
+		cmds.BoolOption(migrateNoBackupKwd, "Don't keep a copy of the files changed by the migrations compiled into ipfs."),
 		cmds.BoolOption(enablePubSubKwd, "Instantiate the ipfs daemon with the experimental pubsub feature enabled."),
 		cmds.BoolOption(enableIPNSPubSubKwd, "Enable IPNS record distribution through pubsub; enables pubsub."),
 		cmds.BoolOption(enableMultiplexKwd, "DEPRECATED"),
@@ -232,6 +241,8 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 	}
 
 	cctx := env.(*oldcmds.Context)
+	// The daemon is the one the clients call.
+	cctx.Daemon = nil
 
 	// check transport encryption flag.
 	unencrypted, _ := req.Options[unencryptTransportKwd].(bool)
@@ -283,9 +294,14 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 		return err
 	case fsrepo.ErrNeedMigration:
 		domigrate, found := req.Options[migrateKwd].(bool)
+		dryRun, _ := req.Options[migrateDryRunKwd].(bool)
+		noBackup, _ := req.Options[migrateNoBackupKwd].(bool)
 		fmt.Println("Found outdated fs-repo, migrations need to be run.")
 
-		if !found {
+		// A dry run changes nothing, there is nothing to confirm.
+		if dryRun {
+			domigrate = true
+		} else if !found {
 			domigrate = YesNoPrompt("Run migrations now? [y/N]")
 		}
 
@@ -341,7 +357,10 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 			}()
 		}
 
-		err = migrations.RunMigration(cctx.Context(), fetcher, fsrepo.RepoVersion, "", false)
+		err = migrations.RunMigrationWithOptions(cctx.Context(), fetcher, fsrepo.RepoVersion, "", migrations.RunOptions{
+			DryRun:   dryRun,
+			NoBackup: noBackup,
+		})
 		if err != nil {
 			fmt.Println("The migrations of fs-repo failed:")
 			fmt.Printf("  %s\n", err)
@@ -349,13 +368,21 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 			fmt.Println("  https://github.com/ipfs/fs-repo-migrations")
 			return err
 		}
+		if dryRun {
+			fmt.Println("Not starting the daemon after a dry run of the migrations.")
+			return nil
+		}
 
 		repo, err = fsrepo.Open(cctx.ConfigRoot)
 		if err != nil {
 			return err
 		}
 	case nil:
-		break
+		if dryRun, _ := req.Options[migrateDryRunKwd].(bool); dryRun {
+			repo.Close()
+			fmt.Println("The fs-repo is up to date, no migrations to run.")
+			return nil
+		}
 	}
 
 	// The node will also close the repo but there are many places we could
@@ -648,6 +675,11 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 		opts = append(opts, corehttp.RedirectOption("", cfg.Gateway.RootRedirect))
 	}
 
+	opts, err = pluginServeOptions(cctx, plugin.HTTPAPI, opts)
+	if err != nil {
+		return nil, fmt.Errorf("serveHTTPApi: %s", err)
+	}
+
 	node, err := cctx.ConstructNode()
 	if err != nil {
 		return nil, fmt.Errorf("serveHTTPApi: ConstructNode() failed: %s", err)
@@ -675,6 +707,25 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 	return errc, nil
 }
 
+// pluginServeOptions wraps opts with the middleware of the HTTP plugins for
+// the server, and appends their serve options.
+func pluginServeOptions(cctx *oldcmds.Context, server plugin.HTTPServer, opts []corehttp.ServeOption) ([]corehttp.ServeOption, error) {
+	middleware, pluginOpts, err := cctx.Plugins.HTTPOptions(server)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]corehttp.ServeOption, 0, len(middleware)+len(opts)+len(pluginOpts))
+	for _, mw := range middleware {
+		all = append(all, corehttp.MiddlewareOption(mw))
+	}
+	all = append(all, opts...)
+	for _, opt := range pluginOpts {
+		all = append(all, opt)
+	}
+	return all, nil
+}
+
 // printSwarmAddrs prints the addresses of the host
 func printSwarmAddrs(node *core.IpfsNode) {
 	if !node.IsOnline {
@@ -781,6 +832,11 @@ func serveHTTPGateway(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, e
 		log.Error("Support for X-Ipfs-Gateway-Prefix and Gateway.PathPrefixes is deprecated and will be removed in the next release. Please comment on the issue if you're using this feature: https://github.com/ipfs/go-ipfs/issues/7702")
 	}
 
+	opts, err = pluginServeOptions(cctx, plugin.HTTPGateway, opts)
+	if err != nil {
+		return nil, fmt.Errorf("serveHTTPGateway: %s", err)
+	}
+
 	node, err := cctx.ConstructNode()
 	if err != nil {
 		return nil, fmt.Errorf("serveHTTPGateway: ConstructNode() failed: %s", err)
@@ -826,12 +882,24 @@ func mountFuse(req *cmds.Request, cctx *oldcmds.Context) error {
 		return fmt.Errorf("mountFuse: ConstructNode() failed: %s", err)
 	}
 
-	err = nodeMount.Mount(node, fsdir, nsdir)
+	mfsdir, found := req.Options[mfsMountKwd].(string)
+	if !found {
+		mcfg, err := fuseMount.ReadConfig(node.Repo)
+		if err != nil {
+			return fmt.Errorf("mountFuse: reading the %s config failed: %s", fuseMount.ConfigKey, err)
+		}
+		mfsdir = mcfg.MFS
+	}
+
+	err = nodeMount.Mount(node, fsdir, nsdir, mfsdir)
 	if err != nil {
 		return err
 	}
 	fmt.Printf("IPFS mounted at: %s\n", fsdir)
 	fmt.Printf("IPNS mounted at: %s\n", nsdir)
+	if mfsdir != "" {
+		fmt.Printf("MFS mounted at: %s\n", mfsdir)
+	}
 	return nil
 }
 
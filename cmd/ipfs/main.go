@@ -141,6 +141,9 @@ func mainRet() int {
 			LoadConfig: loadConfig,
 			ReqLog:     &oldcmds.ReqLog{},
 			Plugins:    plugins,
+			Daemon: func(req *cmds.Request) (cmds.Executor, error) {
+				return apiClient(req, repoPath)
+			},
 			ConstructNode: func() (n *core.IpfsNode, err error) {
 				if req == nil {
 					return nil, errors.New("constructing node without a request")
@@ -214,19 +217,13 @@ func makeExecutor(req *cmds.Request, env interface{}) (cmds.Executor, error) {
 		}
 	}
 
-	// Get the API option from the commandline.
-	apiAddr, err := apiAddrOption(req)
-	if err != nil {
-		return nil, err
-	}
-
-	// Require that the command be run on the daemon when the API flag is
-	// passed (unless we're trying to _run_ the daemon).
-	daemonRequested := apiAddr != nil && req.Command != daemonCmd
-
 	// Run this on the client if required.
 	if req.Command.NoRemote {
-		if daemonRequested {
+		apiAddr, err := apiAddrOption(req)
+		if err != nil {
+			return nil, err
+		}
+		if apiAddr != nil && req.Command != daemonCmd {
 			// User requested that the command be run on the daemon but we can't.
 			// NOTE: We drop this check for the `ipfs daemon` command.
 			return nil, errors.New("api flag specified but command cannot be run on the daemon")
@@ -234,23 +231,46 @@ func makeExecutor(req *cmds.Request, env interface{}) (cmds.Executor, error) {
 		return exe, nil
 	}
 
+	client, err := apiClient(req, cctx.ConfigRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	// Still no api specified? Run it on the client or fail.
+	if client == nil {
+		if req.Command.NoLocal {
+			return nil, fmt.Errorf("command must be run on the daemon: %v", req.Path)
+		}
+		return exe, nil
+	}
+	return client, nil
+}
+
+// apiClient returns an executor running requests on the daemon whose API is
+// given on the command line or in the repo, or nil when there is none.
+func apiClient(req *cmds.Request, repoPath string) (cmds.Executor, error) {
+	// Get the API option from the commandline.
+	apiAddr, err := apiAddrOption(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Require that the command be run on the daemon when the API flag is
+	// passed.
+	daemonRequested := apiAddr != nil
+
 	// Finally, look in the repo for an API file.
 	if apiAddr == nil {
 		var err error
-		apiAddr, err = fsrepo.APIAddr(cctx.ConfigRoot)
+		apiAddr, err = fsrepo.APIAddr(repoPath)
 		switch err {
 		case nil, repo.ErrApiNotRunning:
 		default:
 			return nil, err
 		}
 	}
-
-	// Still no api specified? Run it on the client or fail.
 	if apiAddr == nil {
-		if req.Command.NoLocal {
-			return nil, fmt.Errorf("command must be run on the daemon: %v", req.Path)
-		}
-		return exe, nil
+		return nil, nil
 	}
 
 	// Resolve the API addr.
@@ -270,8 +290,8 @@ func makeExecutor(req *cmds.Request, env interface{}) (cmds.Executor, error) {
 
 	// Fallback on a local executor if we (a) have a repo and (b) aren't
 	// forcing a daemon.
-	if !daemonRequested && fsrepo.IsInitialized(cctx.ConfigRoot) {
-		opts = append(opts, cmdhttp.ClientWithFallback(exe))
+	if !daemonRequested && fsrepo.IsInitialized(repoPath) {
+		opts = append(opts, cmdhttp.ClientWithFallback(cmds.NewExecutor(req.Root)))
 	}
 
 	switch network {
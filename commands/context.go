@@ -33,6 +33,11 @@ type Context struct {
 	api           coreiface.CoreAPI
 	node          *core.IpfsNode
 	ConstructNode func() (*core.IpfsNode, error)
+
+	// Daemon returns an executor running requests on the daemon using the
+	// repo, or nil when no daemon is running. It is nil in the daemon, and
+	// lets the commands running in the client call the daemon.
+	Daemon func(req *cmds.Request) (cmds.Executor, error)
 }
 
 // GetConfig returns the config of the current Command execution
@@ -0,0 +1,431 @@
+// Package connprio gives connections priorities in the connection manager by
+// class of peer: the peers that serve us blocks over bitswap, the peers in the
+// pubsub topics we subscribed to, and configured peers.
+package connprio
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+var log = logging.Logger("connprio")
+
+// ConfigKey is the config key the priorities are read from.
+const ConfigKey = "ConnMgrPriorities"
+
+const (
+	// DefaultBitswapWindow is how long a peer stays a bitswap server after
+	// it last sent us a block.
+	DefaultBitswapWindow = 10 * time.Minute
+	// DefaultPubsubInterval is how often the peers of pubsub topics are
+	// listed.
+	DefaultPubsubInterval = 30 * time.Second
+)
+
+// Tags of the classes in the connection manager. Configured peer classes are
+// tagged PeersTagPrefix + their name.
+const (
+	BitswapTag     = "bitswap-server"
+	PubsubTag      = "pubsub"
+	PeersTagPrefix = "peers/"
+)
+
+// Class sets the priority of a class of peers. A class with no weight that
+// isn't protected is disabled.
+type Class struct {
+	// Weight is added to the value of the peers of the class. The
+	// connection manager trims the connections of the peers with the
+	// lowest values first.
+	Weight int
+	// Protect keeps the connections of the class from being trimmed at
+	// all.
+	Protect bool
+}
+
+func (c Class) enabled() bool {
+	return c.Weight != 0 || c.Protect
+}
+
+// BitswapClass is the class of the peers that sent us blocks.
+type BitswapClass struct {
+	Class
+	// Window is how long a peer stays in the class after it last sent us
+	// a block, e.g. "10m".
+	Window string
+}
+
+// PubsubClass is the class of the peers of pubsub topics.
+type PubsubClass struct {
+	Class
+	// Topics are the topics whose peers are in the class. When empty, the
+	// peers of all the topics we subscribed to are.
+	Topics []string
+}
+
+// PeersClass is a class of configured peers.
+type PeersClass struct {
+	Class
+	// Name of the class, shown when explaining connection priorities.
+	Name string
+	// IDs are the peer IDs in the class.
+	IDs []string
+	// AgentPrefixes puts the peers whose agent version starts with one of
+	// the prefixes in the class, e.g. "ipfs-cluster/".
+	AgentPrefixes []string
+}
+
+// Config is the user-facing configuration of the priorities.
+//
+// The zero value disables all classes.
+type Config struct {
+	BitswapServers BitswapClass
+	Pubsub         PubsubClass
+	Peers          []PeersClass
+}
+
+type peersClass struct {
+	Class
+	tag      string
+	ids      map[peer.ID]struct{}
+	prefixes []string
+}
+
+// Priorities tags the peers of the configured classes in the connection
+// manager of a host.
+type Priorities struct {
+	host host.Host
+
+	bitswap BitswapClass
+	window  time.Duration
+	pubsub  PubsubClass
+	peers   []*peersClass
+
+	ps       *pubsub.PubSub
+	interval time.Duration
+
+	mu sync.Mutex
+	// servers maps the bitswap servers to when they last sent us a block.
+	servers map[peer.ID]time.Time
+	// topicPeers are the peers currently in the pubsub class.
+	topicPeers map[peer.ID]struct{}
+
+	// notifiee tags the peers again when they connect, as the connection
+	// manager forgets the tags of the peers it has no connection to.
+	notifiee *network.NotifyBundle
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns the priorities of a host. ps may be nil when pubsub isn't
+// enabled.
+func New(h host.Host, ps *pubsub.PubSub, cfg Config) (*Priorities, error) {
+	p := &Priorities{
+		host:       h,
+		bitswap:    cfg.BitswapServers,
+		window:     DefaultBitswapWindow,
+		pubsub:     cfg.Pubsub,
+		ps:         ps,
+		interval:   DefaultPubsubInterval,
+		servers:    make(map[peer.ID]time.Time),
+		topicPeers: make(map[peer.ID]struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	if w := cfg.BitswapServers.Window; w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid bitswap servers window %q", w)
+		}
+		p.window = d
+	}
+
+	names := make(map[string]struct{}, len(cfg.Peers))
+	for i, pc := range cfg.Peers {
+		name := pc.Name
+		if name == "" {
+			name = fmt.Sprint(i)
+		}
+		if _, dup := names[name]; dup {
+			return nil, fmt.Errorf("duplicate peers class %q", name)
+		}
+		names[name] = struct{}{}
+
+		c := &peersClass{
+			Class:    pc.Class,
+			tag:      PeersTagPrefix + name,
+			ids:      make(map[peer.ID]struct{}, len(pc.IDs)),
+			prefixes: pc.AgentPrefixes,
+		}
+		for _, s := range pc.IDs {
+			pid, err := peer.Decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer ID %q in peers class %q: %w", s, name, err)
+			}
+			c.ids[pid] = struct{}{}
+		}
+		p.peers = append(p.peers, c)
+	}
+	return p, nil
+}
+
+// Start tags the configured peers, and keeps the classes up to date until
+// Stop is called.
+func (p *Priorities) Start() error {
+	for _, c := range p.peers {
+		if !c.enabled() {
+			continue
+		}
+		for pid := range c.ids {
+			p.add(pid, c.tag, c.Class)
+		}
+	}
+
+	p.notifiee = &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			p.connected(conn.RemotePeer())
+		},
+	}
+	p.host.Network().Notify(p.notifiee)
+
+	if p.hasAgentPrefixes() {
+		sub, err := p.host.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+		if err != nil {
+			return err
+		}
+		for _, pid := range p.host.Network().Peers() {
+			p.identified(pid)
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer sub.Close()
+			for {
+				select {
+				case e, ok := <-sub.Out():
+					if !ok {
+						return
+					}
+					p.identified(e.(event.EvtPeerIdentificationCompleted).Peer)
+				case <-p.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	if p.bitswap.enabled() || (p.pubsub.enabled() && p.ps != nil) {
+		p.wg.Add(1)
+		go p.background()
+	}
+	return nil
+}
+
+// Stop stops updating the classes.
+func (p *Priorities) Stop() error {
+	if p.notifiee != nil {
+		p.host.Network().StopNotify(p.notifiee)
+	}
+	p.cancel()
+	p.wg.Wait()
+	return nil
+}
+
+// connected tags a peer that connected with the classes it is in.
+func (p *Priorities) connected(pid peer.ID) {
+	for _, c := range p.peers {
+		if !c.enabled() {
+			continue
+		}
+		if _, ok := c.ids[pid]; ok {
+			p.add(pid, c.tag, c.Class)
+		}
+	}
+	p.mu.Lock()
+	_, server := p.servers[pid]
+	_, inTopics := p.topicPeers[pid]
+	p.mu.Unlock()
+	if server {
+		p.add(pid, BitswapTag, p.bitswap.Class)
+	}
+	if inTopics {
+		p.add(pid, PubsubTag, p.pubsub.Class)
+	}
+	if p.hasAgentPrefixes() {
+		p.identified(pid)
+	}
+}
+
+func (p *Priorities) hasAgentPrefixes() bool {
+	for _, c := range p.peers {
+		if c.enabled() && len(c.prefixes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// identified puts a peer in the classes matching its agent version.
+func (p *Priorities) identified(pid peer.ID) {
+	v, err := p.host.Peerstore().Get(pid, "AgentVersion")
+	if err != nil {
+		return
+	}
+	agent, _ := v.(string)
+	for _, c := range p.peers {
+		if !c.enabled() {
+			continue
+		}
+		for _, prefix := range c.prefixes {
+			if strings.HasPrefix(agent, prefix) {
+				p.add(pid, c.tag, c.Class)
+				break
+			}
+		}
+	}
+}
+
+func (p *Priorities) background() {
+	defer p.wg.Done()
+
+	interval := p.interval
+	if p.bitswap.enabled() && p.window/2 < interval {
+		interval = p.window / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if p.bitswap.enabled() {
+			p.expireServers(time.Now())
+		}
+		if p.pubsub.enabled() && p.ps != nil {
+			p.refreshTopics()
+		}
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// BlockReceived records that a peer sent us a block, putting it in the
+// bitswap servers class.
+func (p *Priorities) BlockReceived(from peer.ID) {
+	if !p.bitswap.enabled() {
+		return
+	}
+	p.mu.Lock()
+	_, known := p.servers[from]
+	p.servers[from] = time.Now()
+	p.mu.Unlock()
+
+	if !known {
+		p.add(from, BitswapTag, p.bitswap.Class)
+	}
+}
+
+func (p *Priorities) expireServers(now time.Time) {
+	p.mu.Lock()
+	var expired []peer.ID
+	for pid, last := range p.servers {
+		if now.Sub(last) >= p.window {
+			expired = append(expired, pid)
+			delete(p.servers, pid)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, pid := range expired {
+		p.remove(pid, BitswapTag, p.bitswap.Class)
+	}
+}
+
+func (p *Priorities) refreshTopics() {
+	topics := p.pubsub.Topics
+	if len(topics) == 0 {
+		topics = p.ps.GetTopics()
+	}
+	current := make(map[peer.ID]struct{})
+	for _, topic := range topics {
+		for _, pid := range p.ps.ListPeers(topic) {
+			current[pid] = struct{}{}
+		}
+	}
+
+	p.mu.Lock()
+	previous := p.topicPeers
+	p.topicPeers = current
+	p.mu.Unlock()
+
+	for pid := range current {
+		if _, ok := previous[pid]; !ok {
+			p.add(pid, PubsubTag, p.pubsub.Class)
+		}
+	}
+	for pid := range previous {
+		if _, ok := current[pid]; !ok {
+			p.remove(pid, PubsubTag, p.pubsub.Class)
+		}
+	}
+}
+
+func (p *Priorities) add(pid peer.ID, tag string, c Class) {
+	cm := p.host.ConnManager()
+	if c.Weight != 0 {
+		cm.TagPeer(pid, tag, c.Weight)
+	}
+	if c.Protect {
+		cm.Protect(pid, tag)
+	}
+	log.Debugw("peer added to class", "peer", pid, "class", tag)
+}
+
+func (p *Priorities) remove(pid peer.ID, tag string, c Class) {
+	cm := p.host.ConnManager()
+	if c.Weight != 0 {
+		cm.UntagPeer(pid, tag)
+	}
+	if c.Protect {
+		cm.Unprotect(pid, tag)
+	}
+	log.Debugw("peer removed from class", "peer", pid, "class", tag)
+}
+
+// Tags returns the tags of all the enabled classes.
+func (p *Priorities) Tags() []string {
+	var tags []string
+	if p.bitswap.enabled() {
+		tags = append(tags, BitswapTag)
+	}
+	if p.pubsub.enabled() {
+		tags = append(tags, PubsubTag)
+	}
+	for _, c := range p.peers {
+		if c.enabled() {
+			tags = append(tags, c.tag)
+		}
+	}
+	return tags
+}
+
+// Connected returns the connected peers with the number of connections to
+// each.
+func connected(n network.Network) map[peer.ID]int {
+	out := make(map[peer.ID]int)
+	for _, c := range n.Conns() {
+		out[c.RemotePeer()]++
+	}
+	return out
+}
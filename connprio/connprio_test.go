@@ -0,0 +1,196 @@
+package connprio
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	connmgr "github.com/libp2p/go-libp2p-connmgr"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+)
+
+func newHost(ctx context.Context, t *testing.T) host.Host {
+	h, err := libp2p.New(
+		ctx,
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.ConnectionManager(connmgr.NewConnManager(1, 2, 0)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestClasses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newHost(ctx, t)
+	defer h.Close()
+	friend := test.RandPeerIDFatal(t)
+	server := test.RandPeerIDFatal(t)
+
+	p, err := New(h, nil, Config{
+		BitswapServers: BitswapClass{Class: Class{Weight: 20}, Window: "1m"},
+		Peers: []PeersClass{{
+			Class: Class{Weight: 5, Protect: true},
+			Name:  "friends",
+			IDs:   []string{friend.Pretty()},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	cm := h.ConnManager()
+	if !cm.IsProtected(friend, PeersTagPrefix+"friends") {
+		t.Error("configured peer should be protected")
+	}
+	if v := cm.GetTagInfo(friend).Tags[PeersTagPrefix+"friends"]; v != 5 {
+		t.Errorf("expected configured peer to be tagged 5, got %d", v)
+	}
+
+	p.BlockReceived(server)
+	if v := cm.GetTagInfo(server).Tags[BitswapTag]; v != 20 {
+		t.Errorf("expected bitswap server to be tagged 20, got %d", v)
+	}
+	if cm.IsProtected(server, "") {
+		t.Error("bitswap servers aren't protected")
+	}
+
+	p.expireServers(time.Now())
+	if _, ok := cm.GetTagInfo(server).Tags[BitswapTag]; !ok {
+		t.Error("bitswap server expired too early")
+	}
+	p.expireServers(time.Now().Add(time.Minute))
+	if _, ok := cm.GetTagInfo(server).Tags[BitswapTag]; ok {
+		t.Error("bitswap server should have expired")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{BitswapServers: BitswapClass{Window: "soon"}},
+		{Peers: []PeersClass{{IDs: []string{"not a peer"}}}},
+		{Peers: []PeersClass{{Name: "a"}, {Name: "a"}}},
+	} {
+		if _, err := New(nil, nil, cfg); err == nil {
+			t.Errorf("expected %+v to be refused", cfg)
+		}
+	}
+}
+
+func TestSimulateTrim(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	info := connmgr.CMInfo{LowWater: 2, HighWater: 3, GracePeriod: time.Minute}
+
+	peers := []candidate{
+		{id: "protected", value: 0, conns: 1, firstSeen: old, protected: true},
+		{id: "new", value: 0, conns: 1, firstSeen: now},
+		{id: "low", value: 1, conns: 1, firstSeen: old},
+		{id: "lower", value: 0, conns: 1, firstSeen: old},
+		{id: "high", value: 50, conns: 1, firstSeen: old},
+		{id: "higher", value: 100, conns: 1, firstSeen: old},
+	}
+	expected := map[peer.ID]bool{
+		"protected": false,
+		"new":       false,
+		"lower":     true,
+		"low":       true,
+		"high":      false,
+		"higher":    false,
+	}
+	for id, d := range simulateTrim(peers, info, now) {
+		if d.trimmed != expected[id] {
+			t.Errorf("%s: expected trimmed=%t, got %t (%s)", id, expected[id], d.trimmed, d.reason)
+		}
+	}
+
+	// Nothing is trimmed below the low water mark.
+	for id, d := range simulateTrim(peers[2:4], info, now) {
+		if d.trimmed {
+			t.Errorf("%s should not be trimmed below low water: %s", id, d.reason)
+		}
+	}
+}
+
+func TestTagsAfterReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newHost(ctx, t)
+	defer h.Close()
+	friend := newHost(ctx, t)
+	defer friend.Close()
+	server := newHost(ctx, t)
+	defer server.Close()
+
+	p, err := New(h, nil, Config{
+		BitswapServers: BitswapClass{Class: Class{Weight: 20}, Window: "1m"},
+		Peers: []PeersClass{{
+			Class: Class{Weight: 5},
+			Name:  "friends",
+			IDs:   []string{friend.ID().Pretty()},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	cm := h.ConnManager()
+	waitTag := func(pid peer.ID, tag string, value int) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if v, ok := cm.GetTagInfo(pid).Tags[tag]; ok && v == value {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s not tagged %s=%d", pid, tag, value)
+	}
+	connect := func(other host.Host) {
+		t.Helper()
+		if err := h.Connect(ctx, peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	disconnect := func(other host.Host) {
+		t.Helper()
+		if err := h.Network().ClosePeer(other.ID()); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100 && cm.GetTagInfo(other.ID()) != nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if cm.GetTagInfo(other.ID()) != nil {
+			t.Fatalf("the connection manager still tracks %s", other.ID())
+		}
+	}
+
+	connect(friend)
+	connect(server)
+	p.BlockReceived(server.ID())
+	waitTag(friend.ID(), PeersTagPrefix+"friends", 5)
+	waitTag(server.ID(), BitswapTag, 20)
+
+	// The connection manager forgets the tags on disconnect.
+	disconnect(friend)
+	disconnect(server)
+
+	connect(friend)
+	connect(server)
+	waitTag(friend.ID(), PeersTagPrefix+"friends", 5)
+	waitTag(server.ID(), BitswapTag, 20)
+}
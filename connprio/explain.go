@@ -0,0 +1,153 @@
+package connprio
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-ipfs/peering"
+	connmgr "github.com/libp2p/go-libp2p-connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Status explains the priority of the connections to a peer.
+type Status struct {
+	// Value is the value of the peer in the connection manager, the sum of
+	// its tags.
+	Value int
+	// Tags maps the tags of the peer to their values.
+	Tags map[string]int
+	// ProtectedBy lists the tags protecting the peer from being trimmed.
+	ProtectedBy []string
+	// Trimmed is true when the connections to the peer would be closed if
+	// the connection manager trimmed connections now.
+	Trimmed bool
+	// Reason says why the connections are kept or trimmed.
+	Reason string
+}
+
+type candidate struct {
+	id        peer.ID
+	value     int
+	conns     int
+	firstSeen time.Time
+	protected bool
+}
+
+// Explain returns the status of all the connected peers.
+func (p *Priorities) Explain() map[peer.ID]Status {
+	cm := p.host.ConnManager()
+	protectTags := append(p.Tags(), peering.ConnmgrTag)
+
+	out := make(map[peer.ID]Status)
+	var candidates []candidate
+	for pid, conns := range connected(p.host.Network()) {
+		st := Status{Tags: make(map[string]int)}
+		c := candidate{id: pid, conns: conns}
+		if info := cm.GetTagInfo(pid); info != nil {
+			st.Value = info.Value
+			st.Tags = info.Tags
+			c.value = info.Value
+			c.firstSeen = info.FirstSeen
+		}
+		if cm.IsProtected(pid, "") {
+			c.protected = true
+			for _, tag := range protectTags {
+				if cm.IsProtected(pid, tag) {
+					st.ProtectedBy = append(st.ProtectedBy, tag)
+				}
+			}
+			if len(st.ProtectedBy) == 0 {
+				st.ProtectedBy = []string{"unknown"}
+			}
+		}
+		out[pid] = st
+		candidates = append(candidates, c)
+	}
+
+	basic, ok := cm.(*connmgr.BasicConnMgr)
+	if !ok {
+		for pid, st := range out {
+			st.Reason = "no connection manager"
+			out[pid] = st
+		}
+		return out
+	}
+	for pid, d := range simulateTrim(candidates, basic.GetInfo(), time.Now()) {
+		st := out[pid]
+		st.Trimmed = d.trimmed
+		st.Reason = d.reason
+		if len(st.ProtectedBy) > 0 {
+			st.Reason = "protected by " + strings.Join(st.ProtectedBy, ", ")
+		}
+		out[pid] = st
+	}
+	return out
+}
+
+type decision struct {
+	trimmed bool
+	reason  string
+}
+
+// simulateTrim decides what the basic connection manager would do with each
+// peer if it trimmed connections now, following the same rules.
+func simulateTrim(peers []candidate, info connmgr.CMInfo, now time.Time) map[peer.ID]decision {
+	out := make(map[peer.ID]decision, len(peers))
+	if info.LowWater == 0 || info.HighWater == 0 {
+		for _, c := range peers {
+			out[c.id] = decision{reason: "trimming disabled"}
+		}
+		return out
+	}
+
+	nconns := 0
+	for _, c := range peers {
+		nconns += c.conns
+	}
+
+	gracePeriodStart := now.Add(-info.GracePeriod)
+	var candidates []candidate
+	ncandidates := 0
+	for _, c := range peers {
+		switch {
+		case c.protected:
+			out[c.id] = decision{reason: "protected"}
+		case nconns <= info.LowWater:
+			out[c.id] = decision{reason: fmt.Sprintf("below low water (%d/%d connections)", nconns, info.LowWater)}
+		case c.firstSeen.After(gracePeriodStart):
+			out[c.id] = decision{reason: "in grace period"}
+		default:
+			candidates = append(candidates, c)
+			ncandidates += c.conns
+		}
+	}
+	if nconns <= info.LowWater {
+		return out
+	}
+	if ncandidates < info.LowWater {
+		for _, c := range candidates {
+			out[c.id] = decision{reason: "too many connections in grace period to trim"}
+		}
+		return out
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].value < candidates[j].value
+	})
+	target := ncandidates - info.LowWater
+	for _, c := range candidates {
+		if target > 0 {
+			reason := fmt.Sprintf("value %d is among the lowest", c.value)
+			if nconns <= info.HighWater {
+				reason += fmt.Sprintf(", trimmed above high water (%d/%d connections)", nconns, info.HighWater)
+			}
+			out[c.id] = decision{trimmed: true, reason: reason}
+			target -= c.conns
+		} else {
+			out[c.id] = decision{reason: fmt.Sprintf("value %d is above the trim threshold", c.value)}
+		}
+	}
+	return out
+}
@@ -0,0 +1,36 @@
+package connprio
+
+import (
+	"context"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// WrapNetwork returns a bitswap network that puts the peers we receive blocks
+// from in the bitswap servers class.
+func (p *Priorities) WrapNetwork(net bsnet.BitSwapNetwork) bsnet.BitSwapNetwork {
+	return &prioNetwork{BitSwapNetwork: net, prio: p}
+}
+
+type prioNetwork struct {
+	bsnet.BitSwapNetwork
+	prio *Priorities
+}
+
+func (n *prioNetwork) SetDelegate(r bsnet.Receiver) {
+	n.BitSwapNetwork.SetDelegate(&prioReceiver{Receiver: r, prio: n.prio})
+}
+
+type prioReceiver struct {
+	bsnet.Receiver
+	prio *Priorities
+}
+
+func (r *prioReceiver) ReceiveMessage(ctx context.Context, from peer.ID, msg bsmsg.BitSwapMessage) {
+	if len(msg.Blocks()) > 0 {
+		r.prio.BlockReceived(from)
+	}
+	r.Receiver.ReceiveMessage(ctx, from, msg)
+}
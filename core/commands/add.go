@@ -1,6 +1,7 @@
 package commands
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -9,8 +10,10 @@ import (
 	"strings"
 
 	"github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 
 	"github.com/cheggaaa/pb"
+	humanize "github.com/dustin/go-humanize"
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	files "github.com/ipfs/go-ipfs-files"
 	coreiface "github.com/ipfs/interface-go-ipfs-core"
@@ -26,25 +29,34 @@ type AddEvent struct {
 	Hash  string `json:",omitempty"`
 	Bytes int64  `json:",omitempty"`
 	Size  string `json:",omitempty"`
+	// Dedup is set with --dedup-report, on the events of added files and
+	// on a last event without hash for the whole command.
+	Dedup *coreunix.DedupStats `json:",omitempty"`
 }
 
 const (
-	quietOptionName       = "quiet"
-	quieterOptionName     = "quieter"
-	silentOptionName      = "silent"
-	progressOptionName    = "progress"
-	trickleOptionName     = "trickle"
-	wrapOptionName        = "wrap-with-directory"
-	onlyHashOptionName    = "only-hash"
-	chunkerOptionName     = "chunker"
-	pinOptionName         = "pin"
-	rawLeavesOptionName   = "raw-leaves"
-	noCopyOptionName      = "nocopy"
-	fstoreCacheOptionName = "fscache"
-	cidVersionOptionName  = "cid-version"
-	hashOptionName        = "hash"
-	inlineOptionName      = "inline"
-	inlineLimitOptionName = "inline-limit"
+	quietOptionName         = "quiet"
+	quieterOptionName       = "quieter"
+	silentOptionName        = "silent"
+	progressOptionName      = "progress"
+	trickleOptionName       = "trickle"
+	wrapOptionName          = "wrap-with-directory"
+	onlyHashOptionName      = "only-hash"
+	chunkerOptionName       = "chunker"
+	pinOptionName           = "pin"
+	rawLeavesOptionName     = "raw-leaves"
+	noCopyOptionName        = "nocopy"
+	fstoreCacheOptionName   = "fscache"
+	cidVersionOptionName    = "cid-version"
+	hashOptionName          = "hash"
+	inlineOptionName        = "inline"
+	inlineLimitOptionName   = "inline-limit"
+	dedupReportOptionName   = "dedup-report"
+	preserveModeOptionName  = "preserve-mode"
+	preserveMtimeOptionName = "preserve-mtime"
+	fromTarOptionName       = "from-tar"
+	unpackOptionName        = "unpack"
+	layoutOptionName        = "layout"
 )
 
 const adderOutChanSize = 8
@@ -87,6 +99,27 @@ hashes for the same file. The default is a fixed block size of
 Buzhash or Rabin fingerprint chunker for content defined chunking by
 specifying buzhash or rabin-[min]-[avg]-[max] (where min/avg/max refer
 to the desired chunk sizes in bytes), e.g. 'rabin-262144-524288-1048576'.
+The 'auto' chunker picks the chunking of each file from its type: tar and
+zip archives are split at the boundaries of their entries, so that the
+files they contain deduplicate with the same files added on their own,
+disk images are split in 64KiB chunks, compressed files use the default
+chunker and other files use buzhash. Chunker plugins add chunkers
+selected with '[name]-[params]'.
+
+The '--layout' option picks the layout of the DAG of the files: 'balanced'
+(the default), 'trickle' (same as '--trickle') or a layout added by a
+plugin.
+
+The dedup report option, '--dedup-report', prints how many of the blocks
+of each file, and of the whole add, were already stored:
+
+  > ipfs add --chunker=auto --dedup-report -r backups
+  added QmW4DT9mRTRkhm4GuyWG6a1VyjRJ1pNbFCLGwmSk1xuzwh backups/monday.tar
+  dedup backups/monday.tar: 2/66 blocks, 1.0 kB/16 MB already stored
+  added Qme6pX8NWpqmKwq1CcfeyHQUQP6ERwV8vMBsqpBvSGMyWc backups/tuesday.tar
+  dedup backups/tuesday.tar: 63/66 blocks, 15 MB/16 MB already stored
+  added QmS4ustL54uo8FzR9455qaxZwuMiUhyvMcX9Ba8nUH4uVv backups
+  dedup total: 65/133 blocks, 15 MB/33 MB already stored
 
 The following examples use very small byte sizes to demonstrate the
 properties of the different chunkers on a small file. You'll likely
@@ -107,6 +140,32 @@ You can now check what blocks have been created by:
   QmerURi9k4XzKCaaPbsK6BL5pMEjF7PGphjDvkkjDtsVf3 868
   QmQB28iwSriSUSMqG2nXDTLtdPHgWb4rebBrU7Q1j4vxPv 338
 
+The '--preserve-mode' and '--preserve-mtime' options store the permissions
+and the modification time of the files and directories in their UnixFS
+nodes, which 'ipfs get' and the FUSE mounts restore. The client reads them
+and sends them to the daemon, in a first part of the request named "\0posix"
+holding a JSON object, which maps the paths of the files to their 'Mode',
+'HasMode' and 'Mtime'. The daemon never reads them from its own filesystem.
+
+The '--from-tar' option unpacks tar archives, compressed with gzip or not,
+into directories, keeping the permissions and modification times of their
+entries, their symbolic links, and their hard links, as copies of the
+file they point to. The archive is read as a stream, so it may be larger than memory:
+
+  > curl -s https://example.com/site.tar.gz | ipfs add --from-tar -Q
+  QmS4ustL54uo8FzR9455qaxZwuMiUhyvMcX9Ba8nUH4uVv
+
+'ipfs get --to-tar' writes such directories back as tar archives.
+
+The '--unpack' option unpacks archives of the given format: 'tar' (same as
+'--from-tar'), 'tgz' or 'zip'. Zip archives are written to a temporary file
+before being unpacked, as their index is at their end:
+
+  > ipfs add --unpack=zip delivery.zip
+  added QmaG4FuMqEBnQNn3C8XJ5bpW8kLs7zq2ZXgHptJHbKDDVx delivery
+
+'ipfs get --archive-format=zip' writes directories as zip archives.
+
 Finally, a note on hash determinism. While not guaranteed, adding the same
 file/directory with the same flags will almost always result in the same output
 hash. However, almost all of the flags provided by this command (other than pin,
@@ -129,9 +188,10 @@ only-hash, and progress/status related flags) will change the final hash.
 		cmds.BoolOption(silentOptionName, "Write no output."),
 		cmds.BoolOption(progressOptionName, "p", "Stream progress data."),
 		cmds.BoolOption(trickleOptionName, "t", "Use trickle-dag format for dag generation."),
+		cmds.StringOption(layoutOptionName, "Layout of the DAG of files: balanced, trickle or a layout of a plugin."),
 		cmds.BoolOption(onlyHashOptionName, "n", "Only chunk and hash - do not write to disk."),
 		cmds.BoolOption(wrapOptionName, "w", "Wrap files with a directory object."),
-		cmds.StringOption(chunkerOptionName, "s", "Chunking algorithm, size-[bytes], rabin-[min]-[avg]-[max] or buzhash").WithDefault("size-262144"),
+		cmds.StringOption(chunkerOptionName, "s", "Chunking algorithm, size-[bytes], rabin-[min]-[avg]-[max], buzhash, auto or [name]-[params] of a plugin").WithDefault("size-262144"),
 		cmds.BoolOption(pinOptionName, "Pin this object when adding.").WithDefault(true),
 		cmds.BoolOption(rawLeavesOptionName, "Use raw blocks for leaf nodes. (experimental)"),
 		cmds.BoolOption(noCopyOptionName, "Add the file using filestore. Implies raw-leaves. (experimental)"),
@@ -140,8 +200,23 @@ only-hash, and progress/status related flags) will change the final hash.
 		cmds.StringOption(hashOptionName, "Hash function to use. Implies CIDv1 if not sha2-256. (experimental)").WithDefault("sha2-256"),
 		cmds.BoolOption(inlineOptionName, "Inline small blocks into CIDs. (experimental)"),
 		cmds.IntOption(inlineLimitOptionName, "Maximum block size to inline. (experimental)").WithDefault(32),
+		cmds.BoolOption(dedupReportOptionName, "Report how many blocks of each file were already stored."),
+		cmds.BoolOption(preserveModeOptionName, "Store the permissions of the files."),
+		cmds.BoolOption(preserveMtimeOptionName, "Store the modification times of the files."),
+		cmds.BoolOption(fromTarOptionName, "Unpack tar archives, optionally compressed with gzip, into directories."),
+		cmds.StringOption(unpackOptionName, "Unpack archives into directories: tar, tgz or zip."),
 	},
 	PreRun: func(req *cmds.Request, env cmds.Environment) error {
+		preserveMode, _ := req.Options[preserveModeOptionName].(bool)
+		preserveMtime, _ := req.Options[preserveMtimeOptionName].(bool)
+		if preserveMode || preserveMtime {
+			// PreRun runs in the client, which reads the metadata of its
+			// files for the daemon.
+			if err := addPosixEntry(req, coreunix.Preserve{Mode: preserveMode, Mtime: preserveMtime}); err != nil {
+				return err
+			}
+		}
+
 		quiet, _ := req.Options[quietOptionName].(bool)
 		quieter, _ := req.Options[quieterOptionName].(bool)
 		quiet = quiet || quieter
@@ -180,6 +255,38 @@ only-hash, and progress/status related flags) will change the final hash.
 		hashFunStr, _ := req.Options[hashOptionName].(string)
 		inline, _ := req.Options[inlineOptionName].(bool)
 		inlineLimit, _ := req.Options[inlineLimitOptionName].(int)
+		dedupReport, _ := req.Options[dedupReportOptionName].(bool)
+		preserveMode, _ := req.Options[preserveModeOptionName].(bool)
+		preserveMtime, _ := req.Options[preserveMtimeOptionName].(bool)
+		fromTar, _ := req.Options[fromTarOptionName].(bool)
+		unpack, _ := req.Options[unpackOptionName].(string)
+		layout, _ := req.Options[layoutOptionName].(string)
+
+		if layout != "" {
+			if trickle && layout != coreunix.TrickleLayout {
+				return fmt.Errorf("%s cannot be used with %s=%s", trickleOptionName, layoutOptionName, layout)
+			}
+			if _, err := coreunix.Layout(layout); err != nil {
+				return err
+			}
+		}
+		if fromTar {
+			if unpack != "" && unpack != coreunix.UnpackTar {
+				return fmt.Errorf("%s cannot be used with %s=%s", fromTarOptionName, unpackOptionName, unpack)
+			}
+			unpack = coreunix.UnpackTar
+		}
+		switch unpack {
+		case "", coreunix.UnpackTar, coreunix.UnpackTgz, coreunix.UnpackZip:
+		default:
+			return fmt.Errorf("unknown archive format %q, expected tar, tgz or zip", unpack)
+		}
+		if unpack != "" && nocopy {
+			return fmt.Errorf("archives cannot be unpacked with %s", noCopyOptionName)
+		}
+		if unpack != "" && wrap {
+			return fmt.Errorf("archives cannot be unpacked with %s", wrapOptionName)
+		}
 
 		hashFunCode, ok := mh.Names[strings.ToLower(hashFunStr)]
 		if !ok {
@@ -191,10 +298,13 @@ only-hash, and progress/status related flags) will change the final hash.
 			return err
 		}
 
-		toadd := req.Files
+		posix, toadd, err := takePosixEntry(req.Files)
+		if err != nil {
+			return err
+		}
 		if wrap {
 			toadd = files.NewSliceDirectory([]files.DirEntry{
-				files.FileEntry("", req.Files),
+				files.FileEntry("", toadd),
 			})
 		}
 
@@ -223,24 +333,46 @@ only-hash, and progress/status related flags) will change the final hash.
 			opts = append(opts, options.Unixfs.RawLeaves(rawblks))
 		}
 
-		if trickle {
+		if layout != "" {
+			opts = append(opts, coreunix.LayoutOption(layout))
+		} else if trickle {
 			opts = append(opts, options.Unixfs.Layout(options.TrickleLayout))
 		}
 
-		opts = append(opts, nil) // events option placeholder
-
 		var added int
+		var dedupTotal coreunix.DedupStats
 		addit := toadd.Entries()
 		for addit.Next() {
 			_, dir := addit.Node().(files.Directory)
+			name := addit.Name()
+			if unpack != "" {
+				dir = true
+				name = trimArchiveExt(name)
+			}
 			errCh := make(chan error, 1)
 			events := make(chan interface{}, adderOutChanSize)
-			opts[len(opts)-1] = options.Unixfs.Events(events)
+			// The options of every entry are appended to a copy.
+			entryOpts := append(opts[:len(opts):len(opts)], options.Unixfs.Events(events))
+
+			ctx := req.Context
+			if preserveMode || preserveMtime {
+				entryOpts = append(entryOpts,
+					coreunix.PreserveOption(coreunix.Preserve{Mode: preserveMode, Mtime: preserveMtime}),
+					coreunix.PosixOption(entryPosix(posix, addit.Name(), wrap)))
+			}
+			var dedup *coreunix.DedupReport
+			if dedupReport {
+				dedup = coreunix.NewDedupReport()
+				entryOpts = append(entryOpts, coreunix.DedupReportOption(dedup))
+			}
+			if unpack != "" {
+				entryOpts = append(entryOpts, coreunix.UnpackOption(unpack))
+			}
 
 			go func() {
 				var err error
 				defer close(events)
-				_, err = api.Unixfs().Add(req.Context, addit.Node(), opts...)
+				_, err = api.Unixfs().Add(ctx, addit.Node(), entryOpts...)
 				errCh <- err
 			}()
 
@@ -251,14 +383,20 @@ only-hash, and progress/status related flags) will change the final hash.
 				}
 
 				h := ""
+				var stats *coreunix.DedupStats
 				if output.Path != nil {
 					h = enc.Encode(output.Path.Cid())
+					if dedup != nil {
+						if s, ok := dedup.File(output.Name); ok {
+							stats = &s
+						}
+					}
 				}
 
-				if !dir && addit.Name() != "" {
-					output.Name = addit.Name()
+				if !dir && name != "" {
+					output.Name = name
 				} else {
-					output.Name = path.Join(addit.Name(), output.Name)
+					output.Name = path.Join(name, output.Name)
 				}
 
 				if err := res.Emit(&AddEvent{
@@ -266,6 +404,7 @@ only-hash, and progress/status related flags) will change the final hash.
 					Hash:  h,
 					Bytes: output.Bytes,
 					Size:  output.Size,
+					Dedup: stats,
 				}); err != nil {
 					return err
 				}
@@ -274,6 +413,9 @@ only-hash, and progress/status related flags) will change the final hash.
 			if err := <-errCh; err != nil {
 				return err
 			}
+			if dedup != nil {
+				dedupTotal = dedupTotal.Add(dedup.Total())
+			}
 			added++
 		}
 
@@ -285,6 +427,9 @@ only-hash, and progress/status related flags) will change the final hash.
 			return fmt.Errorf("expected a file argument")
 		}
 
+		if dedupReport {
+			return res.Emit(&AddEvent{Dedup: &dedupTotal})
+		}
 		return nil
 	},
 	PostRun: cmds.PostRunMap{
@@ -340,6 +485,13 @@ only-hash, and progress/status related flags) will change the final hash.
 							break LOOP
 						}
 						output := out.(*AddEvent)
+						if output.Dedup != nil && len(output.Hash) == 0 {
+							if progress {
+								fmt.Fprintf(os.Stderr, "\033[2K\r")
+							}
+							fmt.Fprintf(os.Stderr, "dedup total: %s\n", formatDedup(output.Dedup))
+							continue
+						}
 						if len(output.Hash) > 0 {
 							lastHash = output.Hash
 							if quieter {
@@ -355,6 +507,9 @@ only-hash, and progress/status related flags) will change the final hash.
 							} else {
 								fmt.Fprintf(os.Stdout, "added %s %s\n", output.Hash, cmdenv.EscNonPrint(output.Name))
 							}
+							if output.Dedup != nil {
+								fmt.Fprintf(os.Stderr, "dedup %s: %s\n", cmdenv.EscNonPrint(output.Name), formatDedup(output.Dedup))
+							}
 
 						} else {
 							if !progress {
@@ -429,3 +584,128 @@ only-hash, and progress/status related flags) will change the final hash.
 	},
 	Type: AddEvent{},
 }
+
+func formatDedup(s *coreunix.DedupStats) string {
+	return fmt.Sprintf("%d/%d blocks, %s/%s already stored",
+		s.ExistingBlocks, s.Blocks, humanize.Bytes(s.ExistingBytes), humanize.Bytes(s.Bytes))
+}
+
+// posixEntryName is the name of the first entry of the files sent by the
+// client with --preserve-mode or --preserve-mtime, holding the metadata of
+// the files as JSON. The NUL byte keeps it from being the name of a file.
+const posixEntryName = "\x00posix"
+
+// addPosixEntry puts the metadata of the files of req selected by p in a
+// first entry, so that the daemon never reads the paths of the client.
+func addPosixEntry(req *cmds.Request, p coreunix.Preserve) error {
+	if req.Files == nil {
+		return nil
+	}
+	// PreRun may run twice.
+	var entries []files.DirEntry
+	posix := make(map[string]coreunix.Posix)
+	it := req.Files.Entries()
+	for it.Next() {
+		if it.Name() == posixEntryName {
+			return nil
+		}
+		meta, err := coreunix.LocalPosix(it.Node(), p)
+		if err != nil {
+			return err
+		}
+		for fpath, m := range meta {
+			posix[path.Join(it.Name(), fpath)] = m
+		}
+		entries = append(entries, files.FileEntry(it.Name(), it.Node()))
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(posix)
+	if err != nil {
+		return err
+	}
+	entries = append([]files.DirEntry{files.FileEntry(posixEntryName, files.NewBytesFile(data))}, entries...)
+	req.Files = files.NewSliceDirectory(entries)
+	return nil
+}
+
+// takePosixEntry returns the metadata sent by addPosixEntry, if any, and the
+// other files.
+func takePosixEntry(dir files.Directory) (map[string]coreunix.Posix, files.Directory, error) {
+	if dir == nil {
+		return nil, nil, nil
+	}
+	it := dir.Entries()
+	if !it.Next() {
+		return nil, dir, it.Err()
+	}
+	if it.Name() != posixEntryName {
+		return nil, &iteratorDirectory{Directory: dir, it: &peekedIterator{DirIterator: it, peeked: true}}, nil
+	}
+	f, ok := it.Node().(files.File)
+	if !ok {
+		return nil, nil, errors.New("invalid file metadata")
+	}
+	var posix map[string]coreunix.Posix
+	if err := json.NewDecoder(f).Decode(&posix); err != nil {
+		return nil, nil, fmt.Errorf("invalid file metadata: %w", err)
+	}
+	return posix, &iteratorDirectory{Directory: dir, it: it}, nil
+}
+
+// entryPosix returns the metadata of the files of the entry name, by their
+// path in the entry. Wrapped entries are added together, by their path in
+// the wrapping directory.
+func entryPosix(posix map[string]coreunix.Posix, name string, wrap bool) map[string]coreunix.Posix {
+	if wrap {
+		return posix
+	}
+	out := make(map[string]coreunix.Posix)
+	for p, m := range posix {
+		if p == name {
+			out[""] = m
+		} else if strings.HasPrefix(p, name+"/") {
+			out[strings.TrimPrefix(p, name+"/")] = m
+		}
+	}
+	return out
+}
+
+// iteratorDirectory is a directory listed by an iterator which was already
+// started.
+type iteratorDirectory struct {
+	files.Directory
+	it files.DirIterator
+}
+
+func (d *iteratorDirectory) Entries() files.DirIterator {
+	return d.it
+}
+
+// peekedIterator is an iterator whose current entry is returned again by the
+// next call to Next when peeked is set.
+type peekedIterator struct {
+	files.DirIterator
+	peeked bool
+}
+
+func (it *peekedIterator) Next() bool {
+	if it.peeked {
+		it.peeked = false
+		return true
+	}
+	return it.DirIterator.Next()
+}
+
+// trimArchiveExt returns the name of the directory an archive is unpacked
+// into.
+func trimArchiveExt(name string) string {
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
@@ -3,9 +3,13 @@ package commands
 import (
 	"fmt"
 	"io"
+	"sort"
+	"time"
 
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	e "github.com/ipfs/go-ipfs/core/commands/e"
+	"github.com/ipfs/go-ipfs/exchange/policy"
+	"github.com/ipfs/go-ipfs/exchange/sessions"
 
 	humanize "github.com/dustin/go-humanize"
 	bitswap "github.com/ipfs/go-bitswap"
@@ -25,7 +29,9 @@ var BitswapCmd = &cmds.Command{
 		"stat":      bitswapStatCmd,
 		"wantlist":  showWantlistCmd,
 		"ledger":    ledgerCmd,
+		"policy":    bitswapPolicyCmd,
 		"reprovide": reprovideCmd,
+		"sessions":  bitswapSessionsCmd,
 	},
 }
 
@@ -53,8 +59,8 @@ Print out all blocks currently on the bitswap wantlist for the local peer.`,
 			return ErrNotOnline
 		}
 
-		bs, ok := nd.Exchange.(*bitswap.Bitswap)
-		if !ok {
+		bs := nd.Bitswap
+		if bs == nil {
 			return e.TypeErr(bs, nd.Exchange)
 		}
 
@@ -112,8 +118,8 @@ var bitswapStatCmd = &cmds.Command{
 			return cmds.Errorf(cmds.ErrClient, ErrNotOnline.Error())
 		}
 
-		bs, ok := nd.Exchange.(*bitswap.Bitswap)
-		if !ok {
+		bs := nd.Bitswap
+		if bs == nil {
 			return e.TypeErr(bs, nd.Exchange)
 		}
 
@@ -167,6 +173,13 @@ var bitswapStatCmd = &cmds.Command{
 	},
 }
 
+// LedgerOutput is the output of 'ipfs bitswap ledger'.
+type LedgerOutput struct {
+	decision.Receipt
+	// Policy holds the bitswap policy decisions taken for the peer.
+	Policy *policy.PeerStat `json:",omitempty"`
+}
+
 var ledgerCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Show the current ledger for a peer.",
@@ -174,12 +187,16 @@ var ledgerCmd = &cmds.Command{
 The Bitswap decision engine tracks the number of bytes exchanged between IPFS
 nodes, and stores this information as a collection of ledgers. This command
 prints the ledger associated with a given peer.
+
+The ledger also shows what the bitswap policy (see 'ipfs bitswap policy')
+decided for the peer: how many of its wants were served or refused, and how
+much of its quota it used.
 `,
 	},
 	Arguments: []cmds.Argument{
 		cmds.StringArg("peer", true, false, "The PeerID (B58) of the ledger to inspect."),
 	},
-	Type: decision.Receipt{},
+	Type: LedgerOutput{},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		nd, err := cmdenv.GetNode(env)
 		if err != nil {
@@ -190,8 +207,8 @@ prints the ledger associated with a given peer.
 			return ErrNotOnline
 		}
 
-		bs, ok := nd.Exchange.(*bitswap.Bitswap)
-		if !ok {
+		bs := nd.Bitswap
+		if bs == nil {
 			return e.TypeErr(bs, nd.Exchange)
 		}
 
@@ -200,17 +217,254 @@ prints the ledger associated with a given peer.
 			return err
 		}
 
-		return cmds.EmitOnce(res, bs.LedgerForPeer(partner))
+		out := &LedgerOutput{Receipt: *bs.LedgerForPeer(partner)}
+		if nd.BitswapPolicy != nil {
+			st := nd.BitswapPolicy.Stat(partner)
+			out.Policy = &st
+		}
+		return cmds.EmitOnce(res, out)
 	},
 	Encoders: cmds.EncoderMap{
-		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *decision.Receipt) error {
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *LedgerOutput) error {
 			fmt.Fprintf(w, "Ledger for %s\n"+
 				"Debt ratio:\t%f\n"+
 				"Exchanges:\t%d\n"+
 				"Bytes sent:\t%d\n"+
-				"Bytes received:\t%d\n\n",
+				"Bytes received:\t%d\n",
 				out.Peer, out.Value, out.Exchanged,
 				out.Sent, out.Recv)
+			if p := out.Policy; p != nil {
+				refused := uint64(0)
+				reasons := make([]string, 0, len(p.WantsRefused))
+				for reason, n := range p.WantsRefused {
+					refused += n
+					reasons = append(reasons, reason)
+				}
+				sort.Strings(reasons)
+
+				fmt.Fprintf(w, "Wants allowed:\t%d\n", p.WantsAllowed)
+				fmt.Fprintf(w, "Wants refused:\t%d\n", refused)
+				for _, reason := range reasons {
+					fmt.Fprintf(w, "\t%s:\t%d\n", reason, p.WantsRefused[reason])
+				}
+				fmt.Fprintf(w, "Quota blocks:\t%s\n", formatQuota(p.BlocksSent, p.QuotaBlocks))
+				fmt.Fprintf(w, "Quota bytes:\t%s\n", formatQuota(p.BytesSent, p.QuotaBytes))
+			}
+			fmt.Fprintln(w)
+			return nil
+		}),
+	},
+}
+
+func formatQuota(used, limit uint64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d (unlimited)", used)
+	}
+	return fmt.Sprintf("%d / %d", used, limit)
+}
+
+var bitswapPolicyCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage the bitswap server policy.",
+		ShortDescription: `
+The bitswap policy decides which blocks bitswap serves to which peers. It is
+read from the 'Bitswap.Policy' config key:
+
+  {
+    "Peers": ["<peer ID>", ...],
+    "Roots": [{"Root": "<CID>", "Peers": ["<peer ID>", ...]}, ...],
+    "Quota": {"Bytes": 0, "Blocks": 0, "Period": "24h"},
+    "PeerQuotas": {"<peer ID>": {"Bytes": 0, "Blocks": 0, "Period": ""}}
+  }
+
+'Peers' is the global allow-list. When it's empty, every peer is allowed.
+
+'Roots' restricts what is served to the DAGs below the given roots. The DAGs
+must be stored locally, so they should be pinned. Each root may list extra
+peers allowed to fetch it, on top of the global allow-list.
+
+'Quota' limits how many bytes and blocks every peer may fetch, over the given
+period. 'PeerQuotas' overrides it for specific peers. Zero means unlimited.
+
+Wants that the policy refuses are ignored, as if we didn't have the block.
+The decisions taken for a peer are shown by 'ipfs bitswap ledger'.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"reload": bitswapPolicyReloadCmd,
+	},
+}
+
+var bitswapPolicyReloadCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Reload the bitswap policy from the config.",
+		ShortDescription: `
+Apply the 'Bitswap.Policy' config to the running node. Usage counters are
+reset. If the new policy is invalid, the current one stays in place.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		if !nd.IsOnline {
+			return ErrNotOnline
+		}
+
+		if nd.BitswapPolicy == nil {
+			return fmt.Errorf("bitswap policy not available")
+		}
+
+		return nd.BitswapPolicy.Reload(req.Context, nd.Repo, nd.Blockstore)
+	},
+}
+
+const (
+	bitswapSessionsWatchOptionName    = "watch"
+	bitswapSessionsIntervalOptionName = "interval"
+	bitswapSessionsWantedOptionName   = "wanted"
+)
+
+var bitswapSessionsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the active bitswap sessions.",
+		ShortDescription: `
+Print the bitswap sessions of the local node, along with the blocks they are
+waiting for and the peers serving them.
+`,
+		LongDescription: `
+Print the bitswap sessions of the local node, along with the blocks they are
+waiting for and the peers serving them.
+
+Every session lists its root (the first block it requested), the blocks it is
+still waiting for, and for each peer involved: the number of wants sent to
+it, the blocks and duplicate blocks received from it, and the average time
+it took to deliver a block.
+
+Requests made outside of a session, such as single 'ipfs block get' calls,
+are shown as short-lived sessions.
+
+Sessions end when the request that opened them is canceled, or once they
+have been waiting for nothing for a minute.
+
+With --watch, sessions are printed every time they change until the command
+is interrupted. Finished sessions are printed one last time with their end
+time.
+`,
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(bitswapSessionsWatchOptionName, "w", "Keep printing sessions as they change."),
+		cmds.StringOption(bitswapSessionsIntervalOptionName, "i", "Time interval between checks for changes, if 'watch' is true.").WithDefault("1s"),
+		cmds.BoolOption(bitswapSessionsWantedOptionName, "Print the CIDs of the blocks each session is waiting for."),
+		cmds.BoolOption(bitswapHumanOptionName, "Print sizes in human readable format (e.g., 1K 234M 2G)"),
+	},
+	Type: sessions.Stat{},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		if !nd.IsOnline {
+			return ErrNotOnline
+		}
+
+		tracker := nd.Sessions
+		if tracker == nil {
+			return e.TypeErr(tracker, nd.Exchange)
+		}
+
+		watch, _ := req.Options[bitswapSessionsWatchOptionName].(bool)
+		if !watch {
+			for _, st := range tracker.Sessions() {
+				if !st.Active() {
+					continue
+				}
+				if err := res.Emit(&st); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		intervalStr, _ := req.Options[bitswapSessionsIntervalOptionName].(string)
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil {
+			return err
+		}
+
+		// Remember the last version of every session we printed so that
+		// only the sessions that changed get printed again.
+		seen := make(map[uint64]uint64)
+		first := true
+		for {
+			current := make(map[uint64]uint64)
+			for _, st := range tracker.Sessions() {
+				current[st.ID] = st.Version
+				if v, ok := seen[st.ID]; ok && v == st.Version {
+					continue
+				}
+				// Don't print sessions that were already over when we
+				// started watching.
+				if first && !st.Active() {
+					continue
+				}
+				if err := res.Emit(&st); err != nil {
+					return err
+				}
+			}
+			seen = current
+			first = false
+
+			select {
+			case <-time.After(interval):
+			case <-req.Context.Done():
+				return nil
+			}
+		}
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *sessions.Stat) error {
+			enc, err := cmdenv.GetLowLevelCidEncoder(req)
+			if err != nil {
+				return err
+			}
+			showWanted, _ := req.Options[bitswapSessionsWantedOptionName].(bool)
+			human, _ := req.Options[bitswapHumanOptionName].(bool)
+
+			root := "<none>"
+			if out.Root.Defined() {
+				root = enc.Encode(out.Root)
+			}
+			state := "active"
+			age := time.Since(out.Started)
+			if !out.Active() {
+				state = "finished"
+				age = out.Ended.Sub(out.Started)
+			}
+
+			fmt.Fprintf(w, "session %d (%s, %s)\n", out.ID, state, age.Round(time.Millisecond))
+			fmt.Fprintf(w, "\troot: %s\n", root)
+			fmt.Fprintf(w, "\tblocks requested: %d\n", out.Requested)
+			fmt.Fprintf(w, "\tblocks received: %d\n", out.Received)
+			fmt.Fprintf(w, "\twantlist [%d keys]\n", len(out.Wanted))
+			if showWanted {
+				cidutil.Sort(out.Wanted)
+				for _, c := range out.Wanted {
+					fmt.Fprintf(w, "\t\t%s\n", enc.Encode(c))
+				}
+			}
+			fmt.Fprintf(w, "\tpeers [%d]\n", len(out.Peers))
+			for _, p := range out.Peers {
+				data := fmt.Sprintf("%d", p.DataRecvd)
+				if human {
+					data = humanize.Bytes(p.DataRecvd)
+				}
+				fmt.Fprintf(w, "\t\t%s wants: %d blocks: %d dups: %d data: %s latency: %s\n",
+					p.Peer, p.WantsSent, p.Blocks, p.DupBlocks, data, p.Latency.Round(time.Millisecond))
+			}
 			return nil
 		}),
 	},
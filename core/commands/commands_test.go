@@ -75,7 +75,10 @@ func TestCommands(t *testing.T) {
 		"/add",
 		"/bitswap",
 		"/bitswap/ledger",
+		"/bitswap/policy",
+		"/bitswap/policy/reload",
 		"/bitswap/reprovide",
+		"/bitswap/sessions",
 		"/bitswap/stat",
 		"/bitswap/wantlist",
 		"/block",
@@ -123,18 +126,30 @@ func TestCommands(t *testing.T) {
 		"/file",
 		"/file/ls",
 		"/files",
+		"/files/batch",
 		"/files/chcid",
+		"/files/chmod",
 		"/files/cp",
+		"/files/diff",
 		"/files/flush",
+		"/files/log",
 		"/files/ls",
 		"/files/mkdir",
 		"/files/mv",
 		"/files/read",
 		"/files/rm",
+		"/files/snapshot",
+		"/files/snapshot/create",
+		"/files/snapshot/ls",
+		"/files/snapshot/restore",
+		"/files/snapshot/rm",
 		"/files/stat",
+		"/files/sync",
+		"/files/touch",
 		"/filestore",
 		"/filestore/dups",
 		"/filestore/ls",
+		"/filestore/repair",
 		"/filestore/verify",
 		"/files/write",
 		"/get",
@@ -204,8 +219,11 @@ func TestCommands(t *testing.T) {
 		"/refs",
 		"/refs/local",
 		"/repo",
+		"/repo/backup",
+		"/repo/convert",
 		"/repo/fsck",
 		"/repo/gc",
+		"/repo/restore",
 		"/repo/stat",
 		"/repo/verify",
 		"/repo/version",
@@ -214,6 +232,8 @@ func TestCommands(t *testing.T) {
 		"/stats",
 		"/stats/bitswap",
 		"/stats/bw",
+		"/stats/exchange",
+		"/stats/mount",
 		"/stats/dht",
 		"/stats/provide",
 		"/stats/repo",
@@ -226,6 +246,10 @@ func TestCommands(t *testing.T) {
 		"/swarm/filters",
 		"/swarm/filters/add",
 		"/swarm/filters/rm",
+		"/swarm/peering",
+		"/swarm/peering/add",
+		"/swarm/peering/ls",
+		"/swarm/peering/rm",
 		"/swarm/peers",
 		"/tar",
 		"/tar/add",
@@ -233,6 +257,8 @@ func TestCommands(t *testing.T) {
 		"/update",
 		"/urlstore",
 		"/urlstore/add",
+		"/urlstore/health",
+		"/urlstore/verify",
 		"/version",
 		"/version/deps",
 		"/cid",
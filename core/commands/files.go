@@ -1,29 +1,49 @@
 package commands
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	gopath "path"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	humanize "github.com/dustin/go-humanize"
+	oldcmds "github.com/ipfs/go-ipfs/commands"
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/core/commands/e"
+	ocmd "github.com/ipfs/go-ipfs/core/commands/object"
+	"github.com/ipfs/go-ipfs/core/coreunix"
+	"github.com/ipfs/go-ipfs/mfs/batch"
+	"github.com/ipfs/go-ipfs/mfs/dirsync"
+	"github.com/ipfs/go-ipfs/mfs/journal"
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+	"github.com/ipfs/go-ipfs/mfs/snapshot"
 
 	bservice "github.com/ipfs/go-blockservice"
 	cid "github.com/ipfs/go-cid"
 	cidenc "github.com/ipfs/go-cidutil/cidenc"
+	datastore "github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	chunker "github.com/ipfs/go-ipfs-chunker"
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	files "github.com/ipfs/go-ipfs-files"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
 	dag "github.com/ipfs/go-merkledag"
 	mfs "github.com/ipfs/go-mfs"
 	ft "github.com/ipfs/go-unixfs"
+	mod "github.com/ipfs/go-unixfs/mod"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	path "github.com/ipfs/interface-go-ipfs-core/path"
 	mh "github.com/multiformats/go-multihash"
@@ -70,16 +90,23 @@ operations.
 		cmds.BoolOption(filesFlushOptionName, "f", "Flush target and ancestors after write.").WithDefault(true),
 	},
 	Subcommands: map[string]*cmds.Command{
-		"read":  filesReadCmd,
-		"write": filesWriteCmd,
-		"mv":    filesMvCmd,
-		"cp":    filesCpCmd,
-		"ls":    filesLsCmd,
-		"mkdir": filesMkdirCmd,
-		"stat":  filesStatCmd,
-		"rm":    filesRmCmd,
-		"flush": filesFlushCmd,
-		"chcid": filesChcidCmd,
+		"read":     filesReadCmd,
+		"write":    filesWriteCmd,
+		"mv":       filesMvCmd,
+		"cp":       filesCpCmd,
+		"ls":       filesLsCmd,
+		"mkdir":    filesMkdirCmd,
+		"stat":     filesStatCmd,
+		"rm":       filesRmCmd,
+		"flush":    filesFlushCmd,
+		"chcid":    filesChcidCmd,
+		"chmod":    filesChmodCmd,
+		"touch":    filesTouchCmd,
+		"snapshot": filesSnapshotCmd,
+		"log":      filesLogCmd,
+		"diff":     filesDiffCmd,
+		"batch":    filesBatchCmd,
+		"sync":     filesSyncCmd,
 	},
 }
 
@@ -102,6 +129,9 @@ type statOutput struct {
 	WithLocality   bool   `json:",omitempty"`
 	Local          bool   `json:",omitempty"`
 	SizeLocal      uint64 `json:",omitempty"`
+	// Mode and Mtime are set when the node stores them.
+	Mode  string `json:",omitempty"`
+	Mtime string `json:",omitempty"`
 }
 
 const (
@@ -125,7 +155,7 @@ var filesStatCmd = &cmds.Command{
 	},
 	Options: []cmds.Option{
 		cmds.StringOption(filesFormatOptionName, "Print statistics in given format. Allowed tokens: "+
-			"<hash> <size> <cumulsize> <type> <childs>. Conflicts with other format options.").WithDefault(defaultStatFormat),
+			"<hash> <size> <cumulsize> <type> <childs> <mode> <mtime>. Conflicts with other format options.").WithDefault(defaultStatFormat),
 		cmds.BoolOption(filesHashOptionName, "Print only hash. Implies '--format=<hash>'. Conflicts with other format options."),
 		cmds.BoolOption(filesSizeOptionName, "Print only size. Implies '--format=<cumulsize>'. Conflicts with other format options."),
 		cmds.BoolOption(filesWithLocalOptionName, "Compute the amount of the dag that is local, and if possible the total size"),
@@ -141,6 +171,7 @@ var filesStatCmd = &cmds.Command{
 		if err != nil {
 			return err
 		}
+		defer rlockFiles(node)()
 
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
@@ -203,9 +234,20 @@ var filesStatCmd = &cmds.Command{
 			s = strings.Replace(s, "<cumulsize>", fmt.Sprintf("%d", out.CumulativeSize), -1)
 			s = strings.Replace(s, "<childs>", fmt.Sprintf("%d", out.Blocks), -1)
 			s = strings.Replace(s, "<type>", out.Type, -1)
+			s = strings.Replace(s, "<mode>", out.Mode, -1)
+			s = strings.Replace(s, "<mtime>", out.Mtime, -1)
 
 			fmt.Fprintln(w, s)
 
+			if s, _ := statGetFormatOptions(req); s == defaultStatFormat {
+				if out.Mode != "" {
+					fmt.Fprintf(w, "Mode: %s\n", out.Mode)
+				}
+				if out.Mtime != "" {
+					fmt.Fprintf(w, "Mtime: %s\n", out.Mtime)
+				}
+			}
+
 			if out.WithLocality {
 				fmt.Fprintf(w, "Local: %s of %s (%.2f%%)\n",
 					humanize.Bytes(out.SizeLocal),
@@ -244,13 +286,31 @@ func statGetFormatOptions(req *cmds.Request) (string, error) {
 }
 
 func statNode(nd ipld.Node, enc cidenc.Encoder) (*statOutput, error) {
-	c := nd.Cid()
-
 	cumulsize, err := nd.Size()
 	if err != nil {
 		return nil, err
 	}
 
+	o, err := statUnixfs(nd, enc, cumulsize)
+	if err != nil {
+		return nil, err
+	}
+	p, err := coreunix.PosixFromNode(nd)
+	if err != nil {
+		return nil, err
+	}
+	if p.HasMode {
+		o.Mode = fmt.Sprintf("%04o", coreunix.UnixMode(p.Mode))
+	}
+	if !p.Mtime.IsZero() {
+		o.Mtime = p.Mtime.Format(time.RFC3339Nano)
+	}
+	return o, nil
+}
+
+func statUnixfs(nd ipld.Node, enc cidenc.Encoder, cumulsize uint64) (*statOutput, error) {
+	c := nd.Cid()
+
 	switch n := nd.(type) {
 	case *dag.ProtoNode:
 		d, err := ft.FSNodeFromBytes(n.Data())
@@ -393,9 +453,20 @@ GC'ed.
 			dst += gopath.Base(src)
 		}
 
-		node, err := getNodeFromPath(req.Context, nd, api, src)
-		if err != nil {
-			return fmt.Errorf("cp: cannot get node from path %s: %s", src, err)
+		// IPFS paths are resolved before the MFS root is locked, as they may
+		// be fetched from the network.
+		var node ipld.Node
+		if strings.HasPrefix(src, "/ipfs/") {
+			if node, err = getNodeFromPath(req.Context, nd, api, src); err != nil {
+				return fmt.Errorf("cp: cannot get node from path %s: %s", src, err)
+			}
+		}
+
+		defer lockFiles(nd)()
+		if node == nil {
+			if node, err = getNodeFromPath(req.Context, nd, api, src); err != nil {
+				return fmt.Errorf("cp: cannot get node from path %s: %s", src, err)
+			}
 		}
 
 		if mkParents {
@@ -405,6 +476,7 @@ GC'ed.
 			}
 		}
 
+		old := journal.CidAt(nd.FilesRoot, dst)
 		err = mfs.PutNode(nd.FilesRoot, dst, node)
 		if err != nil {
 			return fmt.Errorf("cp: cannot put node in path %s: %s", dst, err)
@@ -417,7 +489,7 @@ GC'ed.
 			}
 		}
 
-		return nil
+		return nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpCp, dst, src, old)
 	},
 }
 
@@ -490,6 +562,7 @@ Examples:
 		if err != nil {
 			return err
 		}
+		defer rlockFiles(nd)()
 
 		fsn, err := mfs.Lookup(nd.FilesRoot, path)
 		if err != nil {
@@ -611,17 +684,21 @@ Examples:
 			return err
 		}
 
+		unlock := rlockFiles(nd)
 		fsn, err := mfs.Lookup(nd.FilesRoot, path)
 		if err != nil {
+			unlock()
 			return err
 		}
 
 		fi, ok := fsn.(*mfs.File)
 		if !ok {
+			unlock()
 			return fmt.Errorf("%s was not a file", path)
 		}
 
 		rfd, err := fi.Open(mfs.Flags{Read: true})
+		unlock()
 		if err != nil {
 			return err
 		}
@@ -694,6 +771,7 @@ Example:
 		if err != nil {
 			return err
 		}
+		defer lockFiles(nd)()
 
 		flush, _ := req.Options[filesFlushOptionName].(bool)
 
@@ -706,11 +784,21 @@ Example:
 			return err
 		}
 
+		// Moving into a directory moves under the same name.
+		target := dst
+		if fsn, err := mfs.Lookup(nd.FilesRoot, dst); err == nil && fsn.Type() == mfs.TDir {
+			target = gopath.Join(dst, gopath.Base(src))
+		}
+		old := journal.CidAt(nd.FilesRoot, target)
+
 		err = mfs.Mv(nd.FilesRoot, src, dst)
 		if err == nil && flush {
 			_, err = mfs.FlushPath(req.Context, nd.FilesRoot, "/")
 		}
-		return err
+		if err != nil {
+			return err
+		}
+		return nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpMv, target, src, old)
 	},
 }
 
@@ -720,6 +808,8 @@ const (
 	filesTruncateOptionName  = "truncate"
 	filesRawLeavesOptionName = "raw-leaves"
 	filesFlushOptionName     = "flush"
+	filesChunkerOptionName   = "chunker"
+	filesLayoutOptionName    = "layout"
 )
 
 var filesWriteCmd = &cmds.Command{
@@ -745,10 +835,20 @@ If the '--flush' option is set to false, changes will not be propagated to the
 merkledag root. This can make operations much faster when doing a large number
 of writes to a deeper directory structure.
 
+The '--chunker' and '--layout' options build the DAG of the file like
+'ipfs add' does, with a chunker and a layout of go-ipfs or of a plugin. They
+write the whole file: the file must be new or empty, or be truncated with
+'--truncate', and the offset must be 0.
+
+The data is read before the MFS root is locked, so the other changes of MFS
+aren't held up while it's sent. If the file changes in the meantime, the
+write fails, and can be retried.
+
 EXAMPLE:
 
     echo "hello world" | ipfs files write --create --parents /myfs/a/b/file
     echo "hello world" | ipfs files write --truncate /myfs/a/b/file
+    ipfs files write --create --chunker=buzhash --layout=trickle /myfs/log < log
 
 WARNING:
 
@@ -768,10 +868,12 @@ stat' on the file or any of its ancestors.
 		cmds.BoolOption(filesTruncateOptionName, "t", "Truncate the file to size zero before writing."),
 		cmds.Int64Option(filesCountOptionName, "n", "Maximum number of bytes to read."),
 		cmds.BoolOption(filesRawLeavesOptionName, "Use raw blocks for newly created leaf nodes. (experimental)"),
+		cmds.StringOption(filesChunkerOptionName, "Chunking algorithm of the file, as in 'ipfs add'."),
+		cmds.StringOption(filesLayoutOptionName, "Layout of the DAG of the file, as in 'ipfs add'."),
 		cidVersionOption,
 		hashOption,
 	},
-	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) (retErr error) {
+	Run: func(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) error {
 		path, err := checkPath(req.Arguments[0])
 		if err != nil {
 			return err
@@ -798,66 +900,198 @@ stat' on the file or any of its ancestors.
 			return fmt.Errorf("cannot have negative write offset")
 		}
 
-		if mkParents {
-			err := ensureContainingDirectoryExists(nd.FilesRoot, path, prefix)
-			if err != nil {
-				return err
+		chunkerStr, _ := req.Options[filesChunkerOptionName].(string)
+		layout, _ := req.Options[filesLayoutOptionName].(string)
+		rebuild := chunkerStr != "" || layout != ""
+		if rebuild {
+			if offset != 0 {
+				return fmt.Errorf("%s and %s write the whole file, and cannot be used with %s", filesChunkerOptionName, filesLayoutOptionName, filesOffsetOptionName)
+			}
+			if layout != "" {
+				if _, err := coreunix.Layout(layout); err != nil {
+					return err
+				}
 			}
 		}
 
-		fi, err := getFileHandle(nd.FilesRoot, path, create, prefix)
+		count, countfound := req.Options[filesCountOptionName].(int64)
+		if countfound && count < 0 {
+			return fmt.Errorf("cannot have negative byte count")
+		}
+
+		// The data is written to a copy of the file without the lock of the
+		// MFS root, as it's streamed from the client. The root is locked to
+		// link the new version of the file only, which fails if the file
+		// changed in between.
+		unlock := rlockFiles(nd)
+		base, err := writeBase(nd.FilesRoot, path, create, mkParents, prefix)
+		unlock()
 		if err != nil {
 			return err
 		}
 		if rawLeavesDef {
-			fi.RawLeaves = rawLeaves
+			base.rawLeaves = rawLeaves
+		}
+		if rebuild && !trunc && base.size != 0 {
+			return fmt.Errorf("%s and %s write the whole file: use them on a new or empty file, or with %s", filesChunkerOptionName, filesLayoutOptionName, filesTruncateOptionName)
 		}
 
-		wfd, err := fi.Open(mfs.Flags{Write: true, Sync: flush})
+		var r io.Reader
+		r, err = cmdenv.GetFileArg(req.Files.Entries())
 		if err != nil {
 			return err
 		}
+		if countfound {
+			r = io.LimitReader(r, count)
+		}
 
-		defer func() {
-			err := wfd.Close()
-			if err != nil {
-				if retErr == nil {
-					retErr = err
-				} else {
-					flog.Error("files: error closing file mfs file descriptor", err)
-				}
-			}
-		}()
+		var fnode ipld.Node
+		if rebuild {
+			fnode, err = rebuildFile(req.Context, nd, base, r, chunkerStr, layout, prefix)
+		} else {
+			fnode, err = modifyFile(req.Context, nd.DAG, base, r, offset, trunc)
+		}
+		if err != nil {
+			return err
+		}
 
-		if trunc {
-			if err := wfd.Truncate(0); err != nil {
+		defer lockFiles(nd)()
+		if mkParents {
+			if err := ensureContainingDirectoryExists(nd.FilesRoot, path, prefix); err != nil {
 				return err
 			}
 		}
-
-		count, countfound := req.Options[filesCountOptionName].(int64)
-		if countfound && count < 0 {
-			return fmt.Errorf("cannot have negative byte count")
+		if cur := journal.CidAt(nd.FilesRoot, path); !cur.Equals(base.old) {
+			return fmt.Errorf("%s changed while the data was written, try again", path)
 		}
-
-		_, err = wfd.Seek(int64(offset), io.SeekStart)
+		dirname, fname := gopath.Split(path)
+		pdir, err := getParentDir(nd.FilesRoot, dirname)
 		if err != nil {
-			flog.Error("seekfail: ", err)
 			return err
 		}
+		if base.old.Defined() {
+			if err := pdir.Unlink(fname); err != nil {
+				return err
+			}
+		}
+		if err := pdir.AddChild(fname, fnode); err != nil {
+			return err
+		}
+		if flush {
+			if _, err := mfs.FlushPath(req.Context, nd.FilesRoot, path); err != nil {
+				return err
+			}
+		}
+		return nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpWrite, path, "", base.old)
+	},
+}
 
-		var r io.Reader
-		r, err = cmdenv.GetFileArg(req.Files.Entries())
+// fileBase is the version of a file that 'files write' changes.
+type fileBase struct {
+	// node is the node of the file, empty when the file is created.
+	node ipld.Node
+	// old is the CID of the file, undefined when the file is created.
+	old       cid.Cid
+	size      int64
+	rawLeaves bool
+}
+
+// writeBase returns the version of the file at path to write to. A missing
+// file is created empty when create is set, with the CID builder of its
+// directory unless builder is set. It must be called with the MFS root
+// locked for reading.
+func writeBase(r *mfs.Root, path string, create, mkParents bool, builder cid.Builder) (fileBase, error) {
+	target, err := mfs.Lookup(r, path)
+	switch err {
+	case nil:
+		fi, ok := target.(*mfs.File)
+		if !ok {
+			return fileBase{}, fmt.Errorf("%s was not a file", path)
+		}
+		nd, err := fi.GetNode()
 		if err != nil {
-			return err
+			return fileBase{}, err
 		}
-		if countfound {
-			r = io.LimitReader(r, int64(count))
+		size, err := fi.Size()
+		if err != nil {
+			return fileBase{}, err
 		}
+		return fileBase{node: nd, old: nd.Cid(), size: size, rawLeaves: fi.RawLeaves}, nil
 
-		_, err = io.Copy(wfd, r)
-		return err
-	},
+	case os.ErrNotExist:
+		if !create {
+			return fileBase{}, err
+		}
+
+		// The missing parents are created with the file, like the ones of
+		// their closest existing directory.
+		dirname := gopath.Dir(path)
+		var dir *mfs.Directory
+		for {
+			dir, err = getParentDir(r, dirname)
+			if err != os.ErrNotExist || !mkParents || dirname == "/" {
+				break
+			}
+			dirname = gopath.Dir(dirname)
+		}
+		if err != nil {
+			return fileBase{}, err
+		}
+		if builder == nil {
+			builder = dir.GetCidBuilder()
+		}
+
+		nd := dag.NodeWithData(ft.FilePBData(nil, 0))
+		nd.SetCidBuilder(builder)
+		return fileBase{node: nd, rawLeaves: nd.Cid().Prefix().Version > 0}, nil
+
+	default:
+		return fileBase{}, err
+	}
+}
+
+// modifyFile writes the data of r at offset to a copy of the file, as MFS
+// descriptors do, and returns the new node of the file.
+func modifyFile(ctx context.Context, dserv ipld.DAGService, base fileBase, r io.Reader, offset int64, trunc bool) (ipld.Node, error) {
+	dmod, err := mod.NewDagModifier(ctx, base.node, dserv, chunker.DefaultSplitter)
+	if err != nil {
+		return nil, err
+	}
+	dmod.RawLeaves = base.rawLeaves
+	if trunc {
+		if err := dmod.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dmod.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(dmod, r); err != nil {
+		return nil, err
+	}
+	nd, err := dmod.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	return nd, dserv.Add(ctx, nd)
+}
+
+// rebuildFile returns the node of the file built from the data of r, with the
+// given chunker and layout.
+func rebuildFile(ctx context.Context, nd *core.IpfsNode, base fileBase, r io.Reader, chunkerStr, layout string, prefix cid.Builder) (ipld.Node, error) {
+	if prefix == nil {
+		prefix = base.node.Cid().Prefix()
+	}
+
+	adder, err := coreunix.NewAdder(ctx, nd.Pinning, nd.Blockstore, nd.DAG)
+	if err != nil {
+		return nil, err
+	}
+	adder.Chunker = chunkerStr
+	adder.Layout = layout
+	adder.RawLeaves = base.rawLeaves
+	adder.CidBuilder = prefix
+	return adder.AddFileData(r)
 }
 
 var filesMkdirCmd = &cmds.Command{
@@ -891,6 +1125,7 @@ Examples:
 		if err != nil {
 			return err
 		}
+		defer lockFiles(n)()
 
 		dashp, _ := req.Options[filesParentsOptionName].(bool)
 		dirtomake, err := checkPath(req.Arguments[0])
@@ -906,13 +1141,16 @@ Examples:
 		}
 		root := n.FilesRoot
 
+		old := journal.CidAt(root, dirtomake)
 		err = mfs.Mkdir(root, dirtomake, mfs.MkdirOpts{
 			Mkparents:  dashp,
 			Flush:      flush,
 			CidBuilder: prefix,
 		})
-
-		return err
+		if err != nil {
+			return err
+		}
+		return n.FilesJournal.Record(n.FilesRoot, journal.ActorFrom(req.Context), journal.OpMkdir, dirtomake, "", old)
 	},
 }
 
@@ -936,6 +1174,7 @@ are run with the '--flush=false'.
 		if err != nil {
 			return err
 		}
+		defer lockFiles(nd)()
 
 		enc, err := cmdenv.GetCidEncoder(req)
 		if err != nil {
@@ -976,6 +1215,7 @@ Change the CID version or hash function of the root node of a given path.
 		if err != nil {
 			return err
 		}
+		defer lockFiles(nd)()
 
 		path := "/"
 		if len(req.Arguments) > 0 {
@@ -989,11 +1229,15 @@ Change the CID version or hash function of the root node of a given path.
 			return err
 		}
 
+		old := journal.CidAt(nd.FilesRoot, path)
 		err = updatePath(nd.FilesRoot, path, prefix)
 		if err == nil && flush {
 			_, err = mfs.FlushPath(req.Context, nd.FilesRoot, path)
 		}
-		return err
+		if err != nil {
+			return err
+		}
+		return nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpChcid, path, "", old)
 	},
 }
 
@@ -1017,6 +1261,174 @@ func updatePath(rt *mfs.Root, pth string, builder cid.Builder) error {
 	return nil
 }
 
+var filesChmodCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Change the permissions of a file or directory.",
+		ShortDescription: `
+Store the permissions of a file or directory in its UnixFS node, which 'ipfs
+get' and the FUSE mounts restore. The mode is an octal number.
+
+Examples:
+
+    $ ipfs files chmod 0755 /bin/tool
+    $ ipfs files stat --format="<mode>" /bin/tool
+    0755
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("mode", true, false, "Octal permissions to set."),
+		cmds.StringArg("path", true, false, "Path to change."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		defer lockFiles(nd)()
+
+		mode, err := strconv.ParseUint(req.Arguments[0], 8, 32)
+		if err != nil || mode > 07777 {
+			return fmt.Errorf("invalid mode %q: expected octal permissions", req.Arguments[0])
+		}
+		path, err := checkPath(req.Arguments[1])
+		if err != nil {
+			return err
+		}
+		flush, _ := req.Options[filesFlushOptionName].(bool)
+
+		old := journal.CidAt(nd.FilesRoot, path)
+		err = updatePosix(req.Context, nd, path, flush, func(p *coreunix.Posix) {
+			p.Mode = coreunix.FileMode(uint32(mode))
+			p.HasMode = true
+		})
+		if err != nil {
+			return err
+		}
+		return nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpChmod, path, "", old)
+	},
+}
+
+const filesMtimeOptionName = "mtime"
+
+var filesTouchCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Change the modification time of a file or directory.",
+		ShortDescription: `
+Store the modification time of a file or directory in its UnixFS node, which
+'ipfs get' and the FUSE mounts restore. The time defaults to now, and can be
+set with --mtime to a unix timestamp in seconds or an RFC3339 time. Missing
+files are created empty.
+
+Examples:
+
+    $ ipfs files touch /notes.txt
+    $ ipfs files touch --mtime=2020-01-01T00:00:00Z /notes.txt
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("path", true, false, "Path to change."),
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(filesMtimeOptionName, "Modification time to set. Default: now."),
+		cidVersionOption,
+		hashOption,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		defer lockFiles(nd)()
+
+		mtime := time.Now()
+		if s, ok := req.Options[filesMtimeOptionName].(string); ok {
+			if mtime, err = parseMtime(s); err != nil {
+				return err
+			}
+		}
+		path, err := checkPath(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		flush, _ := req.Options[filesFlushOptionName].(bool)
+		prefix, err := getPrefixNew(req)
+		if err != nil {
+			return err
+		}
+
+		old := journal.CidAt(nd.FilesRoot, path)
+		if !old.Defined() {
+			fi, err := getFileHandle(nd.FilesRoot, path, true, prefix)
+			if err != nil {
+				return err
+			}
+			if err := fi.Flush(); err != nil {
+				return err
+			}
+		}
+		err = updatePosix(req.Context, nd, path, flush, func(p *coreunix.Posix) {
+			p.Mtime = mtime
+		})
+		if err != nil {
+			return err
+		}
+		return nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpTouch, path, "", old)
+	},
+}
+
+// parseMtime parses a unix timestamp in seconds, or an RFC3339 time.
+func parseMtime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected a unix timestamp or an RFC3339 time", s)
+	}
+	return t, nil
+}
+
+// updatePosix changes the metadata stored in the node at an MFS path.
+func updatePosix(ctx context.Context, nd *core.IpfsNode, p string, flush bool, update func(*coreunix.Posix)) error {
+	if p == "/" {
+		return errors.New("cannot change the metadata of the root")
+	}
+	// The node is replaced in its parent, so the pending changes of
+	// directories are written first.
+	node, err := mfs.FlushPath(ctx, nd.FilesRoot, p)
+	if err != nil {
+		return err
+	}
+	posix, err := coreunix.PosixFromNode(node)
+	if err != nil {
+		return err
+	}
+	update(&posix)
+	changed, err := coreunix.WithPosix(node, posix)
+	if err != nil {
+		return err
+	}
+	if err := nd.DAG.Add(ctx, changed); err != nil {
+		return err
+	}
+
+	dir, name := gopath.Split(p)
+	parent, err := getParentDir(nd.FilesRoot, dir)
+	if err != nil {
+		return err
+	}
+	if err := parent.Unlink(name); err != nil {
+		return err
+	}
+	if err := parent.AddChild(name, changed); err != nil {
+		return err
+	}
+	if flush {
+		_, err = mfs.FlushPath(ctx, nd.FilesRoot, p)
+	}
+	return err
+}
+
 var filesRmCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Remove a file.",
@@ -1044,6 +1456,7 @@ Remove files or directories.
 		if err != nil {
 			return err
 		}
+		defer lockFiles(nd)()
 
 		path, err := checkPath(req.Arguments[0])
 		if err != nil {
@@ -1073,6 +1486,7 @@ Remove files or directories.
 			return fmt.Errorf("parent lookup: %s", err)
 		}
 
+		old := journal.CidAt(nd.FilesRoot, path)
 		if force {
 			err := pdir.Unlink(name)
 			if err != nil {
@@ -1081,7 +1495,10 @@ Remove files or directories.
 				}
 				return err
 			}
-			return pdir.Flush()
+			if err := pdir.Flush(); err != nil {
+				return err
+			}
+			return nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpRm, path, "", old)
 		}
 
 		// get child node by name, when the node is corrupted and nonexistent,
@@ -1105,7 +1522,10 @@ Remove files or directories.
 			return err
 		}
 
-		return pdir.Flush()
+		if err := pdir.Flush(); err != nil {
+			return err
+		}
+		return nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpRm, path, "", old)
 	},
 }
 
@@ -1245,6 +1665,23 @@ func checkPath(p string) (string, error) {
 	return cleaned, nil
 }
 
+// lockFiles locks the MFS root of nd for a change, and returns the function
+// unlocking it. Batches and snapshot restores hold the same lock, so the
+// changes of the files commands never come in the middle of one.
+func lockFiles(nd *core.IpfsNode) func() {
+	lk := rootlock.For(nd.FilesRoot)
+	lk.Lock()
+	return lk.Unlock
+}
+
+// rlockFiles read-locks the MFS root of nd, and returns the function
+// unlocking it.
+func rlockFiles(nd *core.IpfsNode) func() {
+	lk := rootlock.For(nd.FilesRoot)
+	lk.RLock()
+	return lk.RUnlock
+}
+
 func getParentDir(root *mfs.Root, dir string) (*mfs.Directory, error) {
 	parent, err := mfs.Lookup(root, dir)
 	if err != nil {
@@ -1257,3 +1694,877 @@ func getParentDir(root *mfs.Root, dir string) (*mfs.Directory, error) {
 	}
 	return pdir, nil
 }
+
+var filesSnapshotCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage snapshots of the MFS root.",
+		ShortDescription: `
+A snapshot is a named reference to the MFS root at some point in time. Files
+and directories removed from MFS can be restored from a snapshot.
+
+Snapshots are kept by the garbage collector like MFS itself: the blocks of a
+snapshot that are stored locally are not collected, but missing blocks are
+not fetched. Snapshots created with --pin are pinned recursively instead.
+
+Snapshots can also be taken automatically, on a schedule or every n flushes
+of the MFS root, see the FilesSnapshots config section.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"create":  filesSnapshotCreateCmd,
+		"ls":      filesSnapshotLsCmd,
+		"restore": filesSnapshotRestoreCmd,
+		"rm":      filesSnapshotRmCmd,
+	},
+}
+
+type filesSnapshotOutput struct {
+	Name    string
+	Root    string
+	Created time.Time
+	Auto    bool
+	Pinned  bool
+}
+
+func newFilesSnapshotOutput(s snapshot.Snapshot, enc cidenc.Encoder) filesSnapshotOutput {
+	return filesSnapshotOutput{
+		Name:    s.Name,
+		Root:    enc.Encode(s.Root),
+		Created: s.Created,
+		Auto:    s.Auto,
+		Pinned:  s.Pinned,
+	}
+}
+
+const filesSnapshotPinOptionName = "pin"
+
+var filesSnapshotCreateCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Take a snapshot of the MFS root.",
+		ShortDescription: `
+'ipfs files snapshot create' flushes MFS and saves its root under the given
+name. Without a name, the snapshot is named after the current time.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("name", false, false, "Name of the snapshot."),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(filesSnapshotPinOptionName, "Pin the snapshot recursively, fetching missing blocks."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		name := ""
+		if len(req.Arguments) > 0 {
+			name = req.Arguments[0]
+		}
+		pin, _ := req.Options[filesSnapshotPinOptionName].(bool)
+
+		s, err := nd.FilesSnapshots.Create(req.Context, name, pin)
+		if err != nil {
+			return err
+		}
+		out := newFilesSnapshotOutput(s, enc)
+		return cmds.EmitOnce(res, &out)
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *filesSnapshotOutput) error {
+			_, err := fmt.Fprintf(w, "created snapshot %s of %s\n", out.Name, out.Root)
+			return err
+		}),
+	},
+	Type: filesSnapshotOutput{},
+}
+
+type filesSnapshotList struct {
+	Snapshots []filesSnapshotOutput
+}
+
+var filesSnapshotLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List snapshots of the MFS root, oldest first.",
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		snaps, err := nd.FilesSnapshots.List()
+		if err != nil {
+			return err
+		}
+		out := filesSnapshotList{Snapshots: make([]filesSnapshotOutput, 0, len(snaps))}
+		for _, s := range snaps {
+			out.Snapshots = append(out.Snapshots, newFilesSnapshotOutput(s, enc))
+		}
+		return cmds.EmitOnce(res, &out)
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *filesSnapshotList) error {
+			tw := tabwriter.NewWriter(w, 4, 4, 2, ' ', 0)
+			for _, s := range out.Snapshots {
+				var flags []string
+				if s.Auto {
+					flags = append(flags, "auto")
+				}
+				if s.Pinned {
+					flags = append(flags, "pinned")
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, s.Root, s.Created.Format(time.RFC3339), strings.Join(flags, ","))
+			}
+			return tw.Flush()
+		}),
+	},
+	Type: filesSnapshotList{},
+}
+
+type filesSnapshotRestoreOutput struct {
+	Path string
+	// Before is the snapshot of the state before the restore.
+	Before filesSnapshotOutput
+}
+
+var filesSnapshotRestoreCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Restore MFS from a snapshot.",
+		ShortDescription: `
+'ipfs files snapshot restore' replaces the given MFS path, or the whole MFS
+tree, with its content in the snapshot. The state before the restore is
+saved in an automatic snapshot first, so a restore can be undone.
+
+    $ ipfs files rm -r /photos
+    $ ipfs files snapshot restore daily /photos
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("name", true, false, "Name of the snapshot to restore."),
+		cmds.StringArg("path", false, false, "MFS path to restore. Default: '/'."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		path := "/"
+		if len(req.Arguments) > 1 {
+			path, err = checkPath(req.Arguments[1])
+			if err != nil {
+				return err
+			}
+		}
+
+		old := journal.CidAt(nd.FilesRoot, path)
+		before, err := nd.FilesSnapshots.Restore(req.Context, req.Arguments[0], path)
+		if err != nil {
+			return err
+		}
+		if err := nd.FilesJournal.Record(nd.FilesRoot, journal.ActorFrom(req.Context), journal.OpRestore, path, req.Arguments[0], old); err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &filesSnapshotRestoreOutput{
+			Path:   path,
+			Before: newFilesSnapshotOutput(before, enc),
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *filesSnapshotRestoreOutput) error {
+			_, err := fmt.Fprintf(w, "restored %s, the previous state is in snapshot %s\n", out.Path, out.Before.Name)
+			return err
+		}),
+	},
+	Type: filesSnapshotRestoreOutput{},
+}
+
+var filesSnapshotRmCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Remove snapshots of the MFS root.",
+		ShortDescription: `
+'ipfs files snapshot rm' removes snapshots. Their content may then be
+garbage collected, unless it is still in MFS or pinned otherwise.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("name", true, true, "Name of the snapshot to remove."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range req.Arguments {
+			if err := nd.FilesSnapshots.Remove(req.Context, name); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return cmds.EmitOnce(res, &stringList{req.Arguments})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+const (
+	filesLogSinceOptionName = "since"
+	filesLogUntilOptionName = "until"
+)
+
+type filesLogEntry struct {
+	Seq   uint64
+	Time  time.Time
+	Actor string `json:",omitempty"`
+	Op    string
+	Path  string
+	From  string `json:",omitempty"`
+	Old   string
+	New   string
+}
+
+var filesLogCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the changes made to MFS.",
+		ShortDescription: `
+'ipfs files log' lists the changes made to MFS with the files commands or
+through the /mfs mount, oldest first, with the CIDs before and after each
+change. With a path, only the changes to the path or to anything under it are
+listed. The writes through the mount are recorded when the files are closed
+or synced.
+
+Each change lists who made it: 'cli' for the ipfs command without a daemon,
+'fuse' for the /mfs mount, and 'api:<address>' for the clients of the API,
+including the ipfs command talking to a daemon.
+
+The '--since' and '--until' options take a time (RFC3339), or a duration
+meaning that long ago:
+
+    $ ipfs files log --since 24h /photos
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("path", false, false, "MFS path to list the changes of. Default: '/'."),
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(filesLogSinceOptionName, "Only list the changes made since then."),
+		cmds.StringOption(filesLogUntilOptionName, "Only list the changes made until then."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		var f journal.Filter
+		if len(req.Arguments) > 0 {
+			f.Path, err = checkPath(req.Arguments[0])
+			if err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		if s, ok := req.Options[filesLogSinceOptionName].(string); ok {
+			if f.Since, err = parseLogTime(s, now); err != nil {
+				return err
+			}
+		}
+		if s, ok := req.Options[filesLogUntilOptionName].(string); ok {
+			if f.Until, err = parseLogTime(s, now); err != nil {
+				return err
+			}
+		}
+
+		return nd.FilesJournal.ForEach(f, func(e journal.Entry) error {
+			return res.Emit(&filesLogEntry{
+				Seq:   e.Seq,
+				Time:  e.Time,
+				Actor: e.Actor,
+				Op:    e.Op,
+				Path:  e.Path,
+				From:  e.From,
+				Old:   encodeDefinedCid(enc, e.Old),
+				New:   encodeDefinedCid(enc, e.New),
+			})
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *filesLogEntry) error {
+			change := out.Path
+			if out.From != "" {
+				change = fmt.Sprintf("%s (from %s)", out.Path, out.From)
+			}
+			actor, before, after := out.Actor, out.Old, out.New
+			if actor == "" {
+				actor = "-"
+			}
+			if before == "" {
+				before = "-"
+			}
+			if after == "" {
+				after = "-"
+			}
+			_, err := fmt.Fprintf(w, "%d %s %s %s %s %s -> %s\n", out.Seq, out.Time.Format(time.RFC3339), actor, out.Op, change, before, after)
+			return err
+		}),
+	},
+	Type: filesLogEntry{},
+}
+
+// parseLogTime parses a time, or a duration before now.
+func parseLogTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected a time in RFC3339 format or a duration", s)
+	}
+	return t, nil
+}
+
+func encodeDefinedCid(enc cidenc.Encoder, c cid.Cid) string {
+	if !c.Defined() {
+		return ""
+	}
+	return enc.Encode(c)
+}
+
+var filesDiffCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the differences between MFS and a snapshot or CID.",
+		ShortDescription: `
+'ipfs files diff' compares an earlier MFS root, given by the name of a
+snapshot or by its CID, with MFS now, the same way as 'ipfs object diff'.
+With a path, only the path is compared in both trees.
+
+    $ ipfs files diff daily /photos
+    + QmRfFVsjSXkhFxrfWnLpMae2M4GBVsry6VAuYYcji5MiZb "new.jpg"
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("from", true, false, "Name of a snapshot, or CID or path of an earlier MFS root."),
+		cmds.StringArg("path", false, false, "MFS path to compare. Default: '/'."),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(verboseOptionName, "v", "Print extra information."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		defer rlockFiles(nd)()
+
+		api, err := cmdenv.GetApi(env, req)
+		if err != nil {
+			return err
+		}
+
+		p := "/"
+		if len(req.Arguments) > 1 {
+			p, err = checkPath(req.Arguments[1])
+			if err != nil {
+				return err
+			}
+		}
+
+		base, err := resolveFilesRoot(nd, req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		before := base
+		if rel := strings.Trim(p, "/"); rel != "" {
+			before = path.Join(base, rel)
+		}
+
+		after, err := mfs.FlushPath(req.Context, nd.FilesRoot, p)
+		if err != nil {
+			return err
+		}
+
+		changes, err := api.Object().Diff(req.Context, before, path.IpfsPath(after.Cid()))
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, ocmd.NewChanges(changes))
+	},
+	Encoders: ocmd.ObjectDiffCmd.Encoders,
+	Type:     ocmd.Changes{},
+}
+
+// resolveFilesRoot returns the path of an earlier MFS root given by the name of
+// a snapshot, a CID or an IPFS path.
+func resolveFilesRoot(nd *core.IpfsNode, s string) (path.Path, error) {
+	if strings.Contains(s, "/") {
+		p := path.New(s)
+		return p, p.IsValid()
+	}
+
+	snap, err := nd.FilesSnapshots.Get(s)
+	if err == nil {
+		return path.IpfsPath(snap.Root), nil
+	}
+	if err != snapshot.ErrNotFound {
+		return nil, err
+	}
+	c, err := cid.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a snapshot nor a CID", s)
+	}
+	return path.IpfsPath(c), nil
+}
+
+const filesBatchExpectRootOptionName = "expect-root"
+
+type filesBatchOutput struct {
+	Old        string
+	New        string
+	Operations int
+}
+
+var filesBatchCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Apply several operations to MFS atomically.",
+		ShortDescription: `
+'ipfs files batch' reads a list of operations, one JSON object per line, and
+applies them to MFS at once: the MFS root is flushed once when all of them
+succeed, and left untouched when any of them fails.
+
+The operations are:
+
+    {"Op": "cp", "Src": "/ipfs/<cid> or /mfs/path", "Dst": "/path", "Parents": false}
+    {"Op": "mv", "Src": "/path", "Dst": "/path", "Parents": false}
+    {"Op": "rm", "Path": "/path", "Recursive": false}
+    {"Op": "mkdir", "Path": "/path", "Parents": false}
+
+With '--expect-root', the batch fails with a conflict unless the MFS root is
+the given CID, so that concurrent writers don't overwrite each other's
+changes. A batch also fails with a conflict when MFS is changed while it is
+applied.
+
+    $ ROOT=$(ipfs files stat --hash /)
+    $ ipfs files batch --expect-root $ROOT < operations.json
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.FileArg("operations", true, false, "Operations to apply, as JSON lines.").EnableStdin(),
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(filesBatchExpectRootOptionName, "Only apply the operations if the MFS root is this CID."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		api, err := cmdenv.GetApi(env, req)
+		if err != nil {
+			return err
+		}
+
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		expected := cid.Undef
+		if s, ok := req.Options[filesBatchExpectRootOptionName].(string); ok {
+			expected, err = cid.Decode(s)
+			if err != nil {
+				return fmt.Errorf("invalid expected root: %w", err)
+			}
+		}
+
+		r, err := cmdenv.GetFileArg(req.Files.Entries())
+		if err != nil {
+			return err
+		}
+		var ops []batch.Op
+		dec := json.NewDecoder(r)
+		for {
+			var op batch.Op
+			if err := dec.Decode(&op); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("operation %d: %w", len(ops)+1, err)
+			}
+			ops = append(ops, op)
+		}
+
+		resolve := func(ctx context.Context, p string) (ipld.Node, error) {
+			return api.ResolveNode(ctx, path.New(p))
+		}
+		out, err := batch.Apply(req.Context, nd.FilesRoot, nd.DAG, resolve, expected, ops)
+		if err != nil {
+			return err
+		}
+		for _, change := range out.Changes {
+			change.Actor = journal.ActorFrom(req.Context)
+			if _, err := nd.FilesJournal.Append(change); err != nil {
+				return fmt.Errorf("recording the change in the files journal: %w", err)
+			}
+		}
+
+		return cmds.EmitOnce(res, &filesBatchOutput{
+			Old:        enc.Encode(out.Old),
+			New:        enc.Encode(out.New),
+			Operations: len(ops),
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *filesBatchOutput) error {
+			_, err := fmt.Fprintf(w, "applied %d operations: %s -> %s\n", out.Operations, out.Old, out.New)
+			return err
+		}),
+	},
+	Type: filesBatchOutput{},
+}
+
+const (
+	filesSyncDeleteOptionName = "delete"
+	filesSyncHiddenOptionName = "hidden"
+	filesSyncPullOptionName   = "pull"
+	filesSyncWatchOptionName  = "watch"
+)
+
+type filesSyncOutput struct {
+	Op    string `json:",omitempty"`
+	Path  string `json:",omitempty"`
+	Cid   string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+var filesSyncCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Synchronize a local directory with MFS.",
+		ShortDescription: `
+'ipfs files sync' makes an MFS directory the same as a local directory,
+copying only the files that changed. With '--pull', the local directory is
+made the same as the MFS directory instead.
+
+Files are compared by CID. The CIDs of local files are cached with their size
+and modification time, so only the files that changed since the last sync are
+read again. Entries missing from the source are only removed from the
+destination with '--delete'. Hidden files are ignored on both sides unless
+'--hidden' is given.
+
+With '--watch', the local directory is synchronized again after every change
+until the command is interrupted.
+
+    $ ipfs files sync --watch ~/photos /photos
+
+The local directory is walked and watched by the ipfs command, which only
+sends the daemon the files to add and the changes to make to MFS. Every change
+is made with the MFS root locked on its own, so other writers can use MFS
+during a sync, and is recorded in the files journal. The CIDs of the local
+files are cached in the 'filessync' directory of the repo.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("local-dir", true, false, "Local directory to synchronize."),
+		cmds.StringArg("mfs-path", true, false, "MFS directory to synchronize."),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(filesSyncDeleteOptionName, "Remove the entries missing from the source."),
+		cmds.BoolOption(filesSyncHiddenOptionName, "H", "Include files and directories whose name starts with a dot."),
+		cmds.BoolOption(filesSyncPullOptionName, "Synchronize the local directory from MFS."),
+		cmds.BoolOption(filesSyncWatchOptionName, "w", "Synchronize again after every change to the local directory."),
+	},
+	Extra: CreateCmdExtras(SetDoesNotUseRepo(true)),
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		cctx := env.(*oldcmds.Context)
+		if cctx.Daemon == nil {
+			return errors.New("files sync reads and writes local directories, it only runs in the ipfs command")
+		}
+
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		local, err := filepath.Abs(req.Arguments[0])
+		if err != nil {
+			return err
+		}
+		mp, err := checkPath(req.Arguments[1])
+		if err != nil {
+			return err
+		}
+
+		del, _ := req.Options[filesSyncDeleteOptionName].(bool)
+		hidden, _ := req.Options[filesSyncHiddenOptionName].(bool)
+		pull, _ := req.Options[filesSyncPullOptionName].(bool)
+		watch, _ := req.Options[filesSyncWatchOptionName].(bool)
+		if pull && watch {
+			return fmt.Errorf("--%s only watches local directories, it can't be used with --%s", filesSyncWatchOptionName, filesSyncPullOptionName)
+		}
+
+		node, err := syncNode(req, cctx)
+		if err != nil {
+			return err
+		}
+		cache := openSyncCache(cctx.ConfigRoot)
+		defer cache.Close()
+
+		s := dirsync.New(cache, node, dirsync.Options{Delete: del, Hidden: hidden})
+		emit := func(out dirsync.Result) error {
+			for _, change := range out.Changes {
+				err := res.Emit(&filesSyncOutput{
+					Op:   change.Op,
+					Path: change.Path,
+					Cid:  encodeDefinedCid(enc, change.New),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		switch {
+		case pull:
+			out, err := s.Pull(req.Context, mp, local)
+			if err := emit(out); err != nil {
+				return err
+			}
+			return err
+		case watch:
+			return s.Watch(req.Context, local, mp, func(out dirsync.Result, err error) {
+				if err == nil {
+					err = emit(out)
+				}
+				if err != nil {
+					res.Emit(&filesSyncOutput{Error: err.Error()})
+				}
+			})
+		default:
+			out, err := s.Push(req.Context, local, mp)
+			if err := emit(out); err != nil {
+				return err
+			}
+			return err
+		}
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *filesSyncOutput) error {
+			var err error
+			switch {
+			case out.Error != "":
+				_, err = fmt.Fprintf(w, "sync failed: %s\n", out.Error)
+			case out.Cid != "":
+				_, err = fmt.Fprintf(w, "%s %s %s\n", out.Op, out.Path, out.Cid)
+			default:
+				_, err = fmt.Fprintf(w, "%s %s\n", out.Op, out.Path)
+			}
+			return err
+		}),
+	},
+	Type: filesSyncOutput{},
+}
+
+// syncNode returns the node whose MFS directories are synchronized: the
+// daemon when one is running, and the node of the command otherwise.
+func syncNode(req *cmds.Request, cctx *oldcmds.Context) (dirsync.Node, error) {
+	exe, err := cctx.Daemon(req)
+	if err != nil {
+		return nil, err
+	}
+	if exe != nil {
+		return &apiSyncNode{exe: exe, root: req.Root, env: cctx}, nil
+	}
+
+	nd, err := cctx.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	api, err := cctx.GetAPI()
+	if err != nil {
+		return nil, err
+	}
+	return dirsync.NewLocalNode(api, nd.DAG, nd.FilesRoot, nd.FilesJournal), nil
+}
+
+// openSyncCache opens the cache of the CIDs of the synchronized local files.
+// An in-memory cache is used when it can't be opened, e.g. while another
+// sync uses it.
+func openSyncCache(repoPath string) datastore.Datastore {
+	ds, err := leveldb.NewDatastore(filepath.Join(repoPath, "filessync"), nil)
+	if err != nil {
+		flog.Warnf("caching the CIDs of the local files in memory: %s", err)
+		return datastore.NewMapDatastore()
+	}
+	return ds
+}
+
+// apiSyncNode is a daemon reached through its API, whose MFS directories are
+// synchronized by the client.
+type apiSyncNode struct {
+	exe  cmds.Executor
+	root *cmds.Command
+	env  cmds.Environment
+}
+
+// call runs the command at path on the daemon.
+func (n *apiSyncNode) call(ctx context.Context, path []string, opts cmds.OptMap, args []string, f files.Directory) (cmds.Response, error) {
+	req, err := cmds.NewRequest(ctx, path, opts, args, f, n.root)
+	if err != nil {
+		return nil, err
+	}
+	re, res := cmds.NewChanResponsePair(req)
+	go func() {
+		if err := n.exe.Execute(req, re, n.env); err != nil {
+			re.CloseWithError(err)
+		}
+	}()
+	return res, nil
+}
+
+// callOnce runs the command at path on the daemon, and returns the value it
+// emits.
+func (n *apiSyncNode) callOnce(ctx context.Context, path []string, opts cmds.OptMap, args []string, f files.Directory) (interface{}, error) {
+	res, err := n.call(ctx, path, opts, args, f)
+	if err != nil {
+		return nil, err
+	}
+	return res.Next()
+}
+
+func (n *apiSyncNode) Add(ctx context.Context, f files.File, onlyHash bool) (cid.Cid, error) {
+	opts := cmds.OptMap{
+		pinOptionName:      false,
+		onlyHashOptionName: onlyHash,
+		quieterOptionName:  true,
+	}
+	res, err := n.call(ctx, []string{"add"}, opts, nil, files.NewMapDirectory(map[string]files.Node{"file": f}))
+	if err != nil {
+		return cid.Undef, err
+	}
+	c := cid.Undef
+	for {
+		v, err := res.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return cid.Undef, err
+		}
+		out, ok := v.(*AddEvent)
+		if !ok {
+			return cid.Undef, e.TypeErr(out, v)
+		}
+		if out.Hash == "" {
+			continue
+		}
+		if c, err = cid.Decode(out.Hash); err != nil {
+			return cid.Undef, err
+		}
+	}
+	if !c.Defined() {
+		return cid.Undef, errors.New("the daemon didn't return the CID of the file")
+	}
+	return c, nil
+}
+
+type syncReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *syncReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+func (n *apiSyncNode) Cat(ctx context.Context, c cid.Cid) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	v, err := n.callOnce(ctx, []string{"cat"}, nil, []string{path.IpfsPath(c).String()}, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r, ok := v.(io.Reader)
+	if !ok {
+		cancel()
+		return nil, e.TypeErr(r, v)
+	}
+	return &syncReader{Reader: r, cancel: cancel}, nil
+}
+
+func (n *apiSyncNode) Ls(ctx context.Context, p string) ([]dirsync.Entry, error) {
+	v, err := n.callOnce(ctx, []string{"files", "stat"}, nil, []string{p}, nil)
+	if err != nil {
+		// The error lost its type on its way from the daemon.
+		if err.Error() == os.ErrNotExist.Error() {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	st, ok := v.(*statOutput)
+	if !ok {
+		return nil, e.TypeErr(st, v)
+	}
+	if st.Type != "directory" {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+
+	v, err = n.callOnce(ctx, []string{"files", "ls"}, cmds.OptMap{longOptionName: true, dontSortOptionName: true}, []string{p}, nil)
+	if err != nil {
+		return nil, err
+	}
+	out, ok := v.(*filesLsOutput)
+	if !ok {
+		return nil, e.TypeErr(out, v)
+	}
+	entries := make([]dirsync.Entry, 0, len(out.Entries))
+	for _, l := range out.Entries {
+		c, err := cid.Decode(l.Hash)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dirsync.Entry{Name: l.Name, Dir: l.Type == int(mfs.TDir), Cid: c})
+	}
+	return entries, nil
+}
+
+func (n *apiSyncNode) Change(ctx context.Context, ops []batch.Op) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			return err
+		}
+	}
+	body := files.NewMapDirectory(map[string]files.Node{"operations": files.NewBytesFile(buf.Bytes())})
+	_, err := n.callOnce(ctx, []string{"files", "batch"}, nil, nil, body)
+	return err
+}
+
+func (n *apiSyncNode) Flush(ctx context.Context, p string) error {
+	_, err := n.callOnce(ctx, []string{"files", "flush"}, nil, []string{p}, nil)
+	return err
+}
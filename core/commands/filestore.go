@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	filestore "github.com/ipfs/go-filestore"
 	core "github.com/ipfs/go-ipfs/core"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	e "github.com/ipfs/go-ipfs/core/commands/e"
+	"github.com/ipfs/go-ipfs/filestore/repair"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-ipfs-cmds"
@@ -22,6 +24,7 @@ var FileStoreCmd = &cmds.Command{
 		"ls":     lsFileStore,
 		"verify": verifyFileStore,
 		"dups":   dupsFileStore,
+		"repair": repairFileStore,
 	},
 }
 
@@ -223,6 +226,129 @@ var dupsFileStore = &cmds.Command{
 	Type:     RefWrapper{},
 }
 
+const (
+	searchPathOptionName   = "search-path"
+	repairCopyOptionName   = "copy"
+	repairDryRunOptionName = "dry-run"
+)
+
+type filestoreRepairOutput struct {
+	Status  string
+	Path    string
+	NewPath string `json:",omitempty"`
+	Cid     string `json:",omitempty"`
+	Blocks  int
+	Error   string `json:",omitempty"`
+}
+
+var repairFileStore = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Repair the references to moved or modified files.",
+		LongDescription: `
+Repair the filestore objects whose backing file was moved or modified, as
+reported by 'ipfs filestore verify'.
+
+Moved files are searched by content in the directories given with
+--search-path, and the objects are pointed to their new location. Files
+modified in place are added again with --nocopy, and the new root is printed.
+The objects whose backing file can't be found are removed from the filestore.
+
+Moved files found outside of the filestore root, the parent directory of the
+repository, can't be referenced: with --copy their data is copied into the
+blockstore instead, otherwise they are skipped.
+
+The output is:
+
+<status> <path> [<new path>|<hash>] (<blocks> blocks)
+
+Where <status> is one of:
+moved:    the file was found at <new path>
+copied:   the file was found at <new path>, and its data copied
+readded:  the file was modified, and added again as <hash>
+removed:  the file couldn't be found, and its objects were removed
+skipped:  the file was found at <new path>, but couldn't be referenced
+
+The files are searched for by the node, so the search paths must be on the
+machine running the node. Use --dry-run to only report the repairs.
+`,
+	},
+	Options: []cmds.Option{
+		cmds.StringsOption(searchPathOptionName, "Directory to search moved files in. Can be given several times."),
+		cmds.BoolOption(repairCopyOptionName, "Copy the data of files found outside of the filestore root into the blockstore."),
+		cmds.BoolOption(repairDryRunOptionName, "Only report the repairs, without making them."),
+	},
+	PreRun: func(req *cmds.Request, env cmds.Environment) error {
+		// The node may run in another process.
+		paths, _ := req.Options[searchPathOptionName].([]string)
+		for i, p := range paths {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+			paths[i] = abs
+		}
+		return nil
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		_, fs, err := getFilestore(env)
+		if err != nil {
+			return err
+		}
+		api, err := cmdenv.GetApi(env, req)
+		if err != nil {
+			return err
+		}
+		cfgRoot, err := cmdenv.GetConfigRoot(env)
+		if err != nil {
+			return err
+		}
+		root, err := filepath.Abs(filepath.Dir(cfgRoot))
+		if err != nil {
+			return err
+		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		paths, _ := req.Options[searchPathOptionName].([]string)
+		cp, _ := req.Options[repairCopyOptionName].(bool)
+		dryRun, _ := req.Options[repairDryRunOptionName].(bool)
+
+		r := repair.New(fs, root, api, repair.Options{SearchPaths: paths, Copy: cp, DryRun: dryRun})
+		return r.Repair(req.Context, func(r repair.Result) error {
+			out := &filestoreRepairOutput{
+				Status:  r.Status,
+				Path:    r.Path,
+				NewPath: r.NewPath,
+				Blocks:  r.Blocks,
+				Error:   r.Error,
+			}
+			if r.Cid.Defined() {
+				out.Cid = enc.Encode(r.Cid)
+			}
+			return res.Emit(out)
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *filestoreRepairOutput) error {
+			target := out.NewPath
+			if out.Cid != "" {
+				target = out.Cid
+			}
+			if target != "" {
+				target = " " + target
+			}
+			if out.Error != "" {
+				target += ": " + out.Error
+			}
+			_, err := fmt.Fprintf(w, "%-7s %s%s (%d blocks)\n", out.Status, out.Path, target, out.Blocks)
+			return err
+		}),
+	},
+	Type: filestoreRepairOutput{},
+}
+
 func getFilestore(env cmds.Environment) (*core.IpfsNode, *filestore.Filestore, error) {
 	n, err := cmdenv.GetNode(env)
 	if err != nil {
@@ -1,22 +1,32 @@
 package commands
 
 import (
+	gotar "archive/tar"
+	"archive/zip"
 	"bufio"
+	"compress/flate"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	gopath "path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ipfs/go-ipfs/core/commands/cmdenv"
 	"github.com/ipfs/go-ipfs/core/commands/e"
+	"github.com/ipfs/go-ipfs/core/coreunix"
 
 	"github.com/cheggaaa/pb"
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	uio "github.com/ipfs/go-unixfs/io"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 	"github.com/ipfs/tar-utils"
 )
@@ -28,6 +38,14 @@ const (
 	archiveOptionName          = "archive"
 	compressOptionName         = "compress"
 	compressionLevelOptionName = "compression-level"
+	toTarOptionName            = "to-tar"
+	archiveFormatOptionName    = "archive-format"
+)
+
+// Formats of the archives written with --archive-format.
+const (
+	archiveTar = "tar"
+	archiveZip = "zip"
 )
 
 var GetCmd = &cmds.Command{
@@ -40,9 +58,20 @@ By default, the output will be stored at './<ipfs-path>', but an alternate
 path can be specified with '--output=<path>' or '-o=<path>'.
 
 To output a TAR archive instead of unpacked files, use '--archive' or '-a'.
+To output a ZIP archive, use '--archive-format=zip'; the compression level
+then sets the one of its entries.
 
 To compress the output with GZIP compression, use '--compress' or '-C'. You
 may also specify the level of compression by specifying '-l=<1-9>'.
+
+The permissions and modification times stored with 'ipfs add
+--preserve-mode --preserve-mtime' are restored, and set in the TAR archives.
+
+To write a directory as a TAR archive of its content, as 'ipfs add
+--from-tar' reads them, use '--to-tar'. The archive is written to the
+output path, or to the standard output when none is given. UnixFS doesn't
+record hard links, so every file is written with its content, including the
+ones unpacked from hard links.
 `,
 	},
 
@@ -54,8 +83,13 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		cmds.BoolOption(archiveOptionName, "a", "Output a TAR archive."),
 		cmds.BoolOption(compressOptionName, "C", "Compress the output with GZIP compression."),
 		cmds.IntOption(compressionLevelOptionName, "l", "The level of compression (1-9)."),
+		cmds.BoolOption(toTarOptionName, "Output a TAR archive of the content of directories, to stdout by default."),
+		cmds.StringOption(archiveFormatOptionName, "The format of the archive, tar or zip. zip implies --archive.").WithDefault(archiveTar),
 	},
 	PreRun: func(req *cmds.Request, env cmds.Environment) error {
+		if _, err := getArchiveFormat(req); err != nil {
+			return err
+		}
 		_, err := getCompressOptions(req)
 		return err
 	},
@@ -64,6 +98,10 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		if err != nil {
 			return err
 		}
+		format, err := getArchiveFormat(req)
+		if err != nil {
+			return err
+		}
 
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
@@ -72,7 +110,11 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 
 		p := path.New(req.Arguments[0])
 
-		file, err := api.Unixfs().Get(req.Context, p)
+		nd, err := api.ResolveNode(req.Context, p)
+		if err != nil {
+			return err
+		}
+		file, err := api.Unixfs().Get(req.Context, path.IpfsPath(nd.Cid()))
 		if err != nil {
 			return err
 		}
@@ -85,7 +127,23 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		res.SetLength(uint64(size))
 
 		archive, _ := req.Options[archiveOptionName].(bool)
-		reader, err := fileArchive(file, p.String(), archive, cmplvl)
+		toTar, _ := req.Options[toTarOptionName].(bool)
+		tw := &tarWriter{ctx: req.Context, dag: api.Dag()}
+		name := p.String()
+		if toTar {
+			archive = true
+			// The entries of directories are at the root of the archive.
+			if _, ok := file.(files.Directory); ok {
+				name = "."
+			}
+		}
+		var reader io.Reader
+		if format == archiveZip {
+			zw := &zipWriter{ctx: req.Context, dag: api.Dag()}
+			reader, err = zipArchive(zw, nd, file, name, cmplvl)
+		} else {
+			reader, err = fileArchive(tw, nd, file, name, archive, cmplvl)
+		}
 		if err != nil {
 			return err
 		}
@@ -106,6 +164,10 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 				return e.New(e.TypeErr(outReader, v))
 			}
 
+			if toTar, _ := req.Options[toTarOptionName].(bool); toTar {
+				return writeTar(outReader, req)
+			}
+
 			outPath := getOutPath(req)
 
 			cmplvl, err := getCompressOptions(req)
@@ -114,11 +176,16 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 			}
 
 			archive, _ := req.Options[archiveOptionName].(bool)
+			format, err := getArchiveFormat(req)
+			if err != nil {
+				return err
+			}
 
 			gw := getWriter{
 				Out:         os.Stdout,
 				Err:         os.Stderr,
 				Archive:     archive,
+				Format:      format,
 				Compression: cmplvl,
 				Size:        int64(res.Length()),
 			}
@@ -179,27 +246,32 @@ type getWriter struct {
 	Err io.Writer // for progress bar output
 
 	Archive     bool
+	Format      string
 	Compression int
 	Size        int64
 }
 
 func (gw *getWriter) Write(r io.Reader, fpath string) error {
-	if gw.Archive || gw.Compression != gzip.NoCompression {
+	if gw.Archive || gw.Format == archiveZip || gw.Compression != gzip.NoCompression {
 		return gw.writeArchive(r, fpath)
 	}
 	return gw.writeExtracted(r, fpath)
 }
 
 func (gw *getWriter) writeArchive(r io.Reader, fpath string) error {
-	// adjust file name if tar
-	if gw.Archive {
+	// adjust file name if zip, whose entries are compressed instead
+	if gw.Format == archiveZip {
+		if !strings.HasSuffix(fpath, ".zip") {
+			fpath += ".zip"
+		}
+	} else if gw.Archive {
 		if !strings.HasSuffix(fpath, ".tar") && !strings.HasSuffix(fpath, ".tar.gz") {
 			fpath += ".tar"
 		}
 	}
 
 	// adjust file name if gz
-	if gw.Compression != gzip.NoCompression {
+	if gw.Format != archiveZip && gw.Compression != gzip.NoCompression {
 		if !strings.HasSuffix(fpath, ".gz") {
 			fpath += ".gz"
 		}
@@ -228,8 +300,57 @@ func (gw *getWriter) writeExtracted(r io.Reader, fpath string) error {
 	defer bar.Finish()
 	defer bar.Set64(gw.Size)
 
+	// Files extracted in an existing directory are put in it.
+	var intoDir bool
+	if fi, err := os.Lstat(fpath); err == nil {
+		intoDir = fi.IsDir()
+	}
+
+	// The metadata is read from the headers of a copy of the archive, as
+	// the extractor doesn't restore it.
+	pr, pw := io.Pipe()
+	headers := make(chan []*gotar.Header, 1)
+	go func() {
+		headers <- readTarHeaders(pr)
+	}()
+
 	extractor := &tar.Extractor{Path: fpath, Progress: bar.Add64}
-	return extractor.Extract(r)
+	err := extractor.Extract(io.TeeReader(r, pw))
+	pw.Close()
+	hdrs := <-headers
+	if err != nil {
+		return err
+	}
+	return restorePosix(hdrs, fpath, intoDir)
+}
+
+// writeTar writes the archive of --to-tar to the output path, or to stdout.
+func writeTar(r io.Reader, req *cmds.Request) error {
+	var out io.Writer = os.Stdout
+	if outPath, _ := req.Options[outputOptionName].(string); outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	_, err := io.Copy(out, r)
+	return err
+}
+
+func getArchiveFormat(req *cmds.Request) (string, error) {
+	format, _ := req.Options[archiveFormatOptionName].(string)
+	switch format {
+	case "", archiveTar:
+		return archiveTar, nil
+	case archiveZip:
+		if toTar, _ := req.Options[toTarOptionName].(bool); toTar {
+			return "", fmt.Errorf("%s=%s cannot be used with %s", archiveFormatOptionName, format, toTarOptionName)
+		}
+		return archiveZip, nil
+	}
+	return "", fmt.Errorf("unknown archive format %q, expected tar or zip", format)
 }
 
 func getCompressOptions(req *cmds.Request) (int, error) {
@@ -262,7 +383,7 @@ func (i *identityWriteCloser) Close() error {
 	return nil
 }
 
-func fileArchive(f files.Node, name string, archive bool, compression int) (io.Reader, error) {
+func fileArchive(tw *tarWriter, nd ipld.Node, f files.Node, name string, archive bool, compression int) (io.Reader, error) {
 	cleaned := gopath.Clean(name)
 	_, filename := gopath.Split(cleaned)
 
@@ -312,17 +433,16 @@ func fileArchive(f files.Node, name string, archive bool, compression int) (io.R
 		// the case for 1. archive, and 2. not archived and not compressed, in which tar is used anyway as a transport format
 
 		// construct the tar writer
-		w, err := files.NewTarWriter(maybeGzw)
-		if checkErrAndClosePipe(err) {
-			return nil, err
-		}
+		tw.tw = gotar.NewWriter(maybeGzw)
 
 		go func() {
 			// write all the nodes recursively
-			if err := w.WriteFile(f, filename); checkErrAndClosePipe(err) {
+			if err := tw.write(nd, f, filename); checkErrAndClosePipe(err) {
+				return
+			}
+			if err := tw.tw.Close(); checkErrAndClosePipe(err) {
 				return
 			}
-			w.Close()         // close tar writer
 			closeGzwAndPipe() // everything seems to be ok
 		}()
 	}
@@ -336,3 +456,253 @@ func newMaybeGzWriter(w io.Writer, compression int) (io.WriteCloser, error) {
 	}
 	return &identityWriteCloser{w}, nil
 }
+
+// PAX records holding the metadata of the UnixFS nodes in the archives, which
+// tell it from the default permissions and modification times.
+const (
+	paxMode  = "IPFS.mode"
+	paxMtime = "IPFS.mtime"
+)
+
+// tarWriter writes UnixFS nodes to a tar archive, with their metadata.
+type tarWriter struct {
+	ctx context.Context
+	dag ipld.DAGService
+	tw  *gotar.Writer
+}
+
+func (w *tarWriter) write(nd ipld.Node, f files.Node, fpath string) error {
+	p, err := coreunix.PosixFromNode(nd)
+	if err != nil {
+		return err
+	}
+
+	switch f := f.(type) {
+	case *files.Symlink:
+		return w.writeHeader(&gotar.Header{
+			Name:     fpath,
+			Linkname: f.Target,
+			Mode:     0777,
+			Typeflag: gotar.TypeSymlink,
+		}, coreunix.Posix{})
+	case files.File:
+		size, err := f.Size()
+		if err != nil {
+			return err
+		}
+		err = w.writeHeader(&gotar.Header{
+			Name:     fpath,
+			Size:     size,
+			Mode:     0644,
+			Typeflag: gotar.TypeReg,
+		}, p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w.tw, f)
+		return err
+	case files.Directory:
+		err := w.writeHeader(&gotar.Header{
+			Name:     fpath,
+			Mode:     0777,
+			Typeflag: gotar.TypeDir,
+		}, p)
+		if err != nil {
+			return err
+		}
+		dir, err := uio.NewDirectoryFromNode(w.dag, nd)
+		if err != nil {
+			return err
+		}
+		it := f.Entries()
+		for it.Next() {
+			child, err := dir.Find(w.ctx, it.Name())
+			if err != nil {
+				return err
+			}
+			if err := w.write(child, it.Node(), gopath.Join(fpath, it.Name())); err != nil {
+				return err
+			}
+		}
+		return it.Err()
+	default:
+		return fmt.Errorf("unsupported file type: %T", f)
+	}
+}
+
+func (w *tarWriter) writeHeader(h *gotar.Header, p coreunix.Posix) error {
+	h.ModTime = time.Now()
+	if p.HasMode {
+		mode := coreunix.UnixMode(p.Mode)
+		h.Mode = int64(mode)
+		h.PAXRecords = map[string]string{paxMode: strconv.FormatUint(uint64(mode), 8)}
+	}
+	if !p.Mtime.IsZero() {
+		h.ModTime = p.Mtime
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords[paxMtime] = p.Mtime.Format(time.RFC3339Nano)
+		h.Format = gotar.FormatPAX
+	}
+	return w.tw.WriteHeader(h)
+}
+
+// readTarHeaders returns the headers of an archive, and drains it.
+func readTarHeaders(r io.Reader) []*gotar.Header {
+	var hdrs []*gotar.Header
+	tr := gotar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+		hdrs = append(hdrs, h)
+	}
+	_, _ = io.Copy(ioutil.Discard, r)
+	return hdrs
+}
+
+// restorePosix sets the metadata of the files extracted to fpath from the
+// PAX records of their headers.
+func restorePosix(hdrs []*gotar.Header, fpath string, intoDir bool) error {
+	if len(hdrs) == 0 {
+		return nil
+	}
+	rootName := hdrs[0].Name
+	root := fpath
+	if hdrs[0].Typeflag != gotar.TypeDir && intoDir {
+		root = filepath.Join(fpath, rootName)
+	}
+
+	// Directories are changed after their content.
+	for i := len(hdrs) - 1; i >= 0; i-- {
+		h := hdrs[i]
+		target := root
+		if h.Name != rootName {
+			target = filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(h.Name, rootName+"/")))
+		}
+		if mtime, ok := h.PAXRecords[paxMtime]; ok {
+			t, err := time.Parse(time.RFC3339Nano, mtime)
+			if err != nil {
+				return fmt.Errorf("invalid modification time of %s: %w", h.Name, err)
+			}
+			if err := os.Chtimes(target, t, t); err != nil {
+				return err
+			}
+		}
+		if mode, ok := h.PAXRecords[paxMode]; ok {
+			m, err := strconv.ParseUint(mode, 8, 32)
+			if err != nil {
+				return fmt.Errorf("invalid mode of %s: %w", h.Name, err)
+			}
+			if err := os.Chmod(target, coreunix.FileMode(uint32(m))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func zipArchive(zw *zipWriter, nd ipld.Node, f files.Node, name string, compression int) (io.Reader, error) {
+	_, filename := gopath.Split(gopath.Clean(name))
+
+	piper, pipew := io.Pipe()
+	bufw := bufio.NewWriterSize(pipew, DefaultBufSize)
+
+	// The entries are compressed with the level of --compression-level.
+	if compression == gzip.NoCompression {
+		compression = flate.DefaultCompression
+	}
+	if _, err := flate.NewWriter(ioutil.Discard, compression); err != nil {
+		return nil, err
+	}
+	zw.zw = zip.NewWriter(bufw)
+	zw.zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, compression)
+	})
+
+	go func() {
+		err := zw.write(nd, f, filename)
+		if err == nil {
+			err = zw.zw.Close()
+		}
+		if err == nil {
+			err = bufw.Flush()
+		}
+		if err != nil {
+			_ = pipew.CloseWithError(err)
+			return
+		}
+		pipew.Close()
+	}()
+
+	return piper, nil
+}
+
+// zipWriter writes UnixFS nodes to a zip archive, with their metadata.
+type zipWriter struct {
+	ctx context.Context
+	dag ipld.DAGService
+	zw  *zip.Writer
+}
+
+func (w *zipWriter) write(nd ipld.Node, f files.Node, fpath string) error {
+	p, err := coreunix.PosixFromNode(nd)
+	if err != nil {
+		return err
+	}
+
+	switch f := f.(type) {
+	case *files.Symlink:
+		h := &zip.FileHeader{Name: fpath, Method: zip.Store}
+		h.SetMode(os.ModeSymlink | 0777)
+		ew, err := w.zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(ew, f.Target)
+		return err
+	case files.File:
+		ew, err := w.zw.CreateHeader(zipHeader(fpath, zip.Deflate, 0644, p))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ew, f)
+		return err
+	case files.Directory:
+		_, err := w.zw.CreateHeader(zipHeader(fpath+"/", zip.Store, os.ModeDir|0755, p))
+		if err != nil {
+			return err
+		}
+		dir, err := uio.NewDirectoryFromNode(w.dag, nd)
+		if err != nil {
+			return err
+		}
+		it := f.Entries()
+		for it.Next() {
+			child, err := dir.Find(w.ctx, it.Name())
+			if err != nil {
+				return err
+			}
+			if err := w.write(child, it.Node(), gopath.Join(fpath, it.Name())); err != nil {
+				return err
+			}
+		}
+		return it.Err()
+	default:
+		return fmt.Errorf("unsupported file type: %T", f)
+	}
+}
+
+// zipHeader returns the header of a zip entry, with the metadata of its node
+// when set. Without mtime, the entry has no time, so that a CID is always
+// written as the same archive.
+func zipHeader(name string, method uint16, mode os.FileMode, p coreunix.Posix) *zip.FileHeader {
+	h := &zip.FileHeader{Name: name, Method: method, Modified: p.Mtime}
+	if p.HasMode {
+		mode = mode&os.ModeType | p.Mode
+	}
+	h.SetMode(mode)
+	return h
+}
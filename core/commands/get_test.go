@@ -1,11 +1,20 @@
 package commands
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
+	files "github.com/ipfs/go-ipfs-files"
+	dag "github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	ft "github.com/ipfs/go-unixfs"
 )
 
 func TestGetOutputPath(t *testing.T) {
@@ -66,3 +75,39 @@ func TestGetOutputPath(t *testing.T) {
 		})
 	}
 }
+
+func TestZipArchiveIsDeterministic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := []byte("hello")
+	nd := dag.NodeWithData(ft.FilePBData(data, uint64(len(data))))
+
+	var archives [][]byte
+	for i := 0; i < 2; i++ {
+		zw := &zipWriter{ctx: ctx, dag: mdtest.Mock()}
+		r, err := zipArchive(zw, nd, files.NewBytesFile(data), "file", gzip.NoCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, b)
+		if i == 0 {
+			time.Sleep(2 * time.Second)
+		}
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Fatal("the same node was written as different archives")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(archives[0]), int64(len(archives[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := zr.File[0].FileHeader; h.ModifiedDate != 0 || h.ModifiedTime != 0 {
+		t.Fatalf("expected no modification time without mtime, got %s", h.Modified)
+	}
+}
@@ -7,17 +7,24 @@ import (
 	"io"
 
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	mount "github.com/ipfs/go-ipfs/fuse/mount"
 	nodeMount "github.com/ipfs/go-ipfs/fuse/node"
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
-	config "github.com/ipfs/go-ipfs-config"
 )
 
 const (
 	mountIPFSPathOptionName = "ipfs-path"
 	mountIPNSPathOptionName = "ipns-path"
+	mountMFSPathOptionName  = "mfs-path"
 )
 
+type mountOutput struct {
+	IPFS string
+	IPNS string
+	MFS  string `json:",omitempty"`
+}
+
 var MountCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Mounts IPFS to the filesystem (read-only).",
@@ -32,6 +39,9 @@ You may have to create /ipfs and /ipns before using 'ipfs mount':
 > sudo chown $(whoami) /ipfs /ipns
 > ipfs daemon &
 > ipfs mount
+
+The MFS root, the tree of 'ipfs files', can also be mounted read-write with
+--mfs-path or the FuseMounts.MFS setting.
 `,
 		LongDescription: `
 Mount IPFS at a read-only mountpoint on the OS. The default, /ipfs and /ipns,
@@ -73,11 +83,27 @@ baz
 baz
 > cat /ipfs/QmWLdkp93sNxGRjnFHPaYg8tCQ35NBY3XPn6KiETd3Z4WR
 baz
+
+The MFS root, the tree of 'ipfs files', is mounted read-write when a
+mountpoint is given with --mfs-path or set in FuseMounts.MFS. It supports
+creating, writing, truncating, renaming and removing files, directories and
+symbolic links, and changing their mode and modification time. The files
+created store their modification time. Writes are buffered, and written to
+the MFS root when the file is closed or synced:
+
+> ipfs mount --mfs-path=/mfs
+IPFS mounted at: /ipfs
+IPNS mounted at: /ipns
+MFS mounted at: /mfs
+> echo "baz" > /mfs/bar
+> ipfs files read /bar
+baz
 `,
 	},
 	Options: []cmds.Option{
 		cmds.StringOption(mountIPFSPathOptionName, "f", "The path where IPFS should be mounted."),
 		cmds.StringOption(mountIPNSPathOptionName, "n", "The path where IPNS should be mounted."),
+		cmds.StringOption(mountMFSPathOptionName, "m", "The path where the MFS root should be mounted. Not mounted when empty."),
 	},
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
 		cfg, err := cmdenv.GetConfig(env)
@@ -106,21 +132,34 @@ baz
 			nsdir = cfg.Mounts.IPNS // NB: be sure to not redeclare!
 		}
 
-		err = nodeMount.Mount(nd, fsdir, nsdir)
+		mfsdir, found := req.Options[mountMFSPathOptionName].(string)
+		if !found {
+			mcfg, err := mount.ReadConfig(nd.Repo)
+			if err != nil {
+				return err
+			}
+			mfsdir = mcfg.MFS
+		}
+
+		err = nodeMount.Mount(nd, fsdir, nsdir, mfsdir)
 		if err != nil {
 			return err
 		}
 
-		var output config.Mounts
-		output.IPFS = fsdir
-		output.IPNS = nsdir
-		return cmds.EmitOnce(res, &output)
+		return cmds.EmitOnce(res, &mountOutput{
+			IPFS: fsdir,
+			IPNS: nsdir,
+			MFS:  mfsdir,
+		})
 	},
-	Type: config.Mounts{},
+	Type: mountOutput{},
 	Encoders: cmds.EncoderMap{
-		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, mounts *config.Mounts) error {
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, mounts *mountOutput) error {
 			fmt.Fprintf(w, "IPFS mounted at: %s\n", cmdenv.EscNonPrint(mounts.IPFS))
 			fmt.Fprintf(w, "IPNS mounted at: %s\n", cmdenv.EscNonPrint(mounts.IPNS))
+			if mounts.MFS != "" {
+				fmt.Fprintf(w, "MFS mounted at: %s\n", cmdenv.EscNonPrint(mounts.MFS))
+			}
 
 			return nil
 		}),
@@ -6,6 +6,7 @@ import (
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	"github.com/ipfs/go-merkledag/dagutils"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
 	path "github.com/ipfs/interface-go-ipfs-core/path"
 
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
@@ -19,6 +20,27 @@ type Changes struct {
 	Changes []*dagutils.Change
 }
 
+// NewChanges converts the changes between two objects to the output of
+// 'ipfs object diff'.
+func NewChanges(changes []coreiface.ObjectChange) *Changes {
+	out := make([]*dagutils.Change, len(changes))
+	for i, change := range changes {
+		out[i] = &dagutils.Change{
+			Type: dagutils.ChangeType(change.Type),
+			Path: change.Path,
+		}
+
+		if change.Before != nil {
+			out[i].Before = change.Before.Cid()
+		}
+
+		if change.After != nil {
+			out[i].After = change.After.Cid()
+		}
+	}
+	return &Changes{out}
+}
+
 var ObjectDiffCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
 		Tagline: "Display the diff between two IPFS objects.",
@@ -67,23 +89,7 @@ Example:
 			return err
 		}
 
-		out := make([]*dagutils.Change, len(changes))
-		for i, change := range changes {
-			out[i] = &dagutils.Change{
-				Type: dagutils.ChangeType(change.Type),
-				Path: change.Path,
-			}
-
-			if change.Before != nil {
-				out[i].Before = change.Before.Cid()
-			}
-
-			if change.After != nil {
-				out[i].After = change.After.Cid()
-			}
-		}
-
-		return cmds.EmitOnce(res, &Changes{out})
+		return cmds.EmitOnce(res, NewChanges(changes))
 	},
 	Type: Changes{},
 	Encoders: cmds.EncoderMap{
@@ -39,6 +39,9 @@ var RepoCmd = &cmds.Command{
 		"fsck":    repoFsckCmd,
 		"version": repoVersionCmd,
 		"verify":  repoVerifyCmd,
+		"convert": repoConvertCmd,
+		"backup":  repoBackupCmd,
+		"restore": repoRestoreCmd,
 	},
 }
 
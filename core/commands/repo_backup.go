@@ -0,0 +1,171 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	oldcmds "github.com/ipfs/go-ipfs/commands"
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	corerepo "github.com/ipfs/go-ipfs/core/corerepo"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+)
+
+// RepoBackupOutput is the output of "repo backup" and "repo restore".
+type RepoBackupOutput struct {
+	Blocks uint64
+	// Path is set once done, to the backup or to the restored repo.
+	Path string `json:",omitempty"`
+	Pins int    `json:",omitempty"`
+	Keys int    `json:",omitempty"`
+}
+
+const repoBackupBlocksOptionName = "blocks"
+
+// backupProgressInterval is the number of blocks between the progress
+// reports of a backup or a restore.
+const backupProgressInterval = 256
+
+var repoBackupCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Back up the repo.",
+		ShortDescription: `
+'ipfs repo backup <dest>' writes a backup of the repo to the directory <dest>,
+which must not exist. It can be restored with 'ipfs repo restore'.
+`,
+		LongDescription: `
+'ipfs repo backup <dest>' writes a backup of the repo to the directory <dest>,
+which must not exist. It can be restored with 'ipfs repo restore'.
+
+The backup holds a manifest, with the config, the keys of the keystore, the
+pins and the MFS root, and a CAR file with all the blocks of the repo. The
+garbage collection and the changes to the pins wait for the backup.
+
+With --blocks=false, the CAR file only holds the root of MFS: the restored
+node fetches the other blocks from the network.
+
+The backup holds the private keys of the node, and is only readable by its
+owner. When the daemon is running, it writes the backup to the 'backups'
+directory of the repo, and <dest> is the name of the backup in it:
+
+    $ ipfs repo backup monday
+    backed up 1234 blocks, 3 pins and 2 keys to ~/.ipfs/backups/monday
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("dest", true, false, "Directory to write the backup to, or name of the backup when the daemon is running."),
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(repoBackupBlocksOptionName, "Include the blocks of the repo.").WithDefault(true),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		withBlocks, _ := req.Options[repoBackupBlocksOptionName].(bool)
+
+		dest, err := backupDest(env.(*oldcmds.Context).ConfigRoot, req.Arguments[0], nd.IsDaemon)
+		if err != nil {
+			return err
+		}
+
+		m, err := corerepo.Backup(req.Context, nd, dest, withBlocks, func(n uint64) {
+			if n%backupProgressInterval == 0 {
+				res.Emit(&RepoBackupOutput{Blocks: n})
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return res.Emit(&RepoBackupOutput{
+			Blocks: m.BlockCount,
+			Path:   dest,
+			Pins:   len(m.Pins.Recursive) + len(m.Pins.Direct),
+			Keys:   len(m.Keys),
+		})
+	},
+	Type: RepoBackupOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *RepoBackupOutput) error {
+			if out.Path == "" {
+				fmt.Fprintf(w, "%d blocks written\r", out.Blocks)
+				return nil
+			}
+			fmt.Fprintf(w, "backed up %d blocks, %d pins and %d keys to %s\n", out.Blocks, out.Pins, out.Keys, out.Path)
+			return nil
+		}),
+	},
+}
+
+// backupDest returns the directory of a backup. The daemon only writes the
+// backups named dest to the backups directory of the repo at repoRoot, as
+// the API could otherwise make it write the keys of the node anywhere.
+func backupDest(repoRoot, dest string, daemon bool) (string, error) {
+	if !daemon {
+		return filepath.Abs(dest)
+	}
+	if dest != filepath.Base(dest) || dest == "." || dest == ".." {
+		return "", fmt.Errorf("the daemon writes backups to the backups directory of the repo: %q must be the name of the backup", dest)
+	}
+	backups := filepath.Join(repoRoot, "backups")
+	if err := os.MkdirAll(backups, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(backups, dest), nil
+}
+
+var repoRestoreCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Restore a repo from a backup.",
+		ShortDescription: `
+'ipfs repo restore <src>' creates the repo from the backup written by
+'ipfs repo backup' in the directory <src>. The repo must not exist.
+`,
+		LongDescription: `
+'ipfs repo restore <src>' creates the repo from the backup written by
+'ipfs repo backup' in the directory <src>. The repo must not exist.
+
+The config, the keys, the blocks, the pins and the MFS root of the backup are
+restored, and every block is hashed once stored. The IPNS records aren't
+part of the backup: publish them again once restored.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("src", true, false, "Directory of the backup."),
+	},
+	NoRemote: true,
+	Extra:    CreateCmdExtras(SetDoesNotUseRepo(true)),
+	PreRun:   DaemonNotRunning,
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		cctx := env.(*oldcmds.Context)
+
+		m, err := corerepo.Restore(req.Context, cctx.ConfigRoot, req.Arguments[0], func(n uint64) {
+			if n%backupProgressInterval == 0 {
+				res.Emit(&RepoBackupOutput{Blocks: n})
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return res.Emit(&RepoBackupOutput{
+			Blocks: m.BlockCount,
+			Path:   cctx.ConfigRoot,
+			Pins:   len(m.Pins.Recursive) + len(m.Pins.Direct),
+			Keys:   len(m.Keys),
+		})
+	},
+	Type: RepoBackupOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *RepoBackupOutput) error {
+			if out.Path == "" {
+				fmt.Fprintf(w, "%d blocks restored\r", out.Blocks)
+				return nil
+			}
+			fmt.Fprintf(w, "restored %d blocks, %d pins and %d keys to %s\n", out.Blocks, out.Pins, out.Keys, out.Path)
+			return nil
+		}),
+	},
+}
@@ -0,0 +1,131 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	repo "github.com/ipfs/go-ipfs/repo"
+	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	cmds "github.com/ipfs/go-ipfs-cmds"
+	config "github.com/ipfs/go-ipfs-config"
+)
+
+const repoConvertToOptionName = "to"
+
+var repoConvertCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Convert the datastore to the one of a profile.",
+		ShortDescription: `
+'ipfs repo convert --to=<profile>' converts the datastore of the repo to the
+one set by a config profile, such as 'badgerds' or 'flatfs'.
+`,
+		LongDescription: `
+'ipfs repo convert --to=<profile>' converts the datastore of the repo to the
+one set by a config profile, such as 'badgerds' or 'flatfs'.
+
+When the daemon is running, the conversion runs in the background while the
+node keeps working: the new datastore is created next to the current one,
+the keys are copied, and the values missing from the new datastore are read
+from the current one. Once copied, the keys are counted and the values
+compared, and the new datastore replaces the current one in Datastore.Spec
+and in the datastore_spec file.
+
+The command follows the conversion until it finishes. Interrupting it
+doesn't stop a conversion run by the daemon; 'ipfs repo convert' without
+--to follows a running conversion, or shows the last one.
+
+The files of the previous datastore are kept, and can be removed once the
+conversion is done. The paths of the new datastore must not exist.
+`,
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(repoConvertToOptionName, "The profile setting the new datastore."),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		r, ok := repo.Unwrap(nd.Repo).(*fsrepo.FSRepo)
+		if !ok {
+			return errors.New("the repo can't convert its datastore")
+		}
+
+		if profile, ok := req.Options[repoConvertToOptionName].(string); ok {
+			spec, err := profileDatastoreSpec(nd.Repo, profile)
+			if err != nil {
+				return err
+			}
+			if err := r.ConvertDatastore(spec); err != nil {
+				return err
+			}
+		}
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			s, ok := r.DatastoreConversion()
+			if !ok {
+				return errors.New("no datastore conversion")
+			}
+			switch s.Phase {
+			case fsrepo.ConvertFailed:
+				return fmt.Errorf("converting the datastore: %s", s.Error)
+			case fsrepo.ConvertDone:
+				return res.Emit(&s)
+			}
+			if err := res.Emit(&s); err != nil {
+				return err
+			}
+
+			select {
+			case <-ticker.C:
+			case <-req.Context.Done():
+				return req.Context.Err()
+			}
+		}
+	},
+	Type: fsrepo.ConversionStatus{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, s *fsrepo.ConversionStatus) error {
+			if s.Phase != fsrepo.ConvertDone {
+				fmt.Fprintf(w, "%s: %d keys\r", s.Phase, s.Keys)
+				return nil
+			}
+			fmt.Fprintf(w, "converted the datastore to %s\n", s.Spec)
+			if len(s.OldPaths) != 0 {
+				fmt.Fprintf(w, "the previous datastore can be removed: %s\n", strings.Join(s.OldPaths, " "))
+			}
+			return nil
+		}),
+	},
+}
+
+// profileDatastoreSpec returns the datastore spec set by a config profile.
+func profileDatastoreSpec(r repo.Repo, profile string) (map[string]interface{}, error) {
+	transformer, ok := config.Profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("invalid configuration profile: %s", profile)
+	}
+	cfg, err := r.Config()
+	if err != nil {
+		return nil, err
+	}
+	newCfg, err := cfg.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if err := transformer.Transform(newCfg); err != nil {
+		return nil, err
+	}
+	if reflect.DeepEqual(newCfg.Datastore.Spec, cfg.Datastore.Spec) {
+		return nil, fmt.Errorf("profile %s doesn't change the datastore", profile)
+	}
+	return newCfg.Datastore.Spec, nil
+}
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"text/tabwriter"
 	"time"
 
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/exchange/gateways"
 
 	humanize "github.com/dustin/go-humanize"
 	cmds "github.com/ipfs/go-ipfs-cmds"
@@ -26,11 +28,13 @@ for your IPFS node.`,
 	},
 
 	Subcommands: map[string]*cmds.Command{
-		"bw":      statBwCmd,
-		"repo":    repoStatCmd,
-		"bitswap": bitswapStatCmd,
-		"dht":     statDhtCmd,
-		"provide": statProvideCmd,
+		"bw":       statBwCmd,
+		"repo":     repoStatCmd,
+		"bitswap":  bitswapStatCmd,
+		"dht":      statDhtCmd,
+		"provide":  statProvideCmd,
+		"mount":    statMountCmd,
+		"exchange": statExchangeCmd,
 	},
 }
 
@@ -193,3 +197,85 @@ func printStats(out io.Writer, bs *metrics.Stats) {
 	fmt.Fprintf(out, "RateIn: %s/s\n", humanize.Bytes(uint64(bs.RateIn)))
 	fmt.Fprintf(out, "RateOut: %s/s\n", humanize.Bytes(uint64(bs.RateOut)))
 }
+
+// ExchangeStats is the output of 'ipfs stats exchange'.
+type ExchangeStats struct {
+	Sources []gateways.SourceStat
+}
+
+var statExchangeCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Print the blocks fetched from each block source.",
+		ShortDescription: `
+'ipfs stats exchange' prints how many blocks were fetched from bitswap and
+from each of the HTTP gateways configured in 'Bitswap.Gateways'.
+
+Blocks are requested from bitswap and the gateways at the same time. A block
+is only counted for the source that delivered it first.
+`,
+		LongDescription: `
+'ipfs stats exchange' prints how many blocks were fetched from bitswap and
+from each of the HTTP gateways configured in 'Bitswap.Gateways'.
+
+Blocks are requested from bitswap and the gateways at the same time. A block
+is only counted for the source that delivered it first.
+
+The gateways are configured as follows:
+
+  {
+    "URLs": ["https://gateway.example.com", ...],
+    "Delay": "1s",
+    "Timeout": "30s",
+    "MaxConcurrency": 16
+  }
+
+'URLs' are tried in order. Blocks are fetched as '/ipfs/<cid>?format=raw' and
+verified against their CID. 'Delay' gives bitswap a head start before the
+gateways are asked, 'Timeout' bounds a single request and 'MaxConcurrency'
+limits the concurrent requests to the gateways.
+
+The configuration is read when the daemon starts.
+`,
+	},
+	Options: []cmds.Option{
+		cmds.BoolOption(bitswapHumanOptionName, "Print sizes in human readable format (e.g., 1K 234M 2G)"),
+	},
+	Type: ExchangeStats{},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		if !nd.IsOnline {
+			return cmds.Errorf(cmds.ErrClient, ErrNotOnline.Error())
+		}
+
+		if nd.Gateways == nil {
+			return fmt.Errorf("exchange statistics not available")
+		}
+
+		return cmds.EmitOnce(res, &ExchangeStats{Sources: nd.Gateways.Stats()})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *ExchangeStats) error {
+			human, _ := req.Options[bitswapHumanOptionName].(bool)
+
+			tw := tabwriter.NewWriter(w, 4, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "Source\tRequests\tBlocks\tData\tErrors\tLatency")
+			for _, s := range out.Sources {
+				data := fmt.Sprintf("%d", s.Bytes)
+				if human {
+					data = humanize.Bytes(s.Bytes)
+				}
+				requests := "-"
+				if s.Source != "bitswap" {
+					requests = fmt.Sprintf("%d", s.Requests)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\n",
+					s.Source, requests, s.Blocks, data, s.Errors, s.Latency.Round(time.Millisecond))
+			}
+			return tw.Flush()
+		}),
+	},
+}
@@ -0,0 +1,65 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	mount "github.com/ipfs/go-ipfs/fuse/mount"
+
+	humanize "github.com/dustin/go-humanize"
+	cmds "github.com/ipfs/go-ipfs-cmds"
+)
+
+type mountStatsOutput struct {
+	MountPoint string
+	mount.ReadStatsSnapshot
+}
+
+var statMountCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Print statistics about the reads of the /ipfs mount.",
+		ShortDescription: `
+'ipfs stats mount' prints the reads served by the FUSE mount of /ipfs: their
+number and throughput, the file blocks prefetched ahead of sequential reads,
+and the use of the attribute and directory listing caches.
+
+The number of blocks prefetched is set by FuseMounts.ReadAhead.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		if nd.Mounts.Ipfs == nil || !nd.Mounts.Ipfs.IsActive() || nd.Mounts.IpfsStats == nil {
+			return errors.New("/ipfs is not mounted")
+		}
+
+		return cmds.EmitOnce(res, &mountStatsOutput{
+			MountPoint:        nd.Mounts.Ipfs.MountPoint(),
+			ReadStatsSnapshot: nd.Mounts.IpfsStats.Snapshot(),
+		})
+	},
+	Type: mountStatsOutput{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, s *mountStatsOutput) error {
+			wtr := tabwriter.NewWriter(w, 1, 2, 1, ' ', 0)
+			defer wtr.Flush()
+
+			fmt.Fprintf(wtr, "MountPoint:\t%s\n", cmdenv.EscNonPrint(s.MountPoint))
+			fmt.Fprintf(wtr, "Reads:\t%d\n", s.Reads)
+			fmt.Fprintf(wtr, "SequentialReads:\t%d\n", s.SequentialReads)
+			fmt.Fprintf(wtr, "BytesRead:\t%s\n", humanize.Bytes(s.BytesRead))
+			fmt.Fprintf(wtr, "Rate:\t%s/s\n", humanize.Bytes(uint64(s.Rate)))
+			fmt.Fprintf(wtr, "PrefetchedBlocks:\t%d\n", s.PrefetchedBlocks)
+			fmt.Fprintf(wtr, "PrefetchErrors:\t%d\n", s.PrefetchErrors)
+			fmt.Fprintf(wtr, "AttrCache:\t%d hits, %d misses\n", s.AttrCacheHits, s.AttrCacheMisses)
+			fmt.Fprintf(wtr, "DirCache:\t%d hits, %d misses\n", s.DirCacheHits, s.DirCacheMisses)
+			return nil
+		}),
+	},
+}
@@ -7,11 +7,15 @@ import (
 	"io"
 	"path"
 	"sort"
+	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	commands "github.com/ipfs/go-ipfs/commands"
+	connprio "github.com/ipfs/go-ipfs/connprio"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	peering "github.com/ipfs/go-ipfs/peering"
 	repo "github.com/ipfs/go-ipfs/repo"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
 
@@ -50,6 +54,7 @@ ipfs peers in the internet.
 		"connect":    swarmConnectCmd,
 		"disconnect": swarmDisconnectCmd,
 		"filters":    swarmFiltersCmd,
+		"peering":    swarmPeeringCmd,
 		"peers":      swarmPeersCmd,
 	},
 }
@@ -66,6 +71,11 @@ var swarmPeersCmd = &cmds.Command{
 		Tagline: "List peers with open connections.",
 		ShortDescription: `
 'ipfs swarm peers' lists the set of peers this node is connected to.
+
+With --verbose, the priority of each connection in the connection manager
+is shown too: the value of the peer, whether it is protected from being
+trimmed and by what, and whether it would be trimmed next. The priorities
+of classes of peers are set in the ConnMgrPriorities config.
 `,
 	},
 	Options: []cmds.Option{
@@ -90,6 +100,17 @@ var swarmPeersCmd = &cmds.Command{
 			return err
 		}
 
+		var priorities map[peer.ID]connprio.Status
+		if verbose {
+			n, err := cmdenv.GetNode(env)
+			if err != nil {
+				return err
+			}
+			if n.ConnPrio != nil {
+				priorities = n.ConnPrio.Explain()
+			}
+		}
+
 		var out connInfos
 		for _, c := range conns {
 			ci := connInfo{
@@ -124,6 +145,9 @@ var swarmPeersCmd = &cmds.Command{
 					ci.Streams = append(ci.Streams, streamInfo{Protocol: string(s)})
 				}
 			}
+			if st, ok := priorities[c.ID()]; ok {
+				ci.Priority = &st
+			}
 			sort.Sort(&ci)
 			out.Peers = append(out.Peers, ci)
 		}
@@ -145,6 +169,18 @@ var swarmPeersCmd = &cmds.Command{
 				}
 				fmt.Fprintln(w)
 
+				if p := info.Priority; p != nil {
+					fmt.Fprintf(w, "  priority: value %d", p.Value)
+					for _, tag := range sortedKeys(p.Tags) {
+						fmt.Fprintf(w, " %s=%d", tag, p.Tags[tag])
+					}
+					action := "kept"
+					if p.Trimmed {
+						action = "trimmed"
+					}
+					fmt.Fprintf(w, ", %s: %s\n", action, p.Reason)
+				}
+
 				for _, s := range info.Streams {
 					if s.Protocol == "" {
 						s.Protocol = "<no protocol name>"
@@ -171,6 +207,7 @@ type connInfo struct {
 	Muxer     string
 	Direction inet.Direction
 	Streams   []streamInfo
+	Priority  *connprio.Status `json:",omitempty"`
 }
 
 func (ci *connInfo) Less(i, j int) bool {
@@ -780,3 +817,413 @@ func filtersRemove(r repo.Repo, cfg *config.Config, toRemoveFilters []string) ([
 
 	return removed, nil
 }
+
+var swarmPeeringCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Manage the peers the node keeps connections to.",
+		ShortDescription: `
+'ipfs swarm peering' adds and removes peering peers while the daemon runs.
+Peering peers are protected from the connection manager, and reconnected
+with a back-off when the connection is lost. Changes are saved to the
+config, in Peering.Peers and PeeringGroups.DNS.
+`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"add": swarmPeeringAddCmd,
+		"ls":  swarmPeeringLsCmd,
+		"rm":  swarmPeeringRmCmd,
+	},
+}
+
+var swarmPeeringAddCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Add peers or DNS peer groups to peer with.",
+		ShortDescription: `
+'ipfs swarm peering add' starts peering with the given peers. Peers are
+given as multiaddrs ending with /p2p/<peer-id>.
+
+A domain name, or a /dnsaddr multiaddr without a peer ID, adds a DNS
+group: the peers listed in the dnsaddr TXT records of the domain. Groups
+are resolved again every PeeringGroups.RefreshInterval.
+
+Example:
+
+    > ipfs swarm peering add /ip4/1.2.3.4/tcp/4001/p2p/QmSoLPppuBtQSGwKDZT2M73ULpjvfd3aZ6ha4oFGL1KrGM
+    > ipfs swarm peering add peers.example.com
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("address", true, true, "Peer multiaddr or DNS group to peer with.").EnableStdin(),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		if n.Peering == nil || n.PeeringGroups == nil {
+			return ErrNotOnline
+		}
+
+		var (
+			peerAddrs []ma.Multiaddr
+			groups    []ma.Multiaddr
+		)
+		for _, arg := range req.Arguments {
+			pa, group, err := parsePeeringArg(arg)
+			if err != nil {
+				return err
+			}
+			if group != nil {
+				groups = append(groups, group)
+			} else {
+				peerAddrs = append(peerAddrs, pa)
+			}
+		}
+		infos, err := peer.AddrInfosFromP2pAddrs(peerAddrs...)
+		if err != nil {
+			return err
+		}
+
+		r, err := fsrepo.Open(env.(*commands.Context).ConfigRoot)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		added := make([]string, 0, len(req.Arguments))
+		if len(infos) > 0 {
+			cfg, err := r.Config()
+			if err != nil {
+				return err
+			}
+			for _, info := range infos {
+				n.Peering.AddPeer(info)
+				cfg.Peering.Peers = peeringAddPeer(cfg.Peering.Peers, info)
+				added = append(added, info.ID.Pretty())
+			}
+			if err := r.SetConfig(cfg); err != nil {
+				return err
+			}
+		}
+
+		if len(groups) > 0 {
+			gcfg, err := peeringGroupsConfig(r)
+			if err != nil {
+				return err
+			}
+			for _, group := range groups {
+				if err := n.PeeringGroups.Add(req.Context, group); err != nil {
+					log.Warnf("failed to resolve DNS group %s, will retry: %s", group, err)
+				}
+				gcfg.DNS = peeringAddGroup(gcfg.DNS, group)
+				added = append(added, group.String())
+			}
+			if err := r.SetConfigKey(peering.GroupsConfigKey+".DNS", gcfg.DNS); err != nil {
+				return err
+			}
+		}
+
+		return cmds.EmitOnce(res, &stringList{added})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+var swarmPeeringRmCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Stop peering with peers or DNS peer groups.",
+		ShortDescription: `
+'ipfs swarm peering rm' stops peering with the given peers, given by peer
+ID or multiaddr, or with the given DNS groups. The connections are not
+closed, but they are no longer protected from the connection manager.
+
+Peers found through a DNS group stay until the group is removed: the
+command fails for them, after removing the other arguments.
+`,
+	},
+	Arguments: []cmds.Argument{
+		cmds.StringArg("address", true, true, "Peer ID, peer multiaddr or DNS group to stop peering with.").EnableStdin(),
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		if n.Peering == nil || n.PeeringGroups == nil {
+			return ErrNotOnline
+		}
+
+		var (
+			pids   []peer.ID
+			groups []ma.Multiaddr
+		)
+		for _, arg := range req.Arguments {
+			if pid, err := peer.Decode(arg); err == nil {
+				pids = append(pids, pid)
+				continue
+			}
+			pa, group, err := parsePeeringArg(arg)
+			if err != nil {
+				return err
+			}
+			if group != nil {
+				groups = append(groups, group)
+				continue
+			}
+			info, err := peer.AddrInfoFromP2pAddr(pa)
+			if err != nil {
+				return err
+			}
+			pids = append(pids, info.ID)
+		}
+
+		r, err := fsrepo.Open(env.(*commands.Context).ConfigRoot)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		removed := make([]string, 0, len(req.Arguments))
+		// The groups go first, so that a group and its peers can be
+		// removed at once.
+		if len(groups) > 0 {
+			gcfg, err := peeringGroupsConfig(r)
+			if err != nil {
+				return err
+			}
+			for _, group := range groups {
+				n.PeeringGroups.Remove(group)
+				var found bool
+				gcfg.DNS, found = peeringRemoveGroup(gcfg.DNS, group)
+				if found {
+					removed = append(removed, group.String())
+				}
+			}
+			if err := r.SetConfigKey(peering.GroupsConfigKey+".DNS", gcfg.DNS); err != nil {
+				return err
+			}
+		}
+
+		var kept []string
+		if len(pids) > 0 {
+			cfg, err := r.Config()
+			if err != nil {
+				return err
+			}
+			for _, pid := range pids {
+				err := n.Peering.RemovePeer(pid)
+				var found bool
+				cfg.Peering.Peers, found = peeringRemovePeer(cfg.Peering.Peers, pid)
+				if found {
+					removed = append(removed, pid.Pretty())
+				}
+				if err != nil {
+					kept = append(kept, err.Error())
+				}
+			}
+			if err := r.SetConfig(cfg); err != nil {
+				return err
+			}
+		}
+		if len(kept) > 0 {
+			return fmt.Errorf("%s; remove the groups to stop peering with them", strings.Join(kept, "; "))
+		}
+
+		return cmds.EmitOnce(res, &stringList{removed})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(stringListEncoder),
+	},
+	Type: stringList{},
+}
+
+type peeringPeer struct {
+	ID        string
+	Addrs     []string
+	Connected bool
+	// NextRetry is zero when no reconnection is scheduled.
+	NextRetry time.Time
+	Failures  int
+	Sources   []string
+}
+
+type peeringGroup struct {
+	Addr        string
+	Peers       int
+	LastRefresh time.Time
+	Error       string `json:",omitempty"`
+}
+
+type peeringList struct {
+	Peers  []peeringPeer
+	Groups []peeringGroup
+}
+
+var swarmPeeringLsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "List peering peers and DNS peer groups.",
+		ShortDescription: `
+'ipfs swarm peering ls' lists the peering peers with their state: whether
+they are connected, and if not when the next connection attempt is and how
+many attempts failed so far. The sources of a peer say whether it was
+configured directly ("static") or found through DNS groups.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+
+		if n.Peering == nil || n.PeeringGroups == nil {
+			return ErrNotOnline
+		}
+
+		var out peeringList
+		for _, st := range n.Peering.ListPeers() {
+			p := peeringPeer{
+				ID:        st.ID.Pretty(),
+				Addrs:     make([]string, len(st.Addrs)),
+				Connected: st.Connected,
+				NextRetry: st.NextRetry,
+				Failures:  st.Failures,
+				Sources:   st.Sources,
+			}
+			for i, a := range st.Addrs {
+				p.Addrs[i] = a.String()
+			}
+			out.Peers = append(out.Peers, p)
+		}
+		for _, st := range n.PeeringGroups.List() {
+			out.Groups = append(out.Groups, peeringGroup{
+				Addr:        st.Addr.String(),
+				Peers:       st.Peers,
+				LastRefresh: st.LastRefresh,
+				Error:       st.Error,
+			})
+		}
+		return cmds.EmitOnce(res, &out)
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *peeringList) error {
+			tw := tabwriter.NewWriter(w, 4, 4, 2, ' ', 0)
+			for _, p := range out.Peers {
+				state := "connected"
+				if !p.Connected {
+					state = "disconnected"
+					if !p.NextRetry.IsZero() {
+						state += fmt.Sprintf(", retry in %s", time.Until(p.NextRetry).Round(time.Second))
+					}
+					if p.Failures > 0 {
+						state += fmt.Sprintf(", %d failed attempts", p.Failures)
+					}
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", p.ID, state, strings.Join(p.Sources, ","))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+
+			for _, g := range out.Groups {
+				refreshed := "never resolved"
+				if !g.LastRefresh.IsZero() {
+					refreshed = fmt.Sprintf("resolved %s ago", time.Since(g.LastRefresh).Round(time.Second))
+				}
+				fmt.Fprintf(w, "group %s: %d peers, %s", g.Addr, g.Peers, refreshed)
+				if g.Error != "" {
+					fmt.Fprintf(w, ", error: %s", g.Error)
+				}
+				fmt.Fprintln(w)
+			}
+			return nil
+		}),
+	},
+	Type: peeringList{},
+}
+
+// parsePeeringArg parses a peering argument into either a peer multiaddr or a
+// DNS group.
+func parsePeeringArg(arg string) (ma.Multiaddr, ma.Multiaddr, error) {
+	if !strings.HasPrefix(arg, "/") {
+		group, err := peering.ParseDNSGroup(arg)
+		return nil, group, err
+	}
+	addr, err := ma.NewMultiaddr(arg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := addr.ValueForProtocol(ma.P_P2P); err == nil {
+		return addr, nil, nil
+	}
+	group, err := peering.ParseDNSGroup(arg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%q is neither a peer address nor a DNS group", arg)
+	}
+	return nil, group, nil
+}
+
+func peeringGroupsConfig(r repo.Repo) (peering.GroupsConfig, error) {
+	var gcfg peering.GroupsConfig
+	if err := repo.ConfigSection(r, peering.GroupsConfigKey, &gcfg); err != nil {
+		return gcfg, fmt.Errorf("reading %s config: %w", peering.GroupsConfigKey, err)
+	}
+	return gcfg, nil
+}
+
+func peeringAddPeer(peers []peer.AddrInfo, info peer.AddrInfo) []peer.AddrInfo {
+	for i := range peers {
+		if peers[i].ID == info.ID {
+			peers[i].Addrs = info.Addrs
+			return peers
+		}
+	}
+	return append(peers, info)
+}
+
+func peeringRemovePeer(peers []peer.AddrInfo, pid peer.ID) ([]peer.AddrInfo, bool) {
+	for i := range peers {
+		if peers[i].ID == pid {
+			return append(peers[:i], peers[i+1:]...), true
+		}
+	}
+	return peers, false
+}
+
+// peeringGroupIndex finds a group in the config, where groups may be written
+// as domain names or multiaddrs.
+func peeringGroupIndex(groups []string, group ma.Multiaddr) int {
+	for i, s := range groups {
+		if g, err := peering.ParseDNSGroup(s); err == nil && g.Equal(group) {
+			return i
+		}
+	}
+	return -1
+}
+
+func peeringAddGroup(groups []string, group ma.Multiaddr) []string {
+	if peeringGroupIndex(groups, group) >= 0 {
+		return groups
+	}
+	return append(groups, group.String())
+}
+
+func peeringRemoveGroup(groups []string, group ma.Multiaddr) ([]string, bool) {
+	i := peeringGroupIndex(groups, group)
+	if i < 0 {
+		return groups, false
+	}
+	return append(groups[:i], groups[i+1:]...), true
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"text/tabwriter"
+	"time"
 
 	filestore "github.com/ipfs/go-filestore"
 	cmdenv "github.com/ipfs/go-ipfs/core/commands/cmdenv"
+	"github.com/ipfs/go-ipfs/filestore/urlstore"
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	files "github.com/ipfs/go-ipfs-files"
@@ -18,7 +21,9 @@ var urlStoreCmd = &cmds.Command{
 		Tagline: "Interact with urlstore.",
 	},
 	Subcommands: map[string]*cmds.Command{
-		"add": urlAdd,
+		"add":    urlAdd,
+		"health": urlHealth,
+		"verify": urlVerify,
 	},
 }
 
@@ -102,3 +107,122 @@ settings for 'ipfs add'.
 		}),
 	},
 }
+
+type urlHealthOutput struct {
+	URLs       []urlstore.Health
+	LastVerify urlstore.VerifyResult
+}
+
+var urlHealth = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show the health of the URLs backing urlstore blocks.",
+		ShortDescription: `
+Shows the requests made to each URL, and their failures, since the daemon
+started. A URL is down after too many consecutive failures: it is tried after
+its mirrors until it works again. Blocks that can't be fetched from any URL
+are fetched from the network.
+
+The retries, timeouts and mirrors are set in the 'Urlstore' section of the
+config.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if nd.Urlstore == nil {
+			return filestore.ErrUrlstoreNotEnabled
+		}
+		return cmds.EmitOnce(res, &urlHealthOutput{
+			URLs:       nd.Urlstore.Health(),
+			LastVerify: nd.Urlstore.LastVerify(),
+		})
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *urlHealthOutput) error {
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "URL\tStatus\tRequests\tFailures\tLast Error")
+			for _, h := range out.URLs {
+				status := "ok"
+				if h.Down {
+					status = "down"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", h.URL, status, h.Requests, h.Failures, h.LastError)
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if !out.LastVerify.Time.IsZero() {
+				_, err := fmt.Fprintf(w, "\nLast verification: %s, %d/%d blocks failed\n",
+					out.LastVerify.Time.Format(time.RFC3339), out.LastVerify.Failed, out.LastVerify.Blocks)
+				return err
+			}
+			return nil
+		}),
+	},
+	Type: urlHealthOutput{},
+}
+
+type urlVerifyOutput struct {
+	Status string
+	Key    string
+	URL    string
+	Source string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+var urlVerify = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Verify the blocks backed by URLs.",
+		ShortDescription: `
+Fetches every block backed by a URL, with the retries and mirrors of
+the 'Urlstore' config section, and checks it against its CID. The output is:
+
+<status> <hash> <url> [<source>|<error>]
+
+Where <status> is 'ok' or 'failed', and <source> is the mirror that served the
+block when it isn't its URL. The results are recorded in 'ipfs urlstore
+health'. The daemon verifies the blocks every 'Urlstore.VerifyInterval' too.
+`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		nd, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if nd.Urlstore == nil {
+			return filestore.ErrUrlstoreNotEnabled
+		}
+		enc, err := cmdenv.GetCidEncoder(req)
+		if err != nil {
+			return err
+		}
+
+		_, err = nd.Urlstore.Verify(req.Context, func(st urlstore.BlockStatus) error {
+			out := &urlVerifyOutput{Status: "ok", Key: enc.Encode(st.Key), URL: st.URL}
+			if st.Error != nil {
+				out.Status = "failed"
+				out.Error = st.Error.Error()
+			} else if st.Source != st.URL {
+				out.Source = st.Source
+			}
+			return res.Emit(out)
+		})
+		return err
+	},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *urlVerifyOutput) error {
+			extra := out.Source
+			if out.Error != "" {
+				extra = out.Error
+			}
+			if extra != "" {
+				extra = " " + extra
+			}
+			_, err := fmt.Fprintf(w, "%-6s %s %s%s\n", out.Status, out.Key, out.URL, extra)
+			return err
+		}),
+	},
+	Type: urlVerifyOutput{},
+}
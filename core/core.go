@@ -16,6 +16,7 @@ import (
 	"github.com/ipfs/go-filestore"
 	"github.com/ipfs/go-ipfs-pinner"
 
+	bitswap "github.com/ipfs/go-bitswap"
 	bserv "github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-graphsync"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
@@ -42,10 +43,17 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 	madns "github.com/multiformats/go-multiaddr-dns"
 
+	"github.com/ipfs/go-ipfs/connprio"
 	"github.com/ipfs/go-ipfs/core/bootstrap"
 	"github.com/ipfs/go-ipfs/core/node"
 	"github.com/ipfs/go-ipfs/core/node/libp2p"
+	"github.com/ipfs/go-ipfs/exchange/gateways"
+	"github.com/ipfs/go-ipfs/exchange/policy"
+	"github.com/ipfs/go-ipfs/exchange/sessions"
+	"github.com/ipfs/go-ipfs/filestore/urlstore"
 	"github.com/ipfs/go-ipfs/fuse/mount"
+	"github.com/ipfs/go-ipfs/mfs/journal"
+	"github.com/ipfs/go-ipfs/mfs/snapshot"
 	"github.com/ipfs/go-ipfs/p2p"
 	"github.com/ipfs/go-ipfs/peering"
 	"github.com/ipfs/go-ipfs/repo"
@@ -73,6 +81,7 @@ type IpfsNode struct {
 	Peerstore       pstore.Peerstore          `optional:"true"` // storage for other Peer instances
 	Blockstore      bstore.GCBlockstore       // the block store (lower level)
 	Filestore       *filestore.Filestore      `optional:"true"` // the filestore blockstore
+	Urlstore        *urlstore.Store           `optional:"true"` // fetches the URL-backed blocks of the filestore
 	BaseBlocks      node.BaseBlocks           // the raw blockstore, no filestore wrapping
 	GCLocker        bstore.GCLocker           // the locker used to protect the blockstore during gc
 	Blocks          bserv.BlockService        // the block service, get/add blocks.
@@ -81,16 +90,24 @@ type IpfsNode struct {
 	Reporter        *metrics.BandwidthCounter `optional:"true"`
 	Discovery       discovery.Service         `optional:"true"`
 	FilesRoot       *mfs.Root
+	FilesSnapshots  *snapshot.Manager // the snapshots of FilesRoot
+	FilesJournal    *journal.Journal  // the changes made to FilesRoot
 	RecordValidator record.Validator
 
 	// Online
 	PeerHost      p2phost.Host            `optional:"true"` // the network host (server+client)
 	Peering       *peering.PeeringService `optional:"true"`
+	PeeringGroups *peering.DNSGroups      `optional:"true"` // the peer groups published in DNS, if online
 	Filters       *ma.Filters             `optional:"true"`
+	ConnPrio      *connprio.Priorities    `optional:"true"` // tags connections by class of peer, if online
 	Bootstrapper  io.Closer               `optional:"true"` // the periodic bootstrapper
 	Routing       routing.Routing         `optional:"true"` // the routing system. recommend ipfs-dht
 	DNSResolver   *madns.Resolver         // the DNS resolver
 	Exchange      exchange.Interface      // the block exchange + strategy (bitswap)
+	Bitswap       *bitswap.Bitswap        `optional:"true"` // the bitswap instance behind Exchange, if online
+	Sessions      *sessions.Tracker       `optional:"true"` // tracks the bitswap sessions, if online
+	BitswapPolicy *policy.Policy          `optional:"true"` // decides what bitswap serves, if online
+	Gateways      *gateways.Exchange      `optional:"true"` // races HTTP gateways against bitswap, if online
 	Namesys       namesys.NameSystem      // the name system, resolves paths to hashes
 	Provider      provider.System         // the value provider system
 	IpnsRepub     *ipnsrp.Republisher     `optional:"true"`
@@ -120,6 +137,10 @@ type IpfsNode struct {
 type Mounts struct {
 	Ipfs mount.Mount
 	Ipns mount.Mount
+	Mfs  mount.Mount
+
+	// IpfsStats counts the reads served by the Ipfs mount.
+	IpfsStats *mount.ReadStats
 }
 
 // Close calls Close() on the App object
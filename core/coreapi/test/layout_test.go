@@ -0,0 +1,83 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-ipfs/core/coreunix"
+
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	ft "github.com/ipfs/go-unixfs"
+	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// flatLayout links all the chunks from the root.
+func flatLayout(db *ihelper.DagBuilderHelper) (ipld.Node, error) {
+	root := db.NewFSNodeOverDag(ft.TFile)
+	for !db.Done() {
+		child, size, err := db.NewLeafDataNode(ft.TFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := root.AddChild(child, size, db); err != nil {
+			return nil, err
+		}
+	}
+	nd, err := root.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return nd, db.Add(nd)
+}
+
+func TestAddLayout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := coreunix.Layout("testflat"); err != nil {
+		if err := coreunix.AddLayout("testflat", flatLayout); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apis, err := NodeProvider{}.MakeAPISwarm(ctx, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := apis[0]
+
+	data := bytes.Repeat([]byte("0123456789"), 2000)
+	for layout, links := range map[string]int{
+		coreunix.BalancedLayout: 2,
+		coreunix.TrickleLayout:  175,
+		"testflat":              200,
+	} {
+		p, err := api.Unixfs().Add(ctx, files.NewBytesFile(data),
+			options.Unixfs.Chunker("size-100"),
+			coreunix.LayoutOption(layout),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := api.Dag().Get(ctx, p.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nd.Links()) != links {
+			t.Errorf("%d links with the layout %q, expected %d", len(nd.Links()), layout, links)
+		}
+	}
+
+	_, err = api.Unixfs().Add(ctx, files.NewBytesFile(data), coreunix.LayoutOption("unknown"))
+	if err == nil {
+		t.Error("added with an unknown layout")
+	}
+
+	// The HTTP client only applies the options of interface-go-ipfs-core.
+	if _, _, err := options.UnixfsAddOptions(coreunix.LayoutOption(coreunix.TrickleLayout)); err == nil {
+		t.Error("the layout option worked outside of the CoreAPI")
+	}
+}
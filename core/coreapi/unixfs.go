@@ -55,7 +55,7 @@ func getOrCreateNilNode() (*core.IpfsNode, error) {
 // Add builds a merkledag node from a reader, adds it to the blockstore,
 // and returns the key representing that node.
 func (api *UnixfsAPI) Add(ctx context.Context, files files.Node, opts ...options.UnixfsAddOption) (path.Resolved, error) {
-	settings, prefix, err := options.UnixfsAddOptions(opts...)
+	settings, prefix, err := coreunix.AddOptions(opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +95,11 @@ func (api *UnixfsAPI) Add(ctx context.Context, files files.Node, opts ...options
 	}
 
 	bserv := blockservice.New(addblockstore, exch) // hash security 001
-	dserv := dag.NewDAGService(bserv)
+	var dserv ipld.DAGService = dag.NewDAGService(bserv)
+	dedup := settings.Dedup
+	if dedup != nil {
+		dserv = dedup.DAGService(dserv, api.blockstore)
+	}
 
 	// add a sync call to the DagService
 	// this ensures that data written to the DagService is persisted to the underlying datastore
@@ -125,6 +129,10 @@ func (api *UnixfsAPI) Add(ctx context.Context, files files.Node, opts ...options
 	}
 
 	fileAdder.Chunker = settings.Chunker
+	fileAdder.Dedup = dedup
+	fileAdder.Preserve = settings.Preserve
+	fileAdder.Posix = settings.Posix
+	fileAdder.Unpack = settings.Unpack
 	if settings.Events != nil {
 		fileAdder.Out = settings.Events
 		fileAdder.Progress = settings.Progress
@@ -135,13 +143,16 @@ func (api *UnixfsAPI) Add(ctx context.Context, files files.Node, opts ...options
 	fileAdder.NoCopy = settings.NoCopy
 	fileAdder.CidBuilder = prefix
 
-	switch settings.Layout {
-	case options.BalancedLayout:
-		// Default
-	case options.TrickleLayout:
-		fileAdder.Trickle = true
-	default:
-		return nil, fmt.Errorf("unknown layout: %d", settings.Layout)
+	fileAdder.Layout = settings.LayoutName
+	if fileAdder.Layout == "" {
+		switch settings.Layout {
+		case options.BalancedLayout:
+			// Default
+		case options.TrickleLayout:
+			fileAdder.Trickle = true
+		default:
+			return nil, fmt.Errorf("unknown layout: %d", settings.Layout)
+		}
 	}
 
 	if settings.Inline {
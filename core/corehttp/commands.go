@@ -13,6 +13,7 @@ import (
 	oldcmds "github.com/ipfs/go-ipfs/commands"
 	"github.com/ipfs/go-ipfs/core"
 	corecommands "github.com/ipfs/go-ipfs/core/commands"
+	"github.com/ipfs/go-ipfs/mfs/journal"
 
 	cmds "github.com/ipfs/go-ipfs-cmds"
 	cmdsHttp "github.com/ipfs/go-ipfs-cmds/http"
@@ -142,11 +143,20 @@ func commandsOption(cctx oldcmds.Context, command *cmds.Command, allowGet bool)
 		patchCORSVars(cfg, l.Addr())
 
 		cmdHandler := cmdsHttp.NewHandler(&cctx, command, cfg)
-		mux.Handle(APIPath+"/", cmdHandler)
+		mux.Handle(APIPath+"/", withJournalActor(cmdHandler))
 		return mux, nil
 	}
 }
 
+// withJournalActor records the API client as the actor of the MFS changes
+// made by its requests.
+func withJournalActor(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := journal.WithActor(r.Context(), journal.APIActor(r.RemoteAddr))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // CommandsOption constructs a ServerOption for hooking the commands into the
 // HTTP server. It will NOT allow GET requests.
 func CommandsOption(cctx oldcmds.Context) ServeOption {
@@ -0,0 +1,18 @@
+package corehttp
+
+import (
+	"net"
+	"net/http"
+
+	core "github.com/ipfs/go-ipfs/core"
+)
+
+// MiddlewareOption returns a ServeOption wrapping the handlers of the next
+// options with mw.
+func MiddlewareOption(mw func(http.Handler) http.Handler) ServeOption {
+	return func(_ *core.IpfsNode, _ net.Listener, parent *http.ServeMux) (*http.ServeMux, error) {
+		mux := http.NewServeMux()
+		parent.Handle("/", mw(mux))
+		return mux, nil
+	}
+}
@@ -0,0 +1,51 @@
+package corehttp
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	core "github.com/ipfs/go-ipfs/core"
+)
+
+func TestMiddlewareOption(t *testing.T) {
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	endpoint := func(_ *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		mux.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "test!")
+		})
+		return mux, nil
+	}
+
+	h, err := makeHandler(nil, nil, MiddlewareOption(auth), endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		auth string
+		code int
+		body string
+	}{
+		{"", http.StatusUnauthorized, "unauthorized\n"},
+		{"secret", http.StatusOK, "test!"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/test", nil)
+		r.Header.Set("Authorization", tc.auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.code || w.Body.String() != tc.body {
+			t.Errorf("with %q: got %d %q, expected %d %q", tc.auth, w.Code, w.Body.String(), tc.code, tc.body)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package corerepo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	config "github.com/ipfs/go-ipfs-config"
+	serialize "github.com/ipfs/go-ipfs-config/serialize"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	"github.com/ipfs/go-mfs"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/libp2p/go-libp2p-core/crypto"
+)
+
+const (
+	// BackupManifestFile is the name of the manifest in a backup.
+	BackupManifestFile = "manifest.json"
+	// BackupCarFile is the name of the CAR file holding the blocks of a
+	// backup.
+	BackupCarFile = "blocks.car"
+
+	backupVersion = 1
+)
+
+// BackupManifest describes a backup of a repo.
+type BackupManifest struct {
+	// Version is the version of the backup format.
+	Version     int
+	RepoVersion int
+	Created     time.Time
+
+	Config json.RawMessage
+	// Keys are the keys of the keystore, by name.
+	Keys      map[string][]byte
+	Pins      BackupPins
+	FilesRoot cid.Cid
+
+	// Blocks is true when the CAR file holds all the blocks of the repo,
+	// and false when it only holds the MFS root.
+	Blocks     bool
+	BlockCount uint64
+}
+
+// BackupPins are the pins of a backup.
+type BackupPins struct {
+	Recursive []cid.Cid
+	Direct    []cid.Cid
+}
+
+// Backup writes a backup of the repo of n to the directory dest, which
+// must not exist. The garbage collection waits for the backup, which holds
+// the config, the keystore, the pins, the MFS root, and the blocks of the
+// repo when withBlocks is true. progress is called with the number of
+// blocks written.
+func Backup(ctx context.Context, n *core.IpfsNode, dest string, withBlocks bool, progress func(uint64)) (*BackupManifest, error) {
+	if err := os.Mkdir(dest, 0700); err != nil {
+		return nil, err
+	}
+	m, err := backup(ctx, n, dest, withBlocks, progress)
+	if err != nil {
+		os.RemoveAll(dest)
+		return nil, err
+	}
+	return m, nil
+}
+
+func backup(ctx context.Context, n *core.IpfsNode, dest string, withBlocks bool, progress func(uint64)) (*BackupManifest, error) {
+	// The GC waits for the pin lock.
+	defer n.Blockstore.PinLock().Unlock()
+
+	m := &BackupManifest{
+		Version:     backupVersion,
+		RepoVersion: fsrepo.RepoVersion,
+		Created:     time.Now().UTC(),
+		Keys:        make(map[string][]byte),
+		Blocks:      withBlocks,
+	}
+
+	lk := rootlock.For(n.FilesRoot)
+	lk.Lock()
+	root, err := mfs.FlushPath(ctx, n.FilesRoot, "/")
+	lk.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	m.FilesRoot = root.Cid()
+	if m.Pins.Recursive, err = n.Pinning.RecursiveKeys(ctx); err != nil {
+		return nil, err
+	}
+	if m.Pins.Direct, err = n.Pinning.DirectKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	// The whole config file, with the sections go-ipfs-config doesn't know.
+	cfg, err := n.Repo.GetConfigKey("")
+	if err != nil {
+		return nil, err
+	}
+	if m.Config, err = json.Marshal(cfg); err != nil {
+		return nil, err
+	}
+	names, err := n.Repo.Keystore().List()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		sk, err := n.Repo.Keystore().Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if m.Keys[name], err = crypto.MarshalPrivateKey(sk); err != nil {
+			return nil, err
+		}
+	}
+
+	roots := append([]cid.Cid{m.FilesRoot}, m.Pins.Recursive...)
+	roots = append(roots, m.Pins.Direct...)
+	if m.BlockCount, err = writeBackupCar(ctx, n.Blockstore, filepath.Join(dest, BackupCarFile), roots, withBlocks, progress); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return m, ioutil.WriteFile(filepath.Join(dest, BackupManifestFile), data, 0600)
+}
+
+// writeBackupCar writes the blocks of bs to a CAR file, or only the first
+// root when all is false, and returns the number of blocks written.
+func writeBackupCar(ctx context.Context, bs bstore.Blockstore, path string, roots []cid.Cid, all bool, progress func(uint64)) (uint64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, w); err != nil {
+		return 0, err
+	}
+
+	var count uint64
+	write := func(c cid.Cid) error {
+		b, err := bs.Get(c)
+		if err != nil {
+			return err
+		}
+		if err := carutil.LdWrite(w, c.Bytes(), b.RawData()); err != nil {
+			return err
+		}
+		count++
+		progress(count)
+		return nil
+	}
+
+	if !all {
+		if err := write(roots[0]); err != nil {
+			return 0, err
+		}
+	} else {
+		keys, err := bs.AllKeysChan(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for c := range keys {
+			if err := write(c); err == bstore.ErrNotFound {
+				// Removed since listed.
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return count, f.Close()
+}
+
+// Restore creates a repo at repoRoot from the backup in the directory src.
+// The blocks are verified once stored. progress is called with the number
+// of blocks restored.
+func Restore(ctx context.Context, repoRoot, src string, progress func(uint64)) (*BackupManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(src, BackupManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := new(BackupManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("reading the backup manifest: %s", err)
+	}
+	if m.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", m.Version)
+	}
+	if m.RepoVersion != fsrepo.RepoVersion {
+		return nil, fmt.Errorf("the backup is of a repo of version %d, instead of %d", m.RepoVersion, fsrepo.RepoVersion)
+	}
+	cfg := new(config.Config)
+	if err := json.Unmarshal(m.Config, cfg); err != nil {
+		return nil, fmt.Errorf("reading the backup config: %s", err)
+	}
+
+	if fsrepo.IsInitialized(repoRoot) {
+		return nil, fmt.Errorf("a repo exists at %s", repoRoot)
+	}
+	if err := fsrepo.Init(repoRoot, cfg); err != nil {
+		return nil, err
+	}
+	// Keep the sections of the config dropped by config.Config.
+	configFilename, err := config.Filename(repoRoot)
+	if err != nil {
+		return nil, err
+	}
+	if err := serialize.WriteConfigFile(configFilename, m.Config); err != nil {
+		return nil, err
+	}
+	if err := restore(ctx, repoRoot, src, m, progress); err != nil {
+		return nil, fmt.Errorf("%s, remove the repo at %s before restoring again", err, repoRoot)
+	}
+	return m, nil
+}
+
+func restore(ctx context.Context, repoRoot, src string, m *BackupManifest, progress func(uint64)) error {
+	r, err := fsrepo.Open(repoRoot)
+	if err != nil {
+		return err
+	}
+	// NB: the repo is owned by the node once built.
+
+	for name, data := range m.Keys {
+		sk, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		if err := r.Keystore().Put(name, sk); err != nil {
+			r.Close()
+			return err
+		}
+	}
+
+	if err := restoreBlocks(r, filepath.Join(src, BackupCarFile), m.BlockCount, progress); err != nil {
+		r.Close()
+		return err
+	}
+	if err := r.Datastore().Put(datastore.NewKey("/local/filesroot"), m.FilesRoot.Bytes()); err != nil {
+		r.Close()
+		return err
+	}
+
+	nd, err := core.NewNode(ctx, &core.BuildCfg{Repo: r})
+	if err != nil {
+		return err
+	}
+	defer nd.Close()
+	for _, c := range m.Pins.Recursive {
+		nd.Pinning.PinWithMode(c, pin.Recursive)
+	}
+	for _, c := range m.Pins.Direct {
+		nd.Pinning.PinWithMode(c, pin.Direct)
+	}
+	return nd.Pinning.Flush(ctx)
+}
+
+// restoreBlocks stores the blocks of a backup CAR file in the repo, and
+// verifies them.
+func restoreBlocks(r repo.Repo, path string, expected uint64, progress func(uint64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cr, err := car.NewCarReader(f)
+	if err != nil {
+		return err
+	}
+
+	bs := bstore.NewBlockstore(r.Datastore())
+	// Read the blocks back from the datastore, and hash them.
+	verify := bstore.NewBlockstore(r.Datastore())
+	verify.HashOnRead(true)
+
+	var count uint64
+	batch := make([]blocks.Block, 0, 256)
+	flush := func() error {
+		if err := bs.PutMany(batch); err != nil {
+			return err
+		}
+		for _, b := range batch {
+			if _, err := verify.Get(b.Cid()); err != nil {
+				return fmt.Errorf("verifying %s: %s", b.Cid(), err)
+			}
+		}
+		count += uint64(len(batch))
+		progress(count)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		// The reader verifies the hashes of the blocks.
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		batch = append(batch, b)
+		if len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if count != expected {
+		return fmt.Errorf("the backup holds %d blocks, instead of %d", count, expected)
+	}
+	return nil
+}
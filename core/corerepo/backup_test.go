@@ -0,0 +1,78 @@
+package corerepo
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	config "github.com/ipfs/go-ipfs-config"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+func TestBackupKeepsConfigSections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ident, err := config.CreateIdentity(ioutil.Discard, []options.KeyGenerateOption{options.Key.Type(options.Ed25519Key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.InitWithIdentity(ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Datastore.Spec = map[string]interface{}{"type": "mem"}
+
+	repoRoot := t.TempDir()
+	if err := fsrepo.Init(repoRoot, cfg); err != nil {
+		t.Fatal(err)
+	}
+	r, err := fsrepo.Open(repoRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Urlstore is unknown to go-ipfs-config.
+	if err := r.SetConfigKey("Urlstore.Attempts", 5); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := core.NewNode(ctx, &core.BuildCfg{Repo: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backupDir := filepath.Join(t.TempDir(), "backup")
+	_, err = Backup(ctx, nd, backupDir, true, func(uint64) {})
+	nd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoredRoot := t.TempDir()
+	if _, err := Restore(ctx, restoredRoot, backupDir, func(uint64) {}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := fsrepo.Open(restoredRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	attempts, err := restored.GetConfigKey("Urlstore.Attempts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != float64(5) {
+		t.Errorf("Urlstore.Attempts restored as %v", attempts)
+	}
+	peerID, err := restored.GetConfigKey("Identity.PeerID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peerID != ident.PeerID {
+		t.Errorf("Identity.PeerID restored as %v", peerID)
+	}
+}
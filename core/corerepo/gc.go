@@ -83,8 +83,25 @@ func BestEffortRoots(filesRoot *mfs.Root) ([]cid.Cid, error) {
 	return []cid.Cid{rootDag.Cid()}, nil
 }
 
-func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
+// gcRoots returns the best-effort roots of a node: its MFS root and the roots
+// of the MFS snapshots.
+func gcRoots(n *core.IpfsNode) ([]cid.Cid, error) {
 	roots, err := BestEffortRoots(n.FilesRoot)
+	if err != nil {
+		return nil, err
+	}
+	if n.FilesSnapshots != nil {
+		snapRoots, err := n.FilesSnapshots.Roots()
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, snapRoots...)
+	}
+	return roots, nil
+}
+
+func GarbageCollect(n *core.IpfsNode, ctx context.Context) error {
+	roots, err := gcRoots(n)
 	if err != nil {
 		return err
 	}
@@ -148,7 +165,7 @@ func (e *MultiError) Error() string {
 }
 
 func GarbageCollectAsync(n *core.IpfsNode, ctx context.Context) <-chan gc.Result {
-	roots, err := BestEffortRoots(n.FilesRoot)
+	roots, err := gcRoots(n)
 	if err != nil {
 		out := make(chan gc.Result)
 		out <- gc.Result{Error: err}
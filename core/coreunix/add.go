@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	gopath "path"
 	"strconv"
 
@@ -19,9 +20,7 @@ import (
 	dag "github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-mfs"
 	"github.com/ipfs/go-unixfs"
-	"github.com/ipfs/go-unixfs/importer/balanced"
 	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
-	"github.com/ipfs/go-unixfs/importer/trickle"
 	coreiface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/path"
 )
@@ -79,6 +78,20 @@ type Adder struct {
 	tempRoot   cid.Cid
 	CidBuilder cid.Builder
 	liveNodes  uint64
+	// Dedup, when set, records how many of the blocks written were already
+	// stored.
+	Dedup *DedupReport
+	// Preserve selects the POSIX metadata of the files to store. It is
+	// read from the Stat method of the files, or taken from Posix, by the
+	// path of the files relative to the file added.
+	Preserve Preserve
+	Posix    map[string]Posix
+	// Unpack, when set, is the format of the archive added, which is
+	// unpacked into a directory.
+	Unpack string
+	// Layout, when set, is the name of the layout of the files, instead of
+	// the balanced or the trickle layout.
+	Layout string
 }
 
 func (adder *Adder) mfsRoot() (*mfs.Root, error) {
@@ -100,9 +113,28 @@ func (adder *Adder) SetMfsRoot(r *mfs.Root) {
 	adder.mroot = r
 }
 
-// Constructs a node from reader's data, and adds it. Doesn't pin.
-func (adder *Adder) add(reader io.Reader) (ipld.Node, error) {
-	chnk, err := chunker.FromString(reader, adder.Chunker)
+// Constructs a node from reader's data, and adds it. Doesn't pin. The name
+// of the file is used to pick the chunker in auto mode.
+func (adder *Adder) add(reader io.Reader, name string) (ipld.Node, error) {
+	var chnk chunker.Splitter
+	var err error
+	if adder.Chunker == AutoChunker {
+		chnk, err = autoSplitter(reader, name)
+	} else {
+		chnk, err = NewSplitter(reader, adder.Chunker)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	layoutName := adder.Layout
+	if layoutName == "" {
+		layoutName = BalancedLayout
+		if adder.Trickle {
+			layoutName = TrickleLayout
+		}
+	}
+	layout, err := Layout(layoutName)
 	if err != nil {
 		return nil, err
 	}
@@ -119,12 +151,7 @@ func (adder *Adder) add(reader io.Reader) (ipld.Node, error) {
 	if err != nil {
 		return nil, err
 	}
-	var nd ipld.Node
-	if adder.Trickle {
-		nd, err = trickle.Layout(db)
-	} else {
-		nd, err = balanced.Layout(db)
-	}
+	nd, err := layout(db)
 	if err != nil {
 		return nil, err
 	}
@@ -132,6 +159,12 @@ func (adder *Adder) add(reader io.Reader) (ipld.Node, error) {
 	return nd, adder.bufferedDS.Commit()
 }
 
+// AddFileData builds the DAG of a file from the data of r, with the chunker
+// and the layout of the adder, and adds it. Doesn't pin.
+func (adder *Adder) AddFileData(r io.Reader) (ipld.Node, error) {
+	return adder.add(r, "")
+}
+
 // RootNode returns the mfs root node
 func (adder *Adder) curRootNode() (ipld.Node, error) {
 	mr, err := adder.mfsRoot()
@@ -264,7 +297,11 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 		}
 	}()
 
-	if err := adder.addFileNode("", file, true); err != nil {
+	if adder.Unpack != "" {
+		if err := adder.addArchive(file); err != nil {
+			return nil, err
+		}
+	} else if err := adder.addFileNode("", file, true); err != nil {
 		return nil, err
 	}
 
@@ -285,6 +322,7 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 	// if adding a file without wrapping, swap the root to it (when adding a
 	// directory, mfs root is the directory)
 	_, dir := file.(files.Directory)
+	dir = dir || adder.Unpack != ""
 	var name string
 	if !dir {
 		children, err := rootdir.ListNames(adder.ctx)
@@ -336,6 +374,25 @@ func (adder *Adder) AddAllAndPin(file files.Node) (ipld.Node, error) {
 func (adder *Adder) addFileNode(path string, file files.Node, toplevel bool) error {
 	defer file.Close()
 
+	if err := adder.prepareNode(); err != nil {
+		return err
+	}
+
+	switch f := file.(type) {
+	case files.Directory:
+		return adder.addDir(path, f, toplevel)
+	case *files.Symlink:
+		return adder.addSymlink(path, f)
+	case files.File:
+		return adder.addFile(path, f)
+	default:
+		return errors.New("unknown file type")
+	}
+}
+
+// prepareNode pauses for GC if requested and frees the cached nodes before
+// adding a node.
+func (adder *Adder) prepareNode() error {
 	err := adder.maybePauseForGC()
 	if err != nil {
 		return err
@@ -354,17 +411,7 @@ func (adder *Adder) addFileNode(path string, file files.Node, toplevel bool) err
 		adder.liveNodes = 0
 	}
 	adder.liveNodes++
-
-	switch f := file.(type) {
-	case files.Directory:
-		return adder.addDir(path, f, toplevel)
-	case *files.Symlink:
-		return adder.addSymlink(path, f)
-	case files.File:
-		return adder.addFile(path, f)
-	default:
-		return errors.New("unknown file type")
-	}
+	return nil
 }
 
 func (adder *Adder) addSymlink(path string, l *files.Symlink) error {
@@ -396,10 +443,30 @@ func (adder *Adder) addFile(path string, file files.File) error {
 		}
 	}
 
-	dagnode, err := adder.add(reader)
+	if adder.Dedup != nil {
+		adder.Dedup.startFile()
+	}
+	dagnode, err := adder.add(reader, path)
 	if err != nil {
 		return err
 	}
+	if adder.Dedup != nil {
+		// Single files are named after their CID in the events.
+		name := path
+		if name == "" {
+			name = dagnode.Cid().String()
+		}
+		adder.Dedup.endFile(name)
+	}
+
+	if p := adder.posix(path, file); !p.IsZero() {
+		if pi, ok := dagnode.(*posinfo.FilestoreNode); ok {
+			dagnode = pi.Node
+		}
+		if dagnode, err = adder.withPosix(dagnode, p); err != nil {
+			return err
+		}
+	}
 
 	// patch it into the root
 	return adder.addNode(dagnode, path)
@@ -408,7 +475,28 @@ func (adder *Adder) addFile(path string, file files.File) error {
 func (adder *Adder) addDir(path string, dir files.Directory, toplevel bool) error {
 	log.Infof("adding directory: %s", path)
 
-	if !(toplevel && path == "") {
+	it := dir.Entries()
+	next := it.Next()
+
+	p := adder.posix(path, dir)
+
+	if !p.IsZero() {
+		// The directory is created with its metadata, which MFS keeps
+		// while adding the entries.
+		dnode, err := adder.withPosix(unixfs.EmptyDirNode(), p)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			mr, err := mfs.NewRoot(adder.ctx, adder.dagService, dnode, nil)
+			if err != nil {
+				return err
+			}
+			adder.mroot = mr
+		} else if err := adder.putDir(path, dnode); err != nil {
+			return err
+		}
+	} else if !(toplevel && path == "") {
 		mr, err := adder.mfsRoot()
 		if err != nil {
 			return err
@@ -423,8 +511,7 @@ func (adder *Adder) addDir(path string, dir files.Directory, toplevel bool) erro
 		}
 	}
 
-	it := dir.Entries()
-	for it.Next() {
+	for ; next; next = it.Next() {
 		fpath := gopath.Join(path, it.Name())
 		err := adder.addFileNode(fpath, it.Node(), false)
 		if err != nil {
@@ -435,6 +522,56 @@ func (adder *Adder) addDir(path string, dir files.Directory, toplevel bool) erro
 	return it.Err()
 }
 
+// putDir puts a directory node in MFS, creating its parents.
+func (adder *Adder) putDir(path string, nd ipld.Node) error {
+	mr, err := adder.mfsRoot()
+	if err != nil {
+		return err
+	}
+	if dir := gopath.Dir(path); dir != "." {
+		err := mfs.Mkdir(mr, dir, mfs.MkdirOpts{
+			Mkparents:  true,
+			Flush:      false,
+			CidBuilder: adder.CidBuilder,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return mfs.PutNode(mr, path, nd)
+}
+
+// posix returns the metadata to store of the file at path. The paths given
+// by the client are never read: the files sent to the daemon only have the
+// metadata the client sent.
+func (adder *Adder) posix(path string, f files.Node) Posix {
+	if !(adder.Preserve.Mode || adder.Preserve.Mtime) {
+		return Posix{}
+	}
+	if p, ok := adder.Posix[path]; ok {
+		return p
+	}
+	if s, ok := f.(interface{ Stat() os.FileInfo }); ok && s.Stat() != nil {
+		return PosixFromStat(s.Stat(), adder.Preserve)
+	}
+	return Posix{}
+}
+
+// withPosix sets the metadata of a node and adds it.
+func (adder *Adder) withPosix(nd ipld.Node, p Posix) (*dag.ProtoNode, error) {
+	pn, err := WithPosix(nd, p)
+	if err != nil {
+		return nil, err
+	}
+	if adder.CidBuilder != nil {
+		pn.SetCidBuilder(adder.CidBuilder)
+	}
+	if err := adder.dagService.Add(adder.ctx, pn); err != nil {
+		return nil, err
+	}
+	return pn, nil
+}
+
 func (adder *Adder) maybePauseForGC() error {
 	if adder.unlocker != nil && adder.gcLocker.GCRequested() {
 		rn, err := adder.curRootNode()
@@ -0,0 +1,283 @@
+package coreunix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	gopath "path"
+	"strconv"
+	"strings"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	files "github.com/ipfs/go-ipfs-files"
+)
+
+// AutoChunker is the chunker picking a chunker for each file from its type.
+const AutoChunker = "auto"
+
+// vmChunkSize is the chunk size of disk images, so that chunks match the
+// clusters of the image formats.
+const vmChunkSize = 64 << 10
+
+// sniffLen is how many bytes are read to detect the type of a file.
+const sniffLen = 512
+
+var (
+	zipMagic = []byte("PK\x03\x04")
+	tarMagic = []byte("ustar")
+
+	vmMagics = [][]byte{
+		[]byte("QFI\xfb"),                  // qcow2
+		[]byte("KDMV"),                     // vmdk
+		[]byte("# Disk DescriptorFile"),    // vmdk descriptor
+		[]byte("conectix"),                 // dynamic vhd
+		[]byte("vhdxfile"),                 // vhdx
+		[]byte("<<< Oracle VM VirtualBox"), // vdi
+	}
+	vmExtensions = map[string]bool{
+		".img": true, ".iso": true, ".raw": true, ".qcow2": true,
+		".vmdk": true, ".vhd": true, ".vhdx": true, ".vdi": true,
+	}
+
+	// Compressed data doesn't deduplicate with content defined chunking.
+	compressedMagics = [][]byte{
+		[]byte("\x1f\x8b"),         // gzip
+		[]byte("BZh"),              // bzip2
+		[]byte("\xfd7zXZ\x00"),     // xz
+		[]byte("\x28\xb5\x2f\xfd"), // zstd
+		[]byte("7z\xbc\xaf\x27\x1c"),
+		[]byte("\xff\xd8\xff"), // jpeg
+		[]byte("\x89PNG"),
+	}
+)
+
+// autoSplitter picks the chunker of a file from its first bytes and its
+// name:
+//   - tar archives are split at the boundaries of their entries, and their
+//     entries as if they were added on their own, so that the files they
+//     contain deduplicate with the same files elsewhere,
+//   - zip archives are split at the local headers of their entries,
+//   - disk images are split in chunks matching their clusters,
+//   - compressed files use the default chunker,
+//   - other files use content defined chunking.
+func autoSplitter(r io.Reader, name string) (chunker.Splitter, error) {
+	br := bufio.NewReaderSize(r, int(chunker.DefaultBlockSize)+len(zipMagic))
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	sr := sniffedReader(br, r)
+
+	switch {
+	case len(head) >= 262 && bytes.Equal(head[257:262], tarMagic):
+		log.Debugf("auto chunker: %q is a tar archive", name)
+		return &tarSplitter{r: br, orig: sr, size: int(chunker.DefaultBlockSize)}, nil
+	case bytes.HasPrefix(head, zipMagic):
+		log.Debugf("auto chunker: %q is a zip archive", name)
+		return &markerSplitter{r: br, orig: sr, size: int(chunker.DefaultBlockSize), marker: zipMagic}, nil
+	case hasAnyPrefix(head, vmMagics) || vmExtensions[strings.ToLower(gopath.Ext(name))]:
+		log.Debugf("auto chunker: %q is a disk image", name)
+		return chunker.NewSizeSplitter(sr, vmChunkSize), nil
+	case hasAnyPrefix(head, compressedMagics):
+		log.Debugf("auto chunker: %q is compressed", name)
+		return chunker.DefaultSplitter(sr), nil
+	default:
+		return chunker.NewBuzhash(sr), nil
+	}
+}
+
+func hasAnyPrefix(b []byte, prefixes [][]byte) bool {
+	for _, p := range prefixes {
+		if bytes.HasPrefix(b, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffedReader returns a reader of the buffered data, that keeps the file
+// info of the original reader for the filestore.
+func sniffedReader(br *bufio.Reader, orig io.Reader) io.Reader {
+	if fi, ok := orig.(files.FileInfo); ok {
+		return &sniffedFile{Reader: br, fi: fi}
+	}
+	return br
+}
+
+type sniffedFile struct {
+	*bufio.Reader
+	fi files.FileInfo
+}
+
+func (f *sniffedFile) AbsPath() string            { return f.fi.AbsPath() }
+func (f *sniffedFile) Stat() os.FileInfo          { return f.fi.Stat() }
+func (f *sniffedFile) Size() (int64, error)       { return f.fi.Size() }
+func (f *sniffedFile) Close() error               { return f.fi.Close() }
+func (f *sniffedFile) Read(p []byte) (int, error) { return f.Reader.Read(p) }
+
+// tarSplitter puts the headers of tar entries in their own chunks, and
+// splits the data of each entry as if it was added on its own, so that it
+// deduplicates with the same file outside of the archive. When the archive
+// can't be parsed, the rest is split in fixed size chunks.
+type tarSplitter struct {
+	r    *bufio.Reader
+	orig io.Reader
+	size int
+
+	// entry splits the data of the current entry, and pad is the size of
+	// the padding following it.
+	entry chunker.Splitter
+	pad   int64
+	// raw is set after the end of the archive, or when it can't be parsed.
+	raw bool
+}
+
+const tarBlockSize = 512
+
+func (s *tarSplitter) Reader() io.Reader {
+	return s.orig
+}
+
+func (s *tarSplitter) NextBytes() ([]byte, error) {
+	if s.entry != nil {
+		b, err := s.entry.NextBytes()
+		if err != io.EOF {
+			return b, err
+		}
+		s.entry = nil
+		if s.pad > 0 {
+			return s.read(s.pad)
+		}
+	}
+	if s.raw {
+		return s.read(int64(s.size))
+	}
+
+	header, err := s.read(tarBlockSize)
+	if err != nil || s.raw {
+		return header, err
+	}
+	size, err := tarEntrySize(header)
+	if err != nil {
+		// The end of the archive is marked with zero blocks,
+		// possibly followed by padding.
+		s.raw = true
+		return s.appendRaw(header)
+	}
+	if size > 0 {
+		name := string(bytes.TrimRight(header[:100], "\x00"))
+		s.entry, err = autoSplitter(io.LimitReader(s.r, size), name)
+		if err != nil {
+			return nil, err
+		}
+		s.pad = (tarBlockSize - size%tarBlockSize) % tarBlockSize
+	}
+	return header, nil
+}
+
+// read returns the next n bytes, or less at the end of the archive.
+func (s *tarSplitter) read(n int64) ([]byte, error) {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(s.r, buf)
+	switch err {
+	case nil:
+	case io.EOF:
+		return nil, io.EOF
+	case io.ErrUnexpectedEOF:
+		s.raw = true
+	default:
+		return nil, err
+	}
+	return buf[:read], nil
+}
+
+// appendRaw fills a chunk started with b from the rest of the archive.
+func (s *tarSplitter) appendRaw(b []byte) ([]byte, error) {
+	buf := make([]byte, s.size)
+	n := copy(buf, b)
+	read, err := io.ReadFull(s.r, buf[n:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n+read], nil
+}
+
+// tarEntrySize returns the size of the data of the entry of a tar header.
+func tarEntrySize(header []byte) (int64, error) {
+	var sum int64
+	for i, c := range header {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		sum += int64(c)
+	}
+	chksum, err := parseTarNumber(header[148:156])
+	if err != nil || chksum != sum {
+		return 0, fmt.Errorf("invalid tar header checksum")
+	}
+	return parseTarNumber(header[124:136])
+}
+
+func parseTarNumber(b []byte) (int64, error) {
+	// Large sizes are encoded in base-256.
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		var n int64
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			n = n<<8 | int64(c)
+		}
+		return n, nil
+	}
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
+
+// markerSplitter starts a new chunk before every occurrence of a marker, and
+// splits longer runs in chunks of size.
+type markerSplitter struct {
+	r      *bufio.Reader
+	orig   io.Reader
+	size   int
+	marker []byte
+}
+
+func (s *markerSplitter) Reader() io.Reader {
+	return s.orig
+}
+
+func (s *markerSplitter) NextBytes() ([]byte, error) {
+	// Peek far enough to see markers starting before size.
+	buf, err := s.r.Peek(s.size + len(s.marker) - 1)
+	if len(buf) == 0 {
+		if err == nil || err == bufio.ErrBufferFull {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	n := len(buf)
+	if n > s.size {
+		n = s.size
+	}
+	// The chunk starts with a marker, look for the next one.
+	if i := bytes.Index(buf[1:], s.marker); i >= 0 && i+1 < n {
+		n = i + 1
+	}
+
+	out := make([]byte, n)
+	copy(out, buf)
+	if _, err := s.r.Discard(n); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
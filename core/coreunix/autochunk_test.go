@@ -0,0 +1,116 @@
+package coreunix
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+)
+
+func split(t *testing.T, data []byte, name string) [][]byte {
+	spl, err := autoSplitter(bytes.NewReader(data), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		b, err := spl.NextBytes()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, b)
+	}
+	if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+		t.Fatalf("chunks of %s don't match the data", name)
+	}
+	return chunks
+}
+
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func contains(chunks [][]byte, c []byte) bool {
+	for _, chunk := range chunks {
+		if bytes.Equal(chunk, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAutoSplitterTar(t *testing.T) {
+	file := randomData(700 << 10)
+	standalone := split(t, file, "file")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"small", "file"} {
+		data := []byte(name)
+		if name == "file" {
+			data = file
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := split(t, buf.Bytes(), "archive.tar")
+	if len(chunks[0]) != tarBlockSize || string(chunks[1]) != "small" {
+		t.Error("the entries should start new chunks")
+	}
+	for _, c := range standalone {
+		if !contains(chunks, c) {
+			t.Fatal("the data of the entries should be split as on its own")
+		}
+	}
+}
+
+func TestAutoSplitterZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a", "b"} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(randomData(100 << 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := split(t, buf.Bytes(), "archive.zip")
+	if len(chunks) < 2 || !bytes.HasPrefix(chunks[1], zipMagic) {
+		t.Error("the entries should start new chunks")
+	}
+}
+
+func TestAutoSplitterImage(t *testing.T) {
+	chunks := split(t, randomData(200<<10), "disk.img")
+	if len(chunks) != 4 || len(chunks[0]) != vmChunkSize {
+		t.Errorf("disk images should use %d bytes chunks", vmChunkSize)
+	}
+
+	gz := append([]byte("\x1f\x8b"), randomData(300<<10)...)
+	if chunks := split(t, gz, "data"); len(chunks[0]) != int(chunker.DefaultBlockSize) {
+		t.Error("compressed files should use the default chunker")
+	}
+}
@@ -0,0 +1,107 @@
+package coreunix
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	"github.com/ipfs/go-unixfs/importer/trickle"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// SplitterFunc creates the splitter of a chunker added with AddChunker. The
+// params are what follows "<name>-" in the chunker string, or "".
+type SplitterFunc func(r io.Reader, params string) (chunker.Splitter, error)
+
+// LayoutFunc builds the DAG of a file from the chunks of db.
+type LayoutFunc func(db *ihelper.DagBuilderHelper) (ipld.Node, error)
+
+// The layouts built into go-ipfs.
+const (
+	BalancedLayout = "balanced"
+	TrickleLayout  = "trickle"
+)
+
+var (
+	// builtinChunkers are the chunkers of chunker.FromString, and the auto
+	// chunker.
+	builtinChunkers = map[string]bool{
+		"size":      true,
+		"rabin":     true,
+		"buzhash":   true,
+		AutoChunker: true,
+	}
+
+	chunkers = map[string]SplitterFunc{}
+
+	layouts = map[string]LayoutFunc{
+		BalancedLayout: balanced.Layout,
+		TrickleLayout:  trickle.Layout,
+	}
+)
+
+// AddChunker adds a chunker, selected with the chunker string "<name>" or
+// "<name>-<params>". The name can't contain '-'.
+func AddChunker(name string, fn SplitterFunc) error {
+	if name == "" || strings.Contains(name, "-") {
+		return fmt.Errorf("invalid chunker name %q", name)
+	}
+	if _, ok := chunkers[name]; ok || builtinChunkers[name] {
+		return fmt.Errorf("already have a chunker named %q", name)
+	}
+
+	chunkers[name] = fn
+	return nil
+}
+
+// AddLayout adds a layout of the DAG of files, selected by its name.
+func AddLayout(name string, fn LayoutFunc) error {
+	if name == "" {
+		return fmt.Errorf("invalid layout name %q", name)
+	}
+	if _, ok := layouts[name]; ok {
+		return fmt.Errorf("already have a layout named %q", name)
+	}
+
+	layouts[name] = fn
+	return nil
+}
+
+// NewSplitter returns the splitter of r for the chunker string chunkerStr:
+// a chunker added with AddChunker, or one of chunker.FromString.
+func NewSplitter(r io.Reader, chunkerStr string) (chunker.Splitter, error) {
+	name, params := chunkerStr, ""
+	if i := strings.IndexByte(chunkerStr, '-'); i >= 0 {
+		name, params = chunkerStr[:i], chunkerStr[i+1:]
+	}
+	if fn, ok := chunkers[name]; ok {
+		return fn(r, params)
+	}
+	return chunker.FromString(r, chunkerStr)
+}
+
+// Layout returns the layout of the given name.
+func Layout(name string) (LayoutFunc, error) {
+	fn, ok := layouts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown layout %q", name)
+	}
+	return fn, nil
+}
+
+// LayoutOption is the Unixfs().Add option selecting the layout of the given
+// name, including the layouts added with AddLayout. It takes precedence over
+// options.Unixfs.Layout.
+func LayoutOption(name string) options.UnixfsAddOption {
+	return addOption("layout", func(settings *AddSettings) error {
+		if _, ok := layouts[name]; !ok {
+			return fmt.Errorf("unknown layout %q", name)
+		}
+		settings.LayoutName = name
+		return nil
+	})
+}
@@ -0,0 +1,116 @@
+package coreunix
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	ft "github.com/ipfs/go-unixfs"
+	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// fixedSplitter splits in chunks of the size of its params.
+func fixedSplitter(r io.Reader, params string) (chunker.Splitter, error) {
+	size, err := strconv.ParseInt(params, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return chunker.NewSizeSplitter(r, size), nil
+}
+
+// flatLayout links all the chunks from the root.
+func flatLayout(db *ihelper.DagBuilderHelper) (ipld.Node, error) {
+	root := db.NewFSNodeOverDag(ft.TFile)
+	for !db.Done() {
+		child, size, err := db.NewLeafDataNode(ft.TFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := root.AddChild(child, size, db); err != nil {
+			return nil, err
+		}
+	}
+	nd, err := root.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return nd, db.Add(nd)
+}
+
+func TestAddChunkerAndLayout(t *testing.T) {
+	if err := AddChunker("testfixed", fixedSplitter); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddLayout("testflat", flatLayout); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		delete(chunkers, "testfixed")
+		delete(layouts, "testflat")
+	})
+
+	for _, name := range []string{"testfixed", "size", AutoChunker, "my-chunker", ""} {
+		if err := AddChunker(name, fixedSplitter); err == nil {
+			t.Errorf("added the chunker %q", name)
+		}
+	}
+	if err := AddLayout(TrickleLayout, flatLayout); err == nil {
+		t.Error("replaced the trickle layout")
+	}
+
+	ctx := context.Background()
+	dserv := getDagserv(t)
+	bs := blockstore.NewGCBlockstore(blockstore.NewBlockstore(syncds.MutexWrap(datastore.NewMapDatastore())), blockstore.NewGCLocker())
+	data := randomData(100 * 200)
+
+	add := func(chunkerStr, layout string) (ipld.Node, error) {
+		adder, err := NewAdder(ctx, nil, bs, dserv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder.Pin = false
+		adder.Chunker = chunkerStr
+		adder.Layout = layout
+		return adder.AddAllAndPin(files.NewBytesFile(data))
+	}
+
+	for _, layout := range []string{"", "testflat"} {
+		nd, err := add("testfixed-100", layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The balanced layout has at most 174 links per node.
+		links := len(nd.Links())
+		if layout == "" && links != 2 || layout == "testflat" && links != 200 {
+			t.Errorf("%d links with the layout %q", links, layout)
+		}
+		r, err := uio.NewDagReader(ctx, nd, dserv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("the data added with the layout %q doesn't match", layout)
+		}
+	}
+
+	if _, err := add("testfixed-x", ""); err == nil {
+		t.Error("added with invalid chunker params")
+	}
+	if _, err := add("", "unknown"); err == nil {
+		t.Error("added with an unknown layout")
+	}
+}
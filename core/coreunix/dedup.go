@@ -0,0 +1,152 @@
+package coreunix
+
+import (
+	"context"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// DedupStats counts the blocks written while adding, and how many of them
+// were already stored.
+type DedupStats struct {
+	Blocks         uint64
+	Bytes          uint64
+	ExistingBlocks uint64
+	ExistingBytes  uint64
+}
+
+// Add returns the sum of two statistics.
+func (s DedupStats) Add(o DedupStats) DedupStats {
+	return DedupStats{
+		Blocks:         s.Blocks + o.Blocks,
+		Bytes:          s.Bytes + o.Bytes,
+		ExistingBlocks: s.ExistingBlocks + o.ExistingBlocks,
+		ExistingBytes:  s.ExistingBytes + o.ExistingBytes,
+	}
+}
+
+func (s *DedupStats) record(size int, existed bool) {
+	s.Blocks++
+	s.Bytes += uint64(size)
+	if existed {
+		s.ExistingBlocks++
+		s.ExistingBytes += uint64(size)
+	}
+}
+
+// DedupReport records how many of the blocks written while adding were
+// already stored, for each file and in total. Blocks are counted once, even
+// when written several times: a block written earlier in the same add counts
+// as already stored for the file, but not for the total.
+type DedupReport struct {
+	mu    sync.Mutex
+	total DedupStats
+	seen  map[cid.Cid]struct{}
+
+	file     DedupStats
+	fileSeen map[cid.Cid]struct{}
+	files    map[string]DedupStats
+}
+
+// NewDedupReport returns an empty report.
+func NewDedupReport() *DedupReport {
+	return &DedupReport{
+		seen:     make(map[cid.Cid]struct{}),
+		fileSeen: make(map[cid.Cid]struct{}),
+		files:    make(map[string]DedupStats),
+	}
+}
+
+// DedupReportOption is the Unixfs().Add option making the files added record
+// their deduplication in the report.
+func DedupReportOption(r *DedupReport) options.UnixfsAddOption {
+	return addOption("dedup report", func(settings *AddSettings) error {
+		settings.Dedup = r
+		return nil
+	})
+}
+
+// Total returns the statistics of all the blocks written, including the
+// ones of directories.
+func (r *DedupReport) Total() DedupStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.total
+}
+
+// File returns the statistics of a file, by the name in its AddEvent.
+func (r *DedupReport) File(name string) (DedupStats, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.files[name]
+	return s, ok
+}
+
+func (r *DedupReport) record(nd ipld.Node, existed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := len(nd.RawData())
+	_, seen := r.seen[nd.Cid()]
+	if !seen {
+		r.seen[nd.Cid()] = struct{}{}
+		r.total.record(size, existed)
+	}
+	if _, ok := r.fileSeen[nd.Cid()]; !ok {
+		r.fileSeen[nd.Cid()] = struct{}{}
+		r.file.record(size, existed || seen)
+	}
+}
+
+// The adder writes the blocks of one file at a time.
+func (r *DedupReport) startFile() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.file = DedupStats{}
+	r.fileSeen = make(map[cid.Cid]struct{})
+}
+
+func (r *DedupReport) endFile(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[name] = r.file
+}
+
+// DAGService wraps the DAG service nodes are added to, recording whether
+// each node written was already in the existing blockstore. The blockservice
+// skips the blocks it already has, so the blockstore can't be wrapped instead.
+func (r *DedupReport) DAGService(ds ipld.DAGService, existing bstore.Blockstore) ipld.DAGService {
+	return &dedupDAGService{DAGService: ds, existing: existing, report: r}
+}
+
+type dedupDAGService struct {
+	ipld.DAGService
+	existing bstore.Blockstore
+	report   *DedupReport
+}
+
+func (ds *dedupDAGService) Add(ctx context.Context, nd ipld.Node) error {
+	existed, _ := ds.existing.Has(nd.Cid())
+	if err := ds.DAGService.Add(ctx, nd); err != nil {
+		return err
+	}
+	ds.report.record(nd, existed)
+	return nil
+}
+
+func (ds *dedupDAGService) AddMany(ctx context.Context, nds []ipld.Node) error {
+	existed := make([]bool, len(nds))
+	for i, nd := range nds {
+		existed[i], _ = ds.existing.Has(nd.Cid())
+	}
+	if err := ds.DAGService.AddMany(ctx, nds); err != nil {
+		return err
+	}
+	for i, nd := range nds {
+		ds.report.record(nd, existed[i])
+	}
+	return nil
+}
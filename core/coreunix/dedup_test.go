@@ -0,0 +1,56 @@
+package coreunix
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	files "github.com/ipfs/go-ipfs-files"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+func TestDedupReport(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewGCBlockstore(blockstore.NewBlockstore(syncds.MutexWrap(datastore.NewMapDatastore())), blockstore.NewGCLocker())
+	dserv := dag.NewDAGService(blockservice.New(bs, nil))
+
+	existing := randomData(600 << 10)
+	add := func(dir files.Directory) *DedupReport {
+		r := NewDedupReport()
+		adder, err := NewAdder(ctx, nil, bs, r.DAGService(dserv, bs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		adder.Pin = false
+		adder.Dedup = r
+		if _, err := adder.AddAllAndPin(dir); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := add(files.NewMapDirectory(map[string]files.Node{
+		"a": files.NewBytesFile(existing),
+	}))
+	if s, ok := r.File("a"); !ok || s.Blocks != 4 || s.ExistingBlocks != 0 {
+		t.Errorf("unexpected stats of a new file %+v", s)
+	}
+
+	r = add(files.NewMapDirectory(map[string]files.Node{
+		"b": files.NewBytesFile(append(existing, randomData(100)...)),
+		"c": files.NewBytesFile(existing),
+	}))
+	if s, _ := r.File("b"); s.Blocks != 4 || s.ExistingBlocks != 2 || s.ExistingBytes < 2*256<<10 {
+		t.Errorf("unexpected stats of a modified file %+v", s)
+	}
+	if s, _ := r.File("c"); s.Blocks != 4 || s.ExistingBlocks != 4 {
+		t.Errorf("unexpected stats of an existing file %+v", s)
+	}
+	// The blocks shared by b and c are only counted once in the total.
+	if total := r.Total(); total.Blocks != 7 || total.ExistingBlocks != 4 {
+		t.Errorf("unexpected total %+v", total)
+	}
+}
@@ -0,0 +1,71 @@
+package coreunix
+
+import (
+	"fmt"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// AddSettings are the settings of the Unixfs().Add CoreAPI of go-ipfs: the
+// ones of interface-go-ipfs-core, and the ones set with the add options of
+// this package.
+type AddSettings struct {
+	*options.UnixfsAddSettings
+
+	// LayoutName is the layout set with LayoutOption, or "" to use the
+	// Layout of the UnixfsAddSettings.
+	LayoutName string
+	// Dedup, when set, records the deduplication of the blocks added.
+	Dedup *DedupReport
+	// Preserve selects the metadata of the files to store, and Posix
+	// gives the metadata of the files without a Stat method.
+	Preserve Preserve
+	Posix    map[string]Posix
+	// Unpack is the format of the archives to unpack, or "".
+	Unpack string
+}
+
+// building maps the settings being built by AddOptions to the AddSettings
+// the options of this package set.
+var building sync.Map // *options.UnixfsAddSettings -> *AddSettings
+
+// AddOptions applies the Unixfs().Add options, including the ones of this
+// package.
+func AddOptions(opts ...options.UnixfsAddOption) (*AddSettings, cid.Prefix, error) {
+	out := new(AddSettings)
+	// options.UnixfsAddOptions allocates the settings, so the first option
+	// is the one registering them.
+	var key *options.UnixfsAddSettings
+	register := func(settings *options.UnixfsAddSettings) error {
+		key = settings
+		building.Store(settings, out)
+		return nil
+	}
+	defer func() {
+		if key != nil {
+			building.Delete(key)
+		}
+	}()
+
+	settings, prefix, err := options.UnixfsAddOptions(append([]options.UnixfsAddOption{register}, opts...)...)
+	if err != nil {
+		return nil, cid.Prefix{}, err
+	}
+	out.UnixfsAddSettings = settings
+	return out, prefix, nil
+}
+
+// addOption returns an option setting the AddSettings with fn. It fails when
+// the options aren't applied by AddOptions, like in the HTTP client, which
+// only knows the options of interface-go-ipfs-core.
+func addOption(name string, fn func(*AddSettings) error) options.UnixfsAddOption {
+	return func(settings *options.UnixfsAddSettings) error {
+		out, ok := building.Load(settings)
+		if !ok {
+			return fmt.Errorf("the %s add option is only supported by the CoreAPI of go-ipfs", name)
+		}
+		return fn(out.(*AddSettings))
+	}
+}
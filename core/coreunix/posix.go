@@ -0,0 +1,324 @@
+package coreunix
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	gopath "path"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	pb "github.com/ipfs/go-unixfs/pb"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// Fields of the UnixFS 1.5 metadata in the Data message. They are unknown to
+// the protobuf code of go-unixfs, which keeps them when decoding and encoding
+// nodes, so they are read and written here.
+const (
+	modeField  = 7
+	mtimeField = 8
+
+	mtimeSecondsField = 1
+	mtimeNanosField   = 2
+)
+
+// Posix is the POSIX metadata of a UnixFS node.
+type Posix struct {
+	// Mode holds the permission bits, including the setuid, setgid and
+	// sticky bits. It is only meaningful when HasMode is set.
+	Mode    os.FileMode
+	HasMode bool
+	// Mtime is the modification time, or the zero time when not set.
+	Mtime time.Time
+}
+
+// IsZero returns whether no metadata is set.
+func (p Posix) IsZero() bool {
+	return !p.HasMode && p.Mtime.IsZero()
+}
+
+// Preserve selects the metadata of the files stored when adding them.
+type Preserve struct {
+	Mode  bool
+	Mtime bool
+}
+
+// PreserveOption is the Unixfs().Add option storing the metadata selected by
+// p of the files added. The metadata is read with the Stat method of the
+// files, or given with PosixOption.
+func PreserveOption(p Preserve) options.UnixfsAddOption {
+	return addOption("preserve", func(settings *AddSettings) error {
+		settings.Preserve = p
+		return nil
+	})
+}
+
+// PosixOption is the Unixfs().Add option giving the metadata of the files
+// added, by their path relative to the file added, as returned by LocalPosix.
+// It is how the files sent to the daemon, which have no Stat method, get
+// their metadata.
+func PosixOption(m map[string]Posix) options.UnixfsAddOption {
+	return addOption("posix", func(settings *AddSettings) error {
+		settings.Posix = m
+		return nil
+	})
+}
+
+// LocalPosix returns the metadata selected by p of a file and of the files
+// in it, by their path relative to nd, "" being nd itself. Only the files
+// with a Stat method, like local files, have metadata.
+func LocalPosix(nd files.Node, p Preserve) (map[string]Posix, error) {
+	out := make(map[string]Posix)
+	var walk func(string, files.Node) error
+	walk = func(fpath string, nd files.Node) error {
+		if s, ok := nd.(interface{ Stat() os.FileInfo }); ok && s.Stat() != nil {
+			if meta := PosixFromStat(s.Stat(), p); !meta.IsZero() {
+				out[fpath] = meta
+			}
+		}
+		dir, ok := nd.(files.Directory)
+		if !ok {
+			return nil
+		}
+		it := dir.Entries()
+		for it.Next() {
+			child := it.Node()
+			err := walk(gopath.Join(fpath, it.Name()), child)
+			// The entries of local directories are opened when
+			// listed, and opened again when added.
+			child.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return it.Err()
+	}
+	if !(p.Mode || p.Mtime) {
+		return out, nil
+	}
+	return out, walk("", nd)
+}
+
+// PosixFromStat returns the metadata of a local file selected by p. Only the
+// metadata of regular files and directories is kept.
+func PosixFromStat(fi os.FileInfo, p Preserve) Posix {
+	var out Posix
+	if !(fi.Mode().IsRegular() || fi.IsDir()) {
+		return out
+	}
+	if p.Mode {
+		out.Mode = fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		out.HasMode = true
+	}
+	if p.Mtime {
+		out.Mtime = fi.ModTime()
+	}
+	return out
+}
+
+// UnixMode returns the mode as stored in UnixFS, with the POSIX bits.
+func UnixMode(m os.FileMode) uint32 {
+	mode := uint32(m & os.ModePerm)
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// FileMode returns the os.FileMode of a mode stored in UnixFS.
+func FileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode) & os.ModePerm
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+var errInvalidPosix = errors.New("invalid unixfs metadata")
+
+// PosixFromNode returns the metadata of a UnixFS node. Raw nodes have none.
+func PosixFromNode(nd ipld.Node) (Posix, error) {
+	var p Posix
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return p, nil
+	}
+	err := forEachField(pn.Data(), func(f field) error {
+		switch {
+		case f.num == modeField && f.wire == 0:
+			p.Mode = FileMode(uint32(f.value))
+			p.HasMode = true
+		case f.num == mtimeField && f.wire == 2:
+			var sec int64
+			var nsec uint32
+			err := forEachField(f.content, func(f field) error {
+				switch {
+				case f.num == mtimeSecondsField && f.wire == 0:
+					sec = int64(f.value)
+				case f.num == mtimeNanosField && f.wire == 5:
+					nsec = uint32(f.value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if nsec >= 1e9 {
+				return errInvalidPosix
+			}
+			p.Mtime = time.Unix(sec, int64(nsec))
+		}
+		return nil
+	})
+	return p, err
+}
+
+// WithPosix returns a copy of a UnixFS node with the given metadata. Raw
+// nodes are wrapped in a file node, which can hold the metadata.
+func WithPosix(nd ipld.Node, p Posix) (*dag.ProtoNode, error) {
+	var pn *dag.ProtoNode
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		pn = nd.Copy().(*dag.ProtoNode)
+	case *dag.RawNode:
+		size := uint64(len(nd.RawData()))
+		fsn := ft.NewFSNode(pb.Data_File)
+		fsn.AddBlockSize(size)
+		data, err := fsn.GetBytes()
+		if err != nil {
+			return nil, err
+		}
+		pn = dag.NodeWithData(data)
+		prefix := nd.Cid().Prefix()
+		prefix.Codec = cid.DagProtobuf
+		pn.SetCidBuilder(prefix)
+		if err := pn.AddRawLink("", &ipld.Link{Size: size, Cid: nd.Cid()}); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("not a unixfs node: %s", nd.Cid())
+	}
+	if _, err := ft.FSNodeFromBytes(pn.Data()); err != nil {
+		return nil, err
+	}
+
+	// Drop the current metadata, then append the new one.
+	var data []byte
+	err := forEachField(pn.Data(), func(f field) error {
+		if f.num != modeField && f.num != mtimeField {
+			data = append(data, f.raw...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.HasMode {
+		data = appendTag(data, modeField, 0)
+		data = appendUvarint(data, uint64(UnixMode(p.Mode)))
+	}
+	if !p.Mtime.IsZero() {
+		mtime := appendTag(nil, mtimeSecondsField, 0)
+		mtime = appendUvarint(mtime, uint64(p.Mtime.Unix()))
+		if nsec := p.Mtime.Nanosecond(); nsec != 0 {
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], uint32(nsec))
+			mtime = append(appendTag(mtime, mtimeNanosField, 5), b[:]...)
+		}
+		data = appendTag(data, mtimeField, 2)
+		data = appendUvarint(data, uint64(len(mtime)))
+		data = append(data, mtime...)
+	}
+	pn.SetData(data)
+	return pn, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendTag(b []byte, num int, wire int) []byte {
+	return appendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+// field is a field of an encoded protobuf message.
+type field struct {
+	num  int
+	wire int
+	// value holds varints and fixed size values, and content the content
+	// of length delimited fields.
+	value   uint64
+	content []byte
+	// raw is the whole encoded field.
+	raw []byte
+}
+
+// forEachField calls fn with the fields of an encoded protobuf message.
+func forEachField(msg []byte, fn func(field) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errInvalidPosix
+		}
+		f := field{num: int(tag >> 3), wire: int(tag & 7)}
+		l := n
+
+		switch f.wire {
+		case 0:
+			v, m := binary.Uvarint(msg[l:])
+			if m <= 0 {
+				return errInvalidPosix
+			}
+			f.value = v
+			l += m
+		case 1:
+			if len(msg) < l+8 {
+				return errInvalidPosix
+			}
+			f.value = binary.LittleEndian.Uint64(msg[l:])
+			l += 8
+		case 2:
+			size, m := binary.Uvarint(msg[l:])
+			if m <= 0 || uint64(len(msg)-l-m) < size {
+				return errInvalidPosix
+			}
+			l += m
+			f.content = msg[l : l+int(size)]
+			l += int(size)
+		case 5:
+			if len(msg) < l+4 {
+				return errInvalidPosix
+			}
+			f.value = uint64(binary.LittleEndian.Uint32(msg[l:]))
+			l += 4
+		default:
+			return errInvalidPosix
+		}
+
+		f.raw = msg[:l]
+		if err := fn(f); err != nil {
+			return err
+		}
+		msg = msg[l:]
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package coreunix
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+func TestPosixRoundTrip(t *testing.T) {
+	nd := dag.NodeWithData(ft.FilePBData([]byte("data"), 4))
+	mtime := time.Unix(1000000000, 42)
+	p := Posix{Mode: 0755 | os.ModeSetuid, HasMode: true, Mtime: mtime}
+
+	withP, err := WithPosix(nd, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := PosixFromNode(withP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mode != p.Mode || !got.HasMode || !got.Mtime.Equal(mtime) {
+		t.Errorf("expected %+v, got %+v", p, got)
+	}
+
+	// The other fields are kept.
+	fsn, err := ft.FSNodeFromBytes(withP.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fsn.Data()) != "data" || fsn.FileSize() != 4 {
+		t.Error("the unixfs data was changed")
+	}
+
+	// Replacing the metadata drops the previous one.
+	withP, err = WithPosix(withP, Posix{Mtime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := PosixFromNode(withP); got.HasMode || !got.Mtime.Equal(mtime) {
+		t.Errorf("unexpected metadata %+v", got)
+	}
+	if got, _ := PosixFromNode(nd); !got.IsZero() {
+		t.Error("the original node should not be changed")
+	}
+}
+
+func TestPosixRawNode(t *testing.T) {
+	raw := dag.NewRawNode([]byte("raw data"))
+	nd, err := WithPosix(raw, Posix{Mode: 0600, HasMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := ft.FSNodeFromBytes(nd.Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.FileSize() != 8 || len(nd.Links()) != 1 || !nd.Links()[0].Cid.Equals(raw.Cid()) {
+		t.Error("raw nodes should be wrapped in a file node")
+	}
+	if nd.Cid().Version() != 1 {
+		t.Error("the wrapping node should keep the CID version")
+	}
+}
+
+func TestAddPreserve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "tool"), []byte("#!/bin/sh"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"sub/tool", "sub", ""} {
+		if err := os.Chtimes(filepath.Join(dir, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	bs := blockstore.NewGCBlockstore(blockstore.NewBlockstore(syncds.MutexWrap(datastore.NewMapDatastore())), blockstore.NewGCLocker())
+	dserv := dag.NewDAGService(blockservice.New(bs, nil))
+	adder, err := NewAdder(ctx, nil, bs, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adder.Pin = false
+	adder.Preserve = Preserve{Mode: true, Mtime: true}
+
+	st, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := files.NewSerialFile(dir, false, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := adder.AddAllAndPin(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]os.FileMode{"": 0755, "sub": 0700, "sub/tool": 0750}
+	for p, mode := range expected {
+		nd := root
+		if p != "" {
+			if nd, err = resolve(ctx, dserv, root, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := PosixFromNode(nd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == "" {
+			mode = st.Mode().Perm()
+		}
+		if got.Mode != mode || !got.Mtime.Equal(mtime) {
+			t.Errorf("unexpected metadata of %q: %+v", p, got)
+		}
+	}
+}
+
+func resolve(ctx context.Context, ds ipld.DAGService, nd ipld.Node, p string) (ipld.Node, error) {
+	for _, name := range strings.Split(p, "/") {
+		lnk, _, err := nd.ResolveLink([]string{name})
+		if err != nil {
+			return nil, err
+		}
+		if nd, err = lnk.GetNode(ctx, ds); err != nil {
+			return nil, err
+		}
+	}
+	return nd, nil
+}
@@ -0,0 +1,461 @@
+package coreunix
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+
+	files "github.com/ipfs/go-ipfs-files"
+	"github.com/ipfs/go-ipfs-posinfo"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-mfs"
+	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// Formats of the archives unpacked when adding.
+const (
+	// UnpackTar is the format of tar archives, optionally compressed with
+	// gzip.
+	UnpackTar = "tar"
+	// UnpackTgz is the format of tar archives compressed with gzip.
+	UnpackTgz = "tgz"
+	// UnpackZip is the format of zip archives.
+	UnpackZip = "zip"
+)
+
+// UnpackOption is the Unixfs().Add option unpacking the files added as
+// archives of the given format, into directories.
+func UnpackOption(format string) options.UnixfsAddOption {
+	return addOption("unpack", func(settings *AddSettings) error {
+		switch format {
+		case UnpackTar, UnpackTgz, UnpackZip:
+		default:
+			return fmt.Errorf("unknown archive format %q, expected tar, tgz or zip", format)
+		}
+		settings.Unpack = format
+		return nil
+	})
+}
+
+// archiveEntry is an entry of an archive being unpacked.
+type archiveEntry struct {
+	// path is the cleaned path of the entry, "" for the root.
+	path string
+	typ  byte
+	// linkname is the target of symlinks, and the path of the entry hard
+	// links point to.
+	linkname string
+	posix    Posix
+	data     io.Reader
+}
+
+// Types of archive entries, as in tar.
+const (
+	entryFile     = tar.TypeReg
+	entryDir      = tar.TypeDir
+	entrySymlink  = tar.TypeSymlink
+	entryHardlink = tar.TypeLink
+)
+
+// addArchive adds the archive read from f, in the format of adder.Unpack, to
+// the MFS root.
+func (adder *Adder) addArchive(f files.Node) error {
+	file := files.ToFile(f)
+	if file == nil {
+		return fmt.Errorf("only files can be unpacked as %s archives", adder.Unpack)
+	}
+	defer file.Close()
+
+	var next func() (*archiveEntry, error)
+	switch adder.Unpack {
+	case UnpackTar:
+		r, err := maybeGunzip(file)
+		if err != nil {
+			return err
+		}
+		next = tarEntries(r)
+	case UnpackTgz:
+		r, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("reading the tgz archive: %w", err)
+		}
+		next = tarEntries(r)
+	case UnpackZip:
+		zr, cleanup, err := spoolZip(file)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		next = zipEntries(zr)
+	default:
+		return fmt.Errorf("unknown archive format %q", adder.Unpack)
+	}
+
+	mr, err := adder.mfsRoot()
+	if err != nil {
+		return err
+	}
+
+	// The metadata of directories is set once all their entries are added,
+	// as the directories may appear after them.
+	dirs := make(map[string]Posix)
+	for {
+		e, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := adder.prepareNode(); err != nil {
+			return err
+		}
+		// Later entries replace earlier ones, as when extracting.
+		if e.typ != entryDir {
+			if err := unlinkEntry(mr, e.path); err != nil {
+				return err
+			}
+		}
+
+		switch e.typ {
+		case entryDir:
+			if e.path != "" {
+				err := mfs.Mkdir(mr, e.path, mfs.MkdirOpts{
+					Mkparents:  true,
+					CidBuilder: adder.CidBuilder,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if !e.posix.IsZero() {
+				dirs[e.path] = e.posix
+			}
+		case entryFile:
+			if err := adder.addArchiveFile(e); err != nil {
+				return err
+			}
+		case entrySymlink:
+			sdata, err := unixfs.SymlinkData(e.linkname)
+			if err != nil {
+				return err
+			}
+			nd := dag.NodeWithData(sdata)
+			nd.SetCidBuilder(adder.CidBuilder)
+			if err := adder.dagService.Add(adder.ctx, nd); err != nil {
+				return err
+			}
+			if err := adder.addNode(nd, e.path); err != nil {
+				return err
+			}
+		case entryHardlink:
+			target, err := mfs.Lookup(mr, e.linkname)
+			if err != nil {
+				return fmt.Errorf("hard link %s points to %s: %w", e.path, e.linkname, err)
+			}
+			nd, err := target.GetNode()
+			if err != nil {
+				return err
+			}
+			if err := adder.addNode(nd, e.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return adder.setDirsPosix(mr, dirs)
+}
+
+func (adder *Adder) addArchiveFile(e *archiveEntry) error {
+	var reader io.Reader = e.data
+	if adder.Progress {
+		reader = &progressReader{file: reader, path: e.path, out: adder.Out}
+	}
+
+	if adder.Dedup != nil {
+		adder.Dedup.startFile()
+	}
+	nd, err := adder.add(reader, e.path)
+	if err != nil {
+		return err
+	}
+	if adder.Dedup != nil {
+		adder.Dedup.endFile(e.path)
+	}
+
+	if !e.posix.IsZero() {
+		if pi, ok := nd.(*posinfo.FilestoreNode); ok {
+			nd = pi.Node
+		}
+		if nd, err = adder.withPosix(nd, e.posix); err != nil {
+			return err
+		}
+	}
+	return adder.addNode(nd, e.path)
+}
+
+// setDirsPosix sets the metadata of directories, the deepest first so that
+// their parents get their final nodes.
+func (adder *Adder) setDirsPosix(mr *mfs.Root, dirs map[string]Posix) error {
+	paths := make([]string, 0, len(dirs))
+	for p := range dirs {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") > strings.Count(paths[j], "/") ||
+			strings.Count(paths[i], "/") == strings.Count(paths[j], "/") && paths[i] > paths[j]
+	})
+
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		fsn, err := mfs.Lookup(mr, p)
+		if err != nil {
+			return err
+		}
+		nd, err := fsn.GetNode()
+		if err != nil {
+			return err
+		}
+		pn, err := adder.withPosix(nd, dirs[p])
+		if err != nil {
+			return err
+		}
+		parent, err := mfs.Lookup(mr, parentPath(p))
+		if err != nil {
+			return err
+		}
+		pdir, ok := parent.(*mfs.Directory)
+		if !ok {
+			return fmt.Errorf("%s is not a directory", parentPath(p))
+		}
+		name := gopath.Base(p)
+		if err := pdir.Unlink(name); err != nil {
+			return err
+		}
+		if err := pdir.AddChild(name, pn); err != nil {
+			return err
+		}
+	}
+
+	// The root is replaced with a root holding its metadata.
+	if p, ok := dirs[""]; ok {
+		if err := mr.GetDirectory().Flush(); err != nil {
+			return err
+		}
+		nd, err := mr.GetDirectory().GetNode()
+		if err != nil {
+			return err
+		}
+		pn, err := adder.withPosix(nd, p)
+		if err != nil {
+			return err
+		}
+		root, err := mfs.NewRoot(adder.ctx, adder.dagService, pn, nil)
+		if err != nil {
+			return err
+		}
+		adder.mroot = root
+	}
+	return nil
+}
+
+// unlinkEntry removes the entry at p if there is one.
+func unlinkEntry(mr *mfs.Root, p string) error {
+	parent, err := mfs.Lookup(mr, parentPath(p))
+	if err != nil {
+		// The parent is created when adding the entry.
+		return nil
+	}
+	pdir, ok := parent.(*mfs.Directory)
+	if !ok {
+		return fmt.Errorf("%s is not a directory", parentPath(p))
+	}
+	if _, err := pdir.Child(gopath.Base(p)); err != nil {
+		return nil
+	}
+	return pdir.Unlink(gopath.Base(p))
+}
+
+// parentPath returns the path of the directory holding the entry at p.
+func parentPath(p string) string {
+	dir := gopath.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maybeGunzip decompresses r if it's compressed with gzip.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(head, gzipMagic) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// tarEntries returns the entries of a tar archive, one by one.
+func tarEntries(r io.Reader) func() (*archiveEntry, error) {
+	tr := tar.NewReader(r)
+	return func() (*archiveEntry, error) {
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				return nil, err
+			}
+			p, err := archivePath(h.Name)
+			if err != nil {
+				return nil, err
+			}
+			e := &archiveEntry{path: p, typ: h.Typeflag, data: tr}
+			switch h.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				e.typ = entryFile
+			case tar.TypeDir:
+			case tar.TypeSymlink:
+				e.linkname = h.Linkname
+			case tar.TypeLink:
+				if e.linkname, err = archivePath(h.Linkname); err != nil {
+					return nil, err
+				}
+			default:
+				log.Warnf("skipping %s: unsupported tar entry type %q", h.Name, h.Typeflag)
+				continue
+			}
+			if p == "" && e.typ != entryDir {
+				return nil, fmt.Errorf("invalid tar entry name %q", h.Name)
+			}
+			if e.typ != entrySymlink {
+				e.posix = Posix{
+					Mode:    FileMode(uint32(h.Mode) & 07777),
+					HasMode: true,
+					Mtime:   h.ModTime,
+				}
+			}
+			return e, nil
+		}
+	}
+}
+
+// spoolZip copies a zip archive to a temporary file to read it, as its
+// central directory is at its end. The returned function removes the file.
+func spoolZip(r io.Reader) (*zip.Reader, func(), error) {
+	tmp, err := ioutil.TempFile("", "ipfs-unpack-*.zip")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		var zr *zip.Reader
+		if zr, err = zip.NewReader(tmp, size); err == nil {
+			return zr, cleanup, nil
+		}
+	}
+	cleanup()
+	return nil, nil, err
+}
+
+// Systems of the creators of zip entries with unix modes.
+const (
+	zipCreatorUnix   = 3
+	zipCreatorMacOSX = 19
+)
+
+// maxSymlinkSize is the size above which zip entries can't be symbolic links.
+const maxSymlinkSize = 4096
+
+// zipEntries returns the entries of a zip archive, one by one.
+func zipEntries(zr *zip.Reader) func() (*archiveEntry, error) {
+	var i int
+	var prev io.Closer
+	return func() (*archiveEntry, error) {
+		if prev != nil {
+			prev.Close()
+			prev = nil
+		}
+		if i == len(zr.File) {
+			return nil, io.EOF
+		}
+		f := zr.File[i]
+		i++
+
+		p, err := archivePath(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		mode := f.Mode()
+		e := &archiveEntry{path: p, typ: entryFile}
+		switch {
+		case mode.IsDir():
+			e.typ = entryDir
+		case p == "":
+			return nil, fmt.Errorf("invalid zip entry name %q", f.Name)
+		case mode&os.ModeSymlink != 0:
+			e.typ = entrySymlink
+		}
+
+		if e.typ != entrySymlink {
+			e.posix.Mtime = f.Modified
+			switch f.CreatorVersion >> 8 {
+			case zipCreatorUnix, zipCreatorMacOSX:
+				e.posix.Mode = mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+				e.posix.HasMode = true
+			}
+		}
+		if e.typ == entryDir {
+			return e, nil
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		if e.typ == entrySymlink {
+			defer rc.Close()
+			target, err := ioutil.ReadAll(io.LimitReader(rc, maxSymlinkSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(target) > maxSymlinkSize {
+				return nil, fmt.Errorf("target of symbolic link %s too long", f.Name)
+			}
+			e.linkname = string(target)
+			return e, nil
+		}
+		prev = rc
+		e.data = rc
+		return e, nil
+	}
+}
+
+// archivePath cleans the path of an archive entry, which is relative to the
+// root of the archive.
+func archivePath(name string) (string, error) {
+	p := gopath.Clean("/" + name)
+	if strings.Contains(name, "\x00") {
+		return "", fmt.Errorf("invalid entry name %q", name)
+	}
+	return strings.TrimPrefix(p, "/"), nil
+}
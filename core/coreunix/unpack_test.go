@@ -0,0 +1,241 @@
+package coreunix
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+func testTar(t *testing.T, mtime time.Time) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		h    tar.Header
+		data string
+	}{
+		// The directory comes after its content, and the first file is
+		// replaced.
+		{tar.Header{Name: "dir/old", Typeflag: tar.TypeReg, Mode: 0644}, "replaced"},
+		{tar.Header{Name: "./dir/file", Typeflag: tar.TypeReg, Mode: 04750}, "content"},
+		{tar.Header{Name: "dir/old", Typeflag: tar.TypeReg, Mode: 0600}, "new"},
+		{tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0700}, ""},
+		{tar.Header{Name: "../link", Typeflag: tar.TypeSymlink, Linkname: "dir/file"}, ""},
+		{tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "dir/file"}, ""},
+		{tar.Header{Name: "fifo", Typeflag: tar.TypeFifo}, ""},
+	}
+	for _, e := range entries {
+		h := e.h
+		h.ModTime = mtime
+		h.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func addArchive(t *testing.T, ctx context.Context, dserv ipld.DAGService, format string, data []byte) ipld.Node {
+	bs := blockstore.NewGCBlockstore(blockstore.NewBlockstore(syncds.MutexWrap(datastore.NewMapDatastore())), blockstore.NewGCLocker())
+	adder, err := NewAdder(ctx, nil, bs, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adder.Pin = false
+	adder.Unpack = format
+	root, err := adder.AddAllAndPin(files.NewBytesFile(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestUnpackTar(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(syncds.MutexWrap(datastore.NewMapDatastore()))
+	dserv := dag.NewDAGService(blockservice.New(bs, nil))
+	mtime := time.Unix(1500000000, 0)
+
+	data := testTar(t, mtime)
+	root := addArchive(t, ctx, dserv, UnpackTar, data)
+
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	if _, err := gzw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if groot := addArchive(t, ctx, dserv, UnpackTgz, gz.Bytes()); !groot.Cid().Equals(root.Cid()) {
+		t.Errorf("compressed archive added as %s, expected %s", groot.Cid(), root.Cid())
+	}
+
+	adder, err := NewAdder(ctx, nil, blockstore.NewGCBlockstore(bs, blockstore.NewGCLocker()), dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adder.Pin = false
+	adder.Unpack = UnpackTgz
+	if _, err := adder.AddAllAndPin(files.NewBytesFile(data)); err == nil {
+		t.Error("expected a plain tar archive to be refused as tgz")
+	}
+
+	names := make(map[string]bool)
+	for _, l := range root.Links() {
+		names[l.Name] = true
+	}
+	if len(names) != 3 || !names["dir"] || !names["link"] || !names["hard"] {
+		t.Fatalf("unexpected root entries: %v", names)
+	}
+
+	expected := map[string]os.FileMode{
+		"dir":      0700,
+		"dir/file": os.ModeSetuid | 0750,
+		"dir/old":  0600,
+	}
+	for p, mode := range expected {
+		nd, err := resolve(ctx, dserv, root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := PosixFromNode(nd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.HasMode || got.Mode != mode || !got.Mtime.Equal(mtime) {
+			t.Errorf("unexpected metadata of %q: %+v", p, got)
+		}
+	}
+
+	old, err := resolve(ctx, dserv, root, "dir/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := uio.NewDagReader(ctx, old, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "new" {
+		t.Errorf("dir/old holds %q, expected the last entry", content)
+	}
+
+	file, err := resolve(ctx, dserv, root, "dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hard, err := resolve(ctx, dserv, root, "hard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hard.Cid().Equals(file.Cid()) {
+		t.Errorf("hard link added as %s, expected %s", hard.Cid(), file.Cid())
+	}
+
+	link, err := resolve(ctx, dserv, root, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := ft.FSNodeFromBytes(link.(*dag.ProtoNode).Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Type() != ft.TSymlink || string(fsn.Data()) != "dir/file" {
+		t.Errorf("unexpected symlink: %v %q", fsn.Type(), fsn.Data())
+	}
+}
+
+func TestUnpackZip(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(syncds.MutexWrap(datastore.NewMapDatastore()))
+	dserv := dag.NewDAGService(blockservice.New(bs, nil))
+	mtime := time.Unix(1500000000, 0)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	entries := []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{"dir/", os.ModeDir | 0700, ""},
+		{"dir/file", os.ModeSetuid | 0750, "content"},
+		{"link", os.ModeSymlink | 0777, "dir/file"},
+		// Entries created on other systems have no mode.
+		{"dos.txt", 0, "text"},
+	}
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: mtime}
+		if e.mode != 0 {
+			h.SetMode(e.mode)
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := addArchive(t, ctx, dserv, UnpackZip, buf.Bytes())
+
+	expected := map[string]Posix{
+		"dir":      {Mode: 0700, HasMode: true, Mtime: mtime},
+		"dir/file": {Mode: os.ModeSetuid | 0750, HasMode: true, Mtime: mtime},
+		"dos.txt":  {Mtime: mtime},
+	}
+	for p, exp := range expected {
+		nd, err := resolve(ctx, dserv, root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := PosixFromNode(nd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.HasMode != exp.HasMode || got.Mode != exp.Mode || !got.Mtime.Equal(exp.Mtime) {
+			t.Errorf("unexpected metadata of %q: %+v", p, got)
+		}
+	}
+
+	link, err := resolve(ctx, dserv, root, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := ft.FSNodeFromBytes(link.(*dag.ProtoNode).Data())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Type() != ft.TSymlink || string(fsn.Data()) != "dir/file" {
+		t.Errorf("unexpected symlink: %v %q", fsn.Type(), fsn.Data())
+	}
+}
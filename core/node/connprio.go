@@ -0,0 +1,44 @@
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-ipfs/connprio"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/libp2p/go-libp2p-core/host"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"go.uber.org/fx"
+)
+
+type connPrioritiesIn struct {
+	fx.In
+
+	Lc     fx.Lifecycle
+	Repo   repo.Repo
+	Host   host.Host
+	PubSub *pubsub.PubSub `optional:"true"`
+}
+
+// ConnPriorities constructs the connection priorities configured in the repo
+// and hooks them into fx's lifetime management system.
+func ConnPriorities(in connPrioritiesIn) (*connprio.Priorities, error) {
+	var cfg connprio.Config
+	if err := repo.ConfigSection(in.Repo, connprio.ConfigKey, &cfg); err != nil {
+		return nil, fmt.Errorf("reading %s config: %w", connprio.ConfigKey, err)
+	}
+
+	prio, err := connprio.New(in.Host, in.PubSub, cfg)
+	if err != nil {
+		return nil, err
+	}
+	in.Lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			return prio.Start()
+		},
+		OnStop: func(context.Context) error {
+			return prio.Stop()
+		},
+	})
+	return prio, nil
+}
@@ -22,7 +22,14 @@ import (
 	"github.com/libp2p/go-libp2p-core/routing"
 	"go.uber.org/fx"
 
+	"github.com/ipfs/go-ipfs/connprio"
 	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/exchange/gateways"
+	"github.com/ipfs/go-ipfs/exchange/policy"
+	"github.com/ipfs/go-ipfs/exchange/sessions"
+	"github.com/ipfs/go-ipfs/mfs/journal"
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+	"github.com/ipfs/go-ipfs/mfs/snapshot"
 	"github.com/ipfs/go-ipfs/repo"
 )
 
@@ -85,23 +92,86 @@ func Dag(bs blockservice.BlockService) format.DAGService {
 	return merkledag.NewDAGService(bs)
 }
 
+// BitswapPolicy creates the policy deciding what bitswap serves to other peers
+func BitswapPolicy(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, bs blockstore.GCBlockstore) (*policy.Policy, error) {
+	pol := policy.New()
+	if err := pol.Reload(helpers.LifecycleCtx(mctx, lc), repo, bs); err != nil {
+		return nil, err
+	}
+	return pol, nil
+}
+
+type onlineExchangeOut struct {
+	fx.Out
+
+	Exchange exchange.Interface
+	Bitswap  *bitswap.Bitswap
+	Sessions *sessions.Tracker
+	Gateways *gateways.Exchange
+}
+
 // OnlineExchange creates new LibP2P backed block exchange (BitSwap)
 func OnlineExchange(provide bool) interface{} {
-	return func(mctx helpers.MetricsCtx, lc fx.Lifecycle, host host.Host, rt routing.Routing, bs blockstore.GCBlockstore) exchange.Interface {
-		bitswapNetwork := network.NewFromIpfsHost(host, rt)
-		exch := bitswap.New(helpers.LifecycleCtx(mctx, lc), bitswapNetwork, bs, bitswap.ProvideEnabled(provide))
+	return func(mctx helpers.MetricsCtx, lc fx.Lifecycle, r repo.Repo, host host.Host, rt routing.Routing, bs blockstore.GCBlockstore, pol *policy.Policy, prio *connprio.Priorities) (onlineExchangeOut, error) {
+		var gwcfg gateways.Config
+		if err := repo.ConfigSection(r, gateways.ConfigKey, &gwcfg); err != nil {
+			return onlineExchangeOut{}, fmt.Errorf("reading %s config: %w", gateways.ConfigKey, err)
+		}
+
+		tracker := sessions.New()
+		bitswapNetwork := tracker.WrapNetwork(prio.WrapNetwork(pol.WrapNetwork(network.NewFromIpfsHost(host, rt))))
+		exch := bitswap.New(helpers.LifecycleCtx(mctx, lc), bitswapNetwork, bs, bitswap.ProvideEnabled(provide)).(*bitswap.Bitswap)
 		lc.Append(fx.Hook{
 			OnStop: func(ctx context.Context) error {
 				return exch.Close()
 			},
 		})
-		return exch
 
+		gws, err := gateways.New(exch, gwcfg)
+		if err != nil {
+			return onlineExchangeOut{}, err
+		}
+		tracker.SetExchange(gws)
+
+		return onlineExchangeOut{
+			Exchange: tracker,
+			Bitswap:  exch,
+			Sessions: tracker,
+			Gateways: gws,
+		}, nil
 	}
 }
 
+// FilesSnapshots creates the manager of the MFS snapshots, taking automatic
+// snapshots as configured
+func FilesSnapshots(lc fx.Lifecycle, r repo.Repo, pinning pin.Pinner, dag format.DAGService) (*snapshot.Manager, error) {
+	var cfg snapshot.Config
+	if err := repo.ConfigSection(r, snapshot.ConfigKey, &cfg); err != nil {
+		return nil, fmt.Errorf("reading %s config: %w", snapshot.ConfigKey, err)
+	}
+
+	snaps, err := snapshot.NewManager(r.Datastore(), pinning, dag, cfg)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			return snaps.Start()
+		},
+		OnStop: func(context.Context) error {
+			return snaps.Stop()
+		},
+	})
+	return snaps, nil
+}
+
+// FilesJournal opens the journal of the changes to the MFS root
+func FilesJournal(r repo.Repo) (*journal.Journal, error) {
+	return journal.New(r.Datastore())
+}
+
 // Files loads persisted MFS root
-func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.DAGService) (*mfs.Root, error) {
+func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.DAGService, snaps *snapshot.Manager) (*mfs.Root, error) {
 	dsk := datastore.NewKey("/local/filesroot")
 	pf := func(ctx context.Context, c cid.Cid) error {
 		rootDS := repo.Datastore()
@@ -115,7 +185,11 @@ func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.
 		if err := rootDS.Put(dsk, c.Bytes()); err != nil {
 			return err
 		}
-		return rootDS.Sync(dsk)
+		if err := rootDS.Sync(dsk); err != nil {
+			return err
+		}
+		snaps.Published(ctx, c)
+		return nil
 	}
 
 	var nd *merkledag.ProtoNode
@@ -151,12 +225,16 @@ func Files(mctx helpers.MetricsCtx, lc fx.Lifecycle, repo repo.Repo, dag format.
 	}
 
 	root, err := mfs.NewRoot(ctx, dag, nd, pf)
+	if err != nil {
+		return nil, err
+	}
+	snaps.SetRoot(root)
 
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
-			return root.Close()
+			return rootlock.Close(root)
 		},
 	})
 
-	return root, err
+	return root, nil
 }
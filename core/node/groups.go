@@ -263,12 +263,15 @@ func Online(bcfg *BuildCfg, cfg *config.Config) fx.Option {
 	shouldBitswapProvide := !cfg.Experimental.StrategicProviding
 
 	return fx.Options(
+		fx.Provide(BitswapPolicy),
+		fx.Provide(ConnPriorities),
 		fx.Provide(OnlineExchange(shouldBitswapProvide)),
 		maybeProvide(Graphsync, cfg.Experimental.GraphsyncEnabled),
 		fx.Provide(DNSResolver),
 		fx.Provide(Namesys(ipnsCacheSize)),
 		fx.Provide(Peering),
 		PeerWith(cfg.Peering.Peers...),
+		fx.Provide(PeeringGroups),
 
 		fx.Invoke(IpnsRepublisher(repubPeriod, recordLifetime)),
 
@@ -296,6 +299,8 @@ var Core = fx.Options(
 	fx.Provide(Dag),
 	fx.Provide(resolver.NewBasicResolver),
 	fx.Provide(Pinning),
+	fx.Provide(FilesSnapshots),
+	fx.Provide(FilesJournal),
 	fx.Provide(Files),
 )
 
@@ -2,10 +2,14 @@ package node
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/ipfs/go-ipfs/peering"
+	"github.com/ipfs/go-ipfs/repo"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
+	madns "github.com/multiformats/go-multiaddr-dns"
 	"go.uber.org/fx"
 )
 
@@ -32,3 +36,40 @@ func PeerWith(peers ...peer.AddrInfo) fx.Option {
 		}
 	})
 }
+
+// PeeringGroups constructs the DNS peering groups configured in the repo, and
+// refreshes them while the node runs.
+func PeeringGroups(lc fx.Lifecycle, r repo.Repo, ps *peering.PeeringService, resolver *madns.Resolver) (*peering.DNSGroups, error) {
+	var cfg peering.GroupsConfig
+	if err := repo.ConfigSection(r, peering.GroupsConfigKey, &cfg); err != nil {
+		return nil, fmt.Errorf("reading %s config: %w", peering.GroupsConfigKey, err)
+	}
+
+	var interval time.Duration
+	if cfg.RefreshInterval != "" {
+		d, err := time.ParseDuration(cfg.RefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s.RefreshInterval: %w", peering.GroupsConfigKey, err)
+		}
+		interval = d
+	}
+
+	groups := peering.NewDNSGroups(ps, resolver, interval)
+	for _, s := range cfg.DNS {
+		addr, err := peering.ParseDNSGroup(s)
+		if err != nil {
+			return nil, err
+		}
+		// Not started yet, groups are resolved on start.
+		_ = groups.Add(context.Background(), addr)
+	}
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			return groups.Start()
+		},
+		OnStop: func(context.Context) error {
+			return groups.Stop()
+		},
+	})
+	return groups, nil
+}
@@ -1,6 +1,9 @@
 package node
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/ipfs/go-datastore"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	config "github.com/ipfs/go-ipfs-config"
@@ -8,6 +11,7 @@ import (
 
 	"github.com/ipfs/go-filestore"
 	"github.com/ipfs/go-ipfs/core/node/helpers"
+	"github.com/ipfs/go-ipfs/filestore/urlstore"
 	"github.com/ipfs/go-ipfs/repo"
 	"github.com/ipfs/go-ipfs/thirdparty/cidv0v1"
 	"github.com/ipfs/go-ipfs/thirdparty/verifbs"
@@ -61,12 +65,29 @@ func GcBlockstoreCtor(bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockst
 }
 
 // GcBlockstoreCtor wraps GcBlockstore and adds Filestore support
-func FilestoreBlockstoreCtor(repo repo.Repo, bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockstore.GCBlockstore, bs blockstore.Blockstore, fstore *filestore.Filestore) {
+func FilestoreBlockstoreCtor(lc fx.Lifecycle, r repo.Repo, bb BaseBlocks) (gclocker blockstore.GCLocker, gcbs blockstore.GCBlockstore, bs blockstore.Blockstore, fstore *filestore.Filestore, ustore *urlstore.Store, err error) {
 	gclocker = blockstore.NewGCLocker()
 
+	var ucfg urlstore.Config
+	if err = repo.ConfigSection(r, urlstore.ConfigKey, &ucfg); err != nil {
+		err = fmt.Errorf("reading %s config: %w", urlstore.ConfigKey, err)
+		return
+	}
+
 	// hash security
-	fstore = filestore.NewFilestore(bb, repo.FileManager())
-	gcbs = blockstore.NewGCBlockstore(fstore, gclocker)
+	fstore = filestore.NewFilestore(bb, r.FileManager())
+	if ustore, err = urlstore.New(fstore, ucfg); err != nil {
+		return
+	}
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			return ustore.Start()
+		},
+		OnStop: func(context.Context) error {
+			return ustore.Stop()
+		},
+	})
+	gcbs = blockstore.NewGCBlockstore(ustore, gclocker)
 	gcbs = &verifbs.VerifBSGC{GCBlockstore: gcbs}
 
 	bs = gcbs
@@ -0,0 +1,487 @@
+// Package gateways implements an exchange that fetches blocks from trusted
+// HTTP gateways in addition to another exchange, usually bitswap.
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("exchange/gateways")
+
+// ConfigKey is the config key the gateways are read from.
+const ConfigKey = "Bitswap.Gateways"
+
+const (
+	// DefaultDelay gives the wrapped exchange a head start before the
+	// gateways are asked for a block.
+	DefaultDelay = time.Second
+	// DefaultTimeout bounds a single block request to a gateway.
+	DefaultTimeout = 30 * time.Second
+	// DefaultMaxConcurrency bounds the number of concurrent block requests
+	// to the gateways.
+	DefaultMaxConcurrency = 16
+
+	// maxBlockSize is the largest block we accept from a gateway.
+	maxBlockSize = 4 << 20
+
+	bitswapSource = "bitswap"
+)
+
+// Config configures the gateways used as block sources.
+type Config struct {
+	// URLs of the gateways, e.g. "https://ipfs.io". They are tried in order.
+	URLs []string
+	// Delay before asking the gateways for a block. Defaults to 1s.
+	Delay string
+	// Timeout of a single block request. Defaults to 30s.
+	Timeout string
+	// MaxConcurrency limits the concurrent block requests. Defaults to 16.
+	MaxConcurrency int
+}
+
+// SourceStat describes the blocks fetched from a single source.
+type SourceStat struct {
+	// Source is either "bitswap" or the URL of a gateway.
+	Source string
+	// Requests is the number of blocks requested from the source. It's
+	// only counted for gateways.
+	Requests uint64
+	// Blocks and Bytes count the blocks the source delivered first.
+	Blocks uint64
+	Bytes  uint64
+	Errors uint64
+	// Latency is the average time it took the source to deliver a block.
+	Latency time.Duration
+}
+
+type source struct {
+	name       string
+	url        *url.URL
+	requests   uint64
+	blocks     uint64
+	bytes      uint64
+	errors     uint64
+	latencySum time.Duration
+}
+
+func (s *source) stat() SourceStat {
+	st := SourceStat{
+		Source:   s.name,
+		Requests: s.requests,
+		Blocks:   s.blocks,
+		Bytes:    s.bytes,
+		Errors:   s.errors,
+	}
+	if s.blocks > 0 {
+		st.Latency = s.latencySum / time.Duration(s.blocks)
+	}
+	return st
+}
+
+// Exchange races the gateways against a wrapped exchange. Blocks received
+// from a gateway are verified against their CID and handed to the wrapped
+// exchange with HasBlock, which stores them and cancels the pending wants.
+//
+// With no gateway configured, it only keeps the statistics of the wrapped
+// exchange.
+type Exchange struct {
+	exchange.SessionExchange
+
+	client   *http.Client
+	delay    time.Duration
+	limit    chan struct{}
+	gateways []*source
+
+	mu      sync.Mutex
+	bitswap *source
+	// fromGateway remembers which gateway fetched a block that wasn't
+	// delivered yet. The wrapped exchange may deliver it too, once the
+	// block was handed to it.
+	fromGateway map[cid.Cid]gatewayFetch
+}
+
+type gatewayFetch struct {
+	gateway *source
+	start   time.Time
+}
+
+var _ exchange.SessionExchange = (*Exchange)(nil)
+
+// New wraps an exchange with the gateways in cfg.
+func New(exch exchange.SessionExchange, cfg Config) (*Exchange, error) {
+	e := &Exchange{
+		SessionExchange: exch,
+		delay:           DefaultDelay,
+		bitswap:         &source{name: bitswapSource},
+		fromGateway:     make(map[cid.Cid]gatewayFetch),
+	}
+
+	timeout := DefaultTimeout
+	var err error
+	if cfg.Delay != "" {
+		if e.delay, err = time.ParseDuration(cfg.Delay); err != nil {
+			return nil, fmt.Errorf("invalid gateway delay %q: %w", cfg.Delay, err)
+		}
+	}
+	if cfg.Timeout != "" {
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid gateway timeout %q: %w", cfg.Timeout, err)
+		}
+	}
+	e.client = &http.Client{Timeout: timeout}
+
+	concurrency := cfg.MaxConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultMaxConcurrency
+	}
+	e.limit = make(chan struct{}, concurrency)
+
+	for _, u := range cfg.URLs {
+		parsed, err := url.Parse(strings.TrimSuffix(u, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway URL %q: %w", u, err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("invalid gateway URL %q: scheme must be http or https", u)
+		}
+		e.gateways = append(e.gateways, &source{name: u, url: parsed})
+	}
+	return e, nil
+}
+
+// Stats returns the statistics of the wrapped exchange followed by the ones
+// of each gateway.
+func (e *Exchange) Stats() []SourceStat {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := make([]SourceStat, 0, len(e.gateways)+1)
+	out = append(out, e.bitswap.stat())
+	for _, gw := range e.gateways {
+		out = append(out, gw.stat())
+	}
+	return out
+}
+
+// GetBlock fetches a block from the wrapped exchange or the gateways,
+// whichever is faster.
+func (e *Exchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return e.getBlock(ctx, c, e.SessionExchange)
+}
+
+// GetBlocks fetches blocks from the wrapped exchange and the gateways,
+// returning each block from whichever source is faster.
+func (e *Exchange) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks.Block, error) {
+	return e.getBlocks(ctx, keys, e.SessionExchange)
+}
+
+// NewSession opens a session on the wrapped exchange. Blocks requested
+// through the session are raced against the gateways too.
+func (e *Exchange) NewSession(ctx context.Context) exchange.Fetcher {
+	return &fetcher{exchange: e, fetcher: e.SessionExchange.NewSession(ctx)}
+}
+
+type fetcher struct {
+	exchange *Exchange
+	fetcher  exchange.Fetcher
+}
+
+func (f *fetcher) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return f.exchange.getBlock(ctx, c, f.fetcher)
+}
+
+func (f *fetcher) GetBlocks(ctx context.Context, keys []cid.Cid) (<-chan blocks.Block, error) {
+	return f.exchange.getBlocks(ctx, keys, f.fetcher)
+}
+
+func (e *Exchange) getBlock(ctx context.Context, c cid.Cid, f exchange.Fetcher) (blocks.Block, error) {
+	start := time.Now()
+	if len(e.gateways) == 0 {
+		blk, err := f.GetBlock(ctx, c)
+		if err == nil {
+			e.delivered(blk, start)
+		}
+		return blk, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer e.forget(c)
+
+	type result struct {
+		blk blocks.Block
+		err error
+	}
+	bsResult := make(chan result, 1)
+	go func() {
+		blk, err := f.GetBlock(ctx, c)
+		bsResult <- result{blk, err}
+	}()
+
+	gwResult := make(chan blocks.Block, 1)
+	go func() {
+		defer close(gwResult)
+		if blk := e.fetchFromGateways(ctx, c); blk != nil {
+			gwResult <- blk
+		}
+	}()
+
+	for {
+		select {
+		case r := <-bsResult:
+			if r.err == nil {
+				e.delivered(r.blk, start)
+			}
+			return r.blk, r.err
+		case blk, ok := <-gwResult:
+			if !ok {
+				// All gateways failed, keep waiting for the exchange.
+				gwResult = nil
+				continue
+			}
+			e.delivered(blk, start)
+			return blk, nil
+		}
+	}
+}
+
+func (e *Exchange) getBlocks(ctx context.Context, keys []cid.Cid, f exchange.Fetcher) (<-chan blocks.Block, error) {
+	start := time.Now()
+	if len(e.gateways) == 0 {
+		in, err := f.GetBlocks(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		out := make(chan blocks.Block)
+		go func() {
+			defer close(out)
+			for blk := range in {
+				e.delivered(blk, start)
+				select {
+				case out <- blk:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	bsBlocks, err := f.GetBlocks(ctx, keys)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Every key gets its own gateway request, which is canceled when the
+	// block arrives through the exchange first.
+	pending := make(map[cid.Cid]context.CancelFunc, len(keys))
+	gwBlocks := make(chan blocks.Block)
+	var wg sync.WaitGroup
+	for _, c := range keys {
+		if _, ok := pending[c]; ok {
+			continue
+		}
+		keyCtx, keyCancel := context.WithCancel(ctx)
+		pending[c] = keyCancel
+		wg.Add(1)
+		go func(c cid.Cid) {
+			defer wg.Done()
+			if blk := e.fetchFromGateways(keyCtx, c); blk != nil {
+				select {
+				case gwBlocks <- blk:
+				case <-ctx.Done():
+				}
+			}
+		}(c)
+	}
+	go func() {
+		wg.Wait()
+		close(gwBlocks)
+	}()
+
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		defer cancel()
+		defer func() {
+			for c := range pending {
+				e.forget(c)
+			}
+		}()
+
+		for len(pending) > 0 && (bsBlocks != nil || gwBlocks != nil) {
+			var blk blocks.Block
+			select {
+			case b, ok := <-bsBlocks:
+				if !ok {
+					bsBlocks = nil
+					continue
+				}
+				blk = b
+			case b, ok := <-gwBlocks:
+				if !ok {
+					gwBlocks = nil
+					continue
+				}
+				blk = b
+			case <-ctx.Done():
+				return
+			}
+
+			keyCancel, ok := pending[blk.Cid()]
+			if !ok {
+				continue
+			}
+			keyCancel()
+			delete(pending, blk.Cid())
+			e.delivered(blk, start)
+
+			select {
+			case out <- blk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// fetchFromGateways waits for the configured delay, then asks the gateways
+// for a block, in order, until one of them returns it. The block is handed
+// to the wrapped exchange. It returns nil if no gateway has the block or the
+// context is canceled.
+func (e *Exchange) fetchFromGateways(ctx context.Context, c cid.Cid) blocks.Block {
+	if e.delay > 0 {
+		t := time.NewTimer(e.delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	select {
+	case e.limit <- struct{}{}:
+		defer func() { <-e.limit }()
+	case <-ctx.Done():
+		return nil
+	}
+
+	for _, gw := range e.gateways {
+		start := time.Now()
+		e.mu.Lock()
+		gw.requests++
+		e.mu.Unlock()
+
+		blk, err := e.fetchBlock(ctx, gw, c)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Debugf("fetching %s from %s: %s", c, gw.name, err)
+			e.mu.Lock()
+			gw.errors++
+			e.mu.Unlock()
+			continue
+		}
+
+		e.mu.Lock()
+		e.fromGateway[c] = gatewayFetch{gateway: gw, start: start}
+		e.mu.Unlock()
+
+		if err := e.SessionExchange.HasBlock(blk); err != nil {
+			log.Errorf("storing block %s fetched from %s: %s", c, gw.name, err)
+			e.forget(c)
+			return nil
+		}
+		return blk
+	}
+	return nil
+}
+
+// errHashMismatch is returned when a gateway returns data that doesn't
+// match the CID that was asked for.
+var errHashMismatch = errors.New("block data doesn't match its CID")
+
+func (e *Exchange) fetchBlock(ctx context.Context, gw *source, c cid.Cid) (blocks.Block, error) {
+	u := *gw.url
+	u.Path = u.Path + "/ipfs/" + c.String()
+	u.RawQuery = "format=raw"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Drain the body so that the connection can be reused.
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBlockSize))
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBlockSize {
+		return nil, fmt.Errorf("block is larger than %d bytes", maxBlockSize)
+	}
+
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !actual.Equals(c) {
+		return nil, errHashMismatch
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// delivered counts a block returned to the caller for the source that
+// fetched it first.
+func (e *Exchange) delivered(blk blocks.Block, start time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s := e.bitswap
+	if f, ok := e.fromGateway[blk.Cid()]; ok {
+		delete(e.fromGateway, blk.Cid())
+		s = f.gateway
+		start = f.start
+	}
+	s.blocks++
+	s.bytes += uint64(len(blk.RawData()))
+	s.latencySum += time.Since(start)
+}
+
+// forget drops the record of a block fetched from a gateway that was never
+// delivered.
+func (e *Exchange) forget(c cid.Cid) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.fromGateway, c)
+}
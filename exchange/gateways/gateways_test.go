@@ -0,0 +1,226 @@
+package gateways
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+)
+
+// stuckExchange never finds a block by itself, like bitswap without peers.
+// It returns the blocks given to HasBlock.
+type stuckExchange struct {
+	mu     sync.Mutex
+	blocks map[cid.Cid]blocks.Block
+	notify chan struct{}
+}
+
+func newStuckExchange() *stuckExchange {
+	return &stuckExchange{
+		blocks: make(map[cid.Cid]blocks.Block),
+		notify: make(chan struct{}),
+	}
+}
+
+func (s *stuckExchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	for {
+		s.mu.Lock()
+		blk, ok := s.blocks[c]
+		notify := s.notify
+		s.mu.Unlock()
+		if ok {
+			return blk, nil
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *stuckExchange) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		<-ctx.Done()
+	}()
+	return out, nil
+}
+
+func (s *stuckExchange) HasBlock(blk blocks.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks[blk.Cid()] = blk
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return nil
+}
+
+func (s *stuckExchange) IsOnline() bool { return true }
+func (s *stuckExchange) Close() error   { return nil }
+
+func (s *stuckExchange) NewSession(context.Context) exchange.Fetcher { return s }
+
+func (s *stuckExchange) has(c cid.Cid) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blocks[c]
+	return ok
+}
+
+// gateway serves the given blocks as raw blocks.
+func gateway(t *testing.T, blks ...blocks.Block) *httptest.Server {
+	byPath := make(map[string][]byte)
+	for _, b := range blks {
+		byPath["/ipfs/"+b.Cid().String()] = b.RawData()
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "raw" {
+			t.Errorf("expected a raw block request, got %s", r.URL)
+		}
+		data, ok := byPath[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+}
+
+func TestGetBlockFromGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	blk := blocks.NewBlock([]byte("hello gateway"))
+
+	// The first gateway lies about the block, the second one doesn't know
+	// it and the third one has it.
+	liar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("not the block"))
+	}))
+	defer liar.Close()
+	empty := gateway(t)
+	defer empty.Close()
+	good := gateway(t, blk)
+	defer good.Close()
+
+	inner := newStuckExchange()
+	e, err := New(inner, Config{
+		URLs:  []string{liar.URL, empty.URL + "/", good.URL},
+		Delay: "0s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := e.GetBlock(ctx, blk.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Cid().Equals(blk.Cid()) {
+		t.Fatalf("got the wrong block: %s", got.Cid())
+	}
+	if !inner.has(blk.Cid()) {
+		t.Error("block should have been handed to the wrapped exchange")
+	}
+
+	stats := e.Stats()
+	if len(stats) != 4 {
+		t.Fatalf("expected 4 sources, got %d", len(stats))
+	}
+	for i, expected := range []struct {
+		blocks, errors uint64
+	}{{0, 0}, {0, 1}, {0, 1}, {1, 0}} {
+		if stats[i].Blocks != expected.blocks || stats[i].Errors != expected.errors {
+			t.Errorf("source %s: expected %d blocks and %d errors, got %d and %d",
+				stats[i].Source, expected.blocks, expected.errors, stats[i].Blocks, stats[i].Errors)
+		}
+	}
+}
+
+func TestGetBlocksFromGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a := blocks.NewBlock([]byte("a"))
+	b := blocks.NewBlock([]byte("b"))
+	missing := blocks.NewBlock([]byte("missing"))
+
+	gw := gateway(t, a, b)
+	defer gw.Close()
+
+	e, err := New(newStuckExchange(), Config{URLs: []string{gw.URL}, Delay: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqCtx, reqCancel := context.WithCancel(ctx)
+	defer reqCancel()
+	ch, err := e.NewSession(ctx).GetBlocks(reqCtx, []cid.Cid{a.Cid(), b.Cid(), missing.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[cid.Cid]bool)
+	for len(got) < 2 {
+		select {
+		case blk, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed after %d blocks", len(got))
+			}
+			got[blk.Cid()] = true
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+	if !got[a.Cid()] || !got[b.Cid()] {
+		t.Errorf("expected a and b, got %v", got)
+	}
+
+	// The missing block can only be waited for, until the request is
+	// canceled.
+	reqCancel()
+	for range ch {
+	}
+}
+
+func TestNoGateways(t *testing.T) {
+	blk := blocks.NewBlock([]byte("local"))
+	inner := newStuckExchange()
+	_ = inner.HasBlock(blk)
+
+	e, err := New(inner, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.GetBlock(context.Background(), blk.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := e.Stats()
+	if len(stats) != 1 || stats[0].Source != bitswapSource || stats[0].Blocks != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{URLs: []string{"ftp://example.com"}},
+		{Delay: "soon"},
+		{Timeout: "-"},
+	} {
+		if _, err := New(newStuckExchange(), cfg); err == nil {
+			t.Errorf("expected %+v to be refused", cfg)
+		} else if !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+}
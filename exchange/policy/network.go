@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"context"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// WrapNetwork returns a bitswap network that enforces the policy: wants that
+// the policy refuses are removed from incoming messages before bitswap sees
+// them, and the blocks sent out are counted against the peers' quotas.
+//
+// Quotas are checked when a want is received, so a peer may go over its
+// quota by the blocks it asked for before reaching it.
+func (p *Policy) WrapNetwork(net bsnet.BitSwapNetwork) bsnet.BitSwapNetwork {
+	return &policyNetwork{BitSwapNetwork: net, policy: p}
+}
+
+type policyNetwork struct {
+	bsnet.BitSwapNetwork
+	policy *Policy
+}
+
+// SendMessage is used by bitswap to send blocks to the peers that want them.
+func (n *policyNetwork) SendMessage(ctx context.Context, to peer.ID, msg bsmsg.BitSwapMessage) error {
+	if blks := msg.Blocks(); len(blks) > 0 {
+		size := 0
+		for _, b := range blks {
+			size += len(b.RawData())
+		}
+		n.policy.Sent(to, len(blks), size)
+	}
+	return n.BitSwapNetwork.SendMessage(ctx, to, msg)
+}
+
+func (n *policyNetwork) SetDelegate(r bsnet.Receiver) {
+	n.BitSwapNetwork.SetDelegate(&policyReceiver{Receiver: r, policy: n.policy})
+}
+
+type policyReceiver struct {
+	bsnet.Receiver
+	policy *Policy
+}
+
+func (r *policyReceiver) ReceiveMessage(ctx context.Context, from peer.ID, msg bsmsg.BitSwapMessage) {
+	for _, e := range msg.Wantlist() {
+		if e.Cancel {
+			continue
+		}
+		if d := r.policy.Check(from, e.Cid); d != Allowed {
+			log.Debugf("refusing want for %s from %s: %s", e.Cid, from, d)
+			msg.Remove(e.Cid)
+		}
+	}
+	r.Receiver.ReceiveMessage(ctx, from, msg)
+}
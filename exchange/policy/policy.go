@@ -0,0 +1,363 @@
+// Package policy implements server-side access control for bitswap: which
+// peers may fetch which blocks from us, and how much.
+package policy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	bserv "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+var log = logging.Logger("bitswap-policy")
+
+// ConfigKey is the config key the policy is read from.
+const ConfigKey = "Bitswap.Policy"
+
+// Config is the user-facing policy configuration.
+//
+// The zero value allows every peer to fetch every block without limits.
+type Config struct {
+	// Peers is the global allow-list. When empty, every peer is allowed.
+	Peers []string
+	// Roots restricts the blocks we serve to the DAGs below these roots.
+	// When empty, every block in the blockstore may be served.
+	Roots []RootConfig
+	// Quota limits how much every peer may fetch from us.
+	Quota Quota
+	// PeerQuotas overrides Quota for specific peers.
+	PeerQuotas map[string]Quota
+}
+
+// RootConfig lists the peers allowed to fetch a DAG.
+type RootConfig struct {
+	// Root is the CID of the DAG. The whole DAG must be stored locally, so
+	// it should be pinned.
+	Root string
+	// Peers may fetch the DAG in addition to the ones in the global
+	// allow-list. When empty, the DAG is served to the globally allowed
+	// peers, which is everyone if there is no global allow-list.
+	Peers []string
+}
+
+// Quota limits the data served to a peer. Zero values mean no limit.
+type Quota struct {
+	Bytes  uint64
+	Blocks uint64
+	// Period after which the usage is reset, e.g. "24h". Without a
+	// period, the quota applies until the node restarts or the policy is
+	// reloaded.
+	Period string
+}
+
+// Decision is the outcome of checking a want against the policy.
+type Decision int
+
+const (
+	Allowed Decision = iota
+	PeerNotAllowed
+	OutsideAllowedDAGs
+	QuotaExceeded
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allowed:
+		return "allowed"
+	case PeerNotAllowed:
+		return "peer not allowed"
+	case OutsideAllowedDAGs:
+		return "outside allowed DAGs"
+	case QuotaExceeded:
+		return "quota exceeded"
+	default:
+		return fmt.Sprintf("decision(%d)", int(d))
+	}
+}
+
+// PeerStat describes the policy decisions taken for a peer.
+type PeerStat struct {
+	WantsAllowed uint64
+	// WantsRefused counts refused wants by reason.
+	WantsRefused map[string]uint64
+	BytesSent    uint64
+	BlocksSent   uint64
+	// QuotaBytes and QuotaBlocks are zero when unlimited.
+	QuotaBytes  uint64
+	QuotaBlocks uint64
+	// PeriodStart is when the current quota period started.
+	PeriodStart time.Time
+}
+
+type quota struct {
+	bytes  uint64
+	blocks uint64
+	period time.Duration
+}
+
+type root struct {
+	cid    cid.Cid
+	peers  map[peer.ID]struct{}
+	blocks *cid.Set
+}
+
+// rules is the parsed form of a Config. It is never modified once loaded, so
+// that reloading the policy only has to swap it.
+type rules struct {
+	// peers is nil when every peer is allowed.
+	peers      map[peer.ID]struct{}
+	roots      []*root
+	quota      quota
+	peerQuotas map[peer.ID]quota
+}
+
+type usage struct {
+	periodStart time.Time
+	bytes       uint64
+	blocks      uint64
+	allowed     uint64
+	refused     map[Decision]uint64
+}
+
+// Policy decides which wants from remote peers bitswap may serve. It is safe
+// for concurrent use.
+type Policy struct {
+	mu    sync.Mutex
+	rules *rules
+	usage map[peer.ID]*usage
+}
+
+// New returns a policy that allows everything until a config is loaded.
+func New() *Policy {
+	return &Policy{
+		rules: new(rules),
+		usage: make(map[peer.ID]*usage),
+	}
+}
+
+// Load replaces the policy rules with the given config. The DAGs of all
+// configured roots are walked using ng, which should only fetch blocks from
+// the local blockstore.
+//
+// Usage counters are reset. On error, the previous rules stay in place.
+func (p *Policy) Load(ctx context.Context, cfg Config, ng ipld.NodeGetter) error {
+	r, err := parseRules(ctx, cfg, ng)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = r
+	p.usage = make(map[peer.ID]*usage)
+	return nil
+}
+
+func parseRules(ctx context.Context, cfg Config, ng ipld.NodeGetter) (*rules, error) {
+	r := &rules{
+		peerQuotas: make(map[peer.ID]quota, len(cfg.PeerQuotas)),
+	}
+
+	var err error
+	if len(cfg.Peers) > 0 {
+		r.peers, err = parsePeers(cfg.Peers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.quota, err = parseQuota(cfg.Quota)
+	if err != nil {
+		return nil, err
+	}
+	for ps, q := range cfg.PeerQuotas {
+		pid, err := peer.Decode(ps)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID in quotas %q: %w", ps, err)
+		}
+		r.peerQuotas[pid], err = parseQuota(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	getLinks := dag.GetLinksWithDAG(ng)
+	for _, rc := range cfg.Roots {
+		c, err := cid.Decode(rc.Root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root %q: %w", rc.Root, err)
+		}
+		peers, err := parsePeers(rc.Peers)
+		if err != nil {
+			return nil, err
+		}
+		set := cid.NewSet()
+		if err := dag.Walk(ctx, getLinks, c, set.Visit, dag.Concurrent()); err != nil {
+			return nil, fmt.Errorf("loading DAG of root %s: %w", c, err)
+		}
+		log.Debugf("root %s allows %d blocks", c, set.Len())
+		r.roots = append(r.roots, &root{cid: c, peers: peers, blocks: set})
+	}
+
+	return r, nil
+}
+
+func parsePeers(strs []string) (map[peer.ID]struct{}, error) {
+	peers := make(map[peer.ID]struct{}, len(strs))
+	for _, s := range strs {
+		pid, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID %q: %w", s, err)
+		}
+		peers[pid] = struct{}{}
+	}
+	return peers, nil
+}
+
+func parseQuota(q Quota) (quota, error) {
+	out := quota{bytes: q.Bytes, blocks: q.Blocks}
+	if q.Period != "" {
+		d, err := time.ParseDuration(q.Period)
+		if err != nil {
+			return quota{}, fmt.Errorf("invalid quota period %q: %w", q.Period, err)
+		}
+		out.period = d
+	}
+	return out, nil
+}
+
+// Check decides whether a want for c from p may be served, and records the
+// decision.
+func (p *Policy) Check(from peer.ID, c cid.Cid) Decision {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d := p.decide(from, c)
+	u := p.usageFor(from)
+	if d == Allowed {
+		u.allowed++
+	} else {
+		u.refused[d]++
+	}
+	return d
+}
+
+func (p *Policy) decide(from peer.ID, c cid.Cid) Decision {
+	r := p.rules
+
+	_, listed := r.peers[from]
+	globallyAllowed := listed || r.peers == nil
+
+	if len(r.roots) > 0 {
+		inDAG := false
+		allowed := false
+		for _, rt := range r.roots {
+			if !rt.blocks.Has(c) {
+				continue
+			}
+			inDAG = true
+			if len(rt.peers) == 0 {
+				allowed = globallyAllowed
+			} else {
+				_, ok := rt.peers[from]
+				allowed = ok || listed
+			}
+			if allowed {
+				break
+			}
+		}
+		if !inDAG {
+			return OutsideAllowedDAGs
+		}
+		if !allowed {
+			return PeerNotAllowed
+		}
+	} else if !globallyAllowed {
+		return PeerNotAllowed
+	}
+
+	q := p.quotaFor(from)
+	u := p.usageFor(from)
+	if (q.bytes > 0 && u.bytes >= q.bytes) || (q.blocks > 0 && u.blocks >= q.blocks) {
+		return QuotaExceeded
+	}
+	return Allowed
+}
+
+// Sent records the blocks sent to a peer, to be counted against its quota.
+func (p *Policy) Sent(to peer.ID, blocks int, bytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u := p.usageFor(to)
+	u.blocks += uint64(blocks)
+	u.bytes += uint64(bytes)
+}
+
+// Stat returns the decisions taken for a peer.
+func (p *Policy) Stat(pid peer.ID) PeerStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u := p.usageFor(pid)
+	q := p.quotaFor(pid)
+	st := PeerStat{
+		WantsAllowed: u.allowed,
+		WantsRefused: make(map[string]uint64, len(u.refused)),
+		BytesSent:    u.bytes,
+		BlocksSent:   u.blocks,
+		QuotaBytes:   q.bytes,
+		QuotaBlocks:  q.blocks,
+		PeriodStart:  u.periodStart,
+	}
+	for d, n := range u.refused {
+		st.WantsRefused[d.String()] = n
+	}
+	return st
+}
+
+func (p *Policy) quotaFor(pid peer.ID) quota {
+	if q, ok := p.rules.peerQuotas[pid]; ok {
+		return q
+	}
+	return p.rules.quota
+}
+
+// usageFor returns the usage of a peer, starting a new quota period if the
+// current one is over.
+func (p *Policy) usageFor(pid peer.ID) *usage {
+	now := time.Now()
+	u, ok := p.usage[pid]
+	if !ok {
+		u = &usage{periodStart: now, refused: make(map[Decision]uint64)}
+		p.usage[pid] = u
+	}
+	if period := p.quotaFor(pid).period; period > 0 && now.Sub(u.periodStart) >= period {
+		u.periodStart = now
+		u.bytes = 0
+		u.blocks = 0
+	}
+	return u
+}
+
+// Reload loads the policy from the config of the given repo. Root DAGs are
+// read from bs only, without fetching anything from the network.
+func (p *Policy) Reload(ctx context.Context, r repo.Repo, bs blockstore.Blockstore) error {
+	var cfg Config
+	if err := repo.ConfigSection(r, ConfigKey, &cfg); err != nil {
+		return fmt.Errorf("reading %s config: %w", ConfigKey, err)
+	}
+	ng := dag.NewDAGService(bserv.New(bs, offline.Exchange(bs)))
+	return p.Load(ctx, cfg, ng)
+}
@@ -0,0 +1,107 @@
+package policy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	dag "github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+)
+
+func TestPolicy(t *testing.T) {
+	ctx := context.Background()
+	ds := mdtest.Mock()
+
+	leaf := dag.NodeWithData([]byte("leaf"))
+	root := dag.NodeWithData([]byte("root"))
+	if err := root.AddNodeLink("leaf", leaf); err != nil {
+		t.Fatal(err)
+	}
+	other := dag.NodeWithData([]byte("other"))
+	for _, nd := range []*dag.ProtoNode{leaf, root, other} {
+		if err := ds.Add(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	partner := test.RandPeerIDFatal(t)
+	rootPeer := test.RandPeerIDFatal(t)
+	stranger := test.RandPeerIDFatal(t)
+
+	p := New()
+	if d := p.Check(stranger, other.Cid()); d != Allowed {
+		t.Fatalf("empty policy should allow everything, got %s", d)
+	}
+
+	err := p.Load(ctx, Config{
+		Peers: []string{partner.String()},
+		Roots: []RootConfig{{
+			Root:  root.Cid().String(),
+			Peers: []string{rootPeer.String()},
+		}},
+		PeerQuotas: map[string]Quota{
+			partner.String(): {Blocks: 1, Period: "1h"},
+		},
+	}, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		peer     peer.ID
+		cid      cid.Cid
+		decision Decision
+	}{
+		{partner, root.Cid(), Allowed},
+		{partner, leaf.Cid(), Allowed},
+		{rootPeer, leaf.Cid(), Allowed},
+		{stranger, leaf.Cid(), PeerNotAllowed},
+		{partner, other.Cid(), OutsideAllowedDAGs},
+	} {
+		if d := p.Check(tc.peer, tc.cid); d != tc.decision {
+			t.Errorf("%s wanting %s: expected %s, got %s", tc.peer, tc.cid, tc.decision, d)
+		}
+	}
+
+	p.Sent(partner, 1, 4)
+	if d := p.Check(partner, leaf.Cid()); d != QuotaExceeded {
+		t.Errorf("expected quota to be exceeded, got %s", d)
+	}
+	if d := p.Check(rootPeer, leaf.Cid()); d != Allowed {
+		t.Errorf("quota of another peer shouldn't apply, got %s", d)
+	}
+
+	st := p.Stat(partner)
+	if st.WantsAllowed != 2 || st.WantsRefused[QuotaExceeded.String()] != 1 || st.WantsRefused[OutsideAllowedDAGs.String()] != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+	if st.BlocksSent != 1 || st.BytesSent != 4 || st.QuotaBlocks != 1 {
+		t.Errorf("unexpected usage: %+v", st)
+	}
+
+	// A new period resets the usage.
+	p.mu.Lock()
+	p.usage[partner].periodStart = time.Now().Add(-2 * time.Hour)
+	p.mu.Unlock()
+	if d := p.Check(partner, leaf.Cid()); d != Allowed {
+		t.Errorf("expected quota to be reset, got %s", d)
+	}
+}
+
+func TestPolicyLoadKeepsRulesOnError(t *testing.T) {
+	ctx := context.Background()
+	stranger := test.RandPeerIDFatal(t)
+
+	p := New()
+	err := p.Load(ctx, Config{Peers: []string{"not a peer"}}, mdtest.Mock())
+	if err == nil {
+		t.Fatal("expected invalid config to be refused")
+	}
+	if d := p.Check(stranger, dag.NodeWithData(nil).Cid()); d != Allowed {
+		t.Errorf("previous rules should still apply, got %s", d)
+	}
+}
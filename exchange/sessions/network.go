@@ -0,0 +1,78 @@
+package sessions
+
+import (
+	"context"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// WrapNetwork returns a bitswap network that reports the wants sent and the
+// blocks received over net to the tracker.
+func (t *Tracker) WrapNetwork(net bsnet.BitSwapNetwork) bsnet.BitSwapNetwork {
+	return &tapNetwork{BitSwapNetwork: net, tracker: t}
+}
+
+type tapNetwork struct {
+	bsnet.BitSwapNetwork
+	tracker *Tracker
+}
+
+func (n *tapNetwork) SendMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+	n.tracker.messageSent(p, msg)
+	return n.BitSwapNetwork.SendMessage(ctx, p, msg)
+}
+
+func (n *tapNetwork) NewMessageSender(ctx context.Context, p peer.ID, opts *bsnet.MessageSenderOpts) (bsnet.MessageSender, error) {
+	ms, err := n.BitSwapNetwork.NewMessageSender(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &tapSender{MessageSender: ms, tracker: n.tracker, peer: p}, nil
+}
+
+func (n *tapNetwork) SetDelegate(r bsnet.Receiver) {
+	n.BitSwapNetwork.SetDelegate(&tapReceiver{Receiver: r, tracker: n.tracker})
+}
+
+type tapSender struct {
+	bsnet.MessageSender
+	tracker *Tracker
+	peer    peer.ID
+}
+
+func (s *tapSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
+	s.tracker.messageSent(s.peer, msg)
+	return s.MessageSender.SendMsg(ctx, msg)
+}
+
+type tapReceiver struct {
+	bsnet.Receiver
+	tracker *Tracker
+}
+
+func (r *tapReceiver) ReceiveMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) {
+	for _, blk := range msg.Blocks() {
+		r.tracker.blockReceived(p, blk)
+	}
+	r.Receiver.ReceiveMessage(ctx, p, msg)
+}
+
+func (t *Tracker) messageSent(p peer.ID, msg bsmsg.BitSwapMessage) {
+	entries := msg.Wantlist()
+	if len(entries) == 0 {
+		return
+	}
+
+	wants := make([]cid.Cid, 0, len(entries))
+	for _, e := range entries {
+		if !e.Cancel {
+			wants = append(wants, e.Cid)
+		}
+	}
+	if len(wants) > 0 {
+		t.wantSent(p, wants)
+	}
+}
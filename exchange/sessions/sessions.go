@@ -0,0 +1,493 @@
+// Package sessions keeps track of the block requests made through bitswap so
+// that they can be inspected while they are running.
+package sessions
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// finishedRetention is the number of finished sessions that are kept around
+// so that watchers get to see how they ended.
+const finishedRetention = 32
+
+// idleTimeout is how long an exchange session is kept once it isn't waiting
+// for anything anymore. Sessions used again after that are reopened.
+const idleTimeout = time.Minute
+
+// PeerStat describes what a single peer did for a session.
+type PeerStat struct {
+	Peer peer.ID
+	// WantsSent is the number of wants for the session's blocks sent to the
+	// peer.
+	WantsSent uint64
+	// Blocks is the number of blocks the peer sent that the session was
+	// waiting for, DupBlocks the number of blocks it sent that the session
+	// already had.
+	Blocks    uint64
+	DupBlocks uint64
+	DataRecvd uint64
+	// Latency is the average time between requesting a block and receiving
+	// it from this peer.
+	Latency time.Duration
+}
+
+// Stat is a snapshot of a session.
+type Stat struct {
+	ID uint64
+	// Root is the first block requested through the session.
+	Root    cid.Cid
+	Started time.Time
+	// Ended is zero while the session is active.
+	Ended time.Time
+	// Version increases every time the session changes.
+	Version uint64
+	// Wanted lists the blocks that were requested but not received yet.
+	Wanted    []cid.Cid
+	Requested uint64
+	Received  uint64
+	Peers     []PeerStat
+}
+
+// Active returns true if the session hasn't finished yet.
+func (s *Stat) Active() bool {
+	return s.Ended.IsZero()
+}
+
+type peerState struct {
+	wantsSent  uint64
+	blocks     uint64
+	dupBlocks  uint64
+	dataRecvd  uint64
+	latencySum time.Duration
+}
+
+type session struct {
+	id        uint64
+	root      cid.Cid
+	started   time.Time
+	ended     time.Time
+	version   uint64
+	requested uint64
+
+	// wanted maps outstanding blocks to the time they were first requested.
+	wanted map[cid.Cid]time.Time
+	// received remembers every block delivered to the session so that
+	// duplicates can be told apart.
+	received map[cid.Cid]struct{}
+	peers    map[peer.ID]*peerState
+
+	// refs counts the in-flight requests of the session. When it drops to
+	// zero, sessions that aren't backed by an exchange session end, and the
+	// others end after idleTimeout unless they are used again.
+	refs   int
+	scoped bool
+	idle   *time.Timer
+	// canceled is set once the context of the exchange session is done.
+	canceled bool
+}
+
+// Tracker wraps an exchange and records every session opened on it, along
+// with what each session wants and which peers answer.
+//
+// Plain GetBlock/GetBlocks calls on the tracker are recorded as short-lived
+// sessions that end once the call completes.
+type Tracker struct {
+	exchange.SessionExchange
+
+	mu          sync.Mutex
+	nextID      uint64
+	sessions    map[uint64]*session
+	finished    []*session
+	idleTimeout time.Duration
+}
+
+var _ exchange.SessionExchange = (*Tracker)(nil)
+
+// New returns a tracker that doesn't wrap an exchange yet. Call SetExchange
+// before using it as an exchange.
+//
+// The tracker is created before the exchange so that the exchange's network
+// can be wrapped with WrapNetwork.
+func New() *Tracker {
+	return &Tracker{
+		sessions:    make(map[uint64]*session),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// SetExchange sets the exchange the tracker forwards requests to.
+func (t *Tracker) SetExchange(exch exchange.SessionExchange) {
+	t.SessionExchange = exch
+}
+
+// GetBlock fetches a single block, tracking the request as its own session.
+func (t *Tracker) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	s := t.open(true)
+	defer t.release(s)
+
+	t.want(s, []cid.Cid{c})
+	blk, err := t.SessionExchange.GetBlock(ctx, c)
+	if err == nil {
+		t.delivered(s, blk.Cid())
+	}
+	return blk, err
+}
+
+// GetBlocks fetches a set of blocks, tracking the request as its own session.
+func (t *Tracker) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	s := t.open(true)
+	t.want(s, cids)
+	ch, err := t.SessionExchange.GetBlocks(ctx, cids)
+	if err != nil {
+		t.release(s)
+		return nil, err
+	}
+	return t.forward(ctx, s, ch), nil
+}
+
+// NewSession opens a new exchange session. The session is tracked until the
+// context is canceled, or until it has been idle for a minute.
+func (t *Tracker) NewSession(ctx context.Context) exchange.Fetcher {
+	s := t.open(false)
+	go func() {
+		<-ctx.Done()
+		t.close(s)
+	}()
+	return &fetcher{
+		tracker: t,
+		session: s,
+		fetcher: t.SessionExchange.NewSession(ctx),
+	}
+}
+
+// Sessions returns a snapshot of all active sessions followed by the most
+// recently finished ones, ordered by ID.
+func (t *Tracker) Sessions() []Stat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]Stat, 0, len(t.sessions)+len(t.finished))
+	for _, s := range t.sessions {
+		out = append(out, s.stat())
+	}
+	for _, s := range t.finished {
+		out = append(out, s.stat())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Session returns a snapshot of the session with the given ID.
+func (t *Tracker) Session(id uint64) (Stat, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, ok := t.sessions[id]; ok {
+		return s.stat(), true
+	}
+	for _, s := range t.finished {
+		if s.id == id {
+			return s.stat(), true
+		}
+	}
+	return Stat{}, false
+}
+
+// open starts tracking a session. Scoped sessions track a single request
+// and hold a reference to it, the others back an exchange session.
+func (t *Tracker) open(scoped bool) *session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	s := &session{
+		id:       t.nextID,
+		started:  time.Now(),
+		wanted:   make(map[cid.Cid]time.Time),
+		received: make(map[cid.Cid]struct{}),
+		peers:    make(map[peer.ID]*peerState),
+		scoped:   scoped,
+	}
+	t.sessions[s.id] = s
+	if scoped {
+		s.refs = 1
+	} else {
+		t.armIdle(s)
+	}
+	return s
+}
+
+// acquire adds a reference to a session for a request made through it,
+// reopening the session if it ended because it was idle.
+func (t *Tracker) acquire(s *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.refs++
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	if !s.ended.IsZero() && !s.canceled {
+		for i, f := range t.finished {
+			if f == s {
+				t.finished = append(t.finished[:i], t.finished[i+1:]...)
+				break
+			}
+		}
+		s.ended = time.Time{}
+		s.version++
+		t.sessions[s.id] = s
+	}
+}
+
+// release drops a reference to a session. Scoped sessions are closed once
+// nothing refers to them anymore, the others once they stayed idle for the
+// idle timeout.
+func (t *Tracker) release(s *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	if s.scoped {
+		t.closeLocked(s)
+	} else if !s.canceled {
+		t.armIdle(s)
+	}
+}
+
+// armIdle closes the session after the idle timeout, unless it is used again
+// before. The lock must be held.
+func (t *Tracker) armIdle(s *session) {
+	var timer *time.Timer
+	timer = time.AfterFunc(t.idleTimeout, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if s.idle == timer {
+			s.idle = nil
+			t.closeLocked(s)
+		}
+	})
+	s.idle = timer
+}
+
+// close ends a session for good: it won't be reopened if it is used again.
+func (t *Tracker) close(s *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.canceled = true
+	if s.idle != nil {
+		s.idle.Stop()
+		s.idle = nil
+	}
+	t.closeLocked(s)
+}
+
+// closeLocked moves a session to the finished ones. The lock must be held.
+func (t *Tracker) closeLocked(s *session) {
+	if _, ok := t.sessions[s.id]; !ok {
+		return
+	}
+	delete(t.sessions, s.id)
+	s.ended = time.Now()
+	s.version++
+
+	t.finished = append(t.finished, s)
+	if len(t.finished) > finishedRetention {
+		t.finished = t.finished[len(t.finished)-finishedRetention:]
+	}
+}
+
+func (t *Tracker) want(s *session, cids []cid.Cid) {
+	if len(cids) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !s.root.Defined() {
+		s.root = cids[0]
+	}
+	for _, c := range cids {
+		s.requested++
+		if _, ok := s.received[c]; ok {
+			continue
+		}
+		if _, ok := s.wanted[c]; !ok {
+			s.wanted[c] = now
+		}
+	}
+	s.version++
+}
+
+// delivered marks a block as handed to the caller of a session.
+func (t *Tracker) delivered(s *session, c cid.Cid) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := s.wanted[c]; !ok {
+		return
+	}
+	delete(s.wanted, c)
+	s.received[c] = struct{}{}
+	s.version++
+}
+
+// forward relays blocks from in to the returned channel, marking each of them
+// as delivered. Once in is closed, the session is released.
+func (t *Tracker) forward(ctx context.Context, s *session, in <-chan blocks.Block) <-chan blocks.Block {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		defer t.release(s)
+		for blk := range in {
+			t.delivered(s, blk.Cid())
+			select {
+			case out <- blk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// wantSent records that wants for the given blocks were sent to a peer.
+func (t *Tracker) wantSent(p peer.ID, cids []cid.Cid) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.sessions {
+		n := uint64(0)
+		for _, c := range cids {
+			if _, ok := s.wanted[c]; ok {
+				n++
+			}
+		}
+		if n > 0 {
+			s.peer(p).wantsSent += n
+			s.version++
+		}
+	}
+}
+
+// blockReceived attributes a block received from a peer to all sessions
+// interested in it.
+func (t *Tracker) blockReceived(p peer.ID, blk blocks.Block) {
+	now := time.Now()
+	c := blk.Cid()
+	size := uint64(len(blk.RawData()))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.sessions {
+		if wantedAt, ok := s.wanted[c]; ok {
+			ps := s.peer(p)
+			ps.blocks++
+			ps.dataRecvd += size
+			ps.latencySum += now.Sub(wantedAt)
+			// The block counts as received by the session from now on, so
+			// that copies arriving from other peers are seen as
+			// duplicates.
+			delete(s.wanted, c)
+			s.received[c] = struct{}{}
+			s.version++
+		} else if _, ok := s.received[c]; ok {
+			ps := s.peer(p)
+			ps.dupBlocks++
+			ps.dataRecvd += size
+			s.version++
+		}
+	}
+}
+
+func (s *session) peer(p peer.ID) *peerState {
+	ps, ok := s.peers[p]
+	if !ok {
+		ps = new(peerState)
+		s.peers[p] = ps
+	}
+	return ps
+}
+
+func (s *session) stat() Stat {
+	st := Stat{
+		ID:        s.id,
+		Root:      s.root,
+		Started:   s.started,
+		Ended:     s.ended,
+		Version:   s.version,
+		Requested: s.requested,
+		Wanted:    make([]cid.Cid, 0, len(s.wanted)),
+		Peers:     make([]PeerStat, 0, len(s.peers)),
+	}
+	for c := range s.wanted {
+		st.Wanted = append(st.Wanted, c)
+	}
+	st.Received = uint64(len(s.received))
+	for p, ps := range s.peers {
+		pst := PeerStat{
+			Peer:      p,
+			WantsSent: ps.wantsSent,
+			Blocks:    ps.blocks,
+			DupBlocks: ps.dupBlocks,
+			DataRecvd: ps.dataRecvd,
+		}
+		if ps.blocks > 0 {
+			pst.Latency = ps.latencySum / time.Duration(ps.blocks)
+		}
+		st.Peers = append(st.Peers, pst)
+	}
+	sort.Slice(st.Peers, func(i, j int) bool {
+		return st.Peers[i].Peer < st.Peers[j].Peer
+	})
+	return st
+}
+
+// fetcher tracks the requests made through an exchange session.
+type fetcher struct {
+	tracker *Tracker
+	session *session
+	fetcher exchange.Fetcher
+}
+
+func (f *fetcher) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	f.tracker.acquire(f.session)
+	defer f.tracker.release(f.session)
+
+	f.tracker.want(f.session, []cid.Cid{c})
+	blk, err := f.fetcher.GetBlock(ctx, c)
+	if err == nil {
+		f.tracker.delivered(f.session, blk.Cid())
+	}
+	return blk, err
+}
+
+func (f *fetcher) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	f.tracker.acquire(f.session)
+	f.tracker.want(f.session, cids)
+	ch, err := f.fetcher.GetBlocks(ctx, cids)
+	if err != nil {
+		f.tracker.release(f.session)
+		return nil, err
+	}
+	return f.tracker.forward(ctx, f.session, ch), nil
+}
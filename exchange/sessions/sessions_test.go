@@ -0,0 +1,226 @@
+package sessions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// fakeExchange serves blocks from a map, after they were "received" by the
+// test through the tracker.
+type fakeExchange struct {
+	blocks map[cid.Cid]blocks.Block
+}
+
+func (f *fakeExchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return f.blocks[c], nil
+}
+
+func (f *fakeExchange) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block, len(cids))
+	for _, c := range cids {
+		if blk, ok := f.blocks[c]; ok {
+			out <- blk
+		}
+	}
+	close(out)
+	return out, nil
+}
+
+func (f *fakeExchange) HasBlock(blocks.Block) error { return nil }
+func (f *fakeExchange) IsOnline() bool              { return true }
+func (f *fakeExchange) Close() error                { return nil }
+
+func (f *fakeExchange) NewSession(context.Context) exchange.Fetcher { return f }
+
+type nopReceiver struct{}
+
+func (nopReceiver) ReceiveMessage(context.Context, peer.ID, bsmsg.BitSwapMessage) {}
+func (nopReceiver) ReceiveError(error)                                            {}
+func (nopReceiver) PeerConnected(peer.ID)                                         {}
+func (nopReceiver) PeerDisconnected(peer.ID)                                      {}
+
+func TestSessionTracking(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := blocks.NewBlock([]byte("a"))
+	b := blocks.NewBlock([]byte("b"))
+
+	tracker := New()
+	tracker.SetExchange(&fakeExchange{blocks: map[cid.Cid]blocks.Block{
+		a.Cid(): a,
+	}})
+	recv := &tapReceiver{Receiver: nopReceiver{}, tracker: tracker}
+
+	p1 := peer.ID("peer1")
+	p2 := peer.ID("peer2")
+
+	sessCtx, closeSession := context.WithCancel(ctx)
+	ses := tracker.NewSession(sessCtx).(*fetcher)
+	tracker.want(ses.session, []cid.Cid{a.Cid(), b.Cid()})
+
+	want := bsmsg.New(false)
+	want.AddEntry(a.Cid(), 1, pb.Message_Wantlist_Block, true)
+	want.AddEntry(b.Cid(), 1, pb.Message_Wantlist_Block, true)
+	tracker.messageSent(p1, want)
+	tracker.messageSent(p2, want)
+
+	msg := bsmsg.New(false)
+	msg.AddBlock(a)
+	recv.ReceiveMessage(ctx, p1, msg)
+	recv.ReceiveMessage(ctx, p2, msg)
+
+	if _, err := ses.GetBlock(ctx, a.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tracker.Sessions()
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(stats))
+	}
+	st := stats[0]
+	if !st.Root.Equals(a.Cid()) {
+		t.Errorf("expected root %s, got %s", a.Cid(), st.Root)
+	}
+	if len(st.Wanted) != 1 || !st.Wanted[0].Equals(b.Cid()) {
+		t.Errorf("expected %s to be wanted, got %v", b.Cid(), st.Wanted)
+	}
+	if st.Received != 1 {
+		t.Errorf("expected 1 block received, got %d", st.Received)
+	}
+	if len(st.Peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(st.Peers))
+	}
+	for _, ps := range st.Peers {
+		if ps.WantsSent != 2 {
+			t.Errorf("expected 2 wants sent to %s, got %d", ps.Peer, ps.WantsSent)
+		}
+		switch ps.Peer {
+		case p1:
+			if ps.Blocks != 1 || ps.DupBlocks != 0 {
+				t.Errorf("expected 1 block and no dups from %s, got %d/%d", ps.Peer, ps.Blocks, ps.DupBlocks)
+			}
+		case p2:
+			if ps.Blocks != 0 || ps.DupBlocks != 1 {
+				t.Errorf("expected 1 dup from %s, got %d/%d", ps.Peer, ps.Blocks, ps.DupBlocks)
+			}
+		}
+	}
+
+	closeSession()
+	tracker.close(ses.session)
+
+	st, ok := tracker.Session(st.ID)
+	if !ok {
+		t.Fatal("finished session should still be listed")
+	}
+	if st.Active() {
+		t.Error("session should have ended")
+	}
+}
+
+func TestPlainRequestsAreSessions(t *testing.T) {
+	ctx := context.Background()
+
+	a := blocks.NewBlock([]byte("a"))
+	b := blocks.NewBlock([]byte("b"))
+
+	tracker := New()
+	tracker.SetExchange(&fakeExchange{blocks: map[cid.Cid]blocks.Block{
+		a.Cid(): a,
+		b.Cid(): b,
+	}})
+
+	if _, err := tracker.GetBlock(ctx, a.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, err := tracker.GetBlocks(ctx, []cid.Cid{a.Cid(), b.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+
+	stats := tracker.Sessions()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(stats))
+	}
+	for _, st := range stats {
+		if st.Active() {
+			t.Errorf("session %d should have ended", st.ID)
+		}
+		if len(st.Wanted) != 0 {
+			t.Errorf("session %d still wants %v", st.ID, st.Wanted)
+		}
+	}
+	if stats[1].Received != 2 {
+		t.Errorf("expected 2 blocks received, got %d", stats[1].Received)
+	}
+}
+
+func TestIdleSessionsEnd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := blocks.NewBlock([]byte("a"))
+
+	tracker := New()
+	tracker.idleTimeout = 50 * time.Millisecond
+	tracker.SetExchange(&fakeExchange{blocks: map[cid.Cid]blocks.Block{
+		a.Cid(): a,
+	}})
+
+	waitActive := func(id uint64, active bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			st, ok := tracker.Session(id)
+			if !ok {
+				t.Fatalf("session %d isn't listed", id)
+			}
+			if st.Active() == active {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected session %d to be active: %t", id, active)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	sessCtx, closeSession := context.WithCancel(ctx)
+	ses := tracker.NewSession(sessCtx).(*fetcher)
+	if _, err := ses.GetBlock(ctx, a.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	waitActive(ses.session.id, false)
+
+	// Using the session again reopens it.
+	ch, err := ses.GetBlocks(ctx, []cid.Cid{a.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitActive(ses.session.id, true)
+	for range ch {
+	}
+	waitActive(ses.session.id, false)
+
+	// Canceled sessions stay finished.
+	closeSession()
+	tracker.close(ses.session)
+	if _, err := ses.GetBlock(ctx, a.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := tracker.Session(ses.session.id); st.Active() {
+		t.Error("canceled session was reopened")
+	}
+}
@@ -0,0 +1,355 @@
+// Package repair repairs the references of the filestore to files that were
+// moved or modified since they were added.
+//
+// Moved files are found by content in search directories, and the references
+// are pointed to their new location. Files that were modified in place are
+// added again. The references that can't be repaired are removed.
+package repair
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	filestore "github.com/ipfs/go-filestore"
+	files "github.com/ipfs/go-ipfs-files"
+	posinfo "github.com/ipfs/go-ipfs-posinfo"
+	logging "github.com/ipfs/go-log"
+	dag "github.com/ipfs/go-merkledag"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+var log = logging.Logger("filestore/repair")
+
+// Statuses of the repair of a file.
+const (
+	// StatusMoved is the status of files found elsewhere, whose references
+	// now point to their new location.
+	StatusMoved = "moved"
+	// StatusCopied is the status of files found outside of the filestore
+	// root, whose data was copied into the blockstore.
+	StatusCopied = "copied"
+	// StatusReadded is the status of files modified in place, which were
+	// added again.
+	StatusReadded = "readded"
+	// StatusRemoved is the status of files that couldn't be found, whose
+	// references were removed.
+	StatusRemoved = "removed"
+	// StatusSkipped is the status of files that were found, but couldn't
+	// be repaired.
+	StatusSkipped = "skipped"
+)
+
+// Options configures a Repairer.
+type Options struct {
+	// SearchPaths are the directories searched for moved files.
+	SearchPaths []string
+	// Copy copies the data of moved files found outside of the filestore
+	// root into the blockstore. Otherwise they are skipped.
+	Copy bool
+	// DryRun only reports the repairs, without making them.
+	DryRun bool
+}
+
+// Result is the repair of the references to a file.
+type Result struct {
+	Status string
+	// Path is the path of the file the references point to, relative to
+	// the filestore root.
+	Path string
+	// NewPath is the absolute path the file was found at.
+	NewPath string
+	// Cid is the root of the file added again.
+	Cid cid.Cid
+	// Blocks is the number of references repaired or removed.
+	Blocks int
+	Error  string
+}
+
+// Repairer repairs the references of a filestore.
+type Repairer struct {
+	fs   *filestore.Filestore
+	root string
+	api  coreiface.CoreAPI
+	opts Options
+
+	// candidates are the regular files of the search paths, listed when
+	// they are first needed.
+	candidates []candidate
+	listed     bool
+}
+
+type candidate struct {
+	path string
+	size int64
+}
+
+// New returns a Repairer of the filestore, whose references are relative to
+// root. Modified files are added again with api.
+func New(fs *filestore.Filestore, root string, api coreiface.CoreAPI, opts Options) *Repairer {
+	return &Repairer{fs: fs, root: root, api: api, opts: opts}
+}
+
+// Repair repairs the broken references of the filestore, calling emit with
+// the repair of each file.
+func (r *Repairer) Repair(ctx context.Context, emit func(Result) error) error {
+	next, err := filestore.VerifyAll(r.fs, true)
+	if err != nil {
+		return err
+	}
+
+	// The references are listed in file order.
+	var broken [][]*filestore.ListRes
+	last := ""
+	for res := next(); res != nil; res = next() {
+		if res.Status != filestore.StatusFileChanged && res.Status != filestore.StatusFileNotFound {
+			continue
+		}
+		if filestore.IsURL(res.FilePath) {
+			continue
+		}
+		if len(broken) == 0 || res.FilePath != last {
+			broken = append(broken, nil)
+			last = res.FilePath
+		}
+		broken[len(broken)-1] = append(broken[len(broken)-1], res)
+	}
+
+	for _, refs := range broken {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, err := r.repair(ctx, refs)
+		if err != nil {
+			return err
+		}
+		if err := emit(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repair repairs the broken references to a file.
+func (r *Repairer) repair(ctx context.Context, refs []*filestore.ListRes) (Result, error) {
+	p := refs[0].FilePath
+	abs := filepath.Join(r.root, filepath.FromSlash(p))
+
+	nds, found, err := r.locate(abs, refs)
+	if err != nil {
+		return Result{}, err
+	}
+	if found != "" {
+		return r.move(p, found, nds)
+	}
+
+	if fi, err := os.Stat(abs); err == nil && fi.Mode().IsRegular() {
+		return r.readd(ctx, p, abs, refs)
+	}
+
+	res := Result{Status: StatusRemoved, Path: p, Blocks: len(refs)}
+	if r.opts.DryRun {
+		return res, nil
+	}
+	for _, ref := range refs {
+		if err := r.fs.FileManager().DeleteBlock(ref.Key); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// locate searches the file with the data of the references in the search
+// paths, returning its path and the blocks read from it.
+func (r *Repairer) locate(abs string, refs []*filestore.ListRes) ([]*posinfo.FilestoreNode, string, error) {
+	if err := r.list(); err != nil {
+		return nil, "", err
+	}
+
+	var end int64
+	for _, ref := range refs {
+		if e := int64(ref.Offset + ref.Size); e > end {
+			end = e
+		}
+	}
+	var cands []candidate
+	for _, c := range r.candidates {
+		if c.size >= end && c.path != abs {
+			cands = append(cands, c)
+		}
+	}
+	// Files of the same name and size are the most likely to match.
+	rank := func(c candidate) int {
+		n := 0
+		if filepath.Base(c.path) != filepath.Base(abs) {
+			n += 2
+		}
+		if c.size != end {
+			n++
+		}
+		return n
+	}
+	sort.SliceStable(cands, func(i, j int) bool { return rank(cands[i]) < rank(cands[j]) })
+
+	for _, c := range cands {
+		nds, err := read(c.path, refs)
+		if err != nil {
+			log.Debugw("reading candidate", "path", c.path, "error", err)
+			continue
+		}
+		if nds != nil {
+			return nds, c.path, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// list lists the regular files of the search paths.
+func (r *Repairer) list() error {
+	if r.listed {
+		return nil
+	}
+	r.listed = true
+	for _, dir := range r.opts.SearchPaths {
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				log.Debugw("searching moved files", "path", p, "error", err)
+				return nil
+			}
+			if fi.Mode().IsRegular() {
+				abs, err := filepath.Abs(p)
+				if err != nil {
+					return err
+				}
+				r.candidates = append(r.candidates, candidate{path: abs, size: fi.Size()})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read returns the blocks of the references read from the file p, or nil
+// if the file has different data.
+func read(p string, refs []*filestore.ListRes) ([]*posinfo.FilestoreNode, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	nds := make([]*posinfo.FilestoreNode, 0, len(refs))
+	for _, ref := range refs {
+		data := make([]byte, ref.Size)
+		if _, err := f.ReadAt(data, int64(ref.Offset)); err != nil {
+			return nil, err
+		}
+		c, err := ref.Key.Prefix().Sum(data)
+		if err != nil {
+			return nil, err
+		}
+		if !c.Equals(ref.Key) {
+			return nil, nil
+		}
+		b, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return nil, err
+		}
+		nds = append(nds, &posinfo.FilestoreNode{
+			Node:    &dag.RawNode{Block: b},
+			PosInfo: &posinfo.PosInfo{Offset: ref.Offset, FullPath: p, Stat: fi},
+		})
+	}
+	return nds, nil
+}
+
+// move points the references to the file found at newPath, or copies its
+// data when it's outside of the filestore root.
+func (r *Repairer) move(p, newPath string, nds []*posinfo.FilestoreNode) (Result, error) {
+	res := Result{Status: StatusMoved, Path: p, NewPath: newPath, Blocks: len(nds)}
+	rel, err := filepath.Rel(r.root, newPath)
+	inRoot := err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+
+	switch {
+	case inRoot:
+		if r.opts.DryRun {
+			return res, nil
+		}
+		return res, r.fs.FileManager().PutMany(nds)
+	case r.opts.Copy:
+		res.Status = StatusCopied
+		if r.opts.DryRun {
+			return res, nil
+		}
+		bs := make([]blocks.Block, len(nds))
+		for i, nd := range nds {
+			bs[i] = nd
+		}
+		if err := r.fs.MainBlockstore().PutMany(bs); err != nil {
+			return res, err
+		}
+		for _, nd := range nds {
+			if err := r.fs.FileManager().DeleteBlock(nd.Cid()); err != nil {
+				return res, err
+			}
+		}
+		return res, nil
+	default:
+		res.Status = StatusSkipped
+		res.Error = fmt.Sprintf("outside of the filestore root %s", r.root)
+		return res, nil
+	}
+}
+
+// readd adds the modified file again, and removes the references to its
+// previous data.
+func (r *Repairer) readd(ctx context.Context, p, abs string, refs []*filestore.ListRes) (Result, error) {
+	res := Result{Status: StatusReadded, Path: p, Blocks: len(refs)}
+	if r.opts.DryRun {
+		return res, nil
+	}
+
+	f, err := os.Open(abs)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return res, err
+	}
+	nd, err := files.NewReaderPathFile(abs, f, fi)
+	if err != nil {
+		return res, err
+	}
+	rp, err := r.api.Unixfs().Add(ctx, nd, options.Unixfs.Nocopy(true))
+	if err != nil {
+		return res, err
+	}
+	res.Cid = rp.Cid()
+
+	// The new data may have blocks of the previous data, elsewhere in the
+	// file, whose references were just replaced.
+	for _, ref := range refs {
+		if filestore.Verify(r.fs, ref.Key).Status == filestore.StatusOk {
+			continue
+		}
+		if err := r.fs.FileManager().DeleteBlock(ref.Key); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
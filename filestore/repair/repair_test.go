@@ -0,0 +1,202 @@
+package repair
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	filestore "github.com/ipfs/go-filestore"
+	config "github.com/ipfs/go-ipfs-config"
+	files "github.com/ipfs/go-ipfs-files"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+const testPeerID = "QmTFauExutTsy4XP6JbMFcw2Wa9645HJt2bTqL6qYDCKfe"
+
+func setup(t *testing.T) (*core.IpfsNode, coreiface.CoreAPI, string) {
+	root, err := ioutil.TempDir("", "repair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.Config{}
+	c.Identity.PeerID = testPeerID
+	c.Experimental.FilestoreEnabled = true
+	ds := syncds.MutexWrap(datastore.NewMapDatastore())
+	fm := filestore.NewFileManager(ds, root)
+	fm.AllowFiles = true
+	nd, err := core.NewNode(context.Background(), &core.BuildCfg{
+		Repo: &repo.Mock{
+			C: c,
+			D: ds,
+			K: keystore.NewMemKeystore(),
+			F: fm,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := coreapi.NewCoreAPI(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		nd.Close()
+		os.RemoveAll(root)
+	})
+	return nd, api, root
+}
+
+func addFile(t *testing.T, api coreiface.CoreAPI, p string, data []byte) path.Resolved {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := files.NewReaderPathFile(p, f, fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := api.Unixfs().Add(context.Background(), nd, options.Unixfs.Nocopy(true), options.Unixfs.Chunker("size-100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+func data(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7) ^ seed
+	}
+	return b
+}
+
+func repair(t *testing.T, nd *core.IpfsNode, api coreiface.CoreAPI, root string, opts Options) map[string]Result {
+	out := make(map[string]Result)
+	err := New(nd.Filestore, root, api, opts).Repair(context.Background(), func(res Result) error {
+		out[res.Path] = res
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func broken(t *testing.T, nd *core.IpfsNode) int {
+	next, err := filestore.VerifyAll(nd.Filestore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for res := next(); res != nil; res = next() {
+		if res.Status != filestore.StatusOk {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	nd, api, root := setup(t)
+
+	moved := addFile(t, api, filepath.Join(root, "files", "moved"), data(350, 1))
+	addFile(t, api, filepath.Join(root, "files", "modified"), data(250, 2))
+	addFile(t, api, filepath.Join(root, "files", "removed"), data(150, 3))
+
+	if err := os.Rename(filepath.Join(root, "files", "moved"), filepath.Join(root, "files", "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "files", "modified"), data(250, 4), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "files", "removed")); err != nil {
+		t.Fatal(err)
+	}
+	if n := broken(t, nd); n != 9 {
+		t.Fatalf("expected 9 broken references, got %d", n)
+	}
+
+	out := repair(t, nd, api, root, Options{SearchPaths: []string{root}, DryRun: true})
+	if len(out) != 3 || broken(t, nd) != 9 {
+		t.Fatalf("the dry run should only report the repairs, got %v", out)
+	}
+
+	out = repair(t, nd, api, root, Options{SearchPaths: []string{root}})
+	if res := out["files/moved"]; res.Status != StatusMoved || res.NewPath != filepath.Join(root, "files", "renamed") || res.Blocks != 4 {
+		t.Errorf("unexpected repair of the moved file %+v", res)
+	}
+	if res := out["files/modified"]; res.Status != StatusReadded || !res.Cid.Defined() {
+		t.Errorf("unexpected repair of the modified file %+v", res)
+	}
+	if res := out["files/removed"]; res.Status != StatusRemoved || res.Blocks != 2 {
+		t.Errorf("unexpected repair of the removed file %+v", res)
+	}
+	if n := broken(t, nd); n != 0 {
+		t.Errorf("expected no broken references, got %d", n)
+	}
+
+	f, err := api.Unixfs().Get(ctx, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f.(files.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(data(350, 1)) {
+		t.Error("the moved file can't be read")
+	}
+}
+
+func TestRepairOutsideRoot(t *testing.T) {
+	nd, api, root := setup(t)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	rp := addFile(t, api, filepath.Join(root, "file"), data(200, 1))
+	if err := os.Rename(filepath.Join(root, "file"), filepath.Join(outside, "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	out := repair(t, nd, api, root, Options{SearchPaths: []string{outside}})
+	if res := out["file"]; res.Status != StatusSkipped {
+		t.Errorf("expected the file to be skipped, got %+v", res)
+	}
+
+	out = repair(t, nd, api, root, Options{SearchPaths: []string{outside}, Copy: true})
+	if res := out["file"]; res.Status != StatusCopied || res.Blocks != 2 {
+		t.Errorf("expected the file to be copied, got %+v", res)
+	}
+	if _, err := api.Unixfs().Get(context.Background(), rp); err != nil {
+		t.Error(err)
+	}
+	if n := broken(t, nd); n != 0 {
+		t.Errorf("expected no broken references, got %d", n)
+	}
+}
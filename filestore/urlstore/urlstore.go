@@ -0,0 +1,487 @@
+// Package urlstore reads the blocks of the filestore that reference URLs,
+// with retries, mirrors and health tracking of each URL.
+//
+// The filestore fetches URL-backed blocks itself with a single request, and
+// fails the read of the block when it fails. Store wraps the filestore and
+// fetches these blocks instead. When none of the URLs of a block serves its
+// data, the block is reported as missing, so that the blockservice fetches it
+// from the network.
+package urlstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	filestore "github.com/ipfs/go-filestore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	posinfo "github.com/ipfs/go-ipfs-posinfo"
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("filestore/urlstore")
+
+// ConfigKey is the config key the urlstore settings are read from.
+const ConfigKey = "Urlstore"
+
+const (
+	// DefaultTimeout bounds a single request to a URL.
+	DefaultTimeout = 30 * time.Second
+	// DefaultAttempts is the number of requests made to a URL before
+	// trying the next one.
+	DefaultAttempts = 3
+	// DefaultRetryDelay is the delay before the first retry. It doubles
+	// after every attempt.
+	DefaultRetryDelay = time.Second
+	// DefaultDownAfter is the number of consecutive failures after which a
+	// URL is considered down.
+	DefaultDownAfter = 3
+	// DefaultGetTimeout bounds the time spent fetching a block from all its
+	// URLs in Get.
+	DefaultGetTimeout = time.Minute
+)
+
+// Config configures how URL-backed blocks are fetched.
+type Config struct {
+	// Timeout of a single request. Defaults to 30s.
+	Timeout string
+	// Attempts is the number of requests made to a URL before trying the
+	// next one. Defaults to 3.
+	Attempts int
+	// RetryDelay is the delay before the first retry, doubled after every
+	// attempt. Defaults to 1s.
+	RetryDelay string
+	// DownAfter is the number of consecutive failures after which a URL
+	// is considered down. The URLs that are down are tried last, and only
+	// once. Defaults to 3.
+	DownAfter int
+	// GetTimeout bounds the time spent fetching a block from all its URLs,
+	// retries included, when reading it. Defaults to 1m.
+	GetTimeout string
+	// Mirrors maps URL prefixes to the prefixes of their mirrors, tried in
+	// order after the URL itself.
+	Mirrors map[string][]string
+	// VerifyInterval is the interval between verifications of all the
+	// URL-backed blocks. Disabled when empty.
+	VerifyInterval string
+}
+
+// Health describes the requests made to a URL.
+type Health struct {
+	URL      string
+	Requests uint64
+	Failures uint64
+	// ConsecutiveFailures counts the failures since the last success.
+	ConsecutiveFailures int
+	LastError           string
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	// Down is set when the URL failed too many times in a row.
+	Down bool
+}
+
+// VerifyResult is the result of the verification of the URL-backed blocks.
+type VerifyResult struct {
+	Time   time.Time
+	Blocks int
+	Failed int
+}
+
+// BlockStatus is the verification of a single URL-backed block.
+type BlockStatus struct {
+	Key cid.Cid
+	URL string
+	// Source is the URL that served the block, which is a mirror when the
+	// URL failed.
+	Source string
+	Error  error
+}
+
+type mirror struct {
+	prefix  string
+	mirrors []string
+}
+
+// Store wraps a filestore, fetching its URL-backed blocks itself.
+type Store struct {
+	*filestore.Filestore
+
+	client     *http.Client
+	attempts   int
+	retryDelay time.Duration
+	downAfter  int
+	getTimeout time.Duration
+	mirrors    []mirror
+	interval   time.Duration
+
+	mu         sync.Mutex
+	health     map[string]*Health
+	lastVerify VerifyResult
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ blockstore.Blockstore = (*Store)(nil)
+
+// New wraps the filestore with the settings in cfg.
+func New(fs *filestore.Filestore, cfg Config) (*Store, error) {
+	s := &Store{
+		Filestore:  fs,
+		attempts:   cfg.Attempts,
+		retryDelay: DefaultRetryDelay,
+		downAfter:  cfg.DownAfter,
+		getTimeout: DefaultGetTimeout,
+		health:     make(map[string]*Health),
+	}
+	if s.attempts <= 0 {
+		s.attempts = DefaultAttempts
+	}
+	if s.downAfter <= 0 {
+		s.downAfter = DefaultDownAfter
+	}
+
+	timeout := DefaultTimeout
+	var err error
+	if cfg.Timeout != "" {
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid urlstore timeout %q: %w", cfg.Timeout, err)
+		}
+	}
+	s.client = &http.Client{Timeout: timeout}
+	if cfg.RetryDelay != "" {
+		if s.retryDelay, err = time.ParseDuration(cfg.RetryDelay); err != nil {
+			return nil, fmt.Errorf("invalid urlstore retry delay %q: %w", cfg.RetryDelay, err)
+		}
+	}
+	if cfg.GetTimeout != "" {
+		if s.getTimeout, err = time.ParseDuration(cfg.GetTimeout); err != nil {
+			return nil, fmt.Errorf("invalid urlstore get timeout %q: %w", cfg.GetTimeout, err)
+		}
+	}
+	if cfg.VerifyInterval != "" {
+		if s.interval, err = time.ParseDuration(cfg.VerifyInterval); err != nil {
+			return nil, fmt.Errorf("invalid urlstore verify interval %q: %w", cfg.VerifyInterval, err)
+		}
+	}
+
+	for prefix, mirrors := range cfg.Mirrors {
+		for _, u := range append([]string{prefix}, mirrors...) {
+			if !filestore.IsURL(u) {
+				return nil, fmt.Errorf("invalid urlstore mirror %q: must be an http or https URL", u)
+			}
+		}
+		s.mirrors = append(s.mirrors, mirror{prefix: prefix, mirrors: mirrors})
+	}
+	// The longest prefix matching a URL wins.
+	sort.Slice(s.mirrors, func(i, j int) bool { return len(s.mirrors[i].prefix) > len(s.mirrors[j].prefix) })
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// Start verifies the URL-backed blocks periodically, if configured.
+func (s *Store) Start() error {
+	if s.interval == 0 {
+		return nil
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				res, err := s.Verify(s.ctx, nil)
+				if err != nil {
+					log.Errorf("verifying the URL-backed blocks failed: %s", err)
+				} else if res.Failed > 0 {
+					log.Warnf("%d of %d URL-backed blocks failed verification", res.Failed, res.Blocks)
+				}
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the periodic verification.
+func (s *Store) Stop() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// Get returns a block. URL-backed blocks that can't be fetched from any of
+// their URLs are reported as missing, so that they are fetched from the
+// network instead.
+//
+// The blockstore interface doesn't pass the context of the request, so the
+// fetch is bounded by the get timeout instead.
+func (s *Store) Get(c cid.Cid) (blocks.Block, error) {
+	blk, err := s.MainBlockstore().Get(c)
+	if err != blockstore.ErrNotFound {
+		return blk, err
+	}
+	ref := filestore.List(s.Filestore, c)
+	if ref.Status != filestore.StatusOk || !filestore.IsURL(ref.FilePath) || !s.FileManager().AllowUrls {
+		return s.Filestore.Get(c)
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.getTimeout)
+	defer cancel()
+	blk, _, err = s.fetch(ctx, ref)
+	if err != nil {
+		log.Warnw("fetching URL-backed block failed, looking for it on the network", "cid", c, "url", ref.FilePath, "error", err)
+		return nil, blockstore.ErrNotFound
+	}
+	return blk, nil
+}
+
+// Put stores a block. The filestore ignores the blocks it has a reference
+// to, so the URL-backed blocks fetched from the network are stored in the
+// blockstore here.
+func (s *Store) Put(b blocks.Block) error {
+	if s.urlBacked(b) {
+		return s.MainBlockstore().Put(b)
+	}
+	return s.Filestore.Put(b)
+}
+
+// PutMany stores blocks, like Put.
+func (s *Store) PutMany(bs []blocks.Block) error {
+	var fetched, others []blocks.Block
+	for _, b := range bs {
+		if s.urlBacked(b) {
+			fetched = append(fetched, b)
+		} else {
+			others = append(others, b)
+		}
+	}
+	if len(fetched) > 0 {
+		if err := s.MainBlockstore().PutMany(fetched); err != nil {
+			return err
+		}
+	}
+	return s.Filestore.PutMany(others)
+}
+
+// urlBacked returns whether a block that isn't a reference only has a
+// reference to a URL.
+func (s *Store) urlBacked(b blocks.Block) bool {
+	if _, ok := b.(*posinfo.FilestoreNode); ok {
+		return false
+	}
+	if has, err := s.FileManager().Has(b.Cid()); err != nil || !has {
+		return false
+	}
+	if has, err := s.MainBlockstore().Has(b.Cid()); err != nil || has {
+		return false
+	}
+	return filestore.IsURL(filestore.List(s.Filestore, b.Cid()).FilePath)
+}
+
+// Health returns the health of the URLs requested, sorted by URL.
+func (s *Store) Health() []Health {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Health, 0, len(s.health))
+	for _, h := range s.health {
+		out = append(out, *h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
+
+// LastVerify returns the result of the last verification, whose time is zero
+// if none was made.
+func (s *Store) LastVerify() VerifyResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastVerify
+}
+
+// Verify fetches all the URL-backed blocks, calling report with the status of
+// each one when it isn't nil.
+func (s *Store) Verify(ctx context.Context, report func(BlockStatus) error) (VerifyResult, error) {
+	res := VerifyResult{Time: time.Now()}
+	next, err := filestore.ListAll(s.Filestore, false)
+	if err != nil {
+		return res, err
+	}
+	for ref := next(); ref != nil; ref = next() {
+		if ref.Status != filestore.StatusOk || !filestore.IsURL(ref.FilePath) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		_, source, err := s.fetch(ctx, ref)
+		res.Blocks++
+		if err != nil {
+			res.Failed++
+		}
+		if report != nil {
+			if err := report(BlockStatus{Key: ref.Key, URL: ref.FilePath, Source: source, Error: err}); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.lastVerify = res
+	s.mu.Unlock()
+	return res, nil
+}
+
+// errChanged is returned when a URL serves data that doesn't match the block.
+var errChanged = errors.New("data did not match the block")
+
+// permanentError is an error that retrying the request won't fix.
+type permanentError struct{ error }
+
+// fetch fetches the block of ref from its URL and mirrors, returning the
+// URL that served it. The URLs that are down are only tried once.
+func (s *Store) fetch(ctx context.Context, ref *filestore.ListRes) (blocks.Block, string, error) {
+	var errs []string
+	for _, u := range s.sources(ref.FilePath) {
+		attempts := s.attempts
+		if s.down(u) {
+			attempts = 1
+		}
+		for attempt := 0; attempt < attempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-time.After(s.retryDelay << (attempt - 1)):
+				case <-ctx.Done():
+					return nil, "", ctx.Err()
+				}
+			}
+
+			blk, err := s.fetchRange(ctx, ref.Key, u, ref.Offset, ref.Size)
+			s.record(u, err)
+			if err == nil {
+				return blk, u, nil
+			}
+			log.Debugw("fetching URL-backed block", "cid", ref.Key, "url", u, "attempt", attempt+1, "error", err)
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
+			var perm permanentError
+			if errors.As(err, &perm) {
+				errs = append(errs, fmt.Sprintf("%s: %s", u, err))
+				break
+			}
+			if attempt == attempts-1 {
+				errs = append(errs, fmt.Sprintf("%s: %s", u, err))
+			}
+		}
+	}
+	return nil, "", errors.New(strings.Join(errs, "; "))
+}
+
+// sources returns the URL and its mirrors, with the ones that are down last.
+func (s *Store) sources(u string) []string {
+	out := []string{u}
+	for _, m := range s.mirrors {
+		if strings.HasPrefix(u, m.prefix) {
+			for _, p := range m.mirrors {
+				out = append(out, p+strings.TrimPrefix(u, m.prefix))
+			}
+			break
+		}
+	}
+
+	down := make(map[string]bool, len(out))
+	for _, u := range out {
+		down[u] = s.down(u)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return !down[out[i]] && down[out[j]] })
+	return out
+}
+
+// down returns whether a URL is down.
+func (s *Store) down(u string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.health[u]
+	return ok && h.Down
+}
+
+func (s *Store) fetchRange(ctx context.Context, c cid.Cid, u string, offset, size uint64) (blocks.Block, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the range.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, int64(offset)); err != nil {
+			return nil, permanentError{errChanged}
+		}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return nil, permanentError{fmt.Errorf("HTTP %s", resp.Status)}
+	default:
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, permanentError{errChanged}
+		}
+		return nil, err
+	}
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, permanentError{err}
+	}
+	if !sum.Equals(c) {
+		return nil, permanentError{errChanged}
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (s *Store) record(u string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.health[u]
+	if !ok {
+		h = &Health{URL: u}
+		s.health[u] = h
+	}
+	h.Requests++
+	if err == nil {
+		h.ConsecutiveFailures = 0
+		h.LastSuccess = time.Now()
+		h.Down = false
+		return
+	}
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastError = err.Error()
+	h.LastFailure = time.Now()
+	h.Down = h.ConsecutiveFailures >= s.downAfter
+}
@@ -0,0 +1,268 @@
+package urlstore
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	filestore "github.com/ipfs/go-filestore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	posinfo "github.com/ipfs/go-ipfs-posinfo"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+// server serves files from memory, with ranges.
+type server struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, ok := s.files[r.URL.Path]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+}
+
+func (s *server) set(p string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if data == nil {
+		delete(s.files, p)
+		return
+	}
+	s.files[p] = data
+}
+
+func newServer(t *testing.T) (*server, string) {
+	s := &server{files: make(map[string][]byte)}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts.URL
+}
+
+func newStore(t *testing.T, cfg Config) *Store {
+	ds := syncds.MutexWrap(datastore.NewMapDatastore())
+	fm := filestore.NewFileManager(ds, "/")
+	fm.AllowUrls = true
+	s, err := New(filestore.NewFilestore(blockstore.NewBlockstore(ds), fm), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+// putRef references the data at offset in the file at u.
+func putRef(t *testing.T, s *Store, u string, data []byte, offset uint64) *dag.RawNode {
+	nd := dag.NewRawNode(data[offset : offset+100])
+	err := s.FileManager().Put(&posinfo.FilestoreNode{
+		Node:    nd,
+		PosInfo: &posinfo.PosInfo{FullPath: u, Offset: offset},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+func content() []byte {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestMirrors(t *testing.T) {
+	origin, originURL := newServer(t)
+	mirror, mirrorURL := newServer(t)
+	data := content()
+	origin.set("/data/file", data)
+	mirror.set("/copy/file", data)
+
+	s := newStore(t, Config{
+		Attempts:   2,
+		RetryDelay: "1ms",
+		DownAfter:  2,
+		Mirrors:    map[string][]string{originURL + "/data/": {mirrorURL + "/copy/"}},
+	})
+	nd := putRef(t, s, originURL+"/data/file", data, 100)
+
+	blk, err := s.Get(nd.Cid())
+	if err != nil || !bytes.Equal(blk.RawData(), nd.RawData()) {
+		t.Fatalf("unexpected block (%v)", err)
+	}
+	health := func(u string) Health {
+		for _, h := range s.Health() {
+			if h.URL == u {
+				return h
+			}
+		}
+		return Health{}
+	}
+	originFile, mirrorFile := originURL+"/data/file", mirrorURL+"/copy/file"
+
+	// The block is fetched from the mirror when the origin fails, until
+	// the origin is down.
+	origin.set("/data/file", nil)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Get(nd.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := health(originFile); !h.Down || h.Failures != 2 || h.LastError == "" {
+		t.Fatalf("the origin should be down, got %+v", h)
+	}
+	if h := health(mirrorFile); h.Down || h.Requests != 2 {
+		t.Fatalf("unexpected mirror health %+v", h)
+	}
+
+	// The origin is down, so the mirror is tried first.
+	if _, err := s.Get(nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if h := health(originFile); h.Requests != 3 {
+		t.Errorf("the origin should be tried last, got %+v", h)
+	}
+
+	// The origin is up again once it serves the block.
+	origin.set("/data/file", data)
+	mirror.set("/copy/file", nil)
+	if _, err := s.Get(nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if h := health(originFile); h.Down || h.ConsecutiveFailures != 0 {
+		t.Errorf("the origin should be up again, got %+v", h)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var requests int
+	data := content()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	s := newStore(t, Config{Attempts: 3, RetryDelay: "1ms"})
+	nd := putRef(t, s, ts.URL+"/file", data, 100)
+	if _, err := s.Get(nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+}
+
+func TestNetworkFallback(t *testing.T) {
+	origin, originURL := newServer(t)
+	data := content()
+	origin.set("/file", data)
+
+	s := newStore(t, Config{Attempts: 1})
+	nd := putRef(t, s, originURL+"/file", data, 0)
+
+	// Changed data is reported as missing, so that the blockservice
+	// fetches the block from the network.
+	changed := content()
+	changed[0] = 42
+	origin.set("/file", changed)
+	if _, err := s.Get(nd.Cid()); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// Blocks fetched from the network are stored in the blockstore.
+	if err := s.Put(nd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	origin, originURL := newServer(t)
+	data := content()
+	origin.set("/file", data)
+
+	s := newStore(t, Config{Attempts: 1})
+	putRef(t, s, originURL+"/file", data, 0)
+	putRef(t, s, originURL+"/file", data, 100)
+	putRef(t, s, originURL+"/file", data, 200)
+
+	origin.set("/file", data[:150])
+	var failed []BlockStatus
+	res, err := s.Verify(context.Background(), func(st BlockStatus) error {
+		if st.Error != nil {
+			failed = append(failed, st)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blocks != 3 || res.Failed != 2 || len(failed) != 2 {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if s.LastVerify() != res {
+		t.Error("the result should be recorded")
+	}
+}
+
+func TestDownURLsAreNotRetried(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	s := newStore(t, Config{Attempts: 3, RetryDelay: "1ms", DownAfter: 3})
+	nd := putRef(t, s, ts.URL+"/file", content(), 0)
+	for _, expected := range []int{3, 4} {
+		if _, err := s.Get(nd.Cid()); err != blockstore.ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+		mu.Lock()
+		if requests != expected {
+			t.Errorf("expected %d requests, got %d", expected, requests)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	s := newStore(t, Config{Attempts: 3, RetryDelay: "1ms", GetTimeout: "50ms"})
+	nd := putRef(t, s, ts.URL+"/file", content(), 0)
+	start := time.Now()
+	if _, err := s.Get(nd.Cid()); err != blockstore.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Get took %s", d)
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"os"
 	"strings"
 
+	"github.com/ipfs/go-ipfs/core/coreunix"
+
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
 	path "github.com/ipfs/interface-go-ipfs-core/path"
@@ -250,6 +252,24 @@ func (d *Directory) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeDir | 0555
 	a.Uid = uint32(os.Getuid())
 	a.Gid = uint32(os.Getgid())
+	return posixAttr(d.dir, a)
+}
+
+// posixAttr sets the attributes stored in the node of an MFS file or
+// directory.
+func posixAttr(fsn mfs.FSNode, a *fuse.Attr) error {
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return err
+	}
+	p, err := coreunix.PosixFromNode(nd)
+	if err != nil {
+		return err
+	}
+	if p.HasMode {
+		a.Mode = a.Mode&os.ModeType | p.Mode
+	}
+	a.Mtime = p.Mtime
 	return nil
 }
 
@@ -265,7 +285,7 @@ func (fi *FileNode) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Size = uint64(size)
 	a.Uid = uint32(os.Getuid())
 	a.Gid = uint32(os.Getgid())
-	return nil
+	return posixAttr(fi.fi, a)
 }
 
 // Lookup performs a lookup under this node.
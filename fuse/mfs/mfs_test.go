@@ -0,0 +1,399 @@
+// +build !nofuse,!openbsd,!netbsd,!plan9
+
+package mfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+
+	core "github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreunix"
+	"github.com/ipfs/go-ipfs/mfs/journal"
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+
+	fstest "bazil.org/fuse/fs/fstestutil"
+	gomfs "github.com/ipfs/go-mfs"
+	ci "github.com/libp2p/go-libp2p-testing/ci"
+)
+
+func maybeSkipFuseTests(t *testing.T) {
+	if ci.NoFuse() {
+		t.Skip("Skipping FUSE tests")
+	}
+}
+
+type mountWrap struct {
+	*fstest.Mount
+	Fs *FileSystem
+}
+
+func (m *mountWrap) Close() error {
+	m.Fs.Destroy()
+	m.Mount.Close()
+	return nil
+}
+
+func setupMfsTest(t *testing.T) (*core.IpfsNode, *mountWrap) {
+	t.Helper()
+	maybeSkipFuseTests(t)
+
+	node, err := core.NewNode(context.Background(), &core.BuildCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewFileSystem(node.Context(), node.FilesRoot, node.DAG, node.FilesJournal)
+	mnt, err := fstest.MountedT(t, fs, nil)
+	if err == fuse.ErrOSXFUSENotFound {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("error mounting at temporary directory: %v", err)
+	}
+
+	return node, &mountWrap{
+		Mount: mnt,
+		Fs:    fs,
+	}
+}
+
+// readMfs reads a file from the MFS root of the node.
+func readMfs(t *testing.T, node *core.IpfsNode, p string) []byte {
+	t.Helper()
+	fsn, err := gomfs.Lookup(node.FilesRoot, p)
+	if err != nil {
+		t.Fatalf("looking up %s: %s", p, err)
+	}
+	fd, err := fsn.(*gomfs.File).Open(gomfs.Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	data, err := ioutil.ReadAll(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWriteRead(t *testing.T) {
+	node, mnt := setupMfsTest(t)
+	defer mnt.Close()
+
+	p := filepath.Join(mnt.Dir, "file")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if data := readMfs(t, node, "/file"); string(data) != "hello world" {
+		t.Fatalf("MFS holds %q after fsync", data)
+	}
+	if _, err := f.WriteAt([]byte("W"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data := readMfs(t, node, "/file"); string(data) != "hello World" {
+		t.Fatalf("MFS holds %q after close", data)
+	}
+
+	if err := os.Truncate(p, 5); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("read %q after truncating", data)
+	}
+
+	if err := ioutil.WriteFile(p, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data := readMfs(t, node, "/file"); string(data) != "new" {
+		t.Fatalf("MFS holds %q after rewriting", data)
+	}
+}
+
+func TestTree(t *testing.T) {
+	node, mnt := setupMfsTest(t)
+	defer mnt.Close()
+
+	dir := filepath.Join(mnt.Dir, "a", "b")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b/file", filepath.Join(mnt.Dir, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := os.Remove(filepath.Join(mnt.Dir, "a", "b"))
+	if !errorIs(err, syscall.ENOTEMPTY) {
+		t.Fatalf("removing a non-empty directory: %v", err)
+	}
+
+	if err := os.Rename(filepath.Join(mnt.Dir, "a"), filepath.Join(mnt.Dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(mnt.Dir, "c", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" {
+		t.Fatalf("read %q through the link", data)
+	}
+	if target, err := os.Readlink(filepath.Join(mnt.Dir, "c", "link")); err != nil || target != "b/file" {
+		t.Fatalf("link targets %q: %v", target, err)
+	}
+	if data := readMfs(t, node, "/c/b/file"); string(data) != "content" {
+		t.Fatalf("MFS holds %q after renaming", data)
+	}
+	if _, err := os.Stat(filepath.Join(mnt.Dir, "a")); !os.IsNotExist(err) {
+		t.Fatalf("renamed directory still exists: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(mnt.Dir, "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "b" || entries[1].Name() != "link" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+
+	if err := os.Remove(filepath.Join(mnt.Dir, "c", "b", "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(mnt.Dir, "c", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gomfs.Lookup(node.FilesRoot, "/c/b"); err == nil {
+		t.Fatal("removed directory still in MFS")
+	}
+}
+
+func TestRemoveOpen(t *testing.T) {
+	node, mnt := setupMfsTest(t)
+	defer mnt.Close()
+
+	p := filepath.Join(mnt.Dir, "file")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gomfs.Lookup(node.FilesRoot, "/file"); err == nil {
+		t.Fatal("removed file written back to MFS")
+	}
+}
+
+func TestReadOpenFile(t *testing.T) {
+	node, mnt := setupMfsTest(t)
+	defer mnt.Close()
+
+	p := filepath.Join(mnt.Dir, "file")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is read as 'ipfs files read' does, with the lock of the
+	// MFS root taken, while it's open for writing.
+	read := make(chan string, 1)
+	go func() {
+		lk := rootlock.For(node.FilesRoot)
+		lk.RLock()
+		defer lk.RUnlock()
+		fsn, err := gomfs.Lookup(node.FilesRoot, "/file")
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		fd, err := fsn.(*gomfs.File).Open(gomfs.Flags{Read: true})
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		defer fd.Close()
+		data, err := ioutil.ReadAll(fd)
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		read <- string(data)
+	}()
+	select {
+	case data := <-read:
+		if data != "hello" {
+			t.Fatalf("MFS holds %q while the file is open", data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("reading the file through MFS blocked while it's open")
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world" {
+		t.Fatalf("mount reads %q with the buffered writes", data)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data := readMfs(t, node, "/file"); string(data) != "hello world" {
+		t.Fatalf("MFS holds %q after close", data)
+	}
+}
+
+func TestPosix(t *testing.T) {
+	node, mnt := setupMfsTest(t)
+	defer mnt.Close()
+
+	p := filepath.Join(mnt.Dir, "file")
+	if err := ioutil.WriteFile(p, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if err := os.Chmod(p, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode() != 0600 || !st.ModTime().Equal(mtime) {
+		t.Fatalf("unexpected attributes: %v %v", st.Mode(), st.ModTime())
+	}
+
+	fsn, err := gomfs.Lookup(node.FilesRoot, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	posix, err := coreunix.PosixFromNode(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !posix.HasMode || posix.Mode != 0600 || !posix.Mtime.Equal(mtime) {
+		t.Fatalf("unexpected metadata in MFS: %+v", posix)
+	}
+	if data := readMfs(t, node, "/file"); string(data) != "content" {
+		t.Fatalf("MFS holds %q after chmod", data)
+	}
+
+	// Writing updates the stored mtime.
+	if err := ioutil.WriteFile(p, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err = os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.ModTime().After(mtime) {
+		t.Fatalf("mtime not updated by writing: %v", st.ModTime())
+	}
+}
+
+func TestJournal(t *testing.T) {
+	node, mnt := setupMfsTest(t)
+	defer mnt.Close()
+
+	p := filepath.Join(mnt.Dir, "file")
+	if err := ioutil.WriteFile(p, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(mnt.Dir, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(mnt.Dir, "dir", "file")
+	if err := os.Rename(p, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(moved, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(moved); err != nil {
+		t.Fatal(err)
+	}
+
+	last := make(map[string]journal.Entry)
+	err := node.FilesJournal.ForEach(journal.Filter{}, func(e journal.Entry) error {
+		last[e.Op] = e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := last[journal.OpWrite]; e.Path != "/file" || !e.New.Defined() {
+		t.Errorf("unexpected write %+v", e)
+	}
+	if e := last[journal.OpMkdir]; e.Path != "/dir" {
+		t.Errorf("unexpected mkdir %+v", e)
+	}
+	if e := last[journal.OpMv]; e.Path != "/dir/file" || e.From != "/file" {
+		t.Errorf("unexpected mv %+v", e)
+	}
+	if e := last[journal.OpChmod]; e.Path != "/dir/file" || e.Old.Equals(e.New) {
+		t.Errorf("unexpected chmod %+v", e)
+	}
+	if e := last[journal.OpRm]; e.Path != "/dir/file" || !e.Old.Equals(last[journal.OpChmod].New) || e.New.Defined() {
+		t.Errorf("unexpected rm %+v", e)
+	}
+}
+
+func errorIs(err error, errno syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == errno
+	}
+	return false
+}
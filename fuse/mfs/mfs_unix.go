@@ -0,0 +1,1172 @@
+// +build !nofuse,!openbsd,!netbsd,!plan9
+
+// package fuse/mfs implements a read-write fuse filesystem over the MFS
+// root, the tree of 'ipfs files'.
+package mfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	gopath "path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ipfs/go-ipfs/core/coreunix"
+	"github.com/ipfs/go-ipfs/mfs/journal"
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+
+	fuse "bazil.org/fuse"
+	fs "bazil.org/fuse/fs"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log"
+	dag "github.com/ipfs/go-merkledag"
+	gomfs "github.com/ipfs/go-mfs"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+func init() {
+	if os.Getenv("IPFS_FUSE_DEBUG") != "" {
+		fuse.Debug = func(msg interface{}) {
+			fmt.Println(msg)
+		}
+	}
+}
+
+var log = logging.Logger("fuse/mfs")
+
+// Default permissions of the nodes without stored ones. Files and
+// directories created with other permissions store them.
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+)
+
+// FileSystem is the read-write fuse filesystem of the MFS root.
+//
+// The nodes are looked up in MFS by path on every operation, as MFS
+// replaces its objects when the metadata of a node changes. Writes are
+// buffered per file, and applied to the MFS root when the file is closed or
+// synced, when its buffer is full, or when the tree changes around it.
+type FileSystem struct {
+	ctx     context.Context
+	root    *gomfs.Root
+	dag     ipld.DAGService
+	journal *journal.Journal
+
+	// mu guards the tree: the operations changing it take it for writing,
+	// with the lock of the MFS root, and the reads and writes of open files
+	// for reading.
+	mu sync.RWMutex
+	// nodes holds the nodes known to the kernel by path, so that they can
+	// be renamed.
+	nodes map[string]fsNode
+	// open holds the files with open handles.
+	open map[*File]struct{}
+}
+
+// NewFileSystem returns a filesystem of the MFS root. The changes are recorded
+// in j, like the ones made with 'ipfs files', unless it is nil.
+func NewFileSystem(ctx context.Context, root *gomfs.Root, ds ipld.DAGService, j *journal.Journal) *FileSystem {
+	return &FileSystem{
+		ctx:     ctx,
+		root:    root,
+		dag:     ds,
+		journal: j,
+		nodes:   make(map[string]fsNode),
+		open:    make(map[*File]struct{}),
+	}
+}
+
+// Root returns the root directory of the filesystem.
+func (f *FileSystem) Root() (fs.Node, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.node("/", func() fsNode { return &Dir{fs: f, path: "/"} }), nil
+}
+
+// Destroy flushes the open files when the filesystem is unmounted.
+func (f *FileSystem) Destroy() {
+	defer f.lock()()
+	for fi := range f.open {
+		if err := fi.sync(); err != nil {
+			log.Errorf("flushing %s: %s", fi.path, err)
+		}
+	}
+	f.open = make(map[*File]struct{})
+	if err := f.root.GetDirectory().Flush(); err != nil {
+		log.Errorf("flushing the MFS root: %s", err)
+	}
+}
+
+// lock takes f.mu for writing and the lock of the MFS root, for the
+// operations changing the tree. It returns the function unlocking them.
+func (f *FileSystem) lock() func() {
+	f.mu.Lock()
+	lk := rootlock.For(f.root)
+	lk.Lock()
+	return func() {
+		lk.Unlock()
+		f.mu.Unlock()
+	}
+}
+
+// record records a change to p in the files journal. The change is made
+// already, so a failure is only logged.
+func (f *FileSystem) record(op, p, from string, old cid.Cid) {
+	if f.journal == nil {
+		return
+	}
+	if err := f.journal.Record(f.root, journal.ActorFuse, op, p, from, old); err != nil {
+		log.Errorf("%s %s: %s", op, p, err)
+	}
+}
+
+type fsNode interface {
+	fs.Node
+	nodePath() *string
+}
+
+// node returns the node cached at p, or caches the one returned by create.
+// It must be called with f.mu taken for writing.
+func (f *FileSystem) node(p string, create func() fsNode) fsNode {
+	n, ok := f.nodes[p]
+	if ok {
+		// The type of the node may have changed through the API.
+		nn := create()
+		if fmt.Sprintf("%T", n) == fmt.Sprintf("%T", nn) {
+			return n
+		}
+		n = nn
+	} else {
+		n = create()
+	}
+	f.nodes[p] = n
+	return n
+}
+
+// forget removes a node from the cache.
+func (f *FileSystem) forget(n fsNode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p := *n.nodePath(); f.nodes[p] == n {
+		delete(f.nodes, p)
+	}
+}
+
+// under returns whether p is dir or is under it.
+func under(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// syncUnder syncs the open files under p, so that the tree can be changed.
+func (f *FileSystem) syncUnder(p string) error {
+	for fi := range f.open {
+		if fi.orphan == nil && under(fi.path, p) {
+			if err := fi.sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookup returns the MFS node at p.
+func (f *FileSystem) lookup(p string) (gomfs.FSNode, error) {
+	fsn, err := gomfs.Lookup(f.root, p)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	return fsn, nil
+}
+
+// lookupDir returns the MFS directory at p.
+func (f *FileSystem) lookupDir(p string) (*gomfs.Directory, error) {
+	fsn, err := f.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := fsn.(*gomfs.Directory)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	return dir, nil
+}
+
+// replace replaces the node at p, whose open files must be synced.
+func (f *FileSystem) replace(p string, nd ipld.Node) error {
+	parent, err := f.lookupDir(gopath.Dir(p))
+	if err != nil {
+		return err
+	}
+	name := gopath.Base(p)
+	if err := parent.Unlink(name); err != nil {
+		return mapErr(err)
+	}
+	if err := parent.AddChild(name, nd); err != nil {
+		return mapErr(err)
+	}
+	return parent.Flush()
+}
+
+// setPosix changes the metadata of the node at p.
+func (f *FileSystem) setPosix(p string, update func(*coreunix.Posix)) error {
+	if p == "/" {
+		return syscall.EPERM
+	}
+	if err := f.syncUnder(p); err != nil {
+		return err
+	}
+
+	fsn, err := f.lookup(p)
+	if err != nil {
+		return err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return err
+	}
+	posix, err := coreunix.PosixFromNode(nd)
+	if err != nil {
+		return err
+	}
+	update(&posix)
+	changed, err := coreunix.WithPosix(nd, posix)
+	if err != nil {
+		return err
+	}
+	if err := f.dag.Add(f.ctx, changed); err != nil {
+		return err
+	}
+	return f.replace(p, changed)
+}
+
+// setattr applies the mode and mtime of a setattr request.
+func (f *FileSystem) setattr(p string, req *fuse.SetattrRequest) error {
+	if !req.Valid.Mode() && !req.Valid.Mtime() {
+		return nil
+	}
+	mtime := req.Mtime
+	if req.Valid.MtimeNow() {
+		mtime = time.Now()
+	}
+	old := journal.CidAt(f.root, p)
+	err := f.setPosix(p, func(posix *coreunix.Posix) {
+		if req.Valid.Mode() {
+			posix.Mode = req.Mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+			posix.HasMode = true
+		}
+		if req.Valid.Mtime() {
+			posix.Mtime = mtime
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if req.Valid.Mode() {
+		f.record(journal.OpChmod, p, "", old)
+	} else {
+		f.record(journal.OpTouch, p, "", old)
+	}
+	return nil
+}
+
+// attr sets the attributes stored in the node of an MFS file or directory.
+func attr(nd ipld.Node, a *fuse.Attr) error {
+	p, err := coreunix.PosixFromNode(nd)
+	if err != nil {
+		return err
+	}
+	if p.HasMode {
+		a.Mode = a.Mode&os.ModeType | p.Mode
+	}
+	a.Mtime = p.Mtime
+	a.Ctime = p.Mtime
+	a.Uid = uint32(os.Getuid())
+	a.Gid = uint32(os.Getgid())
+	return nil
+}
+
+// isSymlink returns whether an MFS file holds a symbolic link.
+func isSymlink(fsn gomfs.FSNode) (bool, error) {
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return false, err
+	}
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return false, nil
+	}
+	fsnode, err := ft.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return false, err
+	}
+	return fsnode.Type() == ft.TSymlink, nil
+}
+
+// mapErr returns the errno of MFS errors.
+func mapErr(err error) error {
+	switch {
+	case err == os.ErrNotExist:
+		return fuse.ENOENT
+	case err == os.ErrExist, err == gomfs.ErrDirExists:
+		return fuse.EEXIST
+	case errors.Is(err, gomfs.ErrNotYetImplemented):
+		return fuse.ENOSYS
+	}
+	return err
+}
+
+// Dir is a directory of the filesystem.
+type Dir struct {
+	fs   *FileSystem
+	path string
+}
+
+func (d *Dir) nodePath() *string { return &d.path }
+
+func (d *Dir) child(name string) string {
+	return gopath.Join(d.path, name)
+}
+
+// Attr returns the attributes of the directory.
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	dir, err := d.fs.lookupDir(d.path)
+	if err != nil {
+		return err
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		return err
+	}
+	a.Mode = os.ModeDir | defaultDirMode
+	return attr(nd, a)
+}
+
+// Lookup returns the node of an entry of the directory.
+func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	dir, err := d.fs.lookupDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	child, err := dir.Child(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+
+	p := d.child(name)
+	switch child := child.(type) {
+	case *gomfs.Directory:
+		return d.fs.node(p, func() fsNode { return &Dir{fs: d.fs, path: p} }), nil
+	case *gomfs.File:
+		link, err := isSymlink(child)
+		if err != nil {
+			return nil, err
+		}
+		if link {
+			return d.fs.node(p, func() fsNode { return &Symlink{fs: d.fs, path: p} }), nil
+		}
+		return d.fs.node(p, func() fsNode { return &File{fs: d.fs, path: p} }), nil
+	default:
+		return nil, fuse.EIO
+	}
+}
+
+// ReadDirAll lists the entries of the directory.
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	d.fs.mu.RLock()
+	defer d.fs.mu.RUnlock()
+	dir, err := d.fs.lookupDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fuse.Dirent, 0, len(names))
+	for _, name := range names {
+		child, err := dir.Child(name)
+		if err != nil {
+			return nil, err
+		}
+		dirent := fuse.Dirent{Name: name, Type: fuse.DT_File}
+		switch child.(type) {
+		case *gomfs.Directory:
+			dirent.Type = fuse.DT_Dir
+		case *gomfs.File:
+			if link, err := isSymlink(child); err != nil {
+				return nil, err
+			} else if link {
+				dirent.Type = fuse.DT_Link
+			}
+		}
+		entries = append(entries, dirent)
+	}
+	return entries, nil
+}
+
+// Setattr changes the mode and mtime of the directory.
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	defer d.fs.lock()()
+	return d.fs.setattr(d.path, req)
+}
+
+// Mkdir creates a directory, which stores its mode when not the default.
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	defer d.fs.lock()()
+	dir, err := d.fs.lookupDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dir.Mkdir(req.Name); err != nil {
+		return nil, mapErr(err)
+	}
+	if err := dir.Flush(); err != nil {
+		return nil, err
+	}
+
+	p := d.child(req.Name)
+	if mode := req.Mode.Perm() &^ req.Umask; mode != defaultDirMode {
+		err := d.fs.setPosix(p, func(posix *coreunix.Posix) {
+			posix.Mode = mode
+			posix.HasMode = true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	d.fs.record(journal.OpMkdir, p, "", cid.Undef)
+	return d.fs.node(p, func() fsNode { return &Dir{fs: d.fs, path: p} }), nil
+}
+
+// Create creates an empty file and opens it. The file stores its creation
+// time, which is updated by writes, and its mode when not the default.
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	defer d.fs.lock()()
+	dir, err := d.fs.lookupDir(d.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	empty := dag.NodeWithData(ft.FilePBData(nil, 0))
+	empty.SetCidBuilder(dir.GetCidBuilder())
+	posix := coreunix.Posix{Mtime: time.Now()}
+	if mode := req.Mode.Perm() &^ req.Umask; mode != defaultFileMode {
+		posix.Mode = mode
+		posix.HasMode = true
+	}
+	nd, err := coreunix.WithPosix(empty, posix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := dir.AddChild(req.Name, nd); err != nil {
+		return nil, nil, mapErr(err)
+	}
+	if err := dir.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	p := d.child(req.Name)
+	d.fs.record(journal.OpWrite, p, "", cid.Undef)
+	fi := d.fs.node(p, func() fsNode { return &File{fs: d.fs, path: p} }).(*File)
+	fi.refs++
+	d.fs.open[fi] = struct{}{}
+	return fi, &Handle{fi: fi}, nil
+}
+
+// Symlink creates a symbolic link.
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	defer d.fs.lock()()
+	dir, err := d.fs.lookupDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ft.SymlinkData(req.Target)
+	if err != nil {
+		return nil, err
+	}
+	nd := dag.NodeWithData(data)
+	nd.SetCidBuilder(dir.GetCidBuilder())
+	if err := dir.AddChild(req.NewName, nd); err != nil {
+		return nil, mapErr(err)
+	}
+	if err := dir.Flush(); err != nil {
+		return nil, err
+	}
+	p := d.child(req.NewName)
+	d.fs.record(journal.OpWrite, p, "", cid.Undef)
+	return d.fs.node(p, func() fsNode { return &Symlink{fs: d.fs, path: p} }), nil
+}
+
+// Remove removes a file, or an empty directory. The open files removed keep
+// their content until they are closed.
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	defer d.fs.lock()()
+	p := d.child(req.Name)
+	old := journal.CidAt(d.fs.root, p)
+	if err := d.fs.remove(p, req.Dir); err != nil {
+		return err
+	}
+	d.fs.record(journal.OpRm, p, "", old)
+	return nil
+}
+
+func (f *FileSystem) remove(p string, isDir bool) error {
+	fsn, err := f.lookup(p)
+	if err != nil {
+		return err
+	}
+	if dir, ok := fsn.(*gomfs.Directory); ok {
+		if !isDir {
+			return syscall.EISDIR
+		}
+		names, err := dir.ListNames(f.ctx)
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	} else if isDir {
+		return syscall.ENOTDIR
+	}
+
+	// The open files are moved to a root of their own.
+	if err := f.syncUnder(p); err != nil {
+		return err
+	}
+	for fi := range f.open {
+		if fi.orphan != nil || !under(fi.path, p) {
+			continue
+		}
+		if err := fi.orphanFile(); err != nil {
+			log.Errorf("keeping removed file %s: %s", fi.path, err)
+			delete(f.open, fi)
+		}
+	}
+
+	parent, err := f.lookupDir(gopath.Dir(p))
+	if err != nil {
+		return err
+	}
+	if err := parent.Unlink(gopath.Base(p)); err != nil {
+		return mapErr(err)
+	}
+	for np := range f.nodes {
+		if under(np, p) {
+			delete(f.nodes, np)
+		}
+	}
+	return parent.Flush()
+}
+
+// Rename moves an entry of the directory, replacing the destination file or
+// empty directory.
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	nd, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.EIO
+	}
+	defer d.fs.lock()()
+
+	src := d.child(req.OldName)
+	dst := nd.child(req.NewName)
+	if src == dst {
+		return nil
+	}
+	if under(dst, src) {
+		return syscall.EINVAL
+	}
+	fsn, err := d.fs.lookup(src)
+	if err != nil {
+		return err
+	}
+	old := journal.CidAt(d.fs.root, dst)
+	if dfsn, err := d.fs.lookup(dst); err == nil {
+		_, srcDir := fsn.(*gomfs.Directory)
+		_, dstDir := dfsn.(*gomfs.Directory)
+		if srcDir && !dstDir {
+			return syscall.ENOTDIR
+		}
+		if err := d.fs.remove(dst, dstDir); err != nil {
+			return err
+		}
+	}
+
+	if err := d.fs.syncUnder(src); err != nil {
+		return err
+	}
+	// The node is read after the open files are synced.
+	fsn, err = d.fs.lookup(src)
+	if err != nil {
+		return err
+	}
+	node, err := fsn.GetNode()
+	if err != nil {
+		return err
+	}
+	sparent, err := d.fs.lookupDir(gopath.Dir(src))
+	if err != nil {
+		return err
+	}
+	dparent, err := d.fs.lookupDir(gopath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if err := sparent.Unlink(gopath.Base(src)); err != nil {
+		return mapErr(err)
+	}
+	if err := dparent.AddChild(gopath.Base(dst), node); err != nil {
+		return mapErr(err)
+	}
+	d.fs.move(src, dst)
+	if err := sparent.Flush(); err != nil {
+		return err
+	}
+	if err := dparent.Flush(); err != nil {
+		return err
+	}
+	d.fs.record(journal.OpMv, dst, src, old)
+	return nil
+}
+
+// move changes the paths of the nodes under src to dst.
+func (f *FileSystem) move(src, dst string) {
+	moved := make(map[string]fsNode)
+	for p, n := range f.nodes {
+		if under(p, src) {
+			delete(f.nodes, p)
+			np := dst + strings.TrimPrefix(p, src)
+			*n.nodePath() = np
+			moved[np] = n
+		}
+	}
+	for p, n := range moved {
+		f.nodes[p] = n
+	}
+	// The open files may have been looked up before being renamed.
+	for fi := range f.open {
+		if fi.orphan == nil && under(fi.path, src) && f.nodes[fi.path] != fi {
+			fi.path = dst + strings.TrimPrefix(fi.path, src)
+		}
+	}
+}
+
+// Fsync writes the pending changes of the directory to the MFS root.
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	defer d.fs.lock()()
+	if err := d.fs.syncUnder(d.path); err != nil {
+		return err
+	}
+	_, err := gomfs.FlushPath(ctx, d.fs.root, d.path)
+	return err
+}
+
+// Forget removes the directory from the cache of the filesystem.
+func (d *Dir) Forget() {
+	d.fs.forget(d)
+}
+
+// maxPending is the size of the writes buffered in a file above which they
+// are applied to MFS, without waiting for the file to be synced.
+const maxPending = 4 << 20
+
+// File is a file of the filesystem. The writes and truncations of its open
+// handles are buffered, and applied to MFS with the lock of the MFS root
+// taken. No MFS descriptor is kept open between the operations, so that the
+// file stays readable and writable through the API in between.
+type File struct {
+	fs   *FileSystem
+	path string
+
+	// mu guards the buffered changes.
+	mu      sync.Mutex
+	pending []change
+	// pendingSize is the size of the data of the buffered writes.
+	pendingSize int
+	// old is the CID of the file before the changes, recorded in the files
+	// journal with them when the file is synced. It's undefined when the
+	// file is unchanged.
+	old    cid.Cid
+	refs   int
+	orphan *gomfs.Root
+}
+
+// change is a buffered write of data at off, or truncation to off.
+type change struct {
+	off      int64
+	data     []byte
+	truncate bool
+}
+
+func (fi *File) nodePath() *string { return &fi.path }
+
+// file returns the MFS file, in the root of the file once removed.
+func (fi *File) file() (*gomfs.File, error) {
+	root := fi.fs.root
+	p := fi.path
+	if fi.orphan != nil {
+		root = fi.orphan
+		p = gopath.Base(fi.path)
+	}
+	fsn, err := gomfs.Lookup(root, p)
+	if err != nil {
+		return nil, mapErr(err)
+	}
+	mf, ok := fsn.(*gomfs.File)
+	if !ok {
+		return nil, syscall.EISDIR
+	}
+	return mf, nil
+}
+
+// buffer adds a change to the buffered ones. It must be called with fi.mu
+// taken, and fs.mu taken for reading at least.
+func (fi *File) buffer(c change) error {
+	if !fi.old.Defined() {
+		mf, err := fi.file()
+		if err != nil {
+			return err
+		}
+		nd, err := mf.GetNode()
+		if err != nil {
+			return err
+		}
+		fi.old = nd.Cid()
+	}
+	fi.pending = append(fi.pending, c)
+	fi.pendingSize += len(c.data)
+	return nil
+}
+
+// size returns the size of the file with the buffered changes, from the one
+// of its MFS node. It must be called with fi.mu taken.
+func (fi *File) size(size int64) int64 {
+	for _, c := range fi.pending {
+		if c.truncate {
+			size = c.off
+		} else if end := c.off + int64(len(c.data)); end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+// overlay applies the buffered changes to buf, holding the content of the
+// MFS node at off, zero past its end, and returns the size of the file with
+// them. It must be called with fi.mu taken.
+func (fi *File) overlay(buf []byte, off int64, size int64) int64 {
+	for _, c := range fi.pending {
+		if c.truncate {
+			// The content cut is read as zeros if the file grows again.
+			if from := c.off - off; from < int64(len(buf)) {
+				if from < 0 {
+					from = 0
+				}
+				zero(buf[from:])
+			}
+			size = c.off
+			continue
+		}
+		end := c.off + int64(len(c.data))
+		if end > size {
+			size = end
+		}
+		from, to := c.off, end
+		if from < off {
+			from = off
+		}
+		if max := off + int64(len(buf)); to > max {
+			to = max
+		}
+		if from < to {
+			copy(buf[from-off:to-off], c.data[from-c.off:to-c.off])
+		}
+	}
+	return size
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// apply writes the buffered changes to the MFS file, through a descriptor
+// closed before returning. It must be called with the lock of fs taken.
+func (fi *File) apply() error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if len(fi.pending) == 0 {
+		return nil
+	}
+	mf, err := fi.file()
+	if err != nil {
+		return err
+	}
+	fd, err := mf.Open(gomfs.Flags{Write: true, Sync: true})
+	if err != nil {
+		return err
+	}
+	for _, c := range fi.pending {
+		if c.truncate {
+			err = fd.Truncate(c.off)
+		} else {
+			_, err = fd.WriteAt(c.data, c.off)
+		}
+		if err != nil {
+			_ = fd.Close()
+			return err
+		}
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	fi.pending = nil
+	fi.pendingSize = 0
+	return nil
+}
+
+// orphanFile moves the file to a root of its own, as it's removed while
+// open.
+func (fi *File) orphanFile() error {
+	mf, err := fi.file()
+	if err != nil {
+		return err
+	}
+	nd, err := mf.GetNode()
+	if err != nil {
+		return err
+	}
+	root, err := gomfs.NewRoot(fi.fs.ctx, fi.fs.dag, ft.EmptyDirNode(), nil)
+	if err != nil {
+		return err
+	}
+	if err := root.GetDirectory().AddChild(gopath.Base(fi.path), nd); err != nil {
+		return err
+	}
+	fi.orphan = root
+	return nil
+}
+
+// truncate changes the size of the file. It must be called with fs.mu taken.
+func (fi *File) truncate(size int64) error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.buffer(change{off: size, truncate: true})
+}
+
+// release closes a handle of the file. The last one syncs it. It must be
+// called with fs.mu taken for writing.
+func (fi *File) release() error {
+	fi.refs--
+	if fi.refs > 0 {
+		return nil
+	}
+	delete(fi.fs.open, fi)
+	return fi.sync()
+}
+
+// sync applies the changes of the file to the MFS root, and records them in
+// the files journal. Files storing a modification time get the current one.
+// It must be called with the lock of fs taken.
+func (fi *File) sync() error {
+	if err := fi.apply(); err != nil {
+		return err
+	}
+	fi.mu.Lock()
+	old := fi.old
+	fi.old = cid.Undef
+	fi.mu.Unlock()
+	if !old.Defined() || fi.orphan != nil {
+		return nil
+	}
+
+	mf, err := fi.file()
+	if err != nil {
+		return err
+	}
+	nd, err := mf.GetNode()
+	if err != nil {
+		return err
+	}
+	posix, err := coreunix.PosixFromNode(nd)
+	if err != nil {
+		return err
+	}
+	if !posix.Mtime.IsZero() {
+		err := fi.fs.setPosix(fi.path, func(p *coreunix.Posix) {
+			p.Mtime = time.Now()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fi.fs.record(journal.OpWrite, fi.path, "", old)
+	return nil
+}
+
+// Attr returns the attributes of the file.
+func (fi *File) Attr(ctx context.Context, a *fuse.Attr) error {
+	fi.fs.mu.RLock()
+	defer fi.fs.mu.RUnlock()
+	mf, err := fi.file()
+	if err != nil {
+		return err
+	}
+	nd, err := mf.GetNode()
+	if err != nil {
+		return err
+	}
+
+	size, err := mf.Size()
+	if err != nil {
+		return err
+	}
+	fi.mu.Lock()
+	size = fi.size(size)
+	fi.mu.Unlock()
+	a.Size = uint64(size)
+	a.Mode = defaultFileMode
+	return attr(nd, a)
+}
+
+// Open opens a handle of the file.
+func (fi *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	fi.fs.mu.Lock()
+	defer fi.fs.mu.Unlock()
+	if req.Flags&fuse.OpenTruncate != 0 && !req.Flags.IsReadOnly() {
+		if err := fi.truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	fi.refs++
+	fi.fs.open[fi] = struct{}{}
+	return &Handle{fi: fi}, nil
+}
+
+// Setattr changes the size, mode and mtime of the file.
+func (fi *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	defer fi.fs.lock()()
+	if req.Valid.Size() {
+		if err := fi.truncate(int64(req.Size)); err != nil {
+			return err
+		}
+		// Without open handles, nothing else syncs the file.
+		if fi.refs == 0 {
+			if err := fi.sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if fi.orphan != nil {
+		return nil
+	}
+	return fi.fs.setattr(fi.path, req)
+}
+
+// Fsync propagates the changes of the file to the MFS root.
+func (fi *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	defer fi.fs.lock()()
+	return fi.sync()
+}
+
+// Forget removes the file from the cache of the filesystem.
+func (fi *File) Forget() {
+	fi.fs.forget(fi)
+}
+
+// Handle is an open handle of a file.
+type Handle struct {
+	fi *File
+}
+
+// Read reads from the file at the offset of the request, with the buffered
+// changes.
+func (h *Handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.fi.fs.mu.RLock()
+	defer h.fi.fs.mu.RUnlock()
+	h.fi.mu.Lock()
+	defer h.fi.mu.Unlock()
+
+	mf, err := h.fi.file()
+	if err != nil {
+		return err
+	}
+	fd, err := mf.Open(gomfs.Flags{Read: true})
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	size, err := fd.Size()
+	if err != nil {
+		return err
+	}
+	buf := resp.Data[:req.Size]
+	zero(buf)
+	if req.Offset < size {
+		if _, err := fd.Seek(req.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		n := len(buf)
+		if int64(n) > size-req.Offset {
+			n = int(size - req.Offset)
+		}
+		if _, err := fd.CtxReadFull(ctx, buf[:n]); err != nil {
+			return err
+		}
+	}
+	size = h.fi.overlay(buf, req.Offset, size)
+	if req.Offset >= size {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+	if int64(len(buf)) > size-req.Offset {
+		buf = buf[:size-req.Offset]
+	}
+	resp.Data = buf
+	return nil
+}
+
+// Write buffers a write to the file at the offset of the request. The writes
+// are applied to the MFS root when the file is flushed, or when the buffer
+// is full.
+func (h *Handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	fi := h.fi
+	fi.fs.mu.RLock()
+	fi.mu.Lock()
+	err := fi.buffer(change{off: req.Offset, data: append([]byte(nil), req.Data...)})
+	full := fi.pendingSize >= maxPending
+	fi.mu.Unlock()
+	fi.fs.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	if !full {
+		return nil
+	}
+	defer fi.fs.lock()()
+	return fi.apply()
+}
+
+// Flush propagates the changes of the file to the MFS root, when the file
+// is closed.
+func (h *Handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	defer h.fi.fs.lock()()
+	return h.fi.sync()
+}
+
+// Release closes the handle.
+func (h *Handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	defer h.fi.fs.lock()()
+	return h.fi.release()
+}
+
+// Symlink is a symbolic link of the filesystem.
+type Symlink struct {
+	fs   *FileSystem
+	path string
+}
+
+func (s *Symlink) nodePath() *string { return &s.path }
+
+// Attr returns the attributes of the link.
+func (s *Symlink) Attr(ctx context.Context, a *fuse.Attr) error {
+	target, err := s.target()
+	if err != nil {
+		return err
+	}
+	a.Mode = os.ModeSymlink | 0777
+	a.Size = uint64(len(target))
+	a.Uid = uint32(os.Getuid())
+	a.Gid = uint32(os.Getgid())
+	return nil
+}
+
+// Readlink returns the target of the link.
+func (s *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return s.target()
+}
+
+func (s *Symlink) target() (string, error) {
+	s.fs.mu.RLock()
+	defer s.fs.mu.RUnlock()
+	fsn, err := s.fs.lookup(s.path)
+	if err != nil {
+		return "", err
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return "", err
+	}
+	pn, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return "", fuse.EIO
+	}
+	fsnode, err := ft.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return "", err
+	}
+	return string(fsnode.Data()), nil
+}
+
+// Forget removes the link from the cache of the filesystem.
+func (s *Symlink) Forget() {
+	s.fs.forget(s)
+}
+
+// to check that the nodes implement all the interfaces we want
+type mfsDir interface {
+	fs.Node
+	fs.HandleReadDirAller
+	fs.NodeCreater
+	fs.NodeFsyncer
+	fs.NodeMkdirer
+	fs.NodeRemover
+	fs.NodeRenamer
+	fs.NodeSetattrer
+	fs.NodeStringLookuper
+	fs.NodeSymlinker
+	fs.NodeForgetter
+}
+
+var _ mfsDir = (*Dir)(nil)
+
+type mfsFile interface {
+	fs.Node
+	fs.NodeFsyncer
+	fs.NodeOpener
+	fs.NodeSetattrer
+	fs.NodeForgetter
+}
+
+var _ mfsFile = (*File)(nil)
+
+type mfsHandle interface {
+	fs.HandleFlusher
+	fs.HandleReader
+	fs.HandleWriter
+	fs.HandleReleaser
+}
+
+var _ mfsHandle = (*Handle)(nil)
+
+type mfsSymlink interface {
+	fs.Node
+	fs.NodeReadlinker
+	fs.NodeForgetter
+}
+
+var _ mfsSymlink = (*Symlink)(nil)
@@ -0,0 +1,40 @@
+package mount
+
+import (
+	"github.com/ipfs/go-ipfs/repo"
+)
+
+// ConfigKey is the config section of the mount settings unknown to
+// go-ipfs-config, next to its Mounts section.
+const ConfigKey = "FuseMounts"
+
+// DefaultReadAhead is the number of blocks prefetched ahead of sequential
+// reads of /ipfs.
+const DefaultReadAhead = 8
+
+// Config holds the mount settings unknown to go-ipfs-config.
+type Config struct {
+	// MFS is the mountpoint of the MFS root. It isn't mounted when empty.
+	MFS string
+	// ReadAhead is the number of file blocks prefetched ahead of sequential
+	// reads of /ipfs. Defaults to 8, disabled when negative.
+	ReadAhead int
+}
+
+// ReadAheadBlocks returns the number of blocks to prefetch, 0 when disabled.
+func (c Config) ReadAheadBlocks() int {
+	switch {
+	case c.ReadAhead < 0:
+		return 0
+	case c.ReadAhead == 0:
+		return DefaultReadAhead
+	}
+	return c.ReadAhead
+}
+
+// ReadConfig reads the mount settings from the config of r.
+func ReadConfig(r repo.Repo) (Config, error) {
+	var cfg Config
+	err := repo.ConfigSection(r, ConfigKey, &cfg)
+	return cfg, err
+}
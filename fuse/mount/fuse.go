@@ -28,16 +28,13 @@ type mount struct {
 }
 
 // Mount mounts a fuse fs.FS at a given location, and returns a Mount instance.
-// parent is a ContextGroup to bind the mount's ContextGroup to.
-func NewMount(p goprocess.Process, fsys fs.FS, mountpoint string, allow_other bool) (Mount, error) {
-	var conn *fuse.Conn
-	var err error
-
+// parent is a ContextGroup to bind the mount's ContextGroup to. opts are
+// passed to fuse.Mount.
+func NewMount(p goprocess.Process, fsys fs.FS, mountpoint string, allow_other bool, opts ...fuse.MountOption) (Mount, error) {
 	if allow_other {
-		conn, err = fuse.Mount(mountpoint, fuse.AllowOther())
-	} else {
-		conn, err = fuse.Mount(mountpoint)
+		opts = append(opts, fuse.AllowOther())
 	}
+	conn, err := fuse.Mount(mountpoint, opts...)
 
 	if err != nil {
 		return nil, err
@@ -0,0 +1,98 @@
+package mount
+
+import (
+	"sync/atomic"
+
+	flow "github.com/libp2p/go-flow-metrics"
+)
+
+// ReadStats counts the reads served by a mount.
+type ReadStats struct {
+	reads            uint64
+	sequentialReads  uint64
+	bytesRead        uint64
+	prefetchedBlocks uint64
+	prefetchErrors   uint64
+	attrCacheHits    uint64
+	attrCacheMisses  uint64
+	dirCacheHits     uint64
+	dirCacheMisses   uint64
+
+	// rate is only swept periodically, so the bytes read are counted
+	// separately.
+	rate flow.Meter
+}
+
+// ReadStatsSnapshot is the state of ReadStats at a point in time.
+type ReadStatsSnapshot struct {
+	Reads           uint64
+	SequentialReads uint64
+	BytesRead       uint64
+	// Rate is the number of bytes read per second, averaged over the last
+	// seconds.
+	Rate             float64
+	PrefetchedBlocks uint64
+	PrefetchErrors   uint64
+	AttrCacheHits    uint64
+	AttrCacheMisses  uint64
+	DirCacheHits     uint64
+	DirCacheMisses   uint64
+}
+
+// NewReadStats returns empty read stats.
+func NewReadStats() *ReadStats {
+	return &ReadStats{}
+}
+
+// Read records a read of n bytes.
+func (s *ReadStats) Read(n int, sequential bool) {
+	atomic.AddUint64(&s.reads, 1)
+	if sequential {
+		atomic.AddUint64(&s.sequentialReads, 1)
+	}
+	atomic.AddUint64(&s.bytesRead, uint64(n))
+	s.rate.Mark(uint64(n))
+}
+
+// Prefetched records n blocks fetched ahead of reads, and a failure to fetch
+// more when err is set.
+func (s *ReadStats) Prefetched(n int, err error) {
+	atomic.AddUint64(&s.prefetchedBlocks, uint64(n))
+	if err != nil {
+		atomic.AddUint64(&s.prefetchErrors, 1)
+	}
+}
+
+// AttrCache records a lookup in the attribute cache.
+func (s *ReadStats) AttrCache(hit bool) {
+	if hit {
+		atomic.AddUint64(&s.attrCacheHits, 1)
+	} else {
+		atomic.AddUint64(&s.attrCacheMisses, 1)
+	}
+}
+
+// DirCache records a lookup in the directory listing cache.
+func (s *ReadStats) DirCache(hit bool) {
+	if hit {
+		atomic.AddUint64(&s.dirCacheHits, 1)
+	} else {
+		atomic.AddUint64(&s.dirCacheMisses, 1)
+	}
+}
+
+// Snapshot returns the current stats.
+func (s *ReadStats) Snapshot() ReadStatsSnapshot {
+	return ReadStatsSnapshot{
+		Reads:            atomic.LoadUint64(&s.reads),
+		SequentialReads:  atomic.LoadUint64(&s.sequentialReads),
+		BytesRead:        atomic.LoadUint64(&s.bytesRead),
+		Rate:             s.rate.Snapshot().Rate,
+		PrefetchedBlocks: atomic.LoadUint64(&s.prefetchedBlocks),
+		PrefetchErrors:   atomic.LoadUint64(&s.prefetchErrors),
+		AttrCacheHits:    atomic.LoadUint64(&s.attrCacheHits),
+		AttrCacheMisses:  atomic.LoadUint64(&s.attrCacheMisses),
+		DirCacheHits:     atomic.LoadUint64(&s.dirCacheHits),
+		DirCacheMisses:   atomic.LoadUint64(&s.dirCacheMisses),
+	}
+}
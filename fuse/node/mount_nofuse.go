@@ -8,6 +8,6 @@ import (
 	core "github.com/ipfs/go-ipfs/core"
 )
 
-func Mount(node *core.IpfsNode, fsdir, nsdir string) error {
+func Mount(node *core.IpfsNode, fsdir, nsdir, mfsdir string) error {
 	return errors.New("not compiled in")
 }
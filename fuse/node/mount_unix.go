@@ -10,6 +10,7 @@ import (
 
 	core "github.com/ipfs/go-ipfs/core"
 	ipns "github.com/ipfs/go-ipfs/fuse/ipns"
+	mfs "github.com/ipfs/go-ipfs/fuse/mfs"
 	mount "github.com/ipfs/go-ipfs/fuse/mount"
 	rofs "github.com/ipfs/go-ipfs/fuse/readonly"
 
@@ -30,7 +31,7 @@ var platformFuseChecks = func(*core.IpfsNode) error {
 	return nil
 }
 
-func Mount(node *core.IpfsNode, fsdir, nsdir string) error {
+func Mount(node *core.IpfsNode, fsdir, nsdir, mfsdir string) error {
 	// check if we already have live mounts.
 	// if the user said "Mount", then there must be something wrong.
 	// so, close them and try again.
@@ -42,15 +43,21 @@ func Mount(node *core.IpfsNode, fsdir, nsdir string) error {
 		// best effort
 		_ = node.Mounts.Ipns.Unmount()
 	}
+	if node.Mounts.Mfs != nil && node.Mounts.Mfs.IsActive() {
+		// best effort
+		_ = node.Mounts.Mfs.Unmount()
+	}
 
 	if err := platformFuseChecks(node); err != nil {
 		return err
 	}
 
-	return doMount(node, fsdir, nsdir)
+	return doMount(node, fsdir, nsdir, mfsdir)
 }
 
-func doMount(node *core.IpfsNode, fsdir, nsdir string) error {
+// doMount mounts /ipfs, /ipns when online, and the MFS root when mfsdir is
+// set.
+func doMount(node *core.IpfsNode, fsdir, nsdir, mfsdir string) error {
 	fmtFuseErr := func(err error, mountpoint string) error {
 		s := err.Error()
 		if strings.Contains(s, fuseNoDirectory) {
@@ -65,16 +72,18 @@ func doMount(node *core.IpfsNode, fsdir, nsdir string) error {
 		return err
 	}
 
-	// this sync stuff is so that both can be mounted simultaneously.
-	var fsmount, nsmount mount.Mount
-	var err1, err2 error
+	stats := mount.NewReadStats()
+
+	// this sync stuff is so that all can be mounted simultaneously.
+	var fsmount, nsmount, mfsmount mount.Mount
+	var err1, err2, err3 error
 
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		fsmount, err1 = rofs.Mount(node, fsdir)
+		fsmount, err1 = rofs.Mount(node, fsdir, stats)
 	}()
 
 	if node.IsOnline {
@@ -85,6 +94,14 @@ func doMount(node *core.IpfsNode, fsdir, nsdir string) error {
 		}()
 	}
 
+	if mfsdir != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mfsmount, err3 = mfs.Mount(node, mfsdir)
+		}()
+	}
+
 	wg.Wait()
 
 	if err1 != nil {
@@ -95,22 +112,34 @@ func doMount(node *core.IpfsNode, fsdir, nsdir string) error {
 		log.Errorf("error mounting: %s", err2)
 	}
 
-	if err1 != nil || err2 != nil {
+	if err3 != nil {
+		log.Errorf("error mounting: %s", err3)
+	}
+
+	if err1 != nil || err2 != nil || err3 != nil {
 		if fsmount != nil {
 			_ = fsmount.Unmount()
 		}
 		if nsmount != nil {
 			_ = nsmount.Unmount()
 		}
+		if mfsmount != nil {
+			_ = mfsmount.Unmount()
+		}
 
 		if err1 != nil {
 			return fmtFuseErr(err1, fsdir)
 		}
-		return fmtFuseErr(err2, nsdir)
+		if err2 != nil {
+			return fmtFuseErr(err2, nsdir)
+		}
+		return fmtFuseErr(err3, mfsdir)
 	}
 
 	// setup node state, so that it can be cancelled
 	node.Mounts.Ipfs = fsmount
 	node.Mounts.Ipns = nsmount
+	node.Mounts.Mfs = mfsmount
+	node.Mounts.IpfsStats = stats
 	return nil
 }
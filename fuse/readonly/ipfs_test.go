@@ -302,3 +302,76 @@ func TestFileSizeReporting(t *testing.T) {
 		t.Fatal("Read incorrect size from stat!")
 	}
 }
+
+// Test prefetching the leaves following an offset
+func TestPrefetchBlocks(t *testing.T) {
+	nd, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const size = 200 * 1024
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(u.NewTimeSeededRand(), buf); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := importer.BuildTrickleDagFromReader(nd.DAG, chunker.NewSizeSplitter(bytes.NewReader(buf), 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end, n, err := prefetchBlocks(nd.Context(), nd.DAG, obj, 5000, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 8 || end != 12*1024 {
+		t.Fatalf("prefetched %d leaves up to %d", n, end)
+	}
+
+	end, n, err = prefetchBlocks(nd.Context(), nd.DAG, obj, size-100, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || end != size {
+		t.Fatalf("prefetched %d leaves up to %d at the end of the file", n, end)
+	}
+}
+
+// Test that sequential reads are counted, and prefetch blocks
+func TestSequentialRead(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	maybeSkipFuseTests(t)
+
+	nd, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFileSystem(nd)
+	mnt, err := fstest.MountedT(t, fs, nil)
+	if err == fuse.ErrOSXFUSENotFound {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("error mounting temporary directory: %v", err)
+	}
+	defer mnt.Close()
+
+	fi, data := randObj(t, nd, 4*1024*1024)
+	rbuf, err := ioutil.ReadFile(path.Join(mnt.Dir, fi.Cid().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rbuf, data) {
+		t.Fatal("Incorrect Read!")
+	}
+
+	s := fs.Stats.Snapshot()
+	if s.BytesRead != uint64(len(data)) || s.SequentialReads == 0 {
+		t.Fatalf("unexpected read stats: %+v", s)
+	}
+	if s.AttrCacheMisses == 0 {
+		t.Fatalf("attributes not cached: %+v", s)
+	}
+}
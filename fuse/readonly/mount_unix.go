@@ -6,15 +6,28 @@ package readonly
 import (
 	core "github.com/ipfs/go-ipfs/core"
 	mount "github.com/ipfs/go-ipfs/fuse/mount"
+
+	fuse "bazil.org/fuse"
 )
 
+// kernelReadAhead is the read-ahead of the kernel, in blocks of the default
+// size, next to the one of the filesystem.
+const kernelReadAhead = 4 * 256 * 1024
+
 // Mount mounts IPFS at a given location, and returns a mount.Mount instance.
-func Mount(ipfs *core.IpfsNode, mountpoint string) (mount.Mount, error) {
+// The reads are counted in stats.
+func Mount(ipfs *core.IpfsNode, mountpoint string, stats *mount.ReadStats) (mount.Mount, error) {
 	cfg, err := ipfs.Repo.Config()
 	if err != nil {
 		return nil, err
 	}
+	mcfg, err := mount.ReadConfig(ipfs.Repo)
+	if err != nil {
+		return nil, err
+	}
 	allow_other := cfg.Mounts.FuseAllowOther
 	fsys := NewFileSystem(ipfs)
-	return mount.NewMount(ipfs.Process, fsys, mountpoint, allow_other)
+	fsys.ReadAhead = mcfg.ReadAheadBlocks()
+	fsys.Stats = stats
+	return mount.NewMount(ipfs.Process, fsys, mountpoint, allow_other, fuse.MaxReadahead(kernelReadAhead))
 }
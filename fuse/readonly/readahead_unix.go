@@ -0,0 +1,225 @@
+// +build linux darwin freebsd
+// +build !nofuse
+
+package readonly
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	fuse "bazil.org/fuse"
+	fs "bazil.org/fuse/fs"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// fileHandle is an open handle of a file. It keeps its reader between
+// sequential reads, and prefetches the blocks ahead of them.
+type fileHandle struct {
+	node   *Node
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	r  uio.DagReader
+	// next is the offset following the last read.
+	next int64
+
+	// The blocks are prefetched up to prefetchedTo, and the next ones once
+	// the reads get to prefetchFrom. gen changes when the reads stop being
+	// sequential, so that the running prefetch is ignored.
+	prefetchedTo int64
+	prefetchFrom int64
+	prefetching  bool
+	gen          int
+}
+
+func newFileHandle(n *Node) *fileHandle {
+	ctx, cancel := context.WithCancel(n.Ipfs.Context())
+	return &fileHandle{
+		node:   n,
+		ctx:    ctx,
+		cancel: cancel,
+		next:   -1,
+	}
+}
+
+// Read reads from the file at the offset of the request, with the reader of
+// the last read when sequential.
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.r == nil {
+		// The reader outlives the request, so it fetches with the context
+		// of the handle.
+		r, err := uio.NewDagReader(h.ctx, h.node.Nd, h.node.Ipfs.DAG)
+		if err != nil {
+			return err
+		}
+		h.r = r
+	}
+	sequential := req.Offset == h.next
+	if !sequential {
+		if _, err := h.r.Seek(req.Offset, io.SeekStart); err != nil {
+			h.r = nil
+			return err
+		}
+		h.prefetchedTo = 0
+		h.prefetchFrom = 0
+		h.gen++
+	}
+
+	// Data has a capacity of Size
+	buf := resp.Data[:int(req.Size)]
+	n, err := h.r.CtxReadFull(ctx, buf)
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF:
+	default:
+		h.r = nil
+		h.next = -1
+		return err
+	}
+	resp.Data = buf[:n]
+	h.next = req.Offset + int64(n)
+	h.node.fs.Stats.Read(n, sequential)
+
+	if sequential && h.node.fs.ReadAhead > 0 {
+		h.prefetch(h.next)
+	}
+	return nil
+}
+
+// prefetch fetches the blocks of the file following off in the background,
+// once the reads get past the middle of the blocks prefetched last. It must
+// be called with h.mu taken.
+func (h *fileHandle) prefetch(off int64) {
+	if h.prefetching || off < h.prefetchFrom {
+		return
+	}
+	from := off
+	if h.prefetchedTo > from {
+		from = h.prefetchedTo
+	}
+	h.prefetching = true
+	gen := h.gen
+
+	go func() {
+		end, n, err := prefetchBlocks(h.ctx, h.node.Ipfs.DAG, h.node.Nd, from, h.node.fs.ReadAhead)
+		if h.ctx.Err() != nil {
+			// The handle is released.
+			return
+		}
+		if err != nil {
+			log.Debugf("prefetching %s: %s", h.node.Nd.Cid(), err)
+		}
+		h.node.fs.Stats.Prefetched(n, err)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.prefetching = false
+		if gen != h.gen {
+			return
+		}
+		h.prefetchedTo = end
+		h.prefetchFrom = from + (end-from)/2
+		if h.prefetchFrom <= off {
+			// Nothing was fetched, retry with the next read.
+			h.prefetchFrom = off + 1
+		}
+	}()
+}
+
+// Release closes the handle, and stops its prefetching.
+func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.cancel()
+	return nil
+}
+
+// prefetchBlocks fetches the blocks of up to n leaves of the file nd from
+// offset off, with the internal nodes leading to them. It returns the offset
+// following the last leaf fetched, and the number of leaves fetched.
+func prefetchBlocks(ctx context.Context, ng ipld.NodeGetter, nd ipld.Node, off int64, n int) (int64, int, error) {
+	return prefetchChildren(ctx, ng, nd, 0, off, n)
+}
+
+func prefetchChildren(ctx context.Context, ng ipld.NodeGetter, nd ipld.Node, base, off int64, n int) (int64, int, error) {
+	pn, ok := nd.(*mdag.ProtoNode)
+	if !ok || len(pn.Links()) == 0 {
+		return off, 0, nil
+	}
+	fsn, err := ft.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return off, 0, err
+	}
+
+	// The children holding the data from off.
+	var cids []cid.Cid
+	var starts, sizes []int64
+	pos := base + int64(len(fsn.Data()))
+	for i, l := range pn.Links() {
+		size := int64(fsn.BlockSize(i))
+		if pos+size > off {
+			cids = append(cids, l.Cid)
+			starts = append(starts, pos)
+			sizes = append(sizes, size)
+			if len(cids) == n {
+				break
+			}
+		}
+		pos += size
+	}
+	if len(cids) == 0 {
+		return off, 0, nil
+	}
+
+	nodes := make(map[cid.Cid]ipld.Node, len(cids))
+	var fetchErr error
+	for opt := range ng.GetMany(ctx, cids) {
+		if opt.Err != nil {
+			if fetchErr == nil {
+				fetchErr = opt.Err
+			}
+			continue
+		}
+		nodes[opt.Node.Cid()] = opt.Node
+	}
+
+	end := off
+	fetched := 0
+	for i, c := range cids {
+		child, ok := nodes[c]
+		if !ok {
+			break
+		}
+		if len(child.Links()) == 0 {
+			fetched++
+			end = starts[i] + sizes[i]
+		} else {
+			e, f, err := prefetchChildren(ctx, ng, child, starts[i], off, n-fetched)
+			if f > 0 {
+				end = e
+			}
+			fetched += f
+			if err != nil {
+				return end, fetched, err
+			}
+		}
+		if fetched >= n {
+			break
+		}
+	}
+	return end, fetched, fetchErr
+}
+
+// to check that fileHandle implements all the interfaces we want
+type roFileHandle interface {
+	fs.HandleReader
+	fs.HandleReleaser
+}
+
+var _ roFileHandle = (*fileHandle)(nil)
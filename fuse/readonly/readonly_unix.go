@@ -9,8 +9,11 @@ import (
 	"io"
 	"os"
 	"syscall"
+	"time"
 
 	core "github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreunix"
+	mount "github.com/ipfs/go-ipfs/fuse/mount"
 	mdag "github.com/ipfs/go-merkledag"
 	path "github.com/ipfs/go-path"
 	ft "github.com/ipfs/go-unixfs"
@@ -18,30 +21,58 @@ import (
 
 	fuse "bazil.org/fuse"
 	fs "bazil.org/fuse/fs"
+	lru "github.com/hashicorp/golang-lru"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
 )
 
 var log = logging.Logger("fuse/ipfs")
 
+const (
+	// attrCacheSize is the number of nodes whose attributes are cached.
+	attrCacheSize = 4096
+	// dirCacheSize is the number of directories whose listing is cached.
+	dirCacheSize = 256
+	// cacheValid is how long the kernel caches the attributes of the
+	// nodes, which never change.
+	cacheValid = time.Hour
+)
+
 // FileSystem is the readonly IPFS Fuse Filesystem.
 type FileSystem struct {
 	Ipfs *core.IpfsNode
+	// ReadAhead is the number of file blocks prefetched ahead of
+	// sequential reads, none when 0.
+	ReadAhead int
+	// Stats counts the reads served.
+	Stats *mount.ReadStats
+
+	attrs *lru.Cache
+	dirs  *lru.Cache
 }
 
 // NewFileSystem constructs new fs using given core.IpfsNode instance.
 func NewFileSystem(ipfs *core.IpfsNode) *FileSystem {
-	return &FileSystem{Ipfs: ipfs}
+	attrs, _ := lru.New(attrCacheSize)
+	dirs, _ := lru.New(dirCacheSize)
+	return &FileSystem{
+		Ipfs:      ipfs,
+		ReadAhead: mount.DefaultReadAhead,
+		Stats:     mount.NewReadStats(),
+		attrs:     attrs,
+		dirs:      dirs,
+	}
 }
 
 // Root constructs the Root of the filesystem, a Root object.
-func (f FileSystem) Root() (fs.Node, error) {
-	return &Root{Ipfs: f.Ipfs}, nil
+func (f *FileSystem) Root() (fs.Node, error) {
+	return &Root{Ipfs: f.Ipfs, fs: f}, nil
 }
 
 // Root is the root object of the filesystem tree.
 type Root struct {
 	Ipfs *core.IpfsNode
+	fs   *FileSystem
 }
 
 // Attr returns file attributes.
@@ -73,7 +104,7 @@ func (s *Root) Lookup(ctx context.Context, name string) (fs.Node, error) {
 
 	switch nd := nd.(type) {
 	case *mdag.ProtoNode, *mdag.RawNode:
-		return &Node{Ipfs: s.Ipfs, Nd: nd}, nil
+		return &Node{Ipfs: s.Ipfs, Nd: nd, fs: s.fs}, nil
 	default:
 		log.Error("fuse node was not a protobuf node")
 		return nil, fuse.ENOTSUP
@@ -92,6 +123,7 @@ type Node struct {
 	Ipfs   *core.IpfsNode
 	Nd     ipld.Node
 	cached *ft.FSNode
+	fs     *FileSystem
 }
 
 func (s *Node) loadData() error {
@@ -105,9 +137,25 @@ func (s *Node) loadData() error {
 	return nil
 }
 
-// Attr returns the attributes of a given node.
+// Attr returns the attributes of a given node, which are cached.
 func (s *Node) Attr(ctx context.Context, a *fuse.Attr) error {
 	log.Debug("Node attr")
+	if cached, ok := s.fs.attrs.Get(s.Nd.Cid()); ok {
+		s.fs.Stats.AttrCache(true)
+		*a = cached.(fuse.Attr)
+		return nil
+	}
+	s.fs.Stats.AttrCache(false)
+
+	a.Valid = cacheValid
+	if err := s.attr(a); err != nil {
+		return err
+	}
+	s.fs.attrs.Add(s.Nd.Cid(), *a)
+	return nil
+}
+
+func (s *Node) attr(a *fuse.Attr) error {
 	if rawnd, ok := s.Nd.(*mdag.RawNode); ok {
 		a.Mode = 0444
 		a.Size = uint64(len(rawnd.RawData()))
@@ -135,9 +183,20 @@ func (s *Node) Attr(ctx context.Context, a *fuse.Attr) error {
 	case ft.TSymlink:
 		a.Mode = 0777 | os.ModeSymlink
 		a.Size = uint64(len(s.cached.Data()))
+		return nil
 	default:
 		return fmt.Errorf("invalid data type - %s", s.cached.Type())
 	}
+
+	// The stored permissions are kept, without the write ones.
+	p, err := coreunix.PosixFromNode(s.Nd)
+	if err != nil {
+		return err
+	}
+	if p.HasMode {
+		a.Mode = a.Mode&os.ModeType | p.Mode&^0222
+	}
+	a.Mtime = p.Mtime
 	return nil
 }
 
@@ -166,12 +225,28 @@ func (s *Node) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		// noop
 	}
 
-	return &Node{Ipfs: s.Ipfs, Nd: nd}, nil
+	return &Node{Ipfs: s.Ipfs, Nd: nd, fs: s.fs}, nil
 }
 
-// ReadDirAll reads the link structure as directory entries
+// ReadDirAll reads the link structure as directory entries, which are
+// cached.
 func (s *Node) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	log.Debug("Node ReadDir")
+	if cached, ok := s.fs.dirs.Get(s.Nd.Cid()); ok {
+		s.fs.Stats.DirCache(true)
+		return cached.([]fuse.Dirent), nil
+	}
+	s.fs.Stats.DirCache(false)
+
+	entries, err := s.readDirAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.fs.dirs.Add(s.Nd.Cid(), entries)
+	return entries, nil
+}
+
+func (s *Node) readDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	dir, err := uio.NewDirectoryFromNode(s.Ipfs.DAG, s.Nd)
 	if err != nil {
 		return nil, err
@@ -230,12 +305,35 @@ func (s *Node) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fu
 }
 
 func (s *Node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	// The data isn't loaded when the attributes are cached.
+	if s.cached == nil {
+		if err := s.loadData(); err != nil {
+			return "", err
+		}
+	}
 	if s.cached == nil || s.cached.Type() != ft.TSymlink {
 		return "", fuse.Errno(syscall.EINVAL)
 	}
 	return string(s.cached.Data()), nil
 }
 
+// Open opens a handle of the node. Files get a handle of their own, which
+// keeps its reader between sequential reads and prefetches the blocks ahead
+// of them.
+func (s *Node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if s.cached == nil {
+		if err := s.loadData(); err != nil {
+			return nil, err
+		}
+	}
+	if s.cached != nil && s.cached.Type() != ft.TFile && s.cached.Type() != ft.TRaw {
+		return s, nil
+	}
+	// The content never changes, so the kernel can keep it between opens.
+	resp.Flags |= fuse.OpenKeepCache
+	return newFileHandle(s), nil
+}
+
 func (s *Node) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	r, err := uio.NewDagReader(ctx, s.Nd, s.Ipfs.DAG)
 	if err != nil {
@@ -274,6 +372,7 @@ type roNode interface {
 	fs.NodeStringLookuper
 	fs.NodeReadlinker
 	fs.NodeGetxattrer
+	fs.NodeOpener
 }
 
 var _ roNode = (*Node)(nil)
@@ -0,0 +1,331 @@
+// Package batch applies lists of operations to the MFS root atomically: the
+// root is updated and published once when all the operations succeed, and
+// left untouched otherwise.
+package batch
+
+import (
+	"context"
+	"fmt"
+	"os"
+	gopath "path"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	mfs "github.com/ipfs/go-mfs"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	"github.com/ipfs/go-ipfs/mfs/journal"
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+)
+
+// Op is an operation of a batch.
+type Op struct {
+	// Op is one of "cp", "mv", "rm" and "mkdir".
+	Op string
+	// Path is the path removed by rm, or created by mkdir.
+	Path string `json:",omitempty"`
+	// Src and Dst are the source and destination of cp and mv. The source
+	// of cp may be an /ipfs/ path.
+	Src string `json:",omitempty"`
+	Dst string `json:",omitempty"`
+	// Parents creates the missing parent directories.
+	Parents bool `json:",omitempty"`
+	// Recursive allows rm to remove directories.
+	Recursive bool `json:",omitempty"`
+}
+
+func (op Op) validate() error {
+	var paths []string
+	switch op.Op {
+	case journal.OpCp, journal.OpMv:
+		paths = []string{op.Src, op.Dst}
+	case journal.OpRm, journal.OpMkdir:
+		paths = []string{op.Path}
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("%s: paths must start with a leading slash, got %q", op.Op, p)
+		}
+	}
+	if op.Op == journal.OpRm && gopath.Clean(op.Path) == "/" {
+		return fmt.Errorf("cannot delete root")
+	}
+	return nil
+}
+
+// ConflictError is returned when the MFS root isn't the expected one.
+type ConflictError struct {
+	Expected cid.Cid
+	Actual   cid.Cid
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict: the MFS root is %s, expected %s", e.Actual, e.Expected)
+}
+
+// ResolveFunc resolves the /ipfs/ paths copied from.
+type ResolveFunc func(ctx context.Context, p string) (ipld.Node, error)
+
+// Result is the outcome of a batch.
+type Result struct {
+	// Old and New are the MFS root before and after the batch.
+	Old cid.Cid
+	New cid.Cid
+	// Changes are the changes made by each operation, to be recorded in
+	// the journal.
+	Changes []journal.Entry
+}
+
+// Apply applies the operations to the MFS root. When expected is defined, the
+// batch fails with a ConflictError unless the root is expected. The root lock
+// is held from the check to the flush, so no other change can come between
+// them, and nobody sees the root half changed.
+func Apply(ctx context.Context, root *mfs.Root, dserv ipld.DAGService, resolve ResolveFunc, expected cid.Cid, ops []Op) (Result, error) {
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return Result{}, fmt.Errorf("operation %d: %w", i+1, err)
+		}
+	}
+
+	lk := rootlock.For(root)
+	lk.Lock()
+	defer lk.Unlock()
+
+	base, err := root.GetDirectory().GetNode()
+	if err != nil {
+		return Result{}, err
+	}
+	if expected.Defined() && !expected.Equals(base.Cid()) {
+		return Result{}, &ConflictError{Expected: expected, Actual: base.Cid()}
+	}
+	pbase, ok := base.(*dag.ProtoNode)
+	if !ok {
+		return Result{}, dag.ErrNotProtobuf
+	}
+
+	// The operations are applied to a copy of the root, which isn't
+	// published.
+	scratch, err := mfs.NewRoot(ctx, dserv, pbase, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer scratch.Close()
+
+	res := Result{Old: base.Cid()}
+	for i, op := range ops {
+		change, err := apply(ctx, scratch, resolve, op)
+		if err != nil {
+			return Result{}, fmt.Errorf("operation %d (%s): %w", i+1, op.Op, err)
+		}
+		res.Changes = append(res.Changes, change)
+	}
+	if err := scratch.Flush(); err != nil {
+		return Result{}, err
+	}
+	final, err := scratch.GetDirectory().GetNode()
+	if err != nil {
+		return Result{}, err
+	}
+	res.New = final.Cid()
+
+	if err := Swap(ctx, dserv, root, final); err != nil {
+		return Result{}, err
+	}
+	return res, root.Flush()
+}
+
+func apply(ctx context.Context, root *mfs.Root, resolve ResolveFunc, op Op) (journal.Entry, error) {
+	change := journal.Entry{Op: op.Op, Path: gopath.Clean(op.Path)}
+	switch op.Op {
+	case journal.OpCp:
+		change.From = gopath.Clean(op.Src)
+		change.Path = gopath.Clean(op.Dst)
+		if strings.HasSuffix(op.Dst, "/") {
+			change.Path = gopath.Join(change.Path, gopath.Base(change.From))
+		}
+	case journal.OpMv:
+		change.From = gopath.Clean(op.Src)
+		change.Path = gopath.Clean(op.Dst)
+		if fsn, err := mfs.Lookup(root, change.Path); err == nil && fsn.Type() == mfs.TDir {
+			change.Path = gopath.Join(change.Path, gopath.Base(change.From))
+		}
+	}
+	change.Old = journal.CidAt(root, change.Path)
+
+	var err error
+	switch op.Op {
+	case journal.OpCp:
+		err = cp(ctx, root, resolve, change.From, change.Path, op.Parents)
+	case journal.OpMv:
+		if op.Parents {
+			err = mkdirParents(root, change.Path)
+		}
+		if err == nil {
+			err = mfs.Mv(root, change.From, change.Path)
+		}
+	case journal.OpRm:
+		err = rm(root, change.Path, op.Recursive)
+	case journal.OpMkdir:
+		err = mfs.Mkdir(root, change.Path, mfs.MkdirOpts{Mkparents: op.Parents})
+	}
+	if err != nil {
+		return journal.Entry{}, err
+	}
+	change.New = journal.CidAt(root, change.Path)
+	return change, nil
+}
+
+func cp(ctx context.Context, root *mfs.Root, resolve ResolveFunc, src, dst string, parents bool) error {
+	var nd ipld.Node
+	if strings.HasPrefix(src, "/ipfs/") {
+		var err error
+		if nd, err = resolve(ctx, src); err != nil {
+			return err
+		}
+	} else {
+		fsn, err := mfs.Lookup(root, src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		if nd, err = fsn.GetNode(); err != nil {
+			return err
+		}
+	}
+	if parents {
+		if err := mkdirParents(root, dst); err != nil {
+			return err
+		}
+	}
+	return mfs.PutNode(root, dst, nd)
+}
+
+func mkdirParents(root *mfs.Root, p string) error {
+	dir := gopath.Dir(p)
+	if dir == "/" {
+		return nil
+	}
+	return mfs.Mkdir(root, dir, mfs.MkdirOpts{Mkparents: true})
+}
+
+func rm(root *mfs.Root, p string, recursive bool) error {
+	dir, name := gopath.Split(p)
+	parent, err := mfs.Lookup(root, dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	pdir, ok := parent.(*mfs.Directory)
+	if !ok {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	child, err := pdir.Child(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if child.Type() == mfs.TDir && !recursive {
+		return fmt.Errorf("%s is a directory, set Recursive to remove directories", p)
+	}
+	return pdir.Unlink(name)
+}
+
+// Swap replaces the content of the MFS root with the one of the directory
+// node to, as one step for the holders of its lock, which the caller holds.
+// The entries that change are all fetched before the root is touched, and
+// the root is restored if changing it fails. Only the entries that differ
+// are touched, and the root isn't flushed.
+func Swap(ctx context.Context, dserv ipld.DAGService, root *mfs.Root, to ipld.Node) error {
+	dir := root.GetDirectory()
+	from, err := dir.GetNode()
+	if err != nil {
+		return err
+	}
+	before, err := links(ctx, dserv, from)
+	if err != nil {
+		return err
+	}
+	after, err := links(ctx, dserv, to)
+	if err != nil {
+		return err
+	}
+
+	// old and new are the nodes of the entries removed and added, by name.
+	type entry struct {
+		name     string
+		old, new ipld.Node
+	}
+	var changes []entry
+	changed := make(map[string]int)
+	for name, l := range before {
+		if al, ok := after[name]; ok && al.Cid.Equals(l.Cid) {
+			continue
+		}
+		e := entry{name: name}
+		if e.old, err = l.GetNode(ctx, dserv); err != nil {
+			return err
+		}
+		changed[name] = len(changes)
+		changes = append(changes, e)
+	}
+	for name, l := range after {
+		if bl, ok := before[name]; ok && bl.Cid.Equals(l.Cid) {
+			continue
+		}
+		child, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if i, ok := changed[name]; ok {
+			changes[i].new = child
+		} else {
+			changes = append(changes, entry{name: name, new: child})
+		}
+	}
+
+	for i, e := range changes {
+		err := swapEntry(dir, e.name, e.old, e.new)
+		if err == nil {
+			continue
+		}
+		for j := i; j >= 0; j-- {
+			e := changes[j]
+			if rerr := swapEntry(dir, e.name, e.new, e.old); rerr != nil {
+				return fmt.Errorf("%w, and restoring %s failed: %s", err, e.name, rerr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// swapEntry replaces the entry name of dir, whose node is old, with new. Nil
+// nodes are missing entries. A failed swap may leave the entry missing.
+func swapEntry(dir *mfs.Directory, name string, old, new ipld.Node) error {
+	if old != nil {
+		if err := dir.Unlink(name); err != nil && err != os.ErrNotExist {
+			return err
+		}
+	}
+	if new == nil {
+		return nil
+	}
+	return dir.AddChild(name, new)
+}
+
+func links(ctx context.Context, dserv ipld.DAGService, nd ipld.Node) (map[string]*ipld.Link, error) {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return nil, err
+	}
+	ls, err := dir.Links(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]*ipld.Link, len(ls))
+	for _, l := range ls {
+		out[l.Name] = l
+	}
+	return out, nil
+}
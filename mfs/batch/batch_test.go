@@ -0,0 +1,228 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	mfs "github.com/ipfs/go-mfs"
+	ft "github.com/ipfs/go-unixfs"
+
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+)
+
+func setup(t *testing.T) (*mfs.Root, ipld.DAGService) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+	root, err := mfs.NewRoot(ctx, dserv, ft.EmptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/a", "/b"} {
+		nd := dag.NodeWithData(ft.FilePBData([]byte(name), uint64(len(name))))
+		if err := dserv.Add(ctx, nd); err != nil {
+			t.Fatal(err)
+		}
+		if err := mfs.PutNode(root, name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, dserv
+}
+
+func rootCid(t *testing.T, root *mfs.Root) cid.Cid {
+	nd, err := root.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd.Cid()
+}
+
+func exists(root *mfs.Root, p string) bool {
+	_, err := mfs.Lookup(root, p)
+	return err == nil
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	root, dserv := setup(t)
+	before := rootCid(t, root)
+
+	res, err := Apply(ctx, root, dserv, nil, before, []Op{
+		{Op: "mkdir", Path: "/dir"},
+		{Op: "cp", Src: "/a", Dst: "/dir/"},
+		{Op: "mv", Src: "/b", Dst: "/x/y/b", Parents: true},
+		{Op: "rm", Path: "/a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Old.Equals(before) || !res.New.Equals(rootCid(t, root)) {
+		t.Error("unexpected roots in the result")
+	}
+	for _, p := range []string{"/dir/a", "/x/y/b"} {
+		if !exists(root, p) {
+			t.Errorf("%s should exist", p)
+		}
+	}
+	for _, p := range []string{"/a", "/b"} {
+		if exists(root, p) {
+			t.Errorf("%s should not exist", p)
+		}
+	}
+	if len(res.Changes) != 4 || res.Changes[1].Path != "/dir/a" || res.Changes[3].New.Defined() {
+		t.Errorf("unexpected changes %+v", res.Changes)
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	ctx := context.Background()
+	root, dserv := setup(t)
+	before := rootCid(t, root)
+
+	_, err := Apply(ctx, root, dserv, nil, cid.Undef, []Op{
+		{Op: "rm", Path: "/a"},
+		{Op: "rm", Path: "/missing"},
+	})
+	if err == nil {
+		t.Fatal("removing a missing file should fail")
+	}
+	if !exists(root, "/a") || !rootCid(t, root).Equals(before) {
+		t.Error("a failed batch should not change the root")
+	}
+
+	if _, err := Apply(ctx, root, dserv, nil, cid.Undef, []Op{{Op: "chmod", Path: "/a"}}); err == nil {
+		t.Error("unknown operations should be refused")
+	}
+	if _, err := Apply(ctx, root, dserv, nil, cid.Undef, []Op{{Op: "mkdir", Path: "relative"}}); err == nil {
+		t.Error("relative paths should be refused")
+	}
+}
+
+func TestConflict(t *testing.T) {
+	ctx := context.Background()
+	root, dserv := setup(t)
+	stale := rootCid(t, root)
+
+	if err := mfs.Mkdir(root, "/concurrent", mfs.MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Apply(ctx, root, dserv, nil, stale, []Op{{Op: "rm", Path: "/a"}})
+	cerr, ok := err.(*ConflictError)
+	if !ok {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if !cerr.Expected.Equals(stale) || !cerr.Actual.Equals(rootCid(t, root)) {
+		t.Errorf("unexpected conflict %s", cerr)
+	}
+	if !exists(root, "/a") {
+		t.Error("a conflicting batch should not change the root")
+	}
+}
+
+func TestConcurrentChange(t *testing.T) {
+	ctx := context.Background()
+	root, dserv := setup(t)
+
+	lk := rootlock.For(root)
+	lk.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Apply(ctx, root, dserv, nil, cid.Undef, []Op{{Op: "mkdir", Path: "/batch"}})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("the batch didn't wait for the root lock: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := mfs.Mkdir(root, "/concurrent", mfs.MkdirOpts{Flush: true}); err != nil {
+		t.Fatal(err)
+	}
+	lk.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/batch", "/concurrent", "/a"} {
+		if !exists(root, p) {
+			t.Errorf("%s should exist", p)
+		}
+	}
+}
+
+// failingDAG fails to add the node fail.
+type failingDAG struct {
+	ipld.DAGService
+	fail cid.Cid
+}
+
+func (d failingDAG) Add(ctx context.Context, nd ipld.Node) error {
+	if nd.Cid().Equals(d.fail) {
+		return errors.New("add failed")
+	}
+	return d.DAGService.Add(ctx, nd)
+}
+
+func TestSwapFailure(t *testing.T) {
+	ctx := context.Background()
+	dserv := mdtest.Mock()
+	bad := dag.NodeWithData(ft.FilePBData([]byte("bad"), 3))
+	if err := dserv.Add(ctx, bad); err != nil {
+		t.Fatal(err)
+	}
+	root, err := mfs.NewRoot(ctx, failingDAG{dserv, bad.Cid()}, ft.EmptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		nd := dag.NodeWithData(ft.FilePBData([]byte(name), uint64(len(name))))
+		if err := mfs.PutNode(root, name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := rootCid(t, root)
+
+	newA := dag.NodeWithData(ft.FilePBData([]byte("new"), 3))
+	if err := dserv.Add(ctx, newA); err != nil {
+		t.Fatal(err)
+	}
+	missing := dag.NodeWithData(ft.FilePBData([]byte("missing"), 7))
+
+	for _, tc := range []struct {
+		name  string
+		child ipld.Node
+	}{
+		{"missing entry", missing},
+		{"failed add", bad},
+	} {
+		to := ft.EmptyDirNode()
+		if err := to.AddNodeLink("a", newA); err != nil {
+			t.Fatal(err)
+		}
+		if err := to.AddNodeLink("z", tc.child); err != nil {
+			t.Fatal(err)
+		}
+		if err := dserv.Add(ctx, to); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Swap(ctx, dserv, root, to); err == nil {
+			t.Fatalf("%s: expected the swap to fail", tc.name)
+		}
+		if after := rootCid(t, root); !after.Equals(before) {
+			t.Errorf("%s: root changed to %s, expected %s", tc.name, after, before)
+		}
+		if exists(root, "/z") {
+			t.Errorf("%s: failed entry added", tc.name)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Package dirsync synchronizes a local directory with an MFS directory,
+// copying only the files that changed.
+//
+// Files are compared by CID. The CIDs of the local files are cached in a
+// datastore with their size and modification time, so that only the files
+// that changed since the last sync are read again.
+//
+// The local directory is walked and watched by the process running the sync,
+// which may be a client of the daemon owning MFS: the daemon is only sent the
+// files to add, and the changes to make to MFS.
+package dirsync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	files "github.com/ipfs/go-ipfs-files"
+	logging "github.com/ipfs/go-log"
+
+	"github.com/ipfs/go-ipfs/mfs/batch"
+	"github.com/ipfs/go-ipfs/mfs/journal"
+)
+
+var log = logging.Logger("mfs/dirsync")
+
+var prefix = datastore.NewKey("/local/filessync")
+
+// Node is the node owning the MFS directories that are synchronized.
+type Node interface {
+	// Add adds the file, or only hashes it, and returns its CID.
+	Add(ctx context.Context, f files.File, onlyHash bool) (cid.Cid, error)
+	// Cat returns the content of the file c.
+	Cat(ctx context.Context, c cid.Cid) (io.ReadCloser, error)
+	// Ls lists the MFS directory p. It returns os.ErrNotExist when nothing
+	// is at p.
+	Ls(ctx context.Context, p string) ([]Entry, error)
+	// Change applies the operations to MFS as one change, with the MFS
+	// root locked, and records them in the files journal.
+	Change(ctx context.Context, ops []batch.Op) error
+	// Flush flushes the MFS path p.
+	Flush(ctx context.Context, p string) error
+}
+
+// Entry is an entry of an MFS directory.
+type Entry struct {
+	Name string
+	Dir  bool
+	Cid  cid.Cid
+}
+
+// Options configures a Syncer.
+type Options struct {
+	// Delete removes the entries of the destination that are missing from
+	// the source.
+	Delete bool
+	// Hidden includes the entries whose name starts with a dot. Otherwise
+	// they are ignored on both sides.
+	Hidden bool
+}
+
+// Result lists the changes made by a sync.
+type Result struct {
+	// Changes made to the destination: Path is the MFS path when pushing,
+	// and the local path when pulling.
+	Changes []journal.Entry
+}
+
+// Syncer synchronizes local directories with the MFS directories of a node.
+type Syncer struct {
+	ds   datastore.Datastore
+	node Node
+	opts Options
+}
+
+// New returns a Syncer of the MFS directories of node, which caches the CIDs
+// of local files in ds.
+func New(ds datastore.Datastore, node Node, opts Options) *Syncer {
+	return &Syncer{ds: ds, node: node, opts: opts}
+}
+
+func (s *Syncer) ignored(name string) bool {
+	return !s.opts.Hidden && strings.HasPrefix(name, ".")
+}
+
+type cacheEntry struct {
+	Size    int64
+	ModTime int64
+	Cid     cid.Cid
+}
+
+func cacheKey(p string) datastore.Key {
+	return prefix.ChildString(base64.RawURLEncoding.EncodeToString([]byte(p)))
+}
+
+// cached returns the CID of the local file p when it didn't change since it
+// was cached, and an undefined CID otherwise.
+func (s *Syncer) cached(p string, fi os.FileInfo) cid.Cid {
+	b, err := s.ds.Get(cacheKey(p))
+	if err != nil {
+		return cid.Undef
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		log.Debugw("invalid cache entry", "path", p, "error", err)
+		return cid.Undef
+	}
+	if e.Size != fi.Size() || e.ModTime != fi.ModTime().UnixNano() {
+		return cid.Undef
+	}
+	return e.Cid
+}
+
+func (s *Syncer) remember(p string, fi os.FileInfo, c cid.Cid) error {
+	b, err := json.Marshal(cacheEntry{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Cid: c})
+	if err != nil {
+		return err
+	}
+	return s.ds.Put(cacheKey(p), b)
+}
+
+// add adds the local file p, or only hashes it.
+func (s *Syncer) add(ctx context.Context, p string, onlyHash bool) (cid.Cid, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return cid.Undef, err
+	}
+	nd, err := files.NewReaderPathFile(p, f, fi)
+	if err != nil {
+		return cid.Undef, err
+	}
+	c, err := s.node.Add(ctx, nd, onlyHash)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := s.remember(p, fi, c); err != nil {
+		return cid.Undef, err
+	}
+	return c, nil
+}
+
+// change applies the operations of one change to MFS, and adds the change to
+// res.
+func (s *Syncer) change(ctx context.Context, res *Result, e journal.Entry, ops ...batch.Op) error {
+	if err := s.node.Change(ctx, ops); err != nil {
+		return fmt.Errorf("%s %s: %w", e.Op, e.Path, err)
+	}
+	res.Changes = append(res.Changes, e)
+	return nil
+}
+
+// Push makes the MFS directory mp the same as the local directory, and
+// flushes it. The MFS root is only locked while each change is made, so
+// other writers can use MFS during the walk.
+func (s *Syncer) Push(ctx context.Context, local, mp string) (Result, error) {
+	var res Result
+	if err := s.push(ctx, local, gopath.Clean(mp), &res); err != nil {
+		return res, err
+	}
+	return res, s.node.Flush(ctx, mp)
+}
+
+func (s *Syncer) push(ctx context.Context, local, mp string, res *Result) error {
+	listing, err := s.node.Ls(ctx, mp)
+	if errors.Is(err, os.ErrNotExist) {
+		err = s.change(ctx, res, journal.Entry{Op: journal.OpMkdir, Path: mp},
+			batch.Op{Op: journal.OpMkdir, Path: mp, Parents: true})
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]Entry, len(listing))
+	for _, l := range listing {
+		existing[l.Name] = l
+	}
+
+	seen := make(map[string]struct{}, len(entries))
+	for _, fi := range entries {
+		name := fi.Name()
+		if s.ignored(name) || !(fi.IsDir() || fi.Mode().IsRegular()) {
+			continue
+		}
+		seen[name] = struct{}{}
+		lp, p := filepath.Join(local, name), gopath.Join(mp, name)
+		cur, has := existing[name]
+
+		if fi.IsDir() {
+			if has && !cur.Dir {
+				err := s.change(ctx, res, journal.Entry{Op: journal.OpRm, Path: p, Old: cur.Cid},
+					batch.Op{Op: journal.OpRm, Path: p})
+				if err != nil {
+					return err
+				}
+			}
+			if err := s.push(ctx, lp, p, res); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if c := s.cached(lp, fi); has && c.Defined() && c.Equals(cur.Cid) {
+			continue
+		}
+		// The file is added even when cached, in case its blocks were
+		// garbage collected.
+		c, err := s.add(ctx, lp, false)
+		if err != nil {
+			return err
+		}
+		if has && c.Equals(cur.Cid) {
+			continue
+		}
+		var ops []batch.Op
+		if has {
+			ops = append(ops, batch.Op{Op: journal.OpRm, Path: p, Recursive: cur.Dir})
+		}
+		ops = append(ops, batch.Op{Op: journal.OpCp, Src: "/ipfs/" + c.String(), Dst: p})
+		if err := s.change(ctx, res, journal.Entry{Op: journal.OpWrite, Path: p, Old: cur.Cid, New: c}, ops...); err != nil {
+			return err
+		}
+	}
+
+	if !s.opts.Delete {
+		return nil
+	}
+	for _, l := range listing {
+		if _, ok := seen[l.Name]; ok || s.ignored(l.Name) {
+			continue
+		}
+		p := gopath.Join(mp, l.Name)
+		err := s.change(ctx, res, journal.Entry{Op: journal.OpRm, Path: p, Old: l.Cid},
+			batch.Op{Op: journal.OpRm, Path: p, Recursive: true})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pull makes the local directory the same as the MFS directory mp.
+func (s *Syncer) Pull(ctx context.Context, mp, local string) (Result, error) {
+	var res Result
+	err := s.pull(ctx, gopath.Clean(mp), local, &res)
+	return res, err
+}
+
+func (s *Syncer) pull(ctx context.Context, mp, local string, res *Result) error {
+	listing, err := s.node.Ls(ctx, mp)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]os.FileInfo, len(entries))
+	for _, fi := range entries {
+		existing[fi.Name()] = fi
+	}
+
+	seen := make(map[string]struct{}, len(listing))
+	for _, l := range listing {
+		if s.ignored(l.Name) {
+			continue
+		}
+		seen[l.Name] = struct{}{}
+		lp, p := filepath.Join(local, l.Name), gopath.Join(mp, l.Name)
+		fi, has := existing[l.Name]
+
+		if l.Dir {
+			if has && !fi.IsDir() {
+				if err := os.Remove(lp); err != nil {
+					return err
+				}
+				res.Changes = append(res.Changes, journal.Entry{Op: journal.OpRm, Path: lp})
+			}
+			if err := s.pull(ctx, p, lp, res); err != nil {
+				return err
+			}
+			continue
+		}
+
+		old := cid.Undef
+		if has && fi.IsDir() {
+			if err := os.RemoveAll(lp); err != nil {
+				return err
+			}
+			res.Changes = append(res.Changes, journal.Entry{Op: journal.OpRm, Path: lp})
+		} else if has && fi.Mode().IsRegular() {
+			old = s.cached(lp, fi)
+			if !old.Defined() {
+				if old, err = s.add(ctx, lp, true); err != nil {
+					return err
+				}
+			}
+			if old.Equals(l.Cid) {
+				continue
+			}
+		}
+		if err := s.writeFile(ctx, lp, l.Cid); err != nil {
+			return err
+		}
+		res.Changes = append(res.Changes, journal.Entry{Op: journal.OpWrite, Path: lp, Old: old, New: l.Cid})
+	}
+
+	if !s.opts.Delete {
+		return nil
+	}
+	for _, fi := range entries {
+		if _, ok := seen[fi.Name()]; ok || s.ignored(fi.Name()) {
+			continue
+		}
+		lp := filepath.Join(local, fi.Name())
+		if err := os.RemoveAll(lp); err != nil {
+			return err
+		}
+		res.Changes = append(res.Changes, journal.Entry{Op: journal.OpRm, Path: lp})
+	}
+	return nil
+}
+
+// writeFile replaces the local file p with the content of c.
+func (s *Syncer) writeFile(ctx context.Context, p string, c cid.Cid) error {
+	r, err := s.node.Cat(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	return s.remember(p, fi, c)
+}
@@ -0,0 +1,173 @@
+package dirsync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mfs "github.com/ipfs/go-mfs"
+
+	"github.com/ipfs/go-ipfs/core"
+	"github.com/ipfs/go-ipfs/core/coreapi"
+	coremock "github.com/ipfs/go-ipfs/core/mock"
+	"github.com/ipfs/go-ipfs/mfs/journal"
+)
+
+func setup(t *testing.T, opts Options) (*Syncer, *core.IpfsNode, string) {
+	nd, err := coremock.NewMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := coreapi.NewCoreAPI(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "dirsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		nd.Close()
+		os.RemoveAll(dir)
+	})
+	return New(nd.Repo.Datastore(), NewLocalNode(api, nd.DAG, nd.FilesRoot, nd.FilesJournal), opts), nd, dir
+}
+
+func writeFile(t *testing.T, p, data string) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ops(res Result) map[string]string {
+	out := make(map[string]string)
+	for _, c := range res.Changes {
+		out[c.Path] = c.Op
+	}
+	return out
+}
+
+func TestPush(t *testing.T) {
+	ctx := context.Background()
+	s, nd, dir := setup(t, Options{Delete: true})
+
+	writeFile(t, filepath.Join(dir, "a"), "a")
+	writeFile(t, filepath.Join(dir, "sub", "b"), "b")
+	writeFile(t, filepath.Join(dir, ".hidden"), "hidden")
+
+	res, err := s.Push(ctx, dir, "/synced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := ops(res)
+	if changes["/synced/a"] != "write" || changes["/synced/sub/b"] != "write" || len(changes) != 4 {
+		t.Errorf("unexpected changes %v", changes)
+	}
+	if _, err := mfs.Lookup(nd.FilesRoot, "/synced/.hidden"); err == nil {
+		t.Error("hidden files should be ignored")
+	}
+	logged := make(map[string]bool)
+	err = nd.FilesJournal.ForEach(journal.Filter{}, func(e journal.Entry) error {
+		logged[e.Op+" "+e.Path] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !logged["mkdir /synced"] || !logged["cp /synced/a"] || !logged["cp /synced/sub/b"] {
+		t.Errorf("changes missing from the journal: %v", logged)
+	}
+
+	// Nothing changed.
+	res, err = s.Push(ctx, dir, "/synced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Changes) != 0 {
+		t.Errorf("expected no changes, got %v", ops(res))
+	}
+
+	// Only what changed is copied.
+	writeFile(t, filepath.Join(dir, "a"), "changed")
+	if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	res, err = s.Push(ctx, dir, "/synced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes = ops(res)
+	if changes["/synced/a"] != "write" || changes["/synced/sub"] != "rm" || len(changes) != 2 {
+		t.Errorf("unexpected changes %v", changes)
+	}
+}
+
+func TestPull(t *testing.T) {
+	ctx := context.Background()
+	s, _, dir := setup(t, Options{Delete: true})
+
+	src := filepath.Join(dir, "src")
+	writeFile(t, filepath.Join(src, "a"), "a")
+	writeFile(t, filepath.Join(src, "sub", "b"), "b")
+	if _, err := s.Push(ctx, src, "/synced"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	writeFile(t, filepath.Join(dst, "extra"), "extra")
+	res, err := s.Pull(ctx, "/synced", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := ops(res)
+	if len(changes) != 3 || changes[filepath.Join(dst, "extra")] != "rm" {
+		t.Errorf("unexpected changes %v", changes)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dst, "sub", "b"))
+	if err != nil || string(b) != "b" {
+		t.Errorf("unexpected content %q (%v)", b, err)
+	}
+
+	res, err = s.Pull(ctx, "/synced", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Changes) != 0 {
+		t.Errorf("expected no changes, got %v", ops(res))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, nd, dir := setup(t, Options{})
+	WatchDelay = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan Result, 10)
+	go s.Watch(ctx, dir, "/watched", func(res Result, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		results <- res
+	})
+	<-results
+
+	writeFile(t, filepath.Join(dir, "new"), "new")
+	select {
+	case res := <-results:
+		if ops(res)["/watched/new"] != "write" {
+			t.Errorf("unexpected changes %v", ops(res))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change wasn't synced")
+	}
+	if _, err := mfs.Lookup(nd.FilesRoot, "/watched/new"); err != nil {
+		t.Error(err)
+	}
+}
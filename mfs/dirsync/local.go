@@ -0,0 +1,107 @@
+package dirsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	files "github.com/ipfs/go-ipfs-files"
+	ipld "github.com/ipfs/go-ipld-format"
+	mfs "github.com/ipfs/go-mfs"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+	"github.com/ipfs/interface-go-ipfs-core/options"
+	path "github.com/ipfs/interface-go-ipfs-core/path"
+
+	"github.com/ipfs/go-ipfs/mfs/batch"
+	"github.com/ipfs/go-ipfs/mfs/journal"
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+)
+
+type localNode struct {
+	api     coreiface.CoreAPI
+	dserv   ipld.DAGService
+	root    *mfs.Root
+	journal *journal.Journal
+}
+
+// NewLocalNode returns the Node of an MFS root of this process. Files are
+// added with api, and the changes are recorded in j.
+func NewLocalNode(api coreiface.CoreAPI, dserv ipld.DAGService, root *mfs.Root, j *journal.Journal) Node {
+	return &localNode{api: api, dserv: dserv, root: root, journal: j}
+}
+
+func (n *localNode) Add(ctx context.Context, f files.File, onlyHash bool) (cid.Cid, error) {
+	rp, err := n.api.Unixfs().Add(ctx, f, options.Unixfs.Pin(false), options.Unixfs.HashOnly(onlyHash))
+	if err != nil {
+		return cid.Undef, err
+	}
+	return rp.Cid(), nil
+}
+
+func (n *localNode) Cat(ctx context.Context, c cid.Cid) (io.ReadCloser, error) {
+	nd, err := n.api.Unixfs().Get(ctx, path.IpfsPath(c))
+	if err != nil {
+		return nil, err
+	}
+	f, ok := nd.(files.File)
+	if !ok {
+		nd.Close()
+		return nil, fmt.Errorf("%s is not a file", c)
+	}
+	return f, nil
+}
+
+func (n *localNode) Ls(ctx context.Context, p string) ([]Entry, error) {
+	lk := rootlock.For(n.root)
+	lk.RLock()
+	defer lk.RUnlock()
+
+	fsn, err := mfs.Lookup(n.root, p)
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := fsn.(*mfs.Directory)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	listing, err := dir.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(listing))
+	for _, l := range listing {
+		c, err := cid.Decode(l.Hash)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{Name: l.Name, Dir: l.Type == int(mfs.TDir), Cid: c})
+	}
+	return entries, nil
+}
+
+func (n *localNode) Change(ctx context.Context, ops []batch.Op) error {
+	resolve := func(ctx context.Context, p string) (ipld.Node, error) {
+		return n.api.ResolveNode(ctx, path.New(p))
+	}
+	res, err := batch.Apply(ctx, n.root, n.dserv, resolve, cid.Undef, ops)
+	if err != nil {
+		return err
+	}
+	for _, change := range res.Changes {
+		change.Actor = journal.ActorFrom(ctx)
+		if _, err := n.journal.Append(change); err != nil {
+			return fmt.Errorf("recording the change in the files journal: %w", err)
+		}
+	}
+	return nil
+}
+
+func (n *localNode) Flush(ctx context.Context, p string) error {
+	lk := rootlock.For(n.root)
+	lk.Lock()
+	defer lk.Unlock()
+
+	_, err := mfs.FlushPath(ctx, n.root, p)
+	return err
+}
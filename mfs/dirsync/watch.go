@@ -0,0 +1,73 @@
+package dirsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchDelay is how long Watch waits for more changes after a change before
+// syncing.
+var WatchDelay = 500 * time.Millisecond
+
+// Watch pushes the local directory to the MFS directory mp, then pushes it
+// again after every change until the context is cancelled. fn is called with
+// the result of every push.
+func (s *Syncer) Watch(ctx context.Context, local, mp string, fn func(Result, error)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := s.watchTree(w, local); err != nil {
+		return err
+	}
+
+	fn(s.Push(ctx, local, mp))
+	var pending <-chan time.Time
+	for {
+		select {
+		case e := <-w.Events:
+			if s.ignored(filepath.Base(e.Name)) {
+				continue
+			}
+			if e.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(e.Name); err == nil && fi.IsDir() {
+					if err := s.watchTree(w, e.Name); err != nil {
+						log.Warnw("failed to watch directory", "path", e.Name, "error", err)
+					}
+				}
+			}
+			if pending == nil {
+				pending = time.After(WatchDelay)
+			}
+		case err := <-w.Errors:
+			log.Warnw("watch error", "error", err)
+		case <-pending:
+			pending = nil
+			fn(s.Push(ctx, local, mp))
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// watchTree watches a local directory and all the directories under it.
+func (s *Syncer) watchTree(w *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if p != root && s.ignored(fi.Name()) {
+			return filepath.SkipDir
+		}
+		return w.Add(p)
+	})
+}
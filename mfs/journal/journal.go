@@ -0,0 +1,238 @@
+// Package journal records the changes made to the MFS tree in an append-only
+// log in the repo datastore.
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+	mfs "github.com/ipfs/go-mfs"
+)
+
+var prefix = datastore.NewKey("/local/filesjournal")
+
+// The operations recorded in the journal.
+const (
+	OpWrite   = "write"
+	OpMv      = "mv"
+	OpCp      = "cp"
+	OpRm      = "rm"
+	OpMkdir   = "mkdir"
+	OpChcid   = "chcid"
+	OpRestore = "restore"
+	OpChmod   = "chmod"
+	OpTouch   = "touch"
+)
+
+// The actors of the changes not made through the API.
+const (
+	// ActorCLI is the ipfs command, changing MFS without a daemon.
+	ActorCLI = "cli"
+	// ActorFuse is the /mfs mount.
+	ActorFuse = "fuse"
+)
+
+// APIActor returns the actor of the changes requested through the API by
+// the client at addr.
+func APIActor(addr string) string {
+	return "api:" + addr
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose changes are made by actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set in ctx by WithActor. The requests of the
+// API have one, so the others are ActorCLI.
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	return ActorCLI
+}
+
+// Entry is a change to the MFS tree.
+type Entry struct {
+	// Seq numbers the entries in the order they were recorded.
+	Seq  uint64
+	Time time.Time
+	// Actor made the change: ActorCLI, ActorFuse, or the APIActor of an
+	// API client. It is empty in the entries recorded before actors were.
+	Actor string `json:",omitempty"`
+	Op    string
+	// Path is the MFS path that was changed.
+	Path string
+	// From is the source of the change: the source path of mv and cp, or
+	// the snapshot of a restore.
+	From string `json:",omitempty"`
+	// Old and New are the CIDs at Path before and after the change. They
+	// are undefined when nothing was at Path.
+	Old cid.Cid
+	New cid.Cid
+}
+
+// Filter selects entries of the journal. The zero value selects all of them.
+type Filter struct {
+	// Path selects the changes to the path, or to anything under it.
+	Path string
+	// Since and Until bound the time of the changes, when not zero.
+	Since time.Time
+	Until time.Time
+}
+
+func (f Filter) match(e Entry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return under(e.Path, f.Path) || (e.From != "" && under(e.From, f.Path))
+}
+
+// under returns true when p is dir or a path under it.
+func under(p, dir string) bool {
+	dir = strings.TrimRight(dir, "/")
+	if dir == "" {
+		return true
+	}
+	p = strings.TrimRight(p, "/")
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// Journal is an append-only log of the changes to the MFS tree.
+type Journal struct {
+	ds datastore.Datastore
+
+	mu   sync.Mutex
+	next uint64
+}
+
+// New opens the journal stored in a datastore.
+func New(ds datastore.Datastore) (*Journal, error) {
+	j := &Journal{ds: ds}
+
+	res, err := ds.Query(query.Query{
+		Prefix:   prefix.String(),
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Limit:    1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		seq, err := strconv.ParseUint(datastore.RawKey(r.Key).BaseNamespace(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid journal key %s", r.Key)
+		}
+		j.next = seq + 1
+	}
+	return j, nil
+}
+
+// Keys are zero-padded so that they sort in the order of the entries.
+func entryKey(seq uint64) datastore.Key {
+	return prefix.ChildString(fmt.Sprintf("%020d", seq))
+}
+
+// Append records a change, setting its sequence number, and its time when
+// not set.
+func (j *Journal) Append(e Entry) (Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.Seq = j.next
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, err
+	}
+	key := entryKey(e.Seq)
+	if err := j.ds.Put(key, b); err != nil {
+		return Entry{}, err
+	}
+	if err := j.ds.Sync(key); err != nil {
+		return Entry{}, err
+	}
+	j.next++
+	return e, nil
+}
+
+// Record records a change to the path p of an MFS root, made by op on behalf
+// of actor. old is the CID at p before the change, and the new one is looked
+// up in root.
+func (j *Journal) Record(root *mfs.Root, actor, op, p, from string, old cid.Cid) error {
+	_, err := j.Append(Entry{
+		Actor: actor,
+		Op:    op,
+		Path:  p,
+		From:  from,
+		Old:   old,
+		New:   CidAt(root, p),
+	})
+	if err != nil {
+		return fmt.Errorf("recording the change in the files journal: %w", err)
+	}
+	return nil
+}
+
+// CidAt returns the CID at an MFS path, undefined when there is nothing.
+func CidAt(root *mfs.Root, p string) cid.Cid {
+	fsn, err := mfs.Lookup(root, p)
+	if err != nil {
+		return cid.Undef
+	}
+	nd, err := fsn.GetNode()
+	if err != nil {
+		return cid.Undef
+	}
+	return nd.Cid()
+}
+
+// ForEach calls fn with the entries matching the filter, oldest first, until
+// it returns an error.
+func (j *Journal) ForEach(f Filter, fn func(Entry) error) error {
+	res, err := j.ds.Query(query.Query{
+		Prefix: prefix.String(),
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		var e Entry
+		if err := json.Unmarshal(r.Value, &e); err != nil {
+			return fmt.Errorf("invalid journal entry %s: %w", r.Key, err)
+		}
+		if !f.match(e) {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package journal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dag "github.com/ipfs/go-merkledag"
+)
+
+func collect(t *testing.T, j *Journal, f Filter) []Entry {
+	var out []Entry
+	err := j.ForEach(f, func(e Entry) error {
+		out = append(out, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestJournal(t *testing.T) {
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	j, err := New(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := dag.NodeWithData([]byte("a")).Cid()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Op: OpMkdir, Path: "/dir", New: c},
+		{Op: OpWrite, Path: "/dir/a", New: c, Actor: ActorFuse},
+		{Op: OpWrite, Path: "/directory/b", New: c, Actor: APIActor("127.0.0.1:5001")},
+		{Op: OpMv, Path: "/c", From: "/dir/a", New: c},
+		{Op: OpRm, Path: "/c", Old: c},
+	}
+	for i, e := range entries {
+		e.Time = start.Add(time.Duration(i) * time.Hour)
+		if _, err := j.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all := collect(t, j, Filter{})
+	if len(all) != len(entries) {
+		t.Fatalf("expected %d entries, got %d", len(entries), len(all))
+	}
+	for i, e := range all {
+		if e.Seq != uint64(i) || e.Op != entries[i].Op {
+			t.Errorf("entry %d: unexpected %+v", i, e)
+		}
+	}
+	if all[4].New.Defined() || !all[4].Old.Equals(c) {
+		t.Error("CIDs were not preserved")
+	}
+	if all[1].Actor != ActorFuse || all[2].Actor != APIActor("127.0.0.1:5001") || all[0].Actor != "" {
+		t.Error("actors were not preserved")
+	}
+
+	// Changes moving things out of a path are selected too.
+	if n := len(collect(t, j, Filter{Path: "/dir"})); n != 3 {
+		t.Errorf("expected 3 changes under /dir, got %d", n)
+	}
+	if n := len(collect(t, j, Filter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)})); n != 3 {
+		t.Errorf("expected 3 changes in the time range, got %d", n)
+	}
+
+	// Reopening continues the sequence.
+	j, err = New(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := j.Append(Entry{Op: OpChcid, Path: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Seq != uint64(len(entries)) {
+		t.Errorf("expected sequence number %d, got %d", len(entries), e.Seq)
+	}
+}
+
+func TestActorFrom(t *testing.T) {
+	ctx := context.Background()
+	if a := ActorFrom(ctx); a != ActorCLI {
+		t.Errorf("expected %q without an actor, got %q", ActorCLI, a)
+	}
+	api := APIActor("127.0.0.1:5001")
+	if a := ActorFrom(WithActor(ctx, api)); a != api {
+		t.Errorf("expected %q, got %q", api, a)
+	}
+}
@@ -0,0 +1,32 @@
+// Package rootlock holds the locks shared by the code changing MFS roots, so
+// that a change made of several steps, such as a batch or the restore of a
+// snapshot, is never seen or published half applied.
+package rootlock
+
+import (
+	"sync"
+
+	mfs "github.com/ipfs/go-mfs"
+)
+
+var locks sync.Map // *mfs.Root -> *sync.RWMutex
+
+// For returns the lock of root. The changes to root are made with the lock
+// held, and the reads that must see a consistent root hold its read lock.
+func For(root *mfs.Root) *sync.RWMutex {
+	l, _ := locks.LoadOrStore(root, new(sync.RWMutex))
+	return l.(*sync.RWMutex)
+}
+
+// Close closes root once the changes holding its lock are done, and forgets
+// the lock. The roots locked with For are closed with it, so that their
+// locks don't outlive them.
+func Close(root *mfs.Root) error {
+	if l, ok := locks.Load(root); ok {
+		lk := l.(*sync.RWMutex)
+		lk.Lock()
+		defer lk.Unlock()
+		locks.Delete(root)
+	}
+	return root.Close()
+}
@@ -0,0 +1,26 @@
+package rootlock
+
+import (
+	"context"
+	"testing"
+
+	mdtest "github.com/ipfs/go-merkledag/test"
+	mfs "github.com/ipfs/go-mfs"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+func TestCloseForgetsTheLock(t *testing.T) {
+	root, err := mfs.NewRoot(context.Background(), mdtest.Mock(), ft.EmptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if For(root) != For(root) {
+		t.Fatal("expected the same lock for the same root")
+	}
+	if err := Close(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := locks.Load(root); ok {
+		t.Fatal("the lock of a closed root is kept")
+	}
+}
@@ -0,0 +1,518 @@
+// Package snapshot keeps named snapshots of the MFS root, so that the files
+// tree can be restored to an earlier state.
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log"
+	mfs "github.com/ipfs/go-mfs"
+	uio "github.com/ipfs/go-unixfs/io"
+
+	"github.com/ipfs/go-ipfs/mfs/batch"
+	"github.com/ipfs/go-ipfs/mfs/rootlock"
+)
+
+var log = logging.Logger("mfs/snapshot")
+
+// ConfigKey is the config key automatic snapshots are configured with.
+const ConfigKey = "FilesSnapshots"
+
+// ErrNotFound is returned for snapshots that don't exist.
+var ErrNotFound = errors.New("snapshot not found")
+
+var prefix = datastore.NewKey("/local/filesnapshots")
+
+// Config configures automatic snapshots. The zero value disables them.
+type Config struct {
+	// Interval between automatic snapshots, e.g. "1h".
+	Interval string
+	// EveryFlushes takes an automatic snapshot every that many flushes of
+	// the MFS root.
+	EveryFlushes int
+	// KeepLast is the number of automatic snapshots to keep. Zero keeps
+	// them all.
+	KeepLast int
+	// MaxAge removes the automatic snapshots older than this, e.g. "168h".
+	MaxAge string
+}
+
+// Snapshot is a named reference to a past MFS root.
+type Snapshot struct {
+	Name    string
+	Root    cid.Cid
+	Created time.Time
+	// Auto is true for the snapshots taken automatically, which the
+	// retention rules apply to.
+	Auto bool
+	// Pinned is true when the root is pinned recursively. Other snapshots
+	// only keep the blocks that are stored locally from being garbage
+	// collected.
+	Pinned bool
+}
+
+// Manager stores the snapshots of an MFS root and takes automatic snapshots.
+type Manager struct {
+	ds     datastore.Datastore
+	pinner pin.Pinner
+	dag    ipld.DAGService
+
+	interval     time.Duration
+	everyFlushes int
+	keepLast     int
+	maxAge       time.Duration
+
+	// mu serializes changes to the snapshots.
+	mu      sync.Mutex
+	root    *mfs.Root
+	flushes int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewManager returns a manager storing snapshots in ds. The MFS root must be
+// set with SetRoot before snapshots can be created or restored.
+func NewManager(ds datastore.Datastore, pinner pin.Pinner, dag ipld.DAGService, cfg Config) (*Manager, error) {
+	m := &Manager{
+		ds:           ds,
+		pinner:       pinner,
+		dag:          dag,
+		everyFlushes: cfg.EveryFlushes,
+		keepLast:     cfg.KeepLast,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	if cfg.Interval != "" {
+		d, err := time.ParseDuration(cfg.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid %s.Interval %q", ConfigKey, cfg.Interval)
+		}
+		m.interval = d
+	}
+	if cfg.MaxAge != "" {
+		d, err := time.ParseDuration(cfg.MaxAge)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid %s.MaxAge %q", ConfigKey, cfg.MaxAge)
+		}
+		m.maxAge = d
+	}
+	if cfg.EveryFlushes < 0 || cfg.KeepLast < 0 {
+		return nil, fmt.Errorf("invalid %s: negative counts", ConfigKey)
+	}
+	return m, nil
+}
+
+// SetRoot sets the MFS root the snapshots are taken of.
+func (m *Manager) SetRoot(root *mfs.Root) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.root = root
+}
+
+// Start takes automatic snapshots on schedule until Stop is called.
+func (m *Manager) Start() error {
+	if m.interval == 0 {
+		return nil
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c, err := m.currentRoot()
+				if err == nil {
+					err = m.auto(m.ctx, c)
+				}
+				if err != nil {
+					log.Errorf("automatic snapshot failed: %s", err)
+				}
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops taking automatic snapshots.
+func (m *Manager) Stop() error {
+	m.cancel()
+	m.wg.Wait()
+	return nil
+}
+
+// Published must be called with the new root every time the MFS root is
+// flushed, to take the automatic snapshots every n flushes.
+func (m *Manager) Published(ctx context.Context, c cid.Cid) {
+	if m.everyFlushes == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.flushes++
+	take := m.flushes%m.everyFlushes == 0
+	m.mu.Unlock()
+
+	if take {
+		if err := m.auto(ctx, c); err != nil {
+			log.Errorf("automatic snapshot failed: %s", err)
+		}
+	}
+}
+
+func (m *Manager) currentRoot() (cid.Cid, error) {
+	m.mu.Lock()
+	root := m.root
+	m.mu.Unlock()
+	if root == nil {
+		return cid.Undef, errors.New("no MFS root")
+	}
+	nd, err := root.GetDirectory().GetNode()
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// auto takes an automatic snapshot of c, unless the latest snapshot has the
+// same root, and applies the retention rules.
+func (m *Manager) auto(ctx context.Context, c cid.Cid) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snaps, err := m.list()
+	if err != nil {
+		return err
+	}
+	if n := len(snaps); n > 0 && snaps[n-1].Root.Equals(c) {
+		return nil
+	}
+	if _, err := m.create(ctx, m.autoName("auto"), c, true, false); err != nil {
+		return err
+	}
+	return m.prune(ctx)
+}
+
+// autoName returns an unused name made of kind and the time.
+func (m *Manager) autoName(kind string) string {
+	base := kind + "-" + time.Now().UTC().Format("20060102T150405Z")
+	name := base
+	for i := 1; ; i++ {
+		if has, err := m.ds.Has(snapshotKey(name)); err != nil || !has {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// prune removes the automatic snapshots that the retention rules don't keep.
+func (m *Manager) prune(ctx context.Context) error {
+	snaps, err := m.list()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	kept := 0
+	for i := len(snaps) - 1; i >= 0; i-- {
+		s := snaps[i]
+		if !s.Auto {
+			continue
+		}
+		tooMany := m.keepLast > 0 && kept >= m.keepLast
+		tooOld := m.maxAge > 0 && now.Sub(s.Created) > m.maxAge
+		if !tooMany && !tooOld {
+			kept++
+			continue
+		}
+		log.Infof("removing automatic snapshot %s", s.Name)
+		if err := m.remove(ctx, s, snaps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func snapshotKey(name string) datastore.Key {
+	return prefix.ChildString(name)
+}
+
+func checkName(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+// Create takes a snapshot of the current MFS root. Without a name, the
+// snapshot is named after the time. With pin, the root is pinned recursively,
+// fetching the blocks missing locally.
+func (m *Manager) Create(ctx context.Context, name string, pin bool) (Snapshot, error) {
+	c, err := m.currentRoot()
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == "" {
+		name = m.autoName("snapshot")
+	}
+	return m.create(ctx, name, c, false, pin)
+}
+
+func (m *Manager) create(ctx context.Context, name string, c cid.Cid, auto, pinned bool) (Snapshot, error) {
+	if err := checkName(name); err != nil {
+		return Snapshot{}, err
+	}
+	key := snapshotKey(name)
+	if has, err := m.ds.Has(key); err != nil {
+		return Snapshot{}, err
+	} else if has {
+		return Snapshot{}, fmt.Errorf("snapshot %q already exists", name)
+	}
+
+	if pinned {
+		nd, err := m.dag.Get(ctx, c)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		if err := m.pinner.Pin(ctx, nd, true); err != nil {
+			return Snapshot{}, fmt.Errorf("pinning snapshot root: %w", err)
+		}
+		if err := m.pinner.Flush(ctx); err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	s := Snapshot{
+		Name:    name,
+		Root:    c,
+		Created: time.Now(),
+		Auto:    auto,
+		Pinned:  pinned,
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := m.ds.Put(key, b); err != nil {
+		return Snapshot{}, err
+	}
+	return s, m.ds.Sync(key)
+}
+
+// Get returns a snapshot by name.
+func (m *Manager) Get(name string) (Snapshot, error) {
+	if err := checkName(name); err != nil {
+		return Snapshot{}, err
+	}
+	b, err := m.ds.Get(snapshotKey(name))
+	if err == datastore.ErrNotFound {
+		return Snapshot{}, ErrNotFound
+	} else if err != nil {
+		return Snapshot{}, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return Snapshot{}, fmt.Errorf("invalid snapshot %q: %w", name, err)
+	}
+	return s, nil
+}
+
+// List returns all the snapshots, oldest first.
+func (m *Manager) List() ([]Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.list()
+}
+
+func (m *Manager) list() ([]Snapshot, error) {
+	res, err := m.ds.Query(query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var snaps []Snapshot
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		var s Snapshot
+		if err := json.Unmarshal(r.Value, &s); err != nil {
+			log.Errorf("invalid snapshot %s: %s", r.Key, err)
+			continue
+		}
+		snaps = append(snaps, s)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Created.Before(snaps[j].Created)
+	})
+	return snaps, nil
+}
+
+// Remove removes a snapshot, unpinning its root unless another pinned
+// snapshot has the same root.
+func (m *Manager) Remove(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+	snaps, err := m.list()
+	if err != nil {
+		return err
+	}
+	return m.remove(ctx, s, snaps)
+}
+
+func (m *Manager) remove(ctx context.Context, s Snapshot, snaps []Snapshot) error {
+	if err := m.ds.Delete(snapshotKey(s.Name)); err != nil {
+		return err
+	}
+	if !s.Pinned {
+		return nil
+	}
+	for _, o := range snaps {
+		if o.Name != s.Name && o.Pinned && o.Root.Equals(s.Root) {
+			return nil
+		}
+	}
+	if err := m.pinner.Unpin(ctx, s.Root, true); err != nil && err != pin.ErrNotPinned {
+		return err
+	}
+	return m.pinner.Flush(ctx)
+}
+
+// Roots returns the roots of all the snapshots, for the garbage collector to
+// keep.
+func (m *Manager) Roots() ([]cid.Cid, error) {
+	snaps, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]cid.Cid, 0, len(snaps))
+	for _, s := range snaps {
+		roots = append(roots, s.Root)
+	}
+	return roots, nil
+}
+
+// Restore replaces the MFS path p with its content in a snapshot. The current
+// state is saved first in an automatic snapshot, which is returned.
+func (m *Manager) Restore(ctx context.Context, name string, p string) (Snapshot, error) {
+	s, err := m.Get(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	p = gopath.Clean("/" + p)
+
+	nd, err := m.lookup(ctx, s.Root, p)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("%s in snapshot %s: %w", p, name, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.root == nil {
+		return Snapshot{}, errors.New("no MFS root")
+	}
+	lk := rootlock.For(m.root)
+	lk.Lock()
+	defer lk.Unlock()
+
+	rootNd, err := m.root.GetDirectory().GetNode()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	current := rootNd.Cid()
+
+	before, err := m.create(ctx, m.autoName("before-restore"), current, true, false)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if p == "/" {
+		err = m.restoreRoot(ctx, nd)
+	} else {
+		err = m.restorePath(p, nd)
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return before, m.root.Flush()
+}
+
+// lookup finds the node at path p below root.
+func (m *Manager) lookup(ctx context.Context, root cid.Cid, p string) (ipld.Node, error) {
+	nd, err := m.dag.Get(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		dir, err := uio.NewDirectoryFromNode(m.dag, nd)
+		if err != nil {
+			return nil, err
+		}
+		nd, err = dir.Find(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nd, nil
+}
+
+// restoreRoot replaces the content of the MFS root with nd, in one step for
+// the holders of the root lock.
+func (m *Manager) restoreRoot(ctx context.Context, nd ipld.Node) error {
+	return batch.Swap(ctx, m.dag, m.root, nd)
+}
+
+// restorePath replaces the MFS path p with nd, creating its parents as needed.
+func (m *Manager) restorePath(p string, nd ipld.Node) error {
+	dir, name := gopath.Split(p)
+	parent, err := mfs.Lookup(m.root, dir)
+	if err == os.ErrNotExist {
+		if err := mfs.Mkdir(m.root, dir, mfs.MkdirOpts{Mkparents: true}); err != nil {
+			return err
+		}
+		parent, err = mfs.Lookup(m.root, dir)
+	}
+	if err != nil {
+		return err
+	}
+	pdir, ok := parent.(*mfs.Directory)
+	if !ok {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := pdir.Unlink(name); err != nil && err != os.ErrNotExist {
+		return err
+	}
+	if err := pdir.AddChild(name, nd); err != nil {
+		return err
+	}
+	return pdir.Flush()
+}
@@ -0,0 +1,226 @@
+package snapshot
+
+import (
+	"context"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-ipfs-pinner/dspinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	dag "github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	mfs "github.com/ipfs/go-mfs"
+	ft "github.com/ipfs/go-unixfs"
+)
+
+func setup(t *testing.T, cfg Config) (*Manager, *mfs.Root, ipld.DAGService) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	dserv := mdtest.Mock()
+	pinner, err := dspinner.New(ctx, ds, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewManager(ds, pinner, dserv, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a publish function, the tests call Published themselves.
+	root, err := mfs.NewRoot(ctx, dserv, ft.EmptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetRoot(root)
+	return m, root, dserv
+}
+
+func putFile(t *testing.T, root *mfs.Root, dserv ipld.DAGService, p string, data string) {
+	nd := dag.NodeWithData(ft.FilePBData([]byte(data), uint64(len(data))))
+	if err := dserv.Add(context.Background(), nd); err != nil {
+		t.Fatal(err)
+	}
+	if err := mfs.PutNode(root, p, nd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(root *mfs.Root, p string) bool {
+	_, err := mfs.Lookup(root, p)
+	return err == nil
+}
+
+func TestCreateRestore(t *testing.T) {
+	ctx := context.Background()
+	m, root, dserv := setup(t, Config{})
+
+	if err := mfs.Mkdir(root, "/dir", mfs.MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, root, dserv, "/dir/a", "a")
+	putFile(t, root, dserv, "/b", "b")
+
+	s, err := m.Create(ctx, "first", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Create(ctx, "first", false); err == nil {
+		t.Fatal("snapshot names must be unique")
+	}
+
+	// Lose everything.
+	for _, name := range []string{"dir", "b"} {
+		if err := root.GetDirectory().Unlink(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putFile(t, root, dserv, "/c", "c")
+
+	// Restore a single path.
+	if _, err := m.Restore(ctx, "first", "/dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(root, "/dir/a") || exists(root, "/b") || !exists(root, "/c") {
+		t.Fatal("only /dir/a should have been restored")
+	}
+
+	// Restore the whole tree.
+	before, err := m.Restore(ctx, "first", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(root, "/dir/a") || !exists(root, "/b") || exists(root, "/c") {
+		t.Fatal("the whole tree should have been restored")
+	}
+	nd, err := root.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(s.Root) {
+		t.Errorf("expected root %s after restore, got %s", s.Root, nd.Cid())
+	}
+
+	// The state before the restore was saved.
+	if !before.Auto {
+		t.Error("the snapshot before restore should be automatic")
+	}
+	if _, err := m.Restore(ctx, before.Name, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(root, "/c") {
+		t.Error("undoing the restore should bring back /c")
+	}
+
+	roots, err := m.Roots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 4 {
+		t.Errorf("expected 4 snapshot roots, got %d", len(roots))
+	}
+
+	if err := m.Remove(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("first"); err != ErrNotFound {
+		t.Errorf("expected the snapshot to be removed, got %v", err)
+	}
+	if _, pinned, _ := m.pinner.IsPinned(ctx, s.Root); pinned {
+		t.Error("removing the snapshot should unpin its root")
+	}
+}
+
+func TestFailedRestoreChangesNothing(t *testing.T) {
+	ctx := context.Background()
+	m, root, dserv := setup(t, Config{})
+
+	putFile(t, root, dserv, "/a", "a")
+	putFile(t, root, dserv, "/b", "b")
+	if _, err := m.Create(ctx, "first", true); err != nil {
+		t.Fatal(err)
+	}
+	b, err := mfs.Lookup(root, "/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bnd, err := b.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		if err := root.GetDirectory().Unlink(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putFile(t, root, dserv, "/c", "c")
+	current, err := root.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// /b can't be fetched anymore, so the restore fails before touching
+	// the root.
+	if err := dserv.Remove(ctx, bnd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Restore(ctx, "first", "/"); err == nil {
+		t.Fatal("expected the restore to fail")
+	}
+	nd, err := root.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(current.Cid()) || exists(root, "/a") || !exists(root, "/c") {
+		t.Errorf("the failed restore changed the root to %s", nd.Cid())
+	}
+}
+
+func TestAutomaticSnapshots(t *testing.T) {
+	ctx := context.Background()
+	m, root, dserv := setup(t, Config{EveryFlushes: 2, KeepLast: 2})
+
+	manual, err := m.Create(ctx, "manual", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/a", "/b", "/c", "/d", "/e", "/f"} {
+		putFile(t, root, dserv, name, name)
+		nd, err := root.GetDirectory().GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Published(ctx, nd.Cid())
+	}
+
+	snaps, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var autos int
+	for _, s := range snaps {
+		if s.Auto {
+			autos++
+		}
+	}
+	if autos != 2 {
+		t.Errorf("expected 2 automatic snapshots to be kept, got %d", autos)
+	}
+	if _, err := m.Get(manual.Name); err != nil {
+		t.Errorf("manual snapshots are never pruned: %s", err)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Interval: "often"},
+		{MaxAge: "-1h"},
+		{KeepLast: -1},
+	} {
+		if _, err := NewManager(nil, nil, nil, cfg); err == nil {
+			t.Errorf("expected %+v to be refused", cfg)
+		}
+	}
+}
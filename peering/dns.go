@@ -0,0 +1,267 @@
+package peering
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// GroupsConfigKey is the config key the DNS peering groups are read from.
+const GroupsConfigKey = "PeeringGroups"
+
+// DefaultRefreshInterval is how often DNS groups are resolved again when the
+// config doesn't say.
+const DefaultRefreshInterval = 10 * time.Minute
+
+// GroupsConfig configures groups of peers published in DNS.
+type GroupsConfig struct {
+	// DNS lists the groups, as domain names or /dnsaddr multiaddrs. The
+	// dnsaddr TXT records of each domain list the peers of the group.
+	DNS []string
+	// RefreshInterval is how often the groups are resolved again, e.g.
+	// "10m".
+	RefreshInterval string
+}
+
+// Resolver resolves /dnsaddr multiaddrs, like madns.Resolver.
+type Resolver interface {
+	Resolve(context.Context, multiaddr.Multiaddr) ([]multiaddr.Multiaddr, error)
+}
+
+// ParseDNSGroup parses a DNS group given as a domain name or as a /dnsaddr
+// multiaddr without a peer ID.
+func ParseDNSGroup(s string) (multiaddr.Multiaddr, error) {
+	if !strings.HasPrefix(s, "/") {
+		s = "/dnsaddr/" + s
+	}
+	addr, err := multiaddr.NewMultiaddr(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS group %q: %w", s, err)
+	}
+	protos := addr.Protocols()
+	if len(protos) != 1 || protos[0].Code != multiaddr.P_DNSADDR {
+		return nil, fmt.Errorf("invalid DNS group %q: expected a /dnsaddr address without a peer ID", s)
+	}
+	return addr, nil
+}
+
+// GroupState describes a DNS group.
+type GroupState struct {
+	Addr multiaddr.Multiaddr
+	// Peers is the number of peers the group resolved to.
+	Peers int
+	// LastRefresh is when the group was last resolved, successfully or
+	// not.
+	LastRefresh time.Time
+	// Error is the error of the last resolution, if any. The peers found
+	// before the error are kept.
+	Error string
+}
+
+type dnsGroup struct {
+	addr        multiaddr.Multiaddr
+	peers       map[peer.ID]struct{}
+	lastRefresh time.Time
+	err         error
+}
+
+// DNSGroups keeps the peers of DNS groups in a peering service, resolving the
+// groups periodically.
+type DNSGroups struct {
+	ps       *PeeringService
+	resolver Resolver
+	interval time.Duration
+
+	mu      sync.Mutex
+	groups  map[string]*dnsGroup
+	running bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewDNSGroups returns DNS groups adding their peers to ps. Groups are only
+// resolved once Start is called.
+func NewDNSGroups(ps *PeeringService, r Resolver, interval time.Duration) *DNSGroups {
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	g := &DNSGroups{
+		ps:       ps,
+		resolver: r,
+		interval: interval,
+		groups:   make(map[string]*dnsGroup),
+	}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	return g
+}
+
+// Start resolves all groups in the background, and keeps refreshing them until
+// Stop is called.
+func (g *DNSGroups) Start() error {
+	g.mu.Lock()
+	g.running = true
+	g.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+		for {
+			g.Refresh(g.ctx)
+			select {
+			case <-ticker.C:
+			case <-g.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops refreshing the groups.
+func (g *DNSGroups) Stop() error {
+	g.mu.Lock()
+	g.running = false
+	g.mu.Unlock()
+
+	g.cancel()
+	return nil
+}
+
+// Add adds a group. If the service is started, the group is resolved before
+// returning, and a resolution error is returned, but the group is kept and
+// will be resolved again on the next refresh.
+func (g *DNSGroups) Add(ctx context.Context, addr multiaddr.Multiaddr) error {
+	g.mu.Lock()
+	if _, ok := g.groups[addr.String()]; ok {
+		g.mu.Unlock()
+		return nil
+	}
+	grp := &dnsGroup{addr: addr, peers: make(map[peer.ID]struct{})}
+	g.groups[addr.String()] = grp
+	running := g.running
+	g.mu.Unlock()
+
+	if !running {
+		return nil
+	}
+	g.refresh(ctx, grp)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return grp.err
+}
+
+// Remove removes a group, and the peers it added to the peering service. It
+// returns false if there is no such group.
+func (g *DNSGroups) Remove(addr multiaddr.Multiaddr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	grp, ok := g.groups[addr.String()]
+	if !ok {
+		return false
+	}
+	delete(g.groups, addr.String())
+	for p := range grp.peers {
+		g.ps.removePeer(p, addr.String())
+	}
+	grp.peers = nil
+	return true
+}
+
+// List returns the state of all the groups, sorted by address.
+func (g *DNSGroups) List() []GroupState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	out := make([]GroupState, 0, len(g.groups))
+	for _, grp := range g.groups {
+		st := GroupState{
+			Addr:        grp.addr,
+			Peers:       len(grp.peers),
+			LastRefresh: grp.lastRefresh,
+		}
+		if grp.err != nil {
+			st.Error = grp.err.Error()
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr.String() < out[j].Addr.String() })
+	return out
+}
+
+// Refresh resolves all the groups again.
+func (g *DNSGroups) Refresh(ctx context.Context) {
+	g.mu.Lock()
+	groups := make([]*dnsGroup, 0, len(g.groups))
+	for _, grp := range g.groups {
+		groups = append(groups, grp)
+	}
+	g.mu.Unlock()
+
+	for _, grp := range groups {
+		g.refresh(ctx, grp)
+	}
+}
+
+func (g *DNSGroups) refresh(ctx context.Context, grp *dnsGroup) {
+	source := grp.addr.String()
+	infos, err := g.resolve(ctx, grp.addr)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	grp.lastRefresh = time.Now()
+	grp.err = err
+	if err != nil {
+		logger.Warnw("failed to resolve DNS peering group", "group", source, "error", err)
+		return
+	}
+	if g.groups[source] != grp {
+		// Removed while resolving.
+		return
+	}
+
+	found := make(map[peer.ID]struct{}, len(infos))
+	for _, info := range infos {
+		found[info.ID] = struct{}{}
+		g.ps.addPeer(info, source)
+	}
+	for p := range grp.peers {
+		if _, ok := found[p]; !ok {
+			g.ps.removePeer(p, source)
+		}
+	}
+	grp.peers = found
+}
+
+// resolve returns the peers listed in the TXT records of a group. Records
+// without a peer ID are ignored.
+func (g *DNSGroups) resolve(ctx context.Context, addr multiaddr.Multiaddr) ([]peer.AddrInfo, error) {
+	addrs, err := g.resolver.Resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []peer.AddrInfo
+	index := make(map[peer.ID]int)
+	for _, a := range addrs {
+		info, err := peer.AddrInfoFromP2pAddr(a)
+		if err != nil {
+			logger.Debugw("ignoring DNS peering record", "group", addr, "addr", a, "error", err)
+			continue
+		}
+		if i, ok := index[info.ID]; ok {
+			infos[i].Addrs = append(infos[i].Addrs, info.Addrs...)
+			continue
+		}
+		index[info.ID] = len(infos)
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
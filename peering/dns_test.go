@@ -0,0 +1,149 @@
+package peering
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver struct {
+	mu      sync.Mutex
+	records map[string][]multiaddr.Multiaddr
+	err     error
+}
+
+func (r *fakeResolver) set(group string, err error, hosts ...host.Host) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var addrs []multiaddr.Multiaddr
+	for _, h := range hosts {
+		p2p, _ := multiaddr.NewComponent("p2p", h.ID().Pretty())
+		for _, a := range h.Addrs() {
+			addrs = append(addrs, a.Encapsulate(p2p))
+		}
+	}
+	// A record without a peer ID is ignored.
+	addrs = append(addrs, multiaddr.StringCast("/ip4/127.0.0.1/tcp/1"))
+	r.records[group] = addrs
+	r.err = err
+}
+
+func (r *fakeResolver) Resolve(_ context.Context, addr multiaddr.Multiaddr) ([]multiaddr.Multiaddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.records[addr.String()], nil
+}
+
+func sourcesOf(ps *PeeringService) map[peer.ID][]string {
+	out := make(map[peer.ID][]string)
+	for _, st := range ps.ListPeers() {
+		out[st.ID] = st.Sources
+	}
+	return out
+}
+
+func addrsOf(ps *PeeringService) map[peer.ID][]multiaddr.Multiaddr {
+	out := make(map[peer.ID][]multiaddr.Multiaddr)
+	for _, st := range ps.ListPeers() {
+		out[st.ID] = st.Addrs
+	}
+	return out
+}
+
+func TestDNSGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := newNode(ctx, t)
+	h2 := newNode(ctx, t)
+	h3 := newNode(ctx, t)
+
+	ps := NewPeeringService(h1)
+	static := multiaddr.StringCast("/ip4/127.0.0.1/tcp/2")
+	ps.AddPeer(peer.AddrInfo{ID: h2.ID(), Addrs: append([]multiaddr.Multiaddr{static}, h2.Addrs()...)})
+
+	group, err := ParseDNSGroup("peers.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "/dnsaddr/peers.example.com", group.String())
+
+	r := &fakeResolver{records: make(map[string][]multiaddr.Multiaddr)}
+	r.set(group.String(), nil, h2, h3)
+
+	groups := NewDNSGroups(ps, r, 0)
+	require.NoError(t, groups.Add(ctx, group))
+	groups.Refresh(ctx)
+
+	require.Equal(t, map[peer.ID][]string{
+		h2.ID(): {group.String(), SourceStatic},
+		h3.ID(): {group.String()},
+	}, sourcesOf(ps))
+	list := groups.List()
+	require.Len(t, list, 1)
+	require.Equal(t, 2, list[0].Peers)
+
+	// The addresses of all the sources are kept, without duplicates.
+	require.Len(t, addrsOf(ps)[h2.ID()], len(h2.Addrs())+1)
+	require.Contains(t, addrsOf(ps)[h2.ID()], static)
+
+	// A peer still provided by a group isn't removed.
+	err = ps.RemovePeer(h2.ID())
+	require.Equal(t, &StillProvidedError{Peer: h2.ID(), Groups: []string{group.String()}}, err)
+	require.NotContains(t, addrsOf(ps)[h2.ID()], static)
+	ps.AddPeer(peer.AddrInfo{ID: h2.ID(), Addrs: []multiaddr.Multiaddr{static}})
+
+	// Failing to resolve keeps the peers.
+	r.set(group.String(), errors.New("no such host"), h3)
+	groups.Refresh(ctx)
+	require.Len(t, ps.ListPeers(), 2)
+	require.Equal(t, "no such host", groups.List()[0].Error)
+
+	// Peers leaving the group are removed, unless they were also added
+	// statically.
+	r.set(group.String(), nil, h3)
+	groups.Refresh(ctx)
+	require.Equal(t, map[peer.ID][]string{
+		h2.ID(): {SourceStatic},
+		h3.ID(): {group.String()},
+	}, sourcesOf(ps))
+
+	require.Equal(t, []multiaddr.Multiaddr{static}, addrsOf(ps)[h2.ID()])
+
+	// Removing a peer that was only found through DNS fails.
+	require.Error(t, ps.RemovePeer(h3.ID()))
+	require.Len(t, ps.ListPeers(), 2)
+
+	require.True(t, groups.Remove(group))
+	require.False(t, groups.Remove(group))
+	require.Equal(t, map[peer.ID][]string{
+		h2.ID(): {SourceStatic},
+	}, sourcesOf(ps))
+}
+
+func TestParseDNSGroup(t *testing.T) {
+	for _, s := range []string{
+		"/dnsaddr/example.com",
+		"example.com",
+	} {
+		_, err := ParseDNSGroup(s)
+		require.NoError(t, err, s)
+	}
+	for _, s := range []string{
+		"/dns4/example.com/tcp/4001",
+		"/dnsaddr/example.com/p2p/QmSoLPppuBtQSGwKDZT2M73ULpjvfd3aZ6ha4oFGL1KrGM",
+		"/not-a-multiaddr",
+	} {
+		_, err := ParseDNSGroup(s)
+		require.Error(t, err, s)
+	}
+}
@@ -3,7 +3,10 @@ package peering
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,12 +27,15 @@ const (
 	// If we go over the max, we'll adjust the delay down to a random value
 	// between 90-100% of the max backoff.
 	maxBackoffJitter = 10 // %
-	connmgrTag       = "ipfs-peering"
 	// This needs to be sufficient to prevent two sides from simultaneously
 	// dialing.
 	initialDelay = 5 * time.Second
 )
 
+// ConnmgrTag is the tag peering peers are protected with in the connection
+// manager.
+const ConnmgrTag = "ipfs-peering"
+
 var logger = log.Logger("peering")
 
 type state int
@@ -47,9 +53,18 @@ type peerHandler struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// sources maps the sources of the peer to the addresses each of them
+	// gave. It is protected by the PeeringService lock.
+	sources map[string][]multiaddr.Multiaddr
+
 	mu             sync.Mutex
 	addrs          []multiaddr.Multiaddr
 	reconnectTimer *time.Timer
+	// nextAttempt is when reconnectTimer fires.
+	nextAttempt time.Time
+	// failures counts the reconnection attempts that failed since we were
+	// last connected.
+	failures int
 
 	nextDelay time.Duration
 }
@@ -65,6 +80,32 @@ func (ph *peerHandler) setAddrs(addrs []multiaddr.Multiaddr) {
 	ph.addrs = addrCopy
 }
 
+// mergeAddrs returns the addresses given by all the sources, without
+// duplicates.
+func mergeAddrs(sources map[string][]multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	var addrs []multiaddr.Multiaddr
+	seen := make(map[string]struct{})
+	for _, source := range sortedSources(sources) {
+		for _, a := range sources[source] {
+			if _, ok := seen[string(a.Bytes())]; ok {
+				continue
+			}
+			seen[string(a.Bytes())] = struct{}{}
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+func sortedSources(sources map[string][]multiaddr.Multiaddr) []string {
+	out := make([]string, 0, len(sources))
+	for source := range sources {
+		out = append(out, source)
+	}
+	sort.Strings(out)
+	return out
+}
+
 // getAddrs returns a shared slice of addresses for this peer. Do not modify.
 func (ph *peerHandler) getAddrs() []multiaddr.Multiaddr {
 	ph.mu.Lock()
@@ -112,7 +153,8 @@ func (ph *peerHandler) reconnect() {
 		if ph.reconnectTimer != nil {
 			// Only counts if the reconnectTimer still exists. If not, a
 			// connection _was_ somehow established.
-			ph.reconnectTimer.Reset(ph.nextBackoff())
+			ph.failures++
+			ph.schedule(ph.nextBackoff())
 		}
 		// Otherwise, someone else has stopped us so we can assume that
 		// we're either connected or someone else will start us.
@@ -133,6 +175,8 @@ func (ph *peerHandler) stopIfConnected() {
 		ph.reconnectTimer.Stop()
 		ph.reconnectTimer = nil
 		ph.nextDelay = initialDelay
+		ph.nextAttempt = time.Time{}
+		ph.failures = 0
 	}
 }
 
@@ -144,10 +188,56 @@ func (ph *peerHandler) startIfDisconnected() {
 	if ph.reconnectTimer == nil && ph.host.Network().Connectedness(ph.peer) != network.Connected {
 		logger.Debugw("disconnected from peer", "peer", ph.peer)
 		// Always start with a short timeout so we can stagger things a bit.
-		ph.reconnectTimer = time.AfterFunc(ph.nextBackoff(), ph.reconnect)
+		ph.schedule(ph.nextBackoff())
+	}
+}
+
+// schedule (re)arms the reconnect timer. The lock must be held.
+func (ph *peerHandler) schedule(d time.Duration) {
+	if ph.reconnectTimer == nil {
+		ph.reconnectTimer = time.AfterFunc(d, ph.reconnect)
+	} else {
+		ph.reconnectTimer.Reset(d)
+	}
+	ph.nextAttempt = time.Now().Add(d)
+}
+
+// PeerState describes a peer of the peering service.
+type PeerState struct {
+	ID    peer.ID
+	Addrs []multiaddr.Multiaddr
+	// Connected is true when we have at least one connection to the peer.
+	Connected bool
+	// NextRetry is when we will next try to connect. It is zero when we
+	// are connected or the service isn't running.
+	NextRetry time.Time
+	// Failures is the number of failed connection attempts since we were
+	// last connected.
+	Failures int
+	// Sources lists why we peer with this peer: SourceStatic for peers
+	// added with AddPeer, or the DNS groups resolving to it.
+	Sources []string
+}
+
+func (ph *peerHandler) state() PeerState {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	st := PeerState{
+		ID:        ph.peer,
+		Addrs:     ph.addrs,
+		Connected: ph.host.Network().Connectedness(ph.peer) == network.Connected,
+		Failures:  ph.failures,
+	}
+	if ph.reconnectTimer != nil {
+		st.NextRetry = ph.nextAttempt
 	}
+	return st
 }
 
+// SourceStatic is the source of the peers added with AddPeer.
+const SourceStatic = "static"
+
 // PeeringService maintains connections to specified peers, reconnecting on
 // disconnect with a back-off.
 type PeeringService struct {
@@ -210,23 +300,32 @@ func (ps *PeeringService) Stop() error {
 // stops.
 //
 // Add peer may also be called multiple times for the same peer. The new
-// addresses will replace the old.
+// addresses will replace the old ones added with AddPeer, the addresses found
+// through DNS groups are kept.
 func (ps *PeeringService) AddPeer(info peer.AddrInfo) {
+	ps.addPeer(info, SourceStatic)
+}
+
+// addPeer adds a peer on behalf of the given source. The peer is kept until
+// all its sources remove it.
+func (ps *PeeringService) addPeer(info peer.AddrInfo, source string) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
 	if handler, ok := ps.peers[info.ID]; ok {
 		logger.Infow("updating addresses", "peer", info.ID, "addrs", info.Addrs)
-		handler.setAddrs(info.Addrs)
+		handler.sources[source] = info.Addrs
+		handler.setAddrs(mergeAddrs(handler.sources))
 	} else {
 		logger.Infow("peer added", "peer", info.ID, "addrs", info.Addrs)
-		ps.host.ConnManager().Protect(info.ID, connmgrTag)
+		ps.host.ConnManager().Protect(info.ID, ConnmgrTag)
 
 		handler = &peerHandler{
 			host:      ps.host,
 			peer:      info.ID,
 			addrs:     info.Addrs,
 			nextDelay: initialDelay,
+			sources:   map[string][]multiaddr.Multiaddr{source: info.Addrs},
 		}
 		handler.ctx, handler.cancel = context.WithCancel(context.Background())
 		ps.peers[info.ID] = handler
@@ -245,17 +344,62 @@ func (ps *PeeringService) AddPeer(info peer.AddrInfo) {
 // RemovePeer removes a peer from the peering service. This function may be
 // safely called at any time: before the service is started, while running, or
 // after it stops.
-func (ps *PeeringService) RemovePeer(id peer.ID) {
+//
+// Peers that were also added by a DNS group stay until the group stops
+// resolving to them: RemovePeer then returns a *StillProvidedError.
+func (ps *PeeringService) RemovePeer(id peer.ID) error {
+	if groups := ps.removePeer(id, SourceStatic); len(groups) > 0 {
+		return &StillProvidedError{Peer: id, Groups: groups}
+	}
+	return nil
+}
+
+// StillProvidedError is returned by RemovePeer when DNS groups still resolve
+// to the peer, so we keep peering with it.
+type StillProvidedError struct {
+	Peer   peer.ID
+	Groups []string
+}
+
+func (e *StillProvidedError) Error() string {
+	return fmt.Sprintf("peer %s is still provided by the DNS group(s) %s", e.Peer, strings.Join(e.Groups, ", "))
+}
+
+// removePeer removes the given source of a peer, and the peer once it has no
+// sources left. It returns the sources left, sorted.
+func (ps *PeeringService) removePeer(id peer.ID, source string) []string {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
 	if handler, ok := ps.peers[id]; ok {
+		delete(handler.sources, source)
+		if len(handler.sources) > 0 {
+			handler.setAddrs(mergeAddrs(handler.sources))
+			return sortedSources(handler.sources)
+		}
 		logger.Infow("peer removed", "peer", id)
-		ps.host.ConnManager().Unprotect(id, connmgrTag)
+		ps.host.ConnManager().Unprotect(id, ConnmgrTag)
 
 		handler.stop()
 		delete(ps.peers, id)
 	}
+	return nil
+}
+
+// ListPeers returns the state of all the peers of the peering service, sorted
+// by peer ID.
+func (ps *PeeringService) ListPeers() []PeerState {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	out := make([]PeerState, 0, len(ps.peers))
+	for _, handler := range ps.peers {
+		st := handler.state()
+		st.Sources = sortedSources(handler.sources)
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
 }
 
 type netNotifee PeeringService
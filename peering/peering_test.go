@@ -108,7 +108,7 @@ func TestPeeringService(t *testing.T) {
 	}, 30*time.Second, 1*time.Second)
 
 	// Unprotect 2 from 1.
-	ps1.RemovePeer(h2.ID())
+	require.NoError(t, ps1.RemovePeer(h2.ID()))
 
 	// Trim connections.
 	h1.ConnManager().TrimOpenConns(ctx)
@@ -142,7 +142,7 @@ func TestPeeringService(t *testing.T) {
 
 	// Adding and removing should work after stopping.
 	ps1.AddPeer(peer.AddrInfo{ID: h4.ID(), Addrs: h4.Addrs()})
-	ps1.RemovePeer(h2.ID())
+	require.NoError(t, ps1.RemovePeer(h2.ID()))
 }
 
 func TestNextBackoff(t *testing.T) {
@@ -0,0 +1,20 @@
+package plugin
+
+import (
+	"io"
+
+	chunker "github.com/ipfs/go-ipfs-chunker"
+)
+
+// PluginChunker is an interface that can be implemented to add a chunker,
+// selected with the chunker string "<name>-<params>" of 'ipfs add' and
+// 'ipfs files write'
+type PluginChunker interface {
+	Plugin
+
+	// ChunkerName returns the name of the chunker. It can't contain '-'.
+	ChunkerName() string
+	// NewSplitter returns the splitter of r for the params following the
+	// name in the chunker string, or "".
+	NewSplitter(r io.Reader, params string) (chunker.Splitter, error)
+}
@@ -0,0 +1,35 @@
+package plugin
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/ipfs/go-ipfs/core"
+)
+
+// HTTPServer is an HTTP server of the daemon.
+type HTTPServer int
+
+const (
+	// HTTPAPI is the server of the API.
+	HTTPAPI HTTPServer = iota
+	// HTTPGateway is the server of the gateway.
+	HTTPGateway
+)
+
+// ServeOption registers HTTP handlers on the given mux, and returns the mux
+// of the next options. It is a corehttp.ServeOption.
+type ServeOption = func(*core.IpfsNode, net.Listener, *http.ServeMux) (*http.ServeMux, error)
+
+// PluginHTTP is an interface that can be implemented to add handlers and
+// middleware to the HTTP servers of the daemon: the API, the gateway or both.
+type PluginHTTP interface {
+	Plugin
+
+	// ServeOptions returns the options registering the handlers of the
+	// plugin on the server, after the handlers of go-ipfs.
+	ServeOptions(server HTTPServer) ([]ServeOption, error)
+	// Middleware returns the middleware wrapping all the handlers of the
+	// server, or nil.
+	Middleware(server HTTPServer) (func(http.Handler) http.Handler, error)
+}
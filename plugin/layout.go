@@ -0,0 +1,18 @@
+package plugin
+
+import (
+	ipld "github.com/ipfs/go-ipld-format"
+	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+)
+
+// PluginLayout is an interface that can be implemented to add a layout of
+// the DAG of files, selected with the layout option of 'ipfs add' and
+// 'ipfs files write'
+type PluginLayout interface {
+	Plugin
+
+	// LayoutName returns the name of the layout.
+	LayoutName() string
+	// Layout builds the DAG of a file from the chunks of db.
+	Layout(db *ihelper.DagBuilderHelper) (ipld.Node, error)
+}
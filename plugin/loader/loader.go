@@ -3,6 +3,7 @@ package loader
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -14,6 +15,7 @@ import (
 	"github.com/ipfs/go-ipfs/core"
 	"github.com/ipfs/go-ipfs/core/coreapi"
 	coredag "github.com/ipfs/go-ipfs/core/coredag"
+	coreunix "github.com/ipfs/go-ipfs/core/coreunix"
 	plugin "github.com/ipfs/go-ipfs/plugin"
 	fsrepo "github.com/ipfs/go-ipfs/repo/fsrepo"
 
@@ -262,6 +264,20 @@ func (loader *PluginLoader) Inject() error {
 				return err
 			}
 		}
+		if pl, ok := pl.(plugin.PluginChunker); ok {
+			err := injectChunkerPlugin(pl)
+			if err != nil {
+				loader.state = loaderFailed
+				return err
+			}
+		}
+		if pl, ok := pl.(plugin.PluginLayout); ok {
+			err := injectLayoutPlugin(pl)
+			if err != nil {
+				loader.state = loaderFailed
+				return err
+			}
+		}
 	}
 
 	return loader.transition(loaderInjecting, loaderInjected)
@@ -334,6 +350,45 @@ func injectDatastorePlugin(pl plugin.PluginDatastore) error {
 	return fsrepo.AddDatastoreConfigHandler(pl.DatastoreTypeName(), pl.DatastoreConfigParser())
 }
 
+// HTTPOptions returns the middleware and the serve options of the HTTP
+// plugins for the given server. The middleware of the first plugin wraps the
+// others.
+func (loader *PluginLoader) HTTPOptions(server plugin.HTTPServer) ([]func(http.Handler) http.Handler, []plugin.ServeOption, error) {
+	if err := loader.assertState(loaderStarted); err != nil {
+		return nil, nil, err
+	}
+
+	var middleware []func(http.Handler) http.Handler
+	var opts []plugin.ServeOption
+	for _, pl := range loader.plugins {
+		pl, ok := pl.(plugin.PluginHTTP)
+		if !ok {
+			continue
+		}
+		mw, err := pl.Middleware(server)
+		if err != nil {
+			return nil, nil, fmt.Errorf("plugin %s: %s", pl.Name(), err)
+		}
+		if mw != nil {
+			middleware = append(middleware, mw)
+		}
+		plOpts, err := pl.ServeOptions(server)
+		if err != nil {
+			return nil, nil, fmt.Errorf("plugin %s: %s", pl.Name(), err)
+		}
+		opts = append(opts, plOpts...)
+	}
+	return middleware, opts, nil
+}
+
+func injectChunkerPlugin(pl plugin.PluginChunker) error {
+	return coreunix.AddChunker(pl.ChunkerName(), pl.NewSplitter)
+}
+
+func injectLayoutPlugin(pl plugin.PluginLayout) error {
+	return coreunix.AddLayout(pl.LayoutName(), pl.Layout)
+}
+
 func injectIPLDPlugin(pl plugin.PluginIPLD) error {
 	err := pl.RegisterBlockDecoders(ipld.DefaultBlockDecoder)
 	if err != nil {
@@ -0,0 +1,138 @@
+package s3ds
+
+import (
+	"container/list"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// cache keeps values of the bucket in a local datastore, up to a total
+// size. The least recently used values are removed to make room for new
+// ones.
+type cache struct {
+	store   ds.Batching
+	maxSize int64
+
+	// mu guards the bookkeeping, and is held while values are added and
+	// removed, so that it matches the store.
+	mu   sync.Mutex
+	size int64
+	// lru holds the cached keys, the most recently used first.
+	lru     *list.List
+	entries map[ds.Key]*list.Element
+}
+
+type cacheEntry struct {
+	key  ds.Key
+	size int64
+}
+
+// newCache returns the cache of the values in store, which may hold values
+// cached by a previous run. They are evicted first, in listing order, when
+// they don't fit.
+func newCache(store ds.Batching, maxSize int64) (*cache, error) {
+	c := &cache{
+		store:   store,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[ds.Key]*list.Element),
+	}
+	res, err := store.Query(dsq.Query{KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		key := ds.RawKey(r.Key)
+		c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: int64(r.Size)})
+		c.size += int64(r.Size)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c, c.evict()
+}
+
+// get returns a cached value, which becomes the most recently used.
+func (c *cache) get(key ds.Key) ([]byte, error) {
+	value, err := c.store.Get(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		if err == nil {
+			c.lru.MoveToFront(e)
+		} else if err == ds.ErrNotFound {
+			c.remove(e)
+		}
+	}
+	return value, err
+}
+
+func (c *cache) getSize(key ds.Key) (int, error) {
+	return c.store.GetSize(key)
+}
+
+// put caches a value, and evicts the least recently used ones beyond the
+// size of the cache. Values larger than the cache aren't cached.
+func (c *cache) put(key ds.Key, value []byte) error {
+	size := int64(len(value))
+	if size > c.maxSize {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.Put(key, value); err != nil {
+		return err
+	}
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+	return c.evict()
+}
+
+func (c *cache) delete(key ds.Key) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.Delete(key); err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	return nil
+}
+
+// evict removes the least recently used values until the cache fits its
+// size. mu is held.
+func (c *cache) evict() error {
+	for c.size > c.maxSize {
+		e := c.lru.Back()
+		key := e.Value.(*cacheEntry).key
+		if err := c.store.Delete(key); err != nil && err != ds.ErrNotFound {
+			return err
+		}
+		c.remove(e)
+	}
+	return nil
+}
+
+// remove forgets a cached value. mu is held.
+func (c *cache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+func (c *cache) sync(prefix ds.Key) error {
+	return c.store.Sync(prefix)
+}
+
+func (c *cache) close() error {
+	return c.store.Close()
+}
@@ -0,0 +1,401 @@
+package s3ds
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// maxDeleteKeys is the number of objects S3 deletes in a single request.
+const maxDeleteKeys = 1000
+
+// minPartSize is the smallest size S3 accepts for the parts of a multipart
+// upload, the last one excepted.
+const minPartSize = 5 << 20
+
+// client is a client of the S3 API, limited to the requests of the
+// datastore. The requests are signed with AWS signature version 4.
+type client struct {
+	http *http.Client
+
+	// endpoint is the URL of the service, such as
+	// https://s3.us-east-1.amazonaws.com.
+	endpoint *url.URL
+	bucket   string
+	region   string
+	// pathStyle addresses the bucket in the path of the URLs instead of
+	// the host, as most S3-compatible services expect.
+	pathStyle bool
+
+	accessKey string
+	secretKey string
+}
+
+// s3Error is an error returned by the service.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.Status)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+type object struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+type listResult struct {
+	IsTruncated           bool     `xml:"IsTruncated"`
+	Contents              []object `xml:"Contents"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+type deleteRequest struct {
+	XMLName xml.Name       `xml:"Delete"`
+	Quiet   bool           `xml:"Quiet"`
+	Objects []deleteObject `xml:"Object"`
+}
+
+type deleteObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteResult struct {
+	Errors []struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+type initiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeRequest struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// get returns the content of an object, or ds.ErrNotFound.
+func (c *client) get(key string) ([]byte, error) {
+	resp, err := c.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// head returns the size of an object, or ds.ErrNotFound.
+func (c *client) head(key string) (int, error) {
+	resp, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return -1, err
+	}
+	resp.Body.Close()
+	return strconv.Atoi(resp.Header.Get("Content-Length"))
+}
+
+func (c *client) put(key string, value []byte) error {
+	resp, err := c.do("PUT", key, nil, nil, value)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart uploads an object in parts of partSize bytes, the last one
+// excepted. The upload is aborted when it fails, so that the parts aren't
+// kept.
+func (c *client) putMultipart(key string, value []byte, partSize int) error {
+	resp, err := c.do("POST", key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var upload initiateResult
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := c.uploadParts(key, upload.UploadID, value, partSize); err != nil {
+		query := url.Values{"uploadId": {upload.UploadID}}
+		if resp, aerr := c.do("DELETE", key, query, nil, nil); aerr != nil {
+			log.Warnf("aborting the upload of %s: %s", key, aerr)
+		} else {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *client) uploadParts(key, id string, value []byte, partSize int) error {
+	var req completeRequest
+	for len(value) > 0 {
+		n := partSize
+		if n > len(value) {
+			n = len(value)
+		}
+		number := len(req.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {id}}
+		resp, err := c.do("PUT", key, query, nil, value[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		req.Parts = append(req.Parts, completePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		value = value[n:]
+	}
+
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("POST", key, url.Values{"uploadId": {id}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The completion may fail after the response started, with an error in
+	// the body of a successful response.
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		_ = xml.Unmarshal(data, e)
+		return e
+	}
+	return nil
+}
+
+// delete deletes an object. Deleting a missing object succeeds.
+func (c *client) delete(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil, nil)
+	if err == ds.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// deleteMany deletes up to maxDeleteKeys objects in a single request.
+func (c *client) deleteMany(keys []string) error {
+	req := deleteRequest{Quiet: true}
+	for _, k := range keys {
+		req.Objects = append(req.Objects, deleteObject{Key: k})
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+
+	resp, err := c.do("POST", "", url.Values{"delete": {""}}, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res deleteResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if len(res.Errors) > 0 {
+		e := res.Errors[0]
+		return fmt.Errorf("s3: deleting %s: %s: %s", e.Key, e.Code, e.Message)
+	}
+	return nil
+}
+
+// list returns a page of the objects under prefix, and the token of the
+// next page, empty on the last one.
+func (c *client) list(prefix, token string) ([]object, string, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	resp, err := c.do("GET", "", query, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var res listResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, "", err
+	}
+	if !res.IsTruncated {
+		res.NextContinuationToken = ""
+	}
+	return res.Contents, res.NextContinuationToken, nil
+}
+
+// do sends a signed request for an object, or for the bucket when key is
+// empty. Responses to failed requests are turned into errors, and not found
+// ones into ds.ErrNotFound.
+func (c *client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	p := "/"
+	if c.pathStyle {
+		p += c.bucket + "/"
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	p += key
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, body, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, ds.ErrNotFound
+	}
+	e := &s3Error{Status: resp.StatusCode}
+	if data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil {
+		_ = xml.Unmarshal(data, e)
+	}
+	return nil, e
+}
+
+// sign signs a request with AWS signature version 4.
+func (c *client) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	payloadHash := sha256.Sum256(body)
+	payload := hex.EncodeToString(payloadHash[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes a query string sorted by key, as signed.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes s as signed, keeping the slashes unless
+// encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,273 @@
+package s3ds
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	logging "github.com/ipfs/go-log"
+)
+
+var log = logging.Logger("s3ds")
+
+// Datastore stores values as the objects of an S3 bucket, named by their
+// key under a root directory and a shard directory. Values larger than a
+// part are uploaded in parts. Values may be cached on local disk, in a
+// second datastore.
+type Datastore struct {
+	s3       *client
+	root     string
+	shard    flatfs.ShardFunc
+	workers  int
+	partSize int
+	cache    *cache
+}
+
+var _ ds.Batching = (*Datastore)(nil)
+
+// objectKey returns the name of the object storing key.
+func (d *Datastore) objectKey(key ds.Key) string {
+	name := strings.TrimPrefix(key.String(), "/")
+	return d.root + d.shard(path.Base(name)) + "/" + name
+}
+
+// datastoreKey returns the key stored by an object, and false for objects
+// which aren't named by objectKey.
+func (d *Datastore) datastoreKey(object string) (ds.Key, bool) {
+	if !strings.HasPrefix(object, d.root) {
+		return ds.Key{}, false
+	}
+	object = object[len(d.root):]
+	i := strings.IndexByte(object, '/')
+	if i < 0 || i == len(object)-1 {
+		return ds.Key{}, false
+	}
+	return ds.NewKey(object[i+1:]), true
+}
+
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	var err error
+	if len(value) > d.partSize {
+		err = d.s3.putMultipart(d.objectKey(key), value, d.partSize)
+	} else {
+		err = d.s3.put(d.objectKey(key), value)
+	}
+	if err != nil {
+		return err
+	}
+	d.cachePut(key, value)
+	return nil
+}
+
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	if d.cache != nil {
+		if value, err := d.cache.get(key); err == nil {
+			return value, nil
+		}
+	}
+	value, err := d.s3.get(d.objectKey(key))
+	if err != nil {
+		return nil, err
+	}
+	d.cachePut(key, value)
+	return value, nil
+}
+
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	_, err := d.GetSize(key)
+	switch err {
+	case nil:
+		return true, nil
+	case ds.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	if d.cache != nil {
+		if size, err := d.cache.getSize(key); err == nil {
+			return size, nil
+		}
+	}
+	return d.s3.head(d.objectKey(key))
+}
+
+// Delete deletes a value from the bucket, and from the cache.
+func (d *Datastore) Delete(key ds.Key) error {
+	if err := d.s3.delete(d.objectKey(key)); err != nil {
+		return err
+	}
+	if d.cache != nil {
+		return d.cache.delete(key)
+	}
+	return nil
+}
+
+// Query lists the objects of the bucket under the root directory. The
+// prefix, filters and orders of the query are applied to the listing, as
+// the keys are sharded.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	var (
+		objects []object
+		token   string
+		done    bool
+	)
+	next := func() (dsq.Result, bool) {
+		for {
+			for len(objects) > 0 {
+				o := objects[0]
+				objects = objects[1:]
+				key, ok := d.datastoreKey(o.Key)
+				if !ok {
+					continue
+				}
+				e := dsq.Entry{Key: key.String(), Size: int(o.Size)}
+				if !q.KeysOnly {
+					value, err := d.Get(key)
+					if err == ds.ErrNotFound {
+						// Deleted since listed.
+						continue
+					}
+					if err != nil {
+						return dsq.Result{Error: err}, true
+					}
+					e.Value = value
+				}
+				return dsq.Result{Entry: e}, true
+			}
+			if done {
+				return dsq.Result{}, false
+			}
+			var err error
+			objects, token, err = d.s3.list(d.root, token)
+			if err != nil {
+				done = true
+				return dsq.Result{Error: err}, true
+			}
+			done = token == ""
+		}
+	}
+
+	qr := dsq.ResultsFromIterator(q, dsq.Iterator{Next: next})
+	return dsq.NaiveQueryApply(q, qr), nil
+}
+
+func (d *Datastore) Sync(prefix ds.Key) error {
+	if d.cache != nil {
+		return d.cache.sync(prefix)
+	}
+	return nil
+}
+
+func (d *Datastore) Close() error {
+	if d.cache != nil {
+		return d.cache.close()
+	}
+	return nil
+}
+
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{
+		d:       d,
+		puts:    make(map[ds.Key][]byte),
+		deletes: make(map[ds.Key]struct{}),
+	}, nil
+}
+
+// cachePut stores a value in the cache. The cache is best effort, the
+// values are in the bucket.
+func (d *Datastore) cachePut(key ds.Key, value []byte) {
+	if d.cache == nil {
+		return
+	}
+	if err := d.cache.put(key, value); err != nil {
+		log.Debugf("caching %s: %s", key, err)
+	}
+}
+
+// batch collects the changes of a Batch, committed with concurrent puts,
+// multipart for the values larger than a part, and multi-object deletes.
+type batch struct {
+	d       *Datastore
+	puts    map[ds.Key][]byte
+	deletes map[ds.Key]struct{}
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	b.puts[key] = value
+	delete(b.deletes, key)
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	b.deletes[key] = struct{}{}
+	delete(b.puts, key)
+	return nil
+}
+
+// Commit uploads the values put with as many requests at a time as there
+// are workers, and deletes the others by groups of up to 1000.
+func (b *batch) Commit() error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	keys := make(chan ds.Key)
+	for i := 0; i < b.d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if err := b.d.Put(key, b.puts[key]); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	for key := range b.puts {
+		keys <- key
+	}
+	close(keys)
+
+	var objects []string
+	for key := range b.deletes {
+		objects = append(objects, b.d.objectKey(key))
+		if b.d.cache != nil {
+			if err := b.d.cache.delete(key); err != nil {
+				fail(err)
+			}
+		}
+	}
+	for len(objects) > 0 {
+		n := len(objects)
+		if n > maxDeleteKeys {
+			n = maxDeleteKeys
+		}
+		if err := b.d.s3.deleteMany(objects[:n]); err != nil {
+			fail(err)
+		}
+		objects = objects[n:]
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	b.puts = make(map[ds.Key][]byte)
+	b.deletes = make(map[ds.Key]struct{})
+	return nil
+}
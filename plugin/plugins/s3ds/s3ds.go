@@ -0,0 +1,219 @@
+package s3ds
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-ipfs/plugin"
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	flatfs "github.com/ipfs/go-ds-flatfs"
+)
+
+// Plugins is exported list of plugins that will be loaded
+var Plugins = []plugin.Plugin{
+	&s3dsPlugin{},
+}
+
+const (
+	defaultShardFunc = "/repo/flatfs/shard/v1/next-to-last/2"
+	defaultWorkers   = 16
+	defaultPartSize  = 16 << 20
+	defaultCacheSize = 1 << 30
+	requestTimeout   = time.Minute
+)
+
+type s3dsPlugin struct{}
+
+var _ plugin.PluginDatastore = (*s3dsPlugin)(nil)
+
+func (*s3dsPlugin) Name() string {
+	return "ds-s3ds"
+}
+
+func (*s3dsPlugin) Version() string {
+	return "0.1.0"
+}
+
+func (*s3dsPlugin) Init(_ *plugin.Environment) error {
+	return nil
+}
+
+func (*s3dsPlugin) DatastoreTypeName() string {
+	return "s3ds"
+}
+
+type datastoreConfig struct {
+	bucket        string
+	region        string
+	endpoint      string
+	rootDirectory string
+	pathStyle     bool
+	shardFun      *flatfs.ShardIdV1
+	workers       int
+	partSize      int
+	cachePath     string
+	cacheSize     int64
+
+	accessKey string
+	secretKey string
+}
+
+// DatastoreConfigParser returns a configuration stub for an S3 datastore
+// from the given parameters
+func (*s3dsPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
+	return func(params map[string]interface{}) (fsrepo.DatastoreConfig, error) {
+		var c datastoreConfig
+		var ok bool
+		var err error
+
+		c.bucket, ok = params["bucket"].(string)
+		if !ok || c.bucket == "" {
+			return nil, fmt.Errorf("'bucket' field is missing or not string")
+		}
+		c.region, ok = params["region"].(string)
+		if !ok || c.region == "" {
+			return nil, fmt.Errorf("'region' field is missing or not string")
+		}
+
+		optional := map[string]*string{
+			"endpoint":      &c.endpoint,
+			"rootDirectory": &c.rootDirectory,
+			"cachePath":     &c.cachePath,
+			"accessKey":     &c.accessKey,
+			"secretKey":     &c.secretKey,
+		}
+		for name, field := range optional {
+			v, ok := params[name]
+			if !ok {
+				continue
+			}
+			if *field, ok = v.(string); !ok {
+				return nil, fmt.Errorf("'%s' field was not a string", name)
+			}
+		}
+		if c.endpoint == "" {
+			c.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", c.region)
+		}
+		if _, err := url.Parse(c.endpoint); err != nil {
+			return nil, fmt.Errorf("'endpoint' field is not a URL: %s", err)
+		}
+
+		if ps, ok := params["pathStyle"]; ok {
+			if c.pathStyle, ok = ps.(bool); !ok {
+				return nil, fmt.Errorf("'pathStyle' field was not a boolean")
+			}
+		}
+
+		sshardFun := defaultShardFunc
+		if sf, ok := params["shardFunc"]; ok {
+			if sshardFun, ok = sf.(string); !ok {
+				return nil, fmt.Errorf("'shardFunc' field was not a string")
+			}
+		}
+		c.shardFun, err = flatfs.ParseShardFunc(sshardFun)
+		if err != nil {
+			return nil, err
+		}
+
+		c.workers = defaultWorkers
+		if w, ok := params["workers"]; ok {
+			// JSON numbers are parsed as float64.
+			workers, ok := w.(float64)
+			if !ok || workers < 1 {
+				return nil, fmt.Errorf("'workers' field was not a positive number")
+			}
+			c.workers = int(workers)
+		}
+
+		c.partSize = defaultPartSize
+		if ps, ok := params["partSize"]; ok {
+			partSize, ok := ps.(float64)
+			if !ok || partSize < minPartSize {
+				return nil, fmt.Errorf("'partSize' field was not a number of at least %d", minPartSize)
+			}
+			c.partSize = int(partSize)
+		}
+
+		c.cacheSize = defaultCacheSize
+		if cs, ok := params["cacheSize"]; ok {
+			cacheSize, ok := cs.(float64)
+			if !ok || cacheSize < 1 {
+				return nil, fmt.Errorf("'cacheSize' field was not a positive number")
+			}
+			c.cacheSize = int64(cacheSize)
+		}
+
+		return &c, nil
+	}
+}
+
+// DiskSpec identifies the bucket and the objects of the datastore. The
+// credentials, the uploads and the cache can change without converting the
+// datastore.
+func (c *datastoreConfig) DiskSpec() fsrepo.DiskSpec {
+	return map[string]interface{}{
+		"type":          "s3ds",
+		"bucket":        c.bucket,
+		"region":        c.region,
+		"endpoint":      c.endpoint,
+		"rootDirectory": c.rootDirectory,
+		"shardFunc":     c.shardFun.String(),
+	}
+}
+
+func (c *datastoreConfig) Create(path string) (repo.Datastore, error) {
+	endpoint, err := url.Parse(c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	accessKey, secretKey := c.accessKey, c.secretKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	root := strings.Trim(c.rootDirectory, "/")
+	if root != "" {
+		root += "/"
+	}
+	d := &Datastore{
+		s3: &client{
+			http:      &http.Client{Timeout: requestTimeout},
+			endpoint:  endpoint,
+			bucket:    c.bucket,
+			region:    c.region,
+			pathStyle: c.pathStyle,
+			accessKey: accessKey,
+			secretKey: secretKey,
+		},
+		root:     root,
+		shard:    c.shardFun.Func(),
+		workers:  c.workers,
+		partSize: c.partSize,
+	}
+
+	if c.cachePath != "" {
+		p := c.cachePath
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(path, p)
+		}
+		store, err := flatfs.CreateOrOpen(p, c.shardFun, false)
+		if err != nil {
+			return nil, err
+		}
+		if d.cache, err = newCache(store, c.cacheSize); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
@@ -5,7 +5,23 @@ import (
 	"strings"
 )
 
+// KeyNotFoundError is returned by MapGetKV when the requested key isn't set.
+type KeyNotFoundError struct {
+	// Key is the part of the requested key that was found.
+	Key string
+}
+
+func (e KeyNotFoundError) Error() string {
+	return fmt.Sprintf("%s key has no attributes", e.Key)
+}
+
+// MapGetKV returns the value of the dotted key in v, or v itself for the
+// empty key.
 func MapGetKV(v map[string]interface{}, key string) (interface{}, error) {
+	if key == "" {
+		return v, nil
+	}
+
 	var ok bool
 	var mcursor map[string]interface{}
 	var cursor interface{} = v
@@ -21,7 +37,7 @@ func MapGetKV(v map[string]interface{}, key string) (interface{}, error) {
 
 		cursor, ok = mcursor[part]
 		if !ok {
-			return nil, fmt.Errorf("%s key has no attributes", sofar)
+			return nil, KeyNotFoundError{Key: sofar}
 		}
 	}
 	return cursor, nil
@@ -0,0 +1,36 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/ipfs/go-ipfs/repo/common"
+)
+
+// ConfigSection decodes the value stored under key in the repo's config into
+// v, which is left untouched when the key isn't set.
+//
+// This is meant for settings that go-ipfs-config doesn't know about. They are
+// kept in the config file, but dropped when it is loaded into a
+// config.Config, so they have to be read from the file directly. Such
+// settings should live under their own top-level key, as SetConfig replaces
+// the known top-level sections as a whole.
+func ConfigSection(r Repo, key string, v interface{}) error {
+	val, err := r.GetConfigKey(key)
+	if err != nil {
+		var notFound common.KeyNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	if val == nil {
+		return nil
+	}
+
+	buf, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
@@ -74,6 +74,23 @@ var measureConfig = []byte(`{
           "type": "measure"
 }`)
 
+var tieredConfig = []byte(`{
+          "type": "tiered",
+          "mode": "write-back",
+          "maxSize": "1GB",
+          "flushInterval": "1m",
+          "fast": {
+            "type": "mem"
+          },
+          "slow": {
+            "child": {
+              "type": "mem"
+            },
+            "prefix": "slow.datastore",
+            "type": "measure"
+          }
+}`)
+
 func TestDefaultDatastoreConfig(t *testing.T) {
 	loader, err := loader.NewPluginLoader("")
 	if err != nil {
@@ -234,3 +251,36 @@ func TestMeasureConfig(t *testing.T) {
 		t.Errorf("expected '*measure.measure' got '%s'", typ)
 	}
 }
+
+func TestTieredConfig(t *testing.T) {
+	spec := make(map[string]interface{})
+	err := json.Unmarshal(tieredConfig, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsc, err := fsrepo.AnyDatastoreConfig(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"fast":null,"slow":null,"type":"tiered"}`
+	if dsc.DiskSpec().String() != expected {
+		t.Errorf("expected '%s' got '%s' as DiskId", expected, dsc.DiskSpec().String())
+	}
+
+	ds, err := dsc.Create("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	if typ := reflect.TypeOf(ds).String(); typ != "*tiered.Datastore" {
+		t.Errorf("expected '*tiered.Datastore' got '%s'", typ)
+	}
+
+	spec["mode"] = "write-around"
+	if _, err := fsrepo.AnyDatastoreConfig(spec); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,673 @@
+package fsrepo
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-ipfs/repo"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	config "github.com/ipfs/go-ipfs-config"
+)
+
+// convertBatchSize is the number of keys copied or verified while the
+// writes to the datastore wait.
+const convertBatchSize = 256
+
+// Phases of a datastore conversion.
+const (
+	ConvertCopying   = "copying"
+	ConvertVerifying = "verifying"
+	ConvertDone      = "done"
+	ConvertFailed    = "failed"
+)
+
+// ConversionStatus is the state of a datastore conversion.
+type ConversionStatus struct {
+	Phase string
+	// Spec is the disk spec of the new datastore.
+	Spec string
+	// Keys is the number of keys copied or verified.
+	Keys uint64
+	// Error is set when the conversion failed.
+	Error string `json:",omitempty"`
+	// OldPaths are the paths of the previous datastore, which are kept once
+	// the conversion is done.
+	OldPaths []string `json:",omitempty"`
+}
+
+// conversion is a datastore conversion running in the background.
+type conversion struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	status ConversionStatus
+}
+
+func (c *conversion) update(f func(s *ConversionStatus)) {
+	c.mu.Lock()
+	f(&c.status)
+	c.mu.Unlock()
+}
+
+// swapDatastore is the datastore of the repo, which can be converted to
+// another one while in use. During a conversion, the writes go to both
+// datastores, and the reads to the new one, falling through to the
+// previous one.
+type swapDatastore struct {
+	// mu guards cur and next.
+	mu   sync.RWMutex
+	cur  *store
+	next *store
+
+	// writeMu is held by writes, and exclusively by the copy of keys.
+	writeMu sync.RWMutex
+
+	// refsMu guards the users of the stores, and retired.
+	refsMu sync.Mutex
+	// retired are the replaced stores still in use, closed once the
+	// operations and queries using them are done, or with the swap.
+	retired []*store
+}
+
+// store is a datastore of a swapDatastore.
+type store struct {
+	repo.Datastore
+	// users counts the operations and the open queries using the
+	// datastore.
+	users int
+}
+
+var _ repo.Datastore = (*swapDatastore)(nil)
+
+// stores returns the current datastore, and the new one during a
+// conversion. They are in use until released.
+func (d *swapDatastore) stores() (cur, next *store) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	d.refsMu.Lock()
+	defer d.refsMu.Unlock()
+	d.cur.users++
+	if d.next != nil {
+		d.next.users++
+	}
+	return d.cur, d.next
+}
+
+// release ends the use of the stores, and closes the retired ones no longer
+// in use.
+func (d *swapDatastore) release(stores ...*store) {
+	var done []*store
+	d.refsMu.Lock()
+	for _, s := range stores {
+		if s == nil {
+			continue
+		}
+		s.users--
+		if s.users == 0 && d.unretire(s) {
+			done = append(done, s)
+		}
+	}
+	d.refsMu.Unlock()
+	for _, s := range done {
+		closeRetired(s)
+	}
+}
+
+// retire closes s, which was replaced, once no operation or query uses it.
+func (d *swapDatastore) retire(s *store) {
+	d.refsMu.Lock()
+	inUse := s.users > 0
+	if inUse {
+		d.retired = append(d.retired, s)
+	}
+	d.refsMu.Unlock()
+	if !inUse {
+		closeRetired(s)
+	}
+}
+
+// unretire removes s from the retired stores, and reports whether it was
+// one of them.
+func (d *swapDatastore) unretire(s *store) bool {
+	for i, r := range d.retired {
+		if r == s {
+			d.retired = append(d.retired[:i], d.retired[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func closeRetired(s *store) {
+	if err := s.Close(); err != nil {
+		log.Warnf("closing the previous datastore: %s", err)
+	}
+}
+
+func (d *swapDatastore) Put(key ds.Key, value []byte) error {
+	d.writeMu.RLock()
+	defer d.writeMu.RUnlock()
+	cur, next := d.stores()
+	defer d.release(cur, next)
+	if err := cur.Put(key, value); err != nil {
+		return err
+	}
+	if next != nil {
+		return next.Put(key, value)
+	}
+	return nil
+}
+
+func (d *swapDatastore) Delete(key ds.Key) error {
+	d.writeMu.RLock()
+	defer d.writeMu.RUnlock()
+	cur, next := d.stores()
+	defer d.release(cur, next)
+	if err := cur.Delete(key); err != nil {
+		return err
+	}
+	if next != nil {
+		// The key may not be copied yet.
+		if err := next.Delete(key); err != nil && err != ds.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *swapDatastore) Get(key ds.Key) ([]byte, error) {
+	cur, next := d.stores()
+	defer d.release(cur, next)
+	if next != nil {
+		if value, err := next.Get(key); err != ds.ErrNotFound {
+			return value, err
+		}
+	}
+	return cur.Get(key)
+}
+
+func (d *swapDatastore) Has(key ds.Key) (bool, error) {
+	cur, next := d.stores()
+	defer d.release(cur, next)
+	if next != nil {
+		if has, err := next.Has(key); err != nil || has {
+			return has, err
+		}
+	}
+	return cur.Has(key)
+}
+
+func (d *swapDatastore) GetSize(key ds.Key) (int, error) {
+	cur, next := d.stores()
+	defer d.release(cur, next)
+	if next != nil {
+		if size, err := next.GetSize(key); err != ds.ErrNotFound {
+			return size, err
+		}
+	}
+	return cur.GetSize(key)
+}
+
+// Query queries the current datastore, which holds all the keys during a
+// conversion. It is kept open until the results are closed.
+func (d *swapDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	cur, next := d.stores()
+	d.release(next)
+	res, err := cur.Query(q)
+	if err != nil {
+		d.release(cur)
+		return nil, err
+	}
+	return &swapResults{Results: res, release: func() { d.release(cur) }}, nil
+}
+
+// swapResults are the results of a query, which release their datastore
+// when closed.
+type swapResults struct {
+	dsq.Results
+	once    sync.Once
+	release func()
+}
+
+func (r *swapResults) Close() error {
+	err := r.Results.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+func (d *swapDatastore) Sync(prefix ds.Key) error {
+	cur, next := d.stores()
+	defer d.release(cur, next)
+	if err := cur.Sync(prefix); err != nil {
+		return err
+	}
+	if next != nil {
+		return next.Sync(prefix)
+	}
+	return nil
+}
+
+// Close closes the current datastore, and the previous ones still used by
+// queries that weren't closed.
+func (d *swapDatastore) Close() error {
+	d.mu.RLock()
+	cur := d.cur
+	d.mu.RUnlock()
+	d.refsMu.Lock()
+	retired := d.retired
+	d.retired = nil
+	d.refsMu.Unlock()
+	for _, s := range retired {
+		closeRetired(s)
+	}
+	return cur.Close()
+}
+
+func (d *swapDatastore) DiskUsage() (uint64, error) {
+	cur, next := d.stores()
+	defer d.release(cur, next)
+	return ds.DiskUsage(cur.Datastore)
+}
+
+func (d *swapDatastore) CollectGarbage() error {
+	cur, next := d.stores()
+	defer d.release(cur, next)
+	if gc, ok := cur.Datastore.(ds.GCDatastore); ok {
+		return gc.CollectGarbage()
+	}
+	return nil
+}
+
+func (d *swapDatastore) Batch() (ds.Batch, error) {
+	return &swapBatch{d: d}, nil
+}
+
+// swapBatch collects the changes of a batch, committed to both datastores
+// during a conversion.
+type swapBatch struct {
+	d   *swapDatastore
+	ops []swapOp
+}
+
+type swapOp struct {
+	key    ds.Key
+	value  []byte
+	delete bool
+}
+
+func (b *swapBatch) Put(key ds.Key, value []byte) error {
+	b.ops = append(b.ops, swapOp{key: key, value: value})
+	return nil
+}
+
+func (b *swapBatch) Delete(key ds.Key) error {
+	b.ops = append(b.ops, swapOp{key: key, delete: true})
+	return nil
+}
+
+func (b *swapBatch) Commit() error {
+	b.d.writeMu.RLock()
+	defer b.d.writeMu.RUnlock()
+	cur, next := b.d.stores()
+	defer b.d.release(cur, next)
+	if err := commitOps(cur, b.ops); err != nil {
+		return err
+	}
+	if next != nil {
+		if err := commitOps(next, b.ops); err != nil {
+			return err
+		}
+	}
+	b.ops = nil
+	return nil
+}
+
+func commitOps(d repo.Datastore, ops []swapOp) error {
+	b, err := d.Batch()
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.delete {
+			err = b.Delete(op.key)
+		} else {
+			err = b.Put(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.Commit()
+}
+
+// ConvertDatastore starts converting the datastore of the repo to the one
+// of spec in the background. The keys are copied while the repo is in use,
+// then verified, and the new datastore replaces the current one in the
+// config and on disk. The files of the current datastore are kept.
+func (r *FSRepo) ConvertDatastore(spec map[string]interface{}) error {
+	dsc, err := AnyDatastoreConfig(spec)
+	if err != nil {
+		return err
+	}
+	newSpec := dsc.DiskSpec()
+
+	packageLock.Lock()
+	defer packageLock.Unlock()
+	if r.closed {
+		return errors.New("repo is closed")
+	}
+	if r.conv != nil {
+		select {
+		case <-r.conv.done:
+		default:
+			return errors.New("a datastore conversion is already running")
+		}
+	}
+
+	oldSpec, err := r.readSpec()
+	if err != nil {
+		return err
+	}
+	if oldSpec == newSpec.String() {
+		return errors.New("the datastore already has this spec")
+	}
+	oldDsc, err := AnyDatastoreConfig(r.config.Datastore.Spec)
+	if err != nil {
+		return err
+	}
+	oldPaths := r.specPaths(oldDsc.DiskSpec())
+	newPaths := r.specPaths(newSpec)
+	for _, p := range newPaths {
+		for _, op := range oldPaths {
+			if p == op {
+				return fmt.Errorf("the new datastore would use %s, used by the current one", p)
+			}
+		}
+		if _, err := os.Stat(p); err == nil {
+			return fmt.Errorf("%s exists, remove it to convert the datastore", p)
+		}
+	}
+
+	next, err := dsc.Create(r.path)
+	if err != nil {
+		removePaths(newPaths)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &conversion{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		status: ConversionStatus{Phase: ConvertCopying, Spec: newSpec.String()},
+	}
+	r.conv = c
+
+	// Wait for the writes in progress, which would miss the new datastore.
+	r.sds.writeMu.Lock()
+	r.sds.mu.Lock()
+	cur, nextStore := r.sds.cur, &store{Datastore: next}
+	r.sds.next = nextStore
+	r.sds.mu.Unlock()
+	r.sds.writeMu.Unlock()
+
+	go func() {
+		defer close(c.done)
+		err := r.convert(ctx, c, cur, nextStore, spec, newSpec)
+		if err == nil {
+			c.update(func(s *ConversionStatus) {
+				s.Phase = ConvertDone
+				s.OldPaths = oldPaths
+			})
+			return
+		}
+
+		log.Errorf("converting the datastore: %s", err)
+		r.sds.writeMu.Lock()
+		r.sds.mu.Lock()
+		r.sds.next = nil
+		r.sds.mu.Unlock()
+		r.sds.writeMu.Unlock()
+		r.sds.retire(nextStore)
+		removePaths(newPaths)
+		c.update(func(s *ConversionStatus) {
+			s.Phase = ConvertFailed
+			s.Error = err.Error()
+		})
+	}()
+	return nil
+}
+
+// DatastoreConversion returns the state of the running or last datastore
+// conversion, and false when there was none.
+func (r *FSRepo) DatastoreConversion() (ConversionStatus, bool) {
+	packageLock.Lock()
+	c := r.conv
+	packageLock.Unlock()
+	if c == nil {
+		return ConversionStatus{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status, true
+}
+
+// stopConversion cancels a running conversion, and waits for it to stop.
+func (r *FSRepo) stopConversion() {
+	packageLock.Lock()
+	c := r.conv
+	packageLock.Unlock()
+	if c != nil {
+		c.cancel()
+		<-c.done
+	}
+}
+
+func (r *FSRepo) convert(ctx context.Context, c *conversion, cur, next *store, spec map[string]interface{}, newSpec DiskSpec) error {
+	// Copy the keys missing from the new datastore.
+	err := forEachKeys(ctx, cur, &r.sds.writeMu, func(key ds.Key) error {
+		if has, err := next.Has(key); err != nil || has {
+			return err
+		}
+		value, err := cur.Get(key)
+		if err == ds.ErrNotFound {
+			// Deleted since listed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return next.Put(key, value)
+	}, func(n int) {
+		c.update(func(s *ConversionStatus) { s.Keys += uint64(n) })
+	})
+	if err != nil {
+		return err
+	}
+
+	// Verify the copies.
+	c.update(func(s *ConversionStatus) {
+		s.Phase = ConvertVerifying
+		s.Keys = 0
+	})
+	err = forEachKeys(ctx, cur, &r.sds.writeMu, func(key ds.Key) error {
+		value, err := cur.Get(key)
+		if err == ds.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		copied, err := next.Get(key)
+		if err != nil {
+			return fmt.Errorf("reading %s from the new datastore: %s", key, err)
+		}
+		if sha256.Sum256(value) != sha256.Sum256(copied) {
+			return fmt.Errorf("%s differs in the new datastore", key)
+		}
+		return nil
+	}, func(n int) {
+		c.update(func(s *ConversionStatus) { s.Keys += uint64(n) })
+	})
+	if err != nil {
+		return err
+	}
+
+	// Compare the number of keys and swap the datastores, with the writes
+	// waiting.
+	r.sds.writeMu.Lock()
+	defer r.sds.writeMu.Unlock()
+	curKeys, err := countKeys(cur)
+	if err != nil {
+		return err
+	}
+	nextKeys, err := countKeys(next)
+	if err != nil {
+		return err
+	}
+	if curKeys != nextKeys {
+		return fmt.Errorf("the new datastore has %d keys, instead of %d", nextKeys, curKeys)
+	}
+
+	oldConfig, err := r.Config()
+	if err != nil {
+		return err
+	}
+	oldSpec := oldConfig.Datastore.Spec
+	if err := r.SetConfigKey("Datastore.Spec", spec); err != nil {
+		return err
+	}
+	if err := r.writeSpec(newSpec); err != nil {
+		if rerr := r.SetConfigKey("Datastore.Spec", oldSpec); rerr != nil {
+			log.Errorf("restoring Datastore.Spec: %s", rerr)
+		}
+		return err
+	}
+	r.sds.mu.Lock()
+	r.sds.cur = next
+	r.sds.next = nil
+	r.sds.mu.Unlock()
+	// The reads and queries started before the swap may still use the
+	// previous datastore.
+	r.sds.retire(cur)
+	return nil
+}
+
+// forEachKeys calls f on the keys of d by batches, with mu held. progress
+// is called after each batch with its size.
+func forEachKeys(ctx context.Context, d repo.Datastore, mu sync.Locker, f func(ds.Key) error, progress func(int)) error {
+	res, err := d.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	batch := make([]ds.Key, 0, convertBatchSize)
+	flush := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, key := range batch {
+			if err := f(key); err != nil {
+				return err
+			}
+		}
+		progress(len(batch))
+		batch = batch[:0]
+		return ctx.Err()
+	}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		batch = append(batch, ds.RawKey(r.Key))
+		if len(batch) == convertBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+func countKeys(d repo.Datastore) (uint64, error) {
+	res, err := d.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+	var n uint64
+	for r := range res.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+		n++
+	}
+	return n, nil
+}
+
+// writeSpec replaces the disk spec of the datastore.
+func (r *FSRepo) writeSpec(spec DiskSpec) error {
+	fn, err := config.Path(r.path, specFn)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(r.path, specFn)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(spec.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
+
+// specPaths returns the absolute paths of the datastores of a disk spec.
+func (r *FSRepo) specPaths(spec DiskSpec) []string {
+	var paths []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case DiskSpec:
+			walk(map[string]interface{}(v))
+		case map[string]interface{}:
+			if p, ok := v["path"].(string); ok {
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(r.path, p)
+				}
+				paths = append(paths, filepath.Clean(p))
+			}
+			for _, c := range v {
+				walk(c)
+			}
+		case []interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		}
+	}
+	walk(spec)
+	sort.Strings(paths)
+	return paths
+}
+
+func removePaths(paths []string) {
+	for _, p := range paths {
+		if err := os.RemoveAll(p); err != nil {
+			log.Warnf("removing %s: %s", p, err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package fsrepo_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	config "github.com/ipfs/go-ipfs-config"
+	options "github.com/ipfs/interface-go-ipfs-core/options"
+)
+
+// testflatfs is a flatfs datastore, registered without the plugins.
+type testflatfsConfig struct {
+	path string
+}
+
+func init() {
+	err := fsrepo.AddDatastoreConfigHandler("testflatfs", func(params map[string]interface{}) (fsrepo.DatastoreConfig, error) {
+		path, ok := params["path"].(string)
+		if !ok {
+			return nil, fmt.Errorf("'path' field is missing or not string")
+		}
+		return &testflatfsConfig{path: path}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (c *testflatfsConfig) DiskSpec() fsrepo.DiskSpec {
+	return map[string]interface{}{"type": "testflatfs", "path": c.path}
+}
+
+func (c *testflatfsConfig) Create(path string) (repo.Datastore, error) {
+	p := filepath.Join(path, c.path)
+	d, err := flatfs.CreateOrOpen(p, flatfs.NextToLast(2), false)
+	if err != nil {
+		return nil, err
+	}
+	closedStores.Delete(p)
+	return &trackedDatastore{Datastore: d, path: p}, nil
+}
+
+// closedStores records the paths of the testflatfs datastores closed.
+var closedStores sync.Map
+
+type trackedDatastore struct {
+	*flatfs.Datastore
+	path string
+}
+
+func (d *trackedDatastore) Close() error {
+	closedStores.Store(d.path, true)
+	return d.Datastore.Close()
+}
+
+func isClosed(p string) bool {
+	_, ok := closedStores.Load(p)
+	return ok
+}
+
+func testflatfsSpec(path string) map[string]interface{} {
+	return map[string]interface{}{"type": "testflatfs", "path": path}
+}
+
+func waitConversion(t *testing.T, r *fsrepo.FSRepo) fsrepo.ConversionStatus {
+	t.Helper()
+	for {
+		s, ok := r.DatastoreConversion()
+		if !ok {
+			t.Fatal("no conversion")
+		}
+		if s.Phase == fsrepo.ConvertDone || s.Phase == fsrepo.ConvertFailed {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConvertDatastore(t *testing.T) {
+	path := t.TempDir()
+	// The conversion sets the config, which needs an identity.
+	ident, err := config.CreateIdentity(ioutil.Discard, []options.KeyGenerateOption{options.Key.Type(options.Ed25519Key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Identity: ident, Datastore: config.Datastore{Spec: testflatfsSpec("a")}}
+	if err := fsrepo.Init(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	rr, err := fsrepo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := repo.Unwrap(rr).(*fsrepo.FSRepo)
+	d := r.Datastore()
+
+	key := func(i int) ds.Key { return ds.NewKey(fmt.Sprintf("KEY%d", i)) }
+	for i := 0; i < 1000; i++ {
+		if err := d.Put(key(i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.ConvertDatastore(testflatfsSpec("a")); err == nil {
+		t.Fatal("converted to the same datastore")
+	}
+	if err := r.ConvertDatastore(testflatfsSpec("b")); err != nil {
+		t.Fatal(err)
+	}
+	// The repo is used during the conversion.
+	for i := 0; i < 100; i++ {
+		if err := d.Delete(key(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Put(key(1000+i), []byte(fmt.Sprint(1000+i))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Get(key(500 + i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := waitConversion(t, r)
+	if s.Phase != fsrepo.ConvertDone {
+		t.Fatalf("conversion failed: %s", s.Error)
+	}
+	if len(s.OldPaths) != 1 || s.OldPaths[0] != filepath.Join(path, "a") {
+		t.Fatalf("unexpected old paths: %v", s.OldPaths)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := ioutil.ReadFile(filepath.Join(path, "datastore_spec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(spec) != `{"path":"b","type":"testflatfs"}` {
+		t.Fatalf("unexpected datastore_spec: %s", spec)
+	}
+	// Remove the previous datastore, the repo must use the new one.
+	if err := os.RemoveAll(filepath.Join(path, "a")); err != nil {
+		t.Fatal(err)
+	}
+	rr, err = fsrepo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+	d = rr.Datastore()
+	for i := 0; i < 1100; i++ {
+		_, err := d.Get(key(i))
+		if i < 100 && err != ds.ErrNotFound {
+			t.Fatalf("deleted %s: %v", key(i), err)
+		} else if i >= 100 && err != nil {
+			t.Fatalf("reading %s: %s", key(i), err)
+		}
+	}
+}
+
+func TestConvertDatastoreExistingPath(t *testing.T) {
+	path := t.TempDir()
+	if err := fsrepo.Init(path, &config.Config{Datastore: config.Datastore{Spec: testflatfsSpec("a")}}); err != nil {
+		t.Fatal(err)
+	}
+	rr, err := fsrepo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+
+	if err := os.Mkdir(filepath.Join(path, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Unwrap(rr).(*fsrepo.FSRepo).ConvertDatastore(testflatfsSpec("b")); err == nil {
+		t.Fatal("converted to an existing path")
+	}
+}
+
+func TestConvertDatastoreOpenQuery(t *testing.T) {
+	path := t.TempDir()
+	ident, err := config.CreateIdentity(ioutil.Discard, []options.KeyGenerateOption{options.Key.Type(options.Ed25519Key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Identity: ident, Datastore: config.Datastore{Spec: testflatfsSpec("a")}}
+	if err := fsrepo.Init(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	rr, err := fsrepo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rr.Close()
+	r := repo.Unwrap(rr).(*fsrepo.FSRepo)
+	d := r.Datastore()
+
+	for i := 0; i < 100; i++ {
+		if err := d.Put(ds.NewKey(fmt.Sprintf("KEY%d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The query runs on the previous datastore during the swap.
+	res, err := d.Query(dsq.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ConvertDatastore(testflatfsSpec("b")); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitConversion(t, r); s.Phase != fsrepo.ConvertDone {
+		t.Fatalf("conversion failed: %s", s.Error)
+	}
+	old := filepath.Join(path, "a")
+	if isClosed(old) {
+		t.Fatal("the previous datastore was closed during a query")
+	}
+
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 100 {
+		t.Fatalf("got %d entries, expected at least 100", len(entries))
+	}
+	if err := res.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !isClosed(old) {
+		t.Fatal("the previous datastore wasn't closed after the query")
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/tiered"
 
+	humanize "github.com/dustin/go-humanize"
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/mount"
 	dssync "github.com/ipfs/go-datastore/sync"
@@ -61,6 +64,7 @@ func init() {
 		"mem":     MemDatastoreConfig,
 		"log":     LogDatastoreConfig,
 		"measure": MeasureDatastoreConfig,
+		"tiered":  TieredDatastoreConfig,
 	}
 }
 
@@ -246,3 +250,101 @@ func (c measureDatastoreConfig) Create(path string) (repo.Datastore, error) {
 	}
 	return measure.New(c.prefix, child), nil
 }
+
+type tieredDatastoreConfig struct {
+	fast DatastoreConfig
+	slow DatastoreConfig
+	opts tiered.Options
+}
+
+// TieredDatastoreConfig returns a tiered DatastoreConfig from a spec
+func TieredDatastoreConfig(params map[string]interface{}) (DatastoreConfig, error) {
+	var c tieredDatastoreConfig
+	var err error
+
+	for name, child := range map[string]*DatastoreConfig{"fast": &c.fast, "slow": &c.slow} {
+		field, ok := params[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'%s' field is missing or not a map", name)
+		}
+		*child, err = AnyDatastoreConfig(field)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch mode := params["mode"]; mode {
+	case nil, "write-through":
+	case "write-back":
+		c.opts.WriteBack = true
+	default:
+		return nil, fmt.Errorf("'mode' field was not \"write-through\" or \"write-back\"")
+	}
+
+	c.opts.Promote = true
+	if promote, ok := params["promote"]; ok {
+		if c.opts.Promote, ok = promote.(bool); !ok {
+			return nil, fmt.Errorf("'promote' field was not a boolean")
+		}
+	}
+
+	if maxSize, ok := params["maxSize"]; ok {
+		s, ok := maxSize.(string)
+		if !ok {
+			return nil, fmt.Errorf("'maxSize' field was not a string")
+		}
+		if c.opts.MaxSize, err = humanize.ParseBytes(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if interval, ok := params["flushInterval"]; ok {
+		s, ok := interval.(string)
+		if !ok {
+			return nil, fmt.Errorf("'flushInterval' field was not a string")
+		}
+		if c.opts.FlushInterval, err = time.ParseDuration(s); err != nil {
+			return nil, err
+		}
+	}
+
+	c.opts.MetricsPrefix = "tiered.datastore"
+	if prefix, ok := params["prefix"]; ok {
+		if c.opts.MetricsPrefix, ok = prefix.(string); !ok {
+			return nil, fmt.Errorf("'prefix' field was not a string")
+		}
+	}
+	return &c, nil
+}
+
+// DiskSpec identifies both tiers, as the fast one may hold values missing
+// from the slow one in write-back mode.
+func (c *tieredDatastoreConfig) DiskSpec() DiskSpec {
+	return map[string]interface{}{
+		"type": "tiered",
+		"fast": map[string]interface{}(c.fast.DiskSpec()),
+		"slow": map[string]interface{}(c.slow.DiskSpec()),
+	}
+}
+
+// Create opens both tiers, measured with the prefix of the datastore
+// followed by .fast and .slow.
+func (c *tieredDatastoreConfig) Create(path string) (repo.Datastore, error) {
+	fast, err := c.fast.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	slow, err := c.slow.Create(path)
+	if err != nil {
+		fast.Close()
+		return nil, err
+	}
+	prefix := c.opts.MetricsPrefix
+	d, err := tiered.New(measure.New(prefix+".fast", fast), measure.New(prefix+".slow", slow), c.opts)
+	if err != nil {
+		fast.Close()
+		slow.Close()
+		return nil, err
+	}
+	return d, nil
+}
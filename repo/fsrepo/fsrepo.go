@@ -102,6 +102,10 @@ type FSRepo struct {
 	ds       repo.Datastore
 	keystore keystore.Keystore
 	filemgr  *filestore.FileManager
+
+	// sds is the datastore under the metrics, swapped by a conversion.
+	sds  *swapDatastore
+	conv *conversion
 }
 
 var _ repo.Repo = (*FSRepo)(nil)
@@ -441,11 +445,11 @@ func (r *FSRepo) openDatastore() error {
 	if err != nil {
 		return err
 	}
-	r.ds = d
+	r.sds = &swapDatastore{cur: &store{Datastore: d}}
 
 	// Wrap it with metrics gathering
 	prefix := "ipfs.fsrepo.datastore"
-	r.ds = measure.New(prefix, r.ds)
+	r.ds = measure.New(prefix, r.sds)
 
 	return nil
 }
@@ -464,6 +468,9 @@ func (r *FSRepo) readSpec() (string, error) {
 
 // Close closes the FSRepo, releasing held resources.
 func (r *FSRepo) Close() error {
+	// The conversion sets the config, so stop it before taking the lock.
+	r.stopConversion()
+
 	packageLock.Lock()
 	defer packageLock.Unlock()
 
@@ -0,0 +1,164 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	datastore "github.com/ipfs/go-datastore"
+)
+
+// Migration is a migration compiled into the ipfs binary. It is run instead
+// of the fs-repo-X-to-Y binary of the same versions.
+type Migration interface {
+	// Version returns the version of the repo migrated from. The migration
+	// migrates the repo to the next version.
+	Version() int
+	// Apply migrates the repo to the next version.
+	Apply(ctx context.Context, opts Options) error
+	// Revert migrates the repo back from the next version.
+	Revert(ctx context.Context, opts Options) error
+	// Reversible reports whether the migration can be reverted.
+	Reversible() bool
+}
+
+// Options are the options of an embedded migration.
+type Options struct {
+	// Name is the name of the migration, such as fs-repo-11-to-12.
+	Name string
+	// Path is the path of the repo.
+	Path string
+	// DryRun is true when the migration must only log the changes it would
+	// make.
+	DryRun bool
+	// Backup is true when the migration must keep a copy of the files it
+	// changes, with BackupFile.
+	Backup bool
+	// Log is the logger of the migration.
+	Log *log.Logger
+}
+
+// BackupFile copies the file at path to path.<name>.bak, before the
+// migration changes it. It does nothing in a dry run, or without Backup.
+func (opts Options) BackupFile(path string) error {
+	if opts.DryRun || !opts.Backup {
+		return nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	bak := fmt.Sprintf("%s.%s.bak", path, opts.Name)
+	dst, err := os.OpenFile(bak, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	opts.Log.Println("  => Backed up", path, "to", bak)
+	return nil
+}
+
+// BackupKey copies the value of key in d to BackupKeyOf(key), before the
+// migration changes it. It does nothing in a dry run, or without Backup.
+func (opts Options) BackupKey(d datastore.Datastore, key datastore.Key) error {
+	if opts.DryRun || !opts.Backup {
+		return nil
+	}
+	value, err := d.Get(key)
+	if err != nil {
+		return err
+	}
+	bak := opts.BackupKeyOf(key)
+	if err := d.Put(bak, value); err != nil {
+		return err
+	}
+	opts.Log.Println("  => Backed up", key, "to", bak)
+	return nil
+}
+
+// BackupKeyOf returns the key <key>.<name>.bak, which BackupKey copies key
+// to.
+func (opts Options) BackupKeyOf(key datastore.Key) datastore.Key {
+	return datastore.RawKey(fmt.Sprintf("%s.%s.bak", key, opts.Name))
+}
+
+var (
+	embeddedLk sync.Mutex
+	embedded   = make(map[string]Migration)
+)
+
+// Register adds a migration compiled into the binary. It panics when a
+// migration of the same version is registered.
+func Register(m Migration) {
+	embeddedLk.Lock()
+	defer embeddedLk.Unlock()
+
+	name := migrationName(m.Version(), m.Version()+1)
+	if _, ok := embedded[name]; ok {
+		panic(fmt.Sprintf("migration %s registered twice", name))
+	}
+	embedded[name] = m
+}
+
+func embeddedMigration(name string) (Migration, bool) {
+	embeddedLk.Lock()
+	defer embeddedLk.Unlock()
+	m, ok := embedded[name]
+	return m, ok
+}
+
+// runEmbeddedMigration runs an embedded migration, or reverts it, and writes
+// the version of the repo once done. An applied migration which fails is
+// reverted.
+func runEmbeddedMigration(ctx context.Context, m Migration, name, ipfsDir string, revert bool, ropts RunOptions, logger *log.Logger) error {
+	opts := Options{
+		Name:   name,
+		Path:   ipfsDir,
+		DryRun: ropts.DryRun,
+		Backup: !ropts.NoBackup,
+		Log:    logger,
+	}
+
+	version := m.Version() + 1
+	if revert {
+		if !m.Reversible() {
+			return fmt.Errorf("%s can't be reverted", name)
+		}
+		logger.Println("  => Reverting embedded migration", name)
+		if err := m.Revert(ctx, opts); err != nil {
+			return err
+		}
+		version = m.Version()
+	} else {
+		logger.Println("  => Running embedded migration", name)
+		if err := m.Apply(ctx, opts); err != nil {
+			if !opts.DryRun && m.Reversible() {
+				logger.Println("  => Migration failed, reverting:", err)
+				if rerr := m.Revert(ctx, opts); rerr != nil {
+					logger.Println("  => Reverting failed:", rerr)
+				}
+			}
+			return err
+		}
+	}
+
+	if opts.DryRun {
+		return nil
+	}
+	return WriteRepoVersion(ipfsDir, version)
+}
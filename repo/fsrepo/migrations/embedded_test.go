@@ -0,0 +1,131 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testMigration appends its version to the file "migrated" of the repo.
+type testMigration struct {
+	version int
+	fail    bool
+	reverts int
+}
+
+func (m *testMigration) Version() int {
+	return m.version
+}
+
+func (m *testMigration) Apply(ctx context.Context, opts Options) error {
+	fn := filepath.Join(opts.Path, "migrated")
+	if err := opts.BackupFile(fn); err != nil {
+		return err
+	}
+	if opts.DryRun {
+		opts.Log.Println("would write", fn)
+		return nil
+	}
+	if err := ioutil.WriteFile(fn, []byte(migrationName(m.version, m.version+1)), 0644); err != nil {
+		return err
+	}
+	if m.fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (m *testMigration) Revert(ctx context.Context, opts Options) error {
+	m.reverts++
+	return ioutil.WriteFile(filepath.Join(opts.Path, "migrated"), []byte("reverted"), 0644)
+}
+
+func (m *testMigration) Reversible() bool {
+	return true
+}
+
+func registerTestMigrations(t *testing.T, migs ...*testMigration) {
+	for _, m := range migs {
+		Register(m)
+	}
+	t.Cleanup(func() {
+		embeddedLk.Lock()
+		defer embeddedLk.Unlock()
+		for _, m := range migs {
+			delete(embedded, migrationName(m.version, m.version+1))
+		}
+	})
+}
+
+func readMigrated(t *testing.T, ipfsDir string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(ipfsDir, "migrated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	ipfsDir := t.TempDir()
+	if err := WriteRepoVersion(ipfsDir, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ipfsDir, "migrated"), []byte("initial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registerTestMigrations(t, &testMigration{version: 1000}, &testMigration{version: 1001})
+
+	ctx := context.Background()
+	// No fetcher, the migrations are embedded.
+	err := RunMigrationWithOptions(ctx, nil, 1002, ipfsDir, RunOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver, _ := RepoVersion(ipfsDir); ver != 1000 || readMigrated(t, ipfsDir) != "initial" {
+		t.Fatalf("dry run migrated the repo to %d", ver)
+	}
+
+	if err := RunMigration(ctx, nil, 1002, ipfsDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if ver, _ := RepoVersion(ipfsDir); ver != 1002 {
+		t.Fatalf("repo migrated to %d", ver)
+	}
+	if migrated := readMigrated(t, ipfsDir); migrated != "fs-repo-1001-to-1002" {
+		t.Fatalf("unexpected migrated file: %s", migrated)
+	}
+	bak, err := ioutil.ReadFile(filepath.Join(ipfsDir, "migrated.fs-repo-1000-to-1001.bak"))
+	if err != nil || string(bak) != "initial" {
+		t.Fatalf("unexpected backup %q: %v", bak, err)
+	}
+
+	if err := RunMigration(ctx, nil, 1001, ipfsDir, true); err != nil {
+		t.Fatal(err)
+	}
+	if ver, _ := RepoVersion(ipfsDir); ver != 1001 || readMigrated(t, ipfsDir) != "reverted" {
+		t.Fatalf("repo reverted to %d", ver)
+	}
+}
+
+func TestEmbeddedMigrationFails(t *testing.T) {
+	ipfsDir := t.TempDir()
+	if err := WriteRepoVersion(ipfsDir, 1010); err != nil {
+		t.Fatal(err)
+	}
+	m := &testMigration{version: 1010, fail: true}
+	registerTestMigrations(t, m)
+
+	err := RunMigrationWithOptions(context.Background(), nil, 1011, ipfsDir, RunOptions{NoBackup: true})
+	if err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if ver, _ := RepoVersion(ipfsDir); ver != 1010 || m.reverts != 1 || readMigrated(t, ipfsDir) != "reverted" {
+		t.Fatalf("failed migration not reverted: version %d, %d reverts", ver, m.reverts)
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(ipfsDir, "migrated.fs-repo-1010-to-1011.bak")); err == nil {
+		t.Fatal("backup without Backup")
+	}
+}
@@ -0,0 +1,249 @@
+package migrations
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	uio "github.com/ipfs/go-unixfs/io"
+	car "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+)
+
+// FileFetcher fetches files from a local copy of the distribution site: a
+// directory, or a CAR file holding the distribution as a UnixFS directory.
+type FileFetcher struct {
+	root  string
+	limit int64
+
+	openOnce sync.Once
+	car      *carIndex
+	openErr  error
+}
+
+var _ Fetcher = (*FileFetcher)(nil)
+
+// NewFileFetcher creates a new FileFetcher, reading the distribution in the
+// directory or the CAR file root. The files are not read before the first
+// fetch.
+//
+// Specifying 0 for fetchLimit sets the default, -1 means no limit.
+func NewFileFetcher(root string, fetchLimit int64) *FileFetcher {
+	f := &FileFetcher{
+		root:  root,
+		limit: defaultFetchLimit,
+	}
+
+	if fetchLimit != 0 {
+		if fetchLimit < 0 {
+			fetchLimit = 0
+		}
+		f.limit = fetchLimit
+	}
+
+	return f
+}
+
+// Fetch opens the file at the given path of the distribution. Returns
+// io.ReadCloser on success, which caller must close.
+func (f *FileFetcher) Fetch(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	fmt.Printf("Fetching from %q: %q\n", f.root, filePath)
+
+	f.openOnce.Do(f.open)
+	if f.openErr != nil {
+		return nil, f.openErr
+	}
+
+	// Never escape the root.
+	filePath = path.Clean("/" + filePath)
+
+	var rc io.ReadCloser
+	var err error
+	if f.car != nil {
+		rc, err = f.car.open(ctx, filePath)
+	} else {
+		rc, err = os.Open(filepath.Join(f.root, filepath.FromSlash(filePath)))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.limit != 0 {
+		return NewLimitReadCloser(rc, f.limit), nil
+	}
+	return rc, nil
+}
+
+func (f *FileFetcher) open() {
+	fi, err := os.Stat(f.root)
+	if err != nil {
+		f.openErr = err
+		return
+	}
+	if !fi.IsDir() {
+		f.car, f.openErr = newCarIndex(f.root)
+	}
+}
+
+func (f *FileFetcher) Close() error {
+	if f.car != nil {
+		return f.car.file.Close()
+	}
+	return nil
+}
+
+// carIndex reads the blocks of a CAR file, from the offsets of the blocks
+// found when opened.
+type carIndex struct {
+	file   *os.File
+	root   cid.Cid
+	blocks map[string]blockSpan
+}
+
+type blockSpan struct {
+	offset int64
+	size   int
+}
+
+var _ ipld.DAGService = (*carIndex)(nil)
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func newCarIndex(name string) (*carIndex, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := indexCar(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading CAR file %s: %s", name, err)
+	}
+	return idx, nil
+}
+
+func indexCar(file *os.File) (*carIndex, error) {
+	cr := &countingReader{r: file}
+	br := bufio.NewReader(cr)
+	h, err := car.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.Roots) != 1 {
+		return nil, errors.New("the CAR file must have one root")
+	}
+
+	idx := &carIndex{
+		file:   file,
+		root:   h.Roots[0],
+		blocks: make(map[string]blockSpan),
+	}
+	var buf []byte
+	for {
+		l, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if uint64(cap(buf)) < l {
+			buf = make([]byte, l)
+		}
+		buf = buf[:l]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		c, n, err := carutil.ReadCid(buf)
+		if err != nil {
+			return nil, err
+		}
+		end := cr.n - int64(br.Buffered())
+		size := len(buf) - n
+		idx.blocks[c.KeyString()] = blockSpan{offset: end - int64(size), size: size}
+	}
+	return idx, nil
+}
+
+// open opens the UnixFS file at filePath.
+func (idx *carIndex) open(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	nd, err := idx.Get(ctx, idx.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(strings.Trim(filePath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		dir, err := uio.NewDirectoryFromNode(idx, nd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filePath, err)
+		}
+		if nd, err = dir.Find(ctx, name); err != nil {
+			return nil, fmt.Errorf("%s: %s", filePath, err)
+		}
+	}
+	return uio.NewDagReader(ctx, nd, idx)
+}
+
+// Get reads a block of the CAR file, and verifies it.
+func (idx *carIndex) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	span, ok := idx.blocks[c.KeyString()]
+	if !ok {
+		return nil, ipld.ErrNotFound
+	}
+	data := make([]byte, span.size)
+	if _, err := idx.file.ReadAt(data, span.offset); err != nil {
+		return nil, err
+	}
+	hashed, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !hashed.Equals(c) {
+		return nil, fmt.Errorf("block %s of the CAR file is corrupted", c)
+	}
+	b, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+	return ipld.Decode(b)
+}
+
+func (idx *carIndex) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		nd, err := idx.Get(ctx, c)
+		out <- &ipld.NodeOption{Node: nd, Err: err}
+	}
+	close(out)
+	return out
+}
+
+var errReadOnly = errors.New("the CAR file is read-only")
+
+func (idx *carIndex) Add(context.Context, ipld.Node) error        { return errReadOnly }
+func (idx *carIndex) AddMany(context.Context, []ipld.Node) error  { return errReadOnly }
+func (idx *carIndex) Remove(context.Context, cid.Cid) error       { return errReadOnly }
+func (idx *carIndex) RemoveMany(context.Context, []cid.Cid) error { return errReadOnly }
@@ -0,0 +1,163 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	ihelper "github.com/ipfs/go-unixfs/importer/helpers"
+	uio "github.com/ipfs/go-unixfs/io"
+	car "github.com/ipld/go-car"
+)
+
+// createTestDist writes a distribution with the migration fs-repo-1-to-2 in
+// the directory dir.
+func createTestDist(t *testing.T, dir string) {
+	dist := filepath.Join(dir, "fs-repo-1-to-2")
+	if err := os.MkdirAll(filepath.Join(dist, "v1.0.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dist, "versions"), []byte("v1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	atype := "tar.gz"
+	if runtime.GOOS == "windows" {
+		atype = "zip"
+	}
+	arcPath, _ := makeArchivePath("fs-repo-1-to-2", "fs-repo-1-to-2", "v1.0.0", atype)
+	var arc bytes.Buffer
+	createFakeArchive(arcPath, atype == "zip", &arc)
+	if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(arcPath)), arc.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestDir adds the directory dir to dserv, with small blocks.
+func addTestDir(t *testing.T, dserv ipld.DAGService, dir string) ipld.Node {
+	ctx := context.Background()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := uio.NewDirectory(dserv)
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		var nd ipld.Node
+		if e.IsDir() {
+			nd = addTestDir(t, dserv, p)
+		} else {
+			f, err := os.Open(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params := ihelper.DagBuilderParams{Dagserv: dserv, Maxlinks: ihelper.DefaultLinksPerBlock}
+			db, err := params.New(chunker.NewSizeSplitter(f, 64))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nd, err = balanced.Layout(db); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+		}
+		if err := d.AddChild(ctx, e.Name(), nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nd, err := d.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dserv.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
+func testFileFetcher(t *testing.T, fetcher Fetcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ver, err := LatestDistVersion(ctx, fetcher, "fs-repo-1-to-2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != "v1.0.0" {
+		t.Fatalf("latest version %s", ver)
+	}
+
+	out := filepath.Join(t.TempDir(), "fs-repo-1-to-2")
+	bin, err := FetchBinary(ctx, fetcher, "fs-repo-1-to-2", ver, "", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "FAKE DATA" {
+		t.Fatalf("unexpected binary: %q", data)
+	}
+
+	if _, err := fetcher.Fetch(ctx, "fs-repo-1-to-2/not-here"); err == nil {
+		t.Fatal("fetched a missing file")
+	}
+	if _, err := FetchBinary(ctx, fetcher, "fs-repo-1-to-2", "v1.1.0", "", t.TempDir()); err == nil {
+		t.Fatal("fetched a missing version")
+	}
+}
+
+func TestFileFetcherDir(t *testing.T) {
+	dir := t.TempDir()
+	createTestDist(t, dir)
+	fetcher := NewFileFetcher(dir, 0)
+	defer fetcher.Close()
+	testFileFetcher(t, fetcher)
+
+	// Paths are relative to the distribution.
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(dir), "outside"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetcher.Fetch(context.Background(), "../outside"); err == nil {
+		t.Fatal("fetched a file outside of the distribution")
+	}
+}
+
+func TestFileFetcherCar(t *testing.T) {
+	dir := t.TempDir()
+	createTestDist(t, dir)
+
+	dserv := mdtest.Mock()
+	root := addTestDir(t, dserv, dir)
+	carPath := filepath.Join(t.TempDir(), "dist.car")
+	f, err := os.Create(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := car.WriteCar(context.Background(), dserv, []cid.Cid{root.Cid()}, f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	fetcher := NewFileFetcher(carPath, 0)
+	defer fetcher.Close()
+	testFileFetcher(t, fetcher)
+}
+
+func TestFileFetcherMissing(t *testing.T) {
+	fetcher := NewFileFetcher(filepath.Join(t.TempDir(), "missing"), 0)
+	defer fetcher.Close()
+	if _, err := fetcher.Fetch(context.Background(), "fs-repo-1-to-2/versions"); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got: %v", err)
+	}
+}
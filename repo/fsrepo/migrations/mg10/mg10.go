@@ -0,0 +1,291 @@
+// Package mg10 is the fs-repo-10-to-11 migration, compiled into the ipfs
+// binary. It moves the pins from the IPLD pinsets of version 10 to the
+// datastore pinner of version 11, and back when reverted.
+package mg10
+
+import (
+	"context"
+
+	"github.com/ipfs/go-ipfs/repo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo/migrations"
+
+	blockservice "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	"github.com/ipfs/go-ipfs-pinner/dspinner"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+func init() {
+	migrations.Register(Migration{})
+}
+
+var (
+	// pinsKey holds the CID of the root of the pinsets of version 10.
+	pinsKey = datastore.NewKey("/local/pins")
+	// dspinnerPrefix holds the pins of version 11.
+	dspinnerPrefix = datastore.NewKey("/pins")
+)
+
+// Migration is the fs-repo-10-to-11 migration.
+type Migration struct{}
+
+// Version returns 10.
+func (Migration) Version() int {
+	return 10
+}
+
+// Reversible returns true.
+func (Migration) Reversible() bool {
+	return true
+}
+
+// open opens the datastore of the repo at path, and the DAG service of its
+// blocks. The datastore plugins must be loaded.
+func open(path string) (repo.Datastore, ipld.DAGService, error) {
+	cfg, err := fsrepo.ConfigAt(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	dsc, err := fsrepo.AnyDatastoreConfig(cfg.Datastore.Spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := dsc.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	bs := blockstore.NewBlockstore(d)
+	return d, merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))), nil
+}
+
+// Apply moves the pins of the pinsets to the datastore pinner. The pinsets
+// are left in the blockstore, unpinned.
+func (Migration) Apply(ctx context.Context, opts migrations.Options) error {
+	d, dag, err := open(opts.Path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	b, err := d.Get(pinsKey)
+	if err == datastore.ErrNotFound {
+		opts.Log.Println("  => No pinsets to convert")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rootCid, err := cid.Cast(b)
+	if err != nil {
+		return err
+	}
+	nd, err := dag.Get(ctx, rootCid)
+	if err != nil {
+		return err
+	}
+	root, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return merkledag.ErrNotProtobuf
+	}
+	recursive, err := loadSet(ctx, dag, root, linkRecursive)
+	if err != nil {
+		return err
+	}
+	direct, err := loadSet(ctx, dag, root, linkDirect)
+	if err != nil {
+		return err
+	}
+	if opts.DryRun {
+		opts.Log.Printf("  => Would convert %d recursive and %d direct pins\n", len(recursive), len(direct))
+		return nil
+	}
+	// Revert restores the backup when the pins didn't change.
+	if err := opts.BackupKey(d, pinsKey); err != nil {
+		return err
+	}
+
+	pinner, err := dspinner.New(ctx, d, dag)
+	if err != nil {
+		return err
+	}
+	for _, c := range recursive {
+		pinner.PinWithMode(c, pin.Recursive)
+	}
+	for _, c := range direct {
+		pinner.PinWithMode(c, pin.Direct)
+	}
+	if err := pinner.Flush(ctx); err != nil {
+		return err
+	}
+	// Without the key, the pins of the datastore pinner are the ones.
+	if err := d.Delete(pinsKey); err != nil {
+		return err
+	}
+	if err := d.Sync(datastore.NewKey("/")); err != nil {
+		return err
+	}
+	opts.Log.Printf("  => Converted %d recursive and %d direct pins\n", len(recursive), len(direct))
+	return nil
+}
+
+// Revert moves the pins of the datastore pinner back to pinsets. After an
+// Apply that failed, the pinsets are still there, and only the pins of the
+// datastore pinner are removed.
+func (Migration) Revert(ctx context.Context, opts migrations.Options) error {
+	d, dag, err := open(opts.Path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	has, err := d.Has(pinsKey)
+	if err != nil {
+		return err
+	}
+	if !has {
+		pinner, err := dspinner.New(ctx, d, dag)
+		if err != nil {
+			return err
+		}
+		recursive, err := pinner.RecursiveKeys(ctx)
+		if err != nil {
+			return err
+		}
+		direct, err := pinner.DirectKeys(ctx)
+		if err != nil {
+			return err
+		}
+		if opts.DryRun {
+			opts.Log.Printf("  => Would convert back %d recursive and %d direct pins\n", len(recursive), len(direct))
+			return nil
+		}
+		root, err := backedUpRoot(ctx, d, dag, opts, recursive, direct)
+		if err != nil {
+			return err
+		}
+		if root.Defined() {
+			opts.Log.Println("  => Restoring the backed up pinsets", root)
+		} else if root, err = storePinsets(ctx, dag, recursive, direct); err != nil {
+			return err
+		}
+		if err := d.Put(pinsKey, root.Bytes()); err != nil {
+			return err
+		}
+		opts.Log.Printf("  => Converted back %d recursive and %d direct pins\n", len(recursive), len(direct))
+	} else if opts.DryRun {
+		opts.Log.Println("  => Would remove the pins of the datastore pinner")
+		return nil
+	}
+
+	if err := deletePrefix(d, dspinnerPrefix); err != nil {
+		return err
+	}
+	// The pinsets are back under pinsKey.
+	if err := d.Delete(opts.BackupKeyOf(pinsKey)); err != nil && err != datastore.ErrNotFound {
+		return err
+	}
+	return d.Sync(datastore.NewKey("/"))
+}
+
+// backedUpRoot returns the root of the pinsets backed up by Apply when they
+// hold the same pins, and an undefined CID otherwise. As Apply leaves the
+// pinsets unpinned, their blocks may have been removed since.
+func backedUpRoot(ctx context.Context, d datastore.Datastore, dag ipld.DAGService, opts migrations.Options, recursive, direct []cid.Cid) (cid.Cid, error) {
+	b, err := d.Get(opts.BackupKeyOf(pinsKey))
+	if err == datastore.ErrNotFound {
+		return cid.Undef, nil
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	c, err := cid.Cast(b)
+	if err != nil {
+		return cid.Undef, err
+	}
+	nd, err := dag.Get(ctx, c)
+	if err != nil {
+		opts.Log.Println("  => Not restoring the backed up pinsets:", err)
+		return cid.Undef, nil
+	}
+	root, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return cid.Undef, merkledag.ErrNotProtobuf
+	}
+	bakRecursive, err := loadSet(ctx, dag, root, linkRecursive)
+	if err != nil {
+		opts.Log.Println("  => Not restoring the backed up pinsets:", err)
+		return cid.Undef, nil
+	}
+	bakDirect, err := loadSet(ctx, dag, root, linkDirect)
+	if err != nil {
+		opts.Log.Println("  => Not restoring the backed up pinsets:", err)
+		return cid.Undef, nil
+	}
+	if !sameCids(bakRecursive, recursive) || !sameCids(bakDirect, direct) {
+		return cid.Undef, nil
+	}
+	return c, nil
+}
+
+// sameCids reports whether a and b hold the same CIDs.
+func sameCids(a, b []cid.Cid) bool {
+	set := make(map[cid.Cid]bool, len(a))
+	for _, c := range a {
+		set[c] = true
+	}
+	for _, c := range b {
+		if !set[c] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+// storePinsets adds the pinsets of the pins to dag, and returns their root.
+func storePinsets(ctx context.Context, dag ipld.DAGService, recursive, direct []cid.Cid) (cid.Cid, error) {
+	root := &merkledag.ProtoNode{}
+	for _, set := range []struct {
+		name  string
+		items []cid.Cid
+	}{{linkDirect, direct}, {linkRecursive, recursive}} {
+		n, err := storeSet(ctx, dag, set.items)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if err := root.AddNodeLink(set.name, n); err != nil {
+			return cid.Undef, err
+		}
+	}
+	// The empty node is linked by the pinsets, but not added with them.
+	if err := dag.Add(ctx, new(merkledag.ProtoNode)); err != nil {
+		return cid.Undef, err
+	}
+	if err := dag.Add(ctx, root); err != nil {
+		return cid.Undef, err
+	}
+	return root.Cid(), nil
+}
+
+func deletePrefix(d datastore.Datastore, prefix datastore.Key) error {
+	res, err := d.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := d.Delete(datastore.NewKey(e.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
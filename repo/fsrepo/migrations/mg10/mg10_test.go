@@ -0,0 +1,185 @@
+package mg10
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-ipfs/plugin"
+	"github.com/ipfs/go-ipfs/plugin/plugins/levelds"
+	"github.com/ipfs/go-ipfs/repo/fsrepo"
+	"github.com/ipfs/go-ipfs/repo/fsrepo/migrations"
+
+	cid "github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	config "github.com/ipfs/go-ipfs-config"
+	serialize "github.com/ipfs/go-ipfs-config/serialize"
+	pin "github.com/ipfs/go-ipfs-pinner"
+	"github.com/ipfs/go-ipfs-pinner/dspinner"
+	"github.com/ipfs/go-merkledag"
+)
+
+func init() {
+	p := levelds.Plugins[0].(plugin.PluginDatastore)
+	if err := fsrepo.AddDatastoreConfigHandler(p.DatastoreTypeName(), p.DatastoreConfigParser()); err != nil {
+		panic(err)
+	}
+}
+
+func testCids(n int, prefix string) []cid.Cid {
+	cids := make([]cid.Cid, n)
+	for i := range cids {
+		cids[i] = merkledag.NodeWithData([]byte(fmt.Sprintf("%s%d", prefix, i))).Cid()
+	}
+	return cids
+}
+
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	ipfsDir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Datastore.Spec = map[string]interface{}{"type": "levelds", "path": "datastore", "compression": "none"}
+	if err := serialize.WriteConfigFile(filepath.Join(ipfsDir, "config"), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// More recursive pins than fit in a node, to have subtrees.
+	recursive := testCids(maxItems+100, "r")
+	direct := testCids(10, "d")
+	d, dag, err := open(ipfsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := storePinsets(ctx, dag, recursive, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put(pinsKey, root.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	var logged bytes.Buffer
+	opts := migrations.Options{Name: "fs-repo-10-to-11", Path: ipfsDir, Backup: true, Log: log.New(&logged, "", 0)}
+	backup := func() []byte {
+		t.Helper()
+		d, _, err := open(ipfsDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		b, err := d.Get(datastore.NewKey("/local/pins.fs-repo-10-to-11.bak"))
+		if err == datastore.ErrNotFound {
+			return nil
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	check := func(converted bool) {
+		t.Helper()
+		d, dag, err := open(ipfsDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		has, err := d.Has(pinsKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has == converted {
+			t.Fatalf("pinsets still there: %v", has)
+		}
+
+		pinner, err := dspinner.New(ctx, d, dag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dsRecursive, err := pinner.RecursiveKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dsDirect, err := pinner.DirectKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !converted {
+			if len(dsRecursive) != 0 || len(dsDirect) != 0 {
+				t.Fatal("pins left in the datastore pinner")
+			}
+			b, err := d.Get(pinsKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := cid.Cast(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nd, err := dag.Get(ctx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dsRecursive, err = loadSet(ctx, dag, nd.(*merkledag.ProtoNode), linkRecursive); err != nil {
+				t.Fatal(err)
+			}
+			if dsDirect, err = loadSet(ctx, dag, nd.(*merkledag.ProtoNode), linkDirect); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !sameCids(dsRecursive, recursive) || !sameCids(dsDirect, direct) {
+			t.Fatalf("pins differ: %d recursive and %d direct", len(dsRecursive), len(dsDirect))
+		}
+	}
+
+	dry := opts
+	dry.DryRun = true
+	if err := (Migration{}).Apply(ctx, dry); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+	if backup() != nil {
+		t.Fatal("backed up in a dry run")
+	}
+
+	if err := (Migration{}).Apply(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+	if !bytes.Equal(backup(), root.Bytes()) {
+		t.Fatal("the root of the pinsets wasn't backed up")
+	}
+
+	if err := (Migration{}).Revert(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+	if !strings.Contains(logged.String(), "Restoring the backed up pinsets") {
+		t.Fatalf("the backup wasn't restored:\n%s", logged.String())
+	}
+	if backup() != nil {
+		t.Fatal("the backup was kept after it was restored")
+	}
+
+	// Reverting a failed Apply keeps the pinsets.
+	d, dag, err = open(ipfsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinner, err := dspinner.New(ctx, d, dag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinner.PinWithMode(recursive[0], pin.Recursive)
+	if err := pinner.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if err := (Migration{}).Revert(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+}
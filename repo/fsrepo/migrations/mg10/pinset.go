@@ -0,0 +1,241 @@
+package mg10
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// The pinsets of version 10 are trees of protobuf nodes. Every node starts
+// with fanout links to its subtrees, or to emptyKey, followed by its items.
+// The items are put in the subtree numbered by their hash, seeded with the
+// depth, modulo fanout, when there are maxItems of them or more.
+const (
+	defaultFanout = 256
+	maxItems      = 8192
+	setVersion    = 1
+)
+
+// emptyKey is the CID of the empty protobuf node, linked in place of the
+// subtrees without items.
+var emptyKey cid.Cid
+
+func init() {
+	var err error
+	emptyKey, err = cid.Decode("QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// The links of the root of the pinsets.
+const (
+	linkRecursive = "recursive"
+	linkDirect    = "direct"
+)
+
+// setHeader is the header of a pinset node, a protobuf message preceded by
+// its length in the data of the node.
+type setHeader struct {
+	Version uint32
+	Fanout  uint32
+	Seed    uint32
+}
+
+func (h setHeader) marshal() []byte {
+	b := make([]byte, 0, 2*binary.MaxVarintLen32+7)
+	var buf [binary.MaxVarintLen32]byte
+	b = append(b, 1<<3|0)
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(h.Version))]...)
+	b = append(b, 2<<3|0)
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(h.Fanout))]...)
+	b = append(b, 3<<3|5, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], h.Seed)
+	return b
+}
+
+func (h *setHeader) unmarshal(b []byte) error {
+	errInvalid := errors.New("invalid pinset header")
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errInvalid
+		}
+		b = b[n:]
+		var v uint64
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errInvalid
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errInvalid
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errInvalid
+			}
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errInvalid
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return errInvalid
+		}
+		switch key >> 3 {
+		case 1:
+			h.Version = uint32(v)
+		case 2:
+			h.Fanout = uint32(v)
+		case 3:
+			h.Seed = uint32(v)
+		}
+	}
+	return nil
+}
+
+func writeHeader(n *merkledag.ProtoNode, h setHeader) {
+	hdr := h.marshal()
+	data := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(hdr))
+	l := binary.PutUvarint(data, uint64(len(hdr)))
+	n.SetData(append(data[:l], hdr...))
+}
+
+func readHeader(n *merkledag.ProtoNode) (setHeader, error) {
+	var h setHeader
+	l, consumed := binary.Uvarint(n.Data())
+	if consumed <= 0 {
+		return h, errors.New("invalid pinset header length")
+	}
+	data := n.Data()[consumed:]
+	if l > uint64(len(data)) {
+		return h, errors.New("impossibly large pinset header length")
+	}
+	if err := h.unmarshal(data[:l]); err != nil {
+		return h, err
+	}
+	if h.Version != setVersion {
+		return h, fmt.Errorf("unsupported pinset version %d", h.Version)
+	}
+	if int(h.Fanout) > len(n.Links()) {
+		return h, errors.New("impossibly large pinset fanout")
+	}
+	return h, nil
+}
+
+func hash(seed uint32, c cid.Cid) uint32 {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], seed)
+	h := fnv.New32a()
+	_, _ = h.Write(buf[:])
+	_, _ = h.Write(c.Bytes())
+	return h.Sum32()
+}
+
+// loadSet returns the items of the pinset linked as name from root.
+func loadSet(ctx context.Context, dag ipld.DAGService, root *merkledag.ProtoNode, name string) ([]cid.Cid, error) {
+	l, err := root.GetNodeLink(name)
+	if err != nil {
+		return nil, err
+	}
+	var items []cid.Cid
+	err = walkItems(ctx, dag, l.Cid, func(c cid.Cid) {
+		items = append(items, c)
+	})
+	return items, err
+}
+
+func walkItems(ctx context.Context, dag ipld.DAGService, c cid.Cid, fn func(cid.Cid)) error {
+	nd, err := dag.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	n, ok := nd.(*merkledag.ProtoNode)
+	if !ok {
+		return merkledag.ErrNotProtobuf
+	}
+	h, err := readHeader(n)
+	if err != nil {
+		return err
+	}
+	for _, l := range n.Links()[h.Fanout:] {
+		fn(l.Cid)
+	}
+	for _, l := range n.Links()[:h.Fanout] {
+		if l.Cid.Equals(emptyKey) {
+			continue
+		}
+		if err := walkItems(ctx, dag, l.Cid, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeSet adds the nodes of a pinset of items to dag, and returns its root.
+func storeSet(ctx context.Context, dag ipld.DAGService, items []cid.Cid) (*merkledag.ProtoNode, error) {
+	n, err := storeItems(ctx, dag, items, 0)
+	if err != nil {
+		return nil, err
+	}
+	return n, dag.Add(ctx, n)
+}
+
+func storeItems(ctx context.Context, dag ipld.DAGService, items []cid.Cid, depth uint32) (*merkledag.ProtoNode, error) {
+	links := make([]*ipld.Link, 0, defaultFanout+maxItems)
+	for i := 0; i < defaultFanout; i++ {
+		links = append(links, &ipld.Link{Cid: emptyKey})
+	}
+
+	if len(items) < maxItems {
+		for _, c := range items {
+			links = append(links, &ipld.Link{Cid: c})
+		}
+		sorted := links[defaultFanout:]
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return bytes.Compare(sorted[i].Cid.Bytes(), sorted[j].Cid.Bytes()) < 0
+		})
+	} else {
+		hashed := make([][]cid.Cid, defaultFanout)
+		for _, c := range items {
+			h := hash(depth, c) % defaultFanout
+			hashed[h] = append(hashed[h], c)
+		}
+		for h, sub := range hashed {
+			if len(sub) == 0 {
+				continue
+			}
+			child, err := storeItems(ctx, dag, sub, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			size, err := child.Size()
+			if err != nil {
+				return nil, err
+			}
+			if err := dag.Add(ctx, child); err != nil {
+				return nil, err
+			}
+			links[h] = &ipld.Link{Cid: child.Cid(), Size: size}
+		}
+	}
+
+	n := &merkledag.ProtoNode{}
+	n.SetLinks(links)
+	writeHeader(n, setHeader{Version: setVersion, Fanout: defaultFanout, Seed: depth})
+	return n, nil
+}
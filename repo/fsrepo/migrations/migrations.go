@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
@@ -24,9 +25,28 @@ const (
 	distFSRM     = "fs-repo-migrations"
 )
 
+// RunOptions are the options of RunMigrationWithOptions.
+type RunOptions struct {
+	// AllowDowngrade allows reverting migrations to a previous version.
+	AllowDowngrade bool
+	// DryRun logs the migrations without running them, nor fetching them.
+	// The embedded migrations log the changes they would make.
+	DryRun bool
+	// NoBackup doesn't keep a copy of the files changed by the embedded
+	// migrations.
+	NoBackup bool
+}
+
 // RunMigration finds, downloads, and runs the individual migrations needed to
 // migrate the repo from its current version to the target version.
 func RunMigration(ctx context.Context, fetcher Fetcher, targetVer int, ipfsDir string, allowDowngrade bool) error {
+	return RunMigrationWithOptions(ctx, fetcher, targetVer, ipfsDir, RunOptions{AllowDowngrade: allowDowngrade})
+}
+
+// RunMigrationWithOptions finds, downloads, and runs the individual migrations
+// needed to migrate the repo from its current version to the target version.
+// The migrations compiled into the binary are preferred to the binaries.
+func RunMigrationWithOptions(ctx context.Context, fetcher Fetcher, targetVer int, ipfsDir string, opts RunOptions) error {
 	ipfsDir, err := CheckIpfsDir(ipfsDir)
 	if err != nil {
 		return err
@@ -39,7 +59,7 @@ func RunMigration(ctx context.Context, fetcher Fetcher, targetVer int, ipfsDir s
 		// repo already at target version number
 		return nil
 	}
-	if fromVer > targetVer && !allowDowngrade {
+	if fromVer > targetVer && !opts.AllowDowngrade {
 		return fmt.Errorf("downgrade not allowed from %d to %d", fromVer, targetVer)
 	}
 
@@ -61,22 +81,29 @@ func RunMigration(ctx context.Context, fetcher Fetcher, targetVer int, ipfsDir s
 			}
 		}
 
-		logger.Println("Need", len(missing), "migrations, downloading.")
+		if opts.DryRun {
+			logger.Println("Would download", len(missing), "migrations:", strings.Join(missing, " "))
+			for _, mig := range missing {
+				binPaths[mig] = mig
+			}
+		} else {
+			logger.Println("Need", len(missing), "migrations, downloading.")
 
-		tmpDir, err := ioutil.TempDir("", "migrations")
-		if err != nil {
-			return err
-		}
-		defer os.RemoveAll(tmpDir)
+			tmpDir, err := ioutil.TempDir("", "migrations")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmpDir)
 
-		fetched, err := fetchMigrations(ctx, fetcher, missing, tmpDir, logger)
-		if err != nil {
-			logger.Print("Failed to download migrations.")
-			return err
-		}
+			fetched, err := fetchMigrations(ctx, fetcher, missing, tmpDir, logger)
+			if err != nil {
+				logger.Print("Failed to download migrations.")
+				return err
+			}
 
-		for i := range missing {
-			binPaths[missing[i]] = fetched[i]
+			for i := range missing {
+				binPaths[missing[i]] = fetched[i]
+			}
 		}
 	}
 
@@ -86,11 +113,21 @@ func RunMigration(ctx context.Context, fetcher Fetcher, targetVer int, ipfsDir s
 	}
 	for _, migration := range migrations {
 		logger.Println("Running migration", migration, "...")
-		err = runMigration(ctx, binPaths[migration], ipfsDir, revert, logger)
+		if m, ok := embeddedMigration(migration); ok {
+			err = runEmbeddedMigration(ctx, m, migration, ipfsDir, revert, opts, logger)
+		} else if opts.DryRun {
+			logger.Println("  => Would run:", binPaths[migration])
+		} else {
+			err = runMigration(ctx, binPaths[migration], ipfsDir, revert, logger)
+		}
 		if err != nil {
 			return fmt.Errorf("migration %s failed: %s", migration, err)
 		}
 	}
+	if opts.DryRun {
+		logger.Printf("Dry run: fs-repo would be migrated to version %d.\n", targetVer)
+		return nil
+	}
 	logger.Printf("Success: fs-repo migrated to version %d.\n", targetVer)
 
 	return nil
@@ -152,7 +189,8 @@ func ReadMigrationConfig(repoRoot string) (*config.Migration, error) {
 }
 
 // GetMigrationFetcher creates one or more fetchers according to
-// downloadSources,
+// downloadSources. A file:// URL or an absolute path is a local copy of the
+// distribution: a directory, or a CAR file.
 func GetMigrationFetcher(downloadSources []string, distPath string, newIpfsFetcher func(string) Fetcher) (Fetcher, error) {
 	const httpUserAgent = "go-ipfs"
 
@@ -167,6 +205,10 @@ func GetMigrationFetcher(downloadSources []string, distPath string, newIpfsFetch
 				fetchers = append(fetchers, newIpfsFetcher(distPath))
 			}
 		default:
+			if filepath.IsAbs(src) {
+				fetchers = append(fetchers, NewFileFetcher(src, 0))
+				continue
+			}
 			u, err := url.Parse(src)
 			if err != nil {
 				return nil, fmt.Errorf("bad gateway address: %s", err)
@@ -175,8 +217,14 @@ func GetMigrationFetcher(downloadSources []string, distPath string, newIpfsFetch
 			case "":
 				u.Scheme = "https"
 			case "https", "http":
+			case "file":
+				if u.Host != "" && u.Host != "localhost" {
+					return nil, fmt.Errorf("bad file url: %s is not local", src)
+				}
+				fetchers = append(fetchers, NewFileFetcher(filepath.FromSlash(u.Path), 0))
+				continue
 			default:
-				return nil, errors.New("bad gateway address: url scheme must be http or https")
+				return nil, errors.New("bad gateway address: url scheme must be http, https or file")
 			}
 			fetchers = append(fetchers, NewHttpFetcher(distPath, u.String(), httpUserAgent, 0))
 		case "":
@@ -201,7 +249,8 @@ func migrationName(from, to int) string {
 
 // findMigrations returns a list of migrations, ordered from first to last
 // migration to apply, and a map of locations of migration binaries of any
-// migrations that were found.
+// migrations that were found. The embedded migrations are in the map, with
+// their name.
 func findMigrations(ctx context.Context, from, to int) ([]string, map[string]string, error) {
 	step := 1
 	count := to - from
@@ -224,6 +273,10 @@ func findMigrations(ctx context.Context, from, to int) ([]string, map[string]str
 			migName = migrationName(cur, cur+step)
 		}
 		migrations = append(migrations, migName)
+		if _, ok := embeddedMigration(migName); ok {
+			binPaths[migName] = migName
+			continue
+		}
 		bin, err := exec.LookPath(migName)
 		if err != nil {
 			continue
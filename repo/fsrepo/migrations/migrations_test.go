@@ -327,6 +327,30 @@ func TestGetMigrationFetcher(t *testing.T) {
 		t.Fatal("expected HttpFetcher")
 	}
 
+	downloadSources = []string{"file:///media/dist"}
+	f, err = GetMigrationFetcher(downloadSources, "", newIpfsFetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ff, ok := f.(*FileFetcher); !ok || ff.root != filepath.FromSlash("/media/dist") {
+		t.Fatal("expected FileFetcher")
+	}
+
+	downloadSources = []string{filepath.Join(t.TempDir(), "dist.car")}
+	f, err = GetMigrationFetcher(downloadSources, "", newIpfsFetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(*FileFetcher); !ok {
+		t.Fatal("expected FileFetcher")
+	}
+
+	downloadSources = []string{"file://remote.host/dist"}
+	_, err = GetMigrationFetcher(downloadSources, "", newIpfsFetcher)
+	if err == nil {
+		t.Fatal("expected error for a remote file url")
+	}
+
 	downloadSources = []string{"ipfs"}
 	f, err = GetMigrationFetcher(downloadSources, "", newIpfsFetcher)
 	if err != nil {
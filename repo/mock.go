@@ -6,6 +6,8 @@ import (
 	filestore "github.com/ipfs/go-filestore"
 	keystore "github.com/ipfs/go-ipfs-keystore"
 
+	"github.com/ipfs/go-ipfs/repo/common"
+
 	config "github.com/ipfs/go-ipfs-config"
 	ma "github.com/multiformats/go-multiaddr"
 )
@@ -38,7 +40,11 @@ func (m *Mock) SetConfigKey(key string, value interface{}) error {
 }
 
 func (m *Mock) GetConfigKey(key string) (interface{}, error) {
-	return nil, errTODO
+	cfg, err := config.ToMap(&m.C)
+	if err != nil {
+		return nil, err
+	}
+	return common.MapGetKV(cfg, key)
 }
 
 func (m *Mock) Datastore() Datastore { return m.D }
@@ -70,3 +70,12 @@ func (r *ref) Close() error {
 	delete(r.parent.active, r.key)
 	return r.Repo.Close()
 }
+
+// Unwrap returns the Repo opened by an OnlyOne, for the methods of its
+// concrete type.
+func Unwrap(r Repo) Repo {
+	if r, ok := r.(*ref); ok {
+		return r.Repo
+	}
+	return r
+}
@@ -0,0 +1,540 @@
+// Package tiered implements a datastore keeping the values of a slow
+// datastore in a fast one, such as a flatfs on SSD in front of a flatfs on
+// HDD or a remote datastore.
+package tiered
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log"
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+var log = logging.Logger("tiered")
+
+// DefaultFlushInterval is how often the values written to the fast tier are
+// written to the slow one, in write-back mode.
+const DefaultFlushInterval = 10 * time.Second
+
+// Options configures a tiered datastore.
+type Options struct {
+	// WriteBack writes the values to the fast tier, and to the slow one in
+	// the background, every FlushInterval and on Sync, Query and Close.
+	// The values are written to both tiers otherwise.
+	WriteBack     bool
+	FlushInterval time.Duration
+	// Promote copies the values read from the slow tier to the fast one.
+	Promote bool
+	// MaxSize is the size of the values kept in the fast tier, above which
+	// the least recently used ones are evicted. Unbounded when 0.
+	MaxSize uint64
+	// MetricsPrefix starts the names of the metrics of the datastore.
+	MetricsPrefix string
+}
+
+// entry is a value of the fast tier.
+type entry struct {
+	key  ds.Key
+	size uint64
+	// dirty values aren't written to the slow tier yet, and aren't evicted.
+	dirty bool
+	// unknown values were in the fast tier when it was opened, and may be
+	// missing from the slow one.
+	unknown bool
+	// version changes with each write of the value.
+	version uint64
+	elem    *list.Element
+}
+
+// Datastore is a tiered datastore. The slow tier holds all the values, the
+// fast one the values written and read last.
+type Datastore struct {
+	fast, slow ds.Datastore
+	opts       Options
+
+	mu      sync.Mutex
+	entries map[ds.Key]*entry
+	// lru orders the entries from the most recently used.
+	lru  *list.List
+	size uint64
+
+	// flushMu serializes the writes of the dirty values to the slow tier
+	// with the deletes.
+	flushMu sync.Mutex
+	closing chan struct{}
+	done    chan struct{}
+
+	hits       metrics.Counter
+	misses     metrics.Counter
+	promotions metrics.Counter
+	evictions  metrics.Counter
+	sizeGauge  metrics.Gauge
+}
+
+var _ ds.Batching = (*Datastore)(nil)
+var _ ds.PersistentDatastore = (*Datastore)(nil)
+
+// New returns a tiered datastore. The values of the fast tier are listed
+// to track their size, and in write-back mode, the ones missing from the
+// slow tier are written to it in the background.
+func New(fast, slow ds.Datastore, opts Options) (*Datastore, error) {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	prefix := opts.MetricsPrefix
+	d := &Datastore{
+		fast:    fast,
+		slow:    slow,
+		opts:    opts,
+		entries: make(map[ds.Key]*entry),
+		lru:     list.New(),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+
+		hits: metrics.New(prefix+".hits_total",
+			"Number of Datastore.Get calls served by the fast tier").Counter(),
+		misses: metrics.New(prefix+".misses_total",
+			"Number of Datastore.Get calls served by the slow tier").Counter(),
+		promotions: metrics.New(prefix+".promotions_total",
+			"Number of values copied to the fast tier when read").Counter(),
+		evictions: metrics.New(prefix+".evictions_total",
+			"Number of values evicted from the fast tier").Counter(),
+		sizeGauge: metrics.New(prefix+".fast.size_bytes",
+			"Size of the values in the fast tier").Gauge(),
+	}
+
+	res, err := fast.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	for r := range res.Next() {
+		if r.Error != nil {
+			res.Close()
+			return nil, r.Error
+		}
+		key := ds.RawKey(r.Key)
+		size, err := fast.GetSize(key)
+		if err != nil {
+			continue
+		}
+		e := d.entry(key)
+		d.resize(e, uint64(size))
+		e.dirty = opts.WriteBack
+		e.unknown = opts.WriteBack
+	}
+	res.Close()
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+
+	if opts.WriteBack {
+		go d.flushLoop()
+	} else {
+		close(d.done)
+	}
+	return d, nil
+}
+
+// entry returns the entry of a key, created if missing, as the most
+// recently used. It must be called with d.mu taken.
+func (d *Datastore) entry(key ds.Key) *entry {
+	e, ok := d.entries[key]
+	if ok {
+		d.lru.MoveToFront(e.elem)
+		return e
+	}
+	e = &entry{key: key}
+	e.elem = d.lru.PushFront(e)
+	d.entries[key] = e
+	return e
+}
+
+// resize sets the size of an entry. It must be called with d.mu taken.
+func (d *Datastore) resize(e *entry, size uint64) {
+	d.size = d.size - e.size + size
+	e.size = size
+	d.sizeGauge.Set(float64(d.size))
+}
+
+// remove removes the entry of a key. It must be called with d.mu taken.
+func (d *Datastore) remove(key ds.Key) {
+	e, ok := d.entries[key]
+	if !ok {
+		return
+	}
+	d.resize(e, 0)
+	d.lru.Remove(e.elem)
+	delete(d.entries, key)
+}
+
+// evict deletes the least recently used values which are written to the
+// slow tier from the fast one, until it fits in MaxSize. It must be called
+// with d.mu taken.
+func (d *Datastore) evict() {
+	if d.opts.MaxSize == 0 {
+		return
+	}
+	elem := d.lru.Back()
+	for d.size > d.opts.MaxSize && elem != nil {
+		e := elem.Value.(*entry)
+		elem = elem.Prev()
+		if e.dirty {
+			continue
+		}
+		if err := d.fast.Delete(e.key); err != nil {
+			log.Warnf("evicting %s: %s", e.key, err)
+			continue
+		}
+		d.remove(e.key)
+		d.evictions.Inc()
+	}
+}
+
+// cached records a value written to the fast tier, which is in the slow
+// one.
+func (d *Datastore) cached(key ds.Key, size int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resize(d.entry(key), uint64(size))
+	d.evict()
+}
+
+// uncache deletes a value from the fast tier, which may be stale.
+func (d *Datastore) uncache(key ds.Key) error {
+	d.mu.Lock()
+	d.remove(key)
+	d.mu.Unlock()
+	return d.fast.Delete(key)
+}
+
+func (d *Datastore) Get(key ds.Key) ([]byte, error) {
+	value, err := d.fast.Get(key)
+	if err == nil {
+		d.hits.Inc()
+		d.mu.Lock()
+		if e, ok := d.entries[key]; ok {
+			d.lru.MoveToFront(e.elem)
+		}
+		d.mu.Unlock()
+		return value, nil
+	}
+	if err != ds.ErrNotFound {
+		log.Warnf("reading %s from the fast tier: %s", key, err)
+	}
+	d.misses.Inc()
+
+	value, err = d.slow.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if d.opts.Promote {
+		if err := d.fast.Put(key, value); err != nil {
+			log.Warnf("promoting %s: %s", key, err)
+		} else {
+			d.promotions.Inc()
+			d.cached(key, len(value))
+		}
+	}
+	return value, nil
+}
+
+func (d *Datastore) Has(key ds.Key) (bool, error) {
+	if has, err := d.fast.Has(key); err == nil && has {
+		return true, nil
+	}
+	return d.slow.Has(key)
+}
+
+func (d *Datastore) GetSize(key ds.Key) (int, error) {
+	if size, err := d.fast.GetSize(key); err == nil {
+		return size, nil
+	}
+	return d.slow.GetSize(key)
+}
+
+// Put writes a value to both tiers, or in write-back mode, to the fast one.
+func (d *Datastore) Put(key ds.Key, value []byte) error {
+	if !d.opts.WriteBack {
+		if err := d.slow.Put(key, value); err != nil {
+			return err
+		}
+		if err := d.fast.Put(key, value); err != nil {
+			log.Warnf("caching %s: %s", key, err)
+			return d.uncache(key)
+		}
+		d.cached(key, len(value))
+		return nil
+	}
+
+	// The entry is dirty while the value is written, so that it isn't
+	// evicted.
+	d.mu.Lock()
+	d.entry(key).dirty = true
+	d.mu.Unlock()
+
+	if err := d.fast.Put(key, value); err != nil {
+		log.Warnf("writing %s to the fast tier: %s", key, err)
+		if err := d.uncache(key); err != nil {
+			return err
+		}
+		return d.slow.Put(key, value)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := d.entry(key)
+	// The value may have been flushed while written, with the previous
+	// version.
+	e.dirty = true
+	e.unknown = false
+	e.version++
+	d.resize(e, uint64(len(value)))
+	d.evict()
+	return nil
+}
+
+// Delete deletes a value from both tiers.
+func (d *Datastore) Delete(key ds.Key) error {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+	if err := d.uncache(key); err != nil {
+		return err
+	}
+	return d.slow.Delete(key)
+}
+
+// Query queries the slow tier, once the fast one is flushed in write-back
+// mode.
+func (d *Datastore) Query(q dsq.Query) (dsq.Results, error) {
+	if err := d.flush(); err != nil {
+		return nil, err
+	}
+	return d.slow.Query(q)
+}
+
+// Sync flushes the fast tier in write-back mode, and syncs both tiers.
+func (d *Datastore) Sync(prefix ds.Key) error {
+	if err := d.flush(); err != nil {
+		return err
+	}
+	if err := d.slow.Sync(prefix); err != nil {
+		return err
+	}
+	return d.fast.Sync(prefix)
+}
+
+// DiskUsage returns the disk usage of the slow tier, which holds all the
+// values.
+func (d *Datastore) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(d.slow)
+}
+
+// Close flushes the fast tier in write-back mode, and closes both tiers.
+func (d *Datastore) Close() error {
+	select {
+	case <-d.closing:
+	default:
+		close(d.closing)
+	}
+	<-d.done
+
+	err := d.flush()
+	if cerr := d.slow.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := d.fast.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (d *Datastore) flushLoop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		// Flush at once, for the values left from a previous run.
+		if err := d.flush(); err != nil {
+			log.Errorf("flushing the fast tier: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-d.closing:
+			return
+		}
+	}
+}
+
+// flush writes the dirty values of the fast tier to the slow one.
+func (d *Datastore) flush() error {
+	if !d.opts.WriteBack {
+		return nil
+	}
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	type dirty struct {
+		key     ds.Key
+		version uint64
+		unknown bool
+	}
+	var keys []dirty
+	d.mu.Lock()
+	for _, e := range d.entries {
+		if e.dirty {
+			keys = append(keys, dirty{e.key, e.version, e.unknown})
+		}
+	}
+	d.mu.Unlock()
+
+	var firstErr error
+	for _, k := range keys {
+		err := d.flushKey(k.key, k.unknown)
+		if err == ds.ErrNotFound {
+			// Lost from the fast tier, there's nothing to write.
+			d.mu.Lock()
+			d.remove(k.key)
+			d.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		d.mu.Lock()
+		if e, ok := d.entries[k.key]; ok && e.version == k.version {
+			e.dirty = false
+			e.unknown = false
+		}
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+	return firstErr
+}
+
+// flushKey writes a value of the fast tier to the slow one, unless it's
+// known to be there.
+func (d *Datastore) flushKey(key ds.Key, unknown bool) error {
+	if unknown {
+		has, err := d.slow.Has(key)
+		if err != nil || has {
+			return err
+		}
+	}
+	value, err := d.fast.Get(key)
+	if err != nil {
+		return err
+	}
+	return d.slow.Put(key, value)
+}
+
+func (d *Datastore) Batch() (ds.Batch, error) {
+	return &batch{
+		d:       d,
+		puts:    make(map[ds.Key][]byte),
+		deletes: make(map[ds.Key]struct{}),
+	}, nil
+}
+
+// batch collects the changes of a Batch. In write-through mode, they are
+// committed to the slow tier in a batch when it supports them.
+type batch struct {
+	d       *Datastore
+	puts    map[ds.Key][]byte
+	deletes map[ds.Key]struct{}
+}
+
+func (b *batch) Put(key ds.Key, value []byte) error {
+	b.puts[key] = value
+	delete(b.deletes, key)
+	return nil
+}
+
+func (b *batch) Delete(key ds.Key) error {
+	b.deletes[key] = struct{}{}
+	delete(b.puts, key)
+	return nil
+}
+
+func (b *batch) Commit() error {
+	var err error
+	if slow, ok := b.d.slow.(ds.Batching); ok && !b.d.opts.WriteBack {
+		err = b.commitThrough(slow)
+	} else {
+		err = b.commit()
+	}
+	if err != nil {
+		return err
+	}
+	b.puts = make(map[ds.Key][]byte)
+	b.deletes = make(map[ds.Key]struct{})
+	return nil
+}
+
+// commit applies the changes one by one.
+func (b *batch) commit() error {
+	for key, value := range b.puts {
+		if err := b.d.Put(key, value); err != nil {
+			return err
+		}
+	}
+	for key := range b.deletes {
+		if err := b.d.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitThrough applies the changes to the slow tier in a batch, then to
+// the fast one.
+func (b *batch) commitThrough(slow ds.Batching) error {
+	sb, err := slow.Batch()
+	if err == ds.ErrBatchUnsupported {
+		return b.commit()
+	}
+	if err != nil {
+		return err
+	}
+	for key, value := range b.puts {
+		if err := sb.Put(key, value); err != nil {
+			return err
+		}
+	}
+	for key := range b.deletes {
+		if err := sb.Delete(key); err != nil {
+			return err
+		}
+	}
+	// The fast tier may hold stale values until the slow one is written.
+	for key := range b.deletes {
+		if err := b.d.uncache(key); err != nil {
+			return err
+		}
+	}
+	if err := sb.Commit(); err != nil {
+		return err
+	}
+
+	for key, value := range b.puts {
+		if err := b.d.fast.Put(key, value); err != nil {
+			log.Warnf("caching %s: %s", key, err)
+			if err := b.d.uncache(key); err != nil {
+				return err
+			}
+			continue
+		}
+		b.d.cached(key, len(value))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package tiered
+
+import (
+	"fmt"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	dstest "github.com/ipfs/go-datastore/test"
+)
+
+func newTiered(t *testing.T, opts Options) (*Datastore, ds.Datastore, ds.Datastore) {
+	t.Helper()
+	fast := dssync.MutexWrap(ds.NewMapDatastore())
+	slow := dssync.MutexWrap(ds.NewMapDatastore())
+	d, err := New(fast, slow, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, fast, slow
+}
+
+func TestSuite(t *testing.T) {
+	t.Run("write-through", func(t *testing.T) {
+		d, _, _ := newTiered(t, Options{Promote: true, MaxSize: 1000})
+		defer d.Close()
+		dstest.SubtestAll(t, d)
+	})
+	t.Run("write-back", func(t *testing.T) {
+		d, _, _ := newTiered(t, Options{WriteBack: true, Promote: true, MaxSize: 1000})
+		defer d.Close()
+		dstest.SubtestAll(t, d)
+	})
+}
+
+// fastSize returns the size of the values in the fast tier.
+func fastSize(d *Datastore) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
+
+func key(i int) ds.Key {
+	return ds.NewKey(fmt.Sprintf("key%d", i))
+}
+
+func TestEvictAndPromote(t *testing.T) {
+	d, fast, slow := newTiered(t, Options{Promote: true, MaxSize: 100})
+	defer d.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := d.Put(key(i), []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if has, _ := slow.Has(key(i)); !has {
+			t.Fatalf("%s not written through", key(i))
+		}
+		has, _ := fast.Has(key(i))
+		if has != (i >= 10) {
+			t.Fatalf("%s in the fast tier: %v", key(i), has)
+		}
+	}
+
+	if _, err := d.Get(key(0)); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := fast.Has(key(0)); !has {
+		t.Fatal("value read not promoted")
+	}
+	if has, _ := fast.Has(key(10)); has {
+		t.Fatal("least recently used value not evicted")
+	}
+	if size := fastSize(d); size != 100 {
+		t.Fatalf("fast tier holds %d bytes", size)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	d, fast, slow := newTiered(t, Options{WriteBack: true, MaxSize: 50})
+	defer d.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := d.Put(key(i), []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Dirty values aren't evicted.
+	for i := 0; i < 10; i++ {
+		if has, _ := fast.Has(key(i)); !has {
+			t.Fatalf("dirty value %s evicted", key(i))
+		}
+	}
+
+	if err := d.Sync(ds.NewKey("/")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if has, _ := slow.Has(key(i)); !has {
+			t.Fatalf("%s not flushed", key(i))
+		}
+	}
+	if size := fastSize(d); size != 50 {
+		t.Fatalf("fast tier holds %d bytes once flushed", size)
+	}
+
+	if err := d.Delete(key(9)); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := slow.Has(key(9)); has {
+		t.Fatal("deleted value in the slow tier")
+	}
+}
+
+func TestReopenWriteBack(t *testing.T) {
+	fast := dssync.MutexWrap(ds.NewMapDatastore())
+	slow := dssync.MutexWrap(ds.NewMapDatastore())
+
+	// Values left in the fast tier by a previous run.
+	if err := fast.Put(key(0), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fast.Put(key(1), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := slow.Put(key(1), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(fast, slow, Options{WriteBack: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := fastSize(d); size != 10 {
+		t.Fatalf("fast tier holds %d bytes", size)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := slow.Get(key(0)); err != nil || string(value) != "value" {
+		t.Fatalf("value left in the fast tier not flushed: %q, %v", value, err)
+	}
+}
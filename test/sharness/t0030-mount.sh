@@ -67,17 +67,87 @@ test_expect_success FUSE "can resolve ipns names" '
   test_cmp expected actual
 '
 
+test_expect_success FUSE "reads from /ipfs are reported by 'ipfs stats mount'" '
+  random 1000000 42 >bigfile &&
+  HASH=$(ipfsi 0 add -q bigfile) &&
+  test_cmp bigfile "ipfs/$HASH" &&
+  ipfsi 0 stats mount >stats &&
+  grep "^MountPoint: *$(pwd)/ipfs$" stats &&
+  grep "^BytesRead: *[0-9.]* [kM]B$" stats
+'
+
+test_expect_success FUSE "'ipfs mount' mounts the MFS root" '
+  mkdir "$(pwd)/mfs" &&
+  do_umount "$(pwd)/ipfs" &&
+  do_umount "$(pwd)/ipns" &&
+  ipfsi 0 mount -f "$(pwd)/ipfs" -n "$(pwd)/ipns" -m "$(pwd)/mfs" >actual &&
+  echo "IPFS mounted at: $(pwd)/ipfs" >expected &&
+  echo "IPNS mounted at: $(pwd)/ipns" >>expected &&
+  echo "MFS mounted at: $(pwd)/mfs" >>expected &&
+  test_cmp expected actual
+'
+
+test_expect_success FUSE "files written to the MFS mount are in MFS" '
+  mkdir -p mfs/dir &&
+  echo "hello" >mfs/dir/file &&
+  echo "world" >>mfs/dir/file &&
+  printf "hello\nworld\n" >expected &&
+  ipfsi 0 files read /dir/file >actual &&
+  test_cmp expected actual
+'
+
+test_expect_success FUSE "files open for writing in the MFS mount can be read with files read" '
+  exec 3>mfs/open &&
+  echo "open" >&3 &&
+  timeout 10 ipfsi 0 files read /open >actual;
+  status=$? &&
+  exec 3>&- &&
+  test $status = 0 &&
+  echo "open" >expected &&
+  test_cmp expected mfs/open &&
+  ipfsi 0 files read /open >actual &&
+  test_cmp expected actual &&
+  ipfsi 0 files rm /open
+'
+
+test_expect_success FUSE "MFS changes show in the MFS mount" '
+  ipfsi 0 files mkdir /other &&
+  echo "content" | ipfsi 0 files write --create /other/file &&
+  echo "content" >expected &&
+  test_cmp expected mfs/other/file
+'
+
+test_expect_success FUSE "files can be renamed, linked and removed in the MFS mount" '
+  mv mfs/dir/file mfs/other/renamed &&
+  ln -s renamed mfs/other/link &&
+  test_cmp mfs/other/renamed mfs/other/link &&
+  rm mfs/other/file &&
+  rmdir mfs/dir &&
+  printf "link\nrenamed\n" >expected &&
+  ipfsi 0 files ls /other >actual &&
+  test_cmp expected actual
+'
+
+test_expect_success FUSE "mode and mtime can be set in the MFS mount" '
+  chmod 0600 mfs/other/renamed &&
+  touch -d @1500000000 mfs/other/renamed &&
+  ipfsi 0 files stat --format="<mode> <mtime>" /other/renamed >actual &&
+  echo "0600 2017-07-14T02:40:00Z" >expected &&
+  test_cmp expected actual
+'
+
 test_expect_success "mount directories cannot be removed while active" '
   test_must_fail rmdir ipfs ipns 2>/dev/null
 '
 
 test_expect_success "unmount directories" '
   do_umount "$(pwd)/ipfs" &&
-  do_umount "$(pwd)/ipns"
+  do_umount "$(pwd)/ipns" &&
+  do_umount "$(pwd)/mfs"
 '
 
 test_expect_success "mount directories can be removed after shutdown" '
-  rmdir ipfs ipns
+  rmdir ipfs ipns mfs
 '
 
 test_expect_success 'stop iptb' '
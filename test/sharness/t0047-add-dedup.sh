@@ -0,0 +1,42 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="Test add --chunker=auto and --dedup-report"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "create files and a tar of them" '
+  mkdir src &&
+  random 1000000 1 > src/a &&
+  random 300000 2 > src/b &&
+  tar -cf archive.tar -C src a b
+'
+
+test_expect_success "add the files with the auto chunker" '
+  ipfs add -r -q --chunker=auto --dedup-report src 2> dedup_out > /dev/null
+'
+
+test_expect_success "new files have no existing blocks" '
+  grep "^dedup src/a: 0/" dedup_out &&
+  grep "^dedup total: 0/" dedup_out
+'
+
+test_expect_success "add the tar with the auto chunker" '
+  HASH=$(ipfs add -q --chunker=auto --dedup-report archive.tar 2> dedup_out)
+'
+
+test_expect_success "the data of the tar entries was already stored" '
+  grep "^dedup $HASH: " dedup_out &&
+  test_must_fail grep "^dedup $HASH: 0/" dedup_out
+'
+
+test_expect_success "the tar is unchanged" '
+  ipfs cat $HASH > archive.out &&
+  test_cmp archive.tar archive.out
+'
+
+test_done
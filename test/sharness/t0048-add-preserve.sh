@@ -0,0 +1,79 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="Test add --preserve-mode --preserve-mtime and files chmod/touch"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "create files with a mode and mtime" '
+  mkdir -p src/sub/empty &&
+  echo tool > src/sub/tool &&
+  chmod 750 src/sub/tool &&
+  chmod 700 src/sub &&
+  chmod 711 src/sub/empty &&
+  touch -d @1000000000 src/sub/tool src/sub/empty src/sub
+'
+
+test_expect_success "add the files with their metadata" '
+  HASH=$(ipfs add -r -Q --preserve-mode --preserve-mtime src)
+'
+
+test_expect_success "files stat shows the metadata" '
+  ipfs files stat --format="<mode> <mtime>" /ipfs/$HASH/sub/tool > stat_out &&
+  echo "0750 2001-09-09T01:46:40Z" > stat_exp &&
+  test_cmp stat_exp stat_out
+'
+
+test_expect_success "get restores the metadata" '
+  ipfs get -o out $HASH &&
+  test "$(stat -c "%a %Y" out/sub/tool)" = "750 1000000000" &&
+  test "$(stat -c "%a %Y" out/sub)" = "700 1000000000" &&
+  test "$(stat -c "%a %Y" out/sub/empty)" = "711 1000000000"
+'
+
+test_launch_ipfs_daemon_without_network
+
+test_expect_success "the client sends the metadata to the daemon" '
+  test "$(ipfs add -r -Q --preserve-mode --preserve-mtime src)" = "$HASH"
+'
+
+test_kill_ipfs_daemon
+
+test_expect_success "files without metadata are unchanged" '
+  test "$(ipfs add -r -Q src)" != "$HASH" &&
+  ipfs files stat --format="[<mode>]" /ipfs/$(ipfs add -r -Q src)/sub/tool > stat_out &&
+  echo "[]" > stat_exp &&
+  test_cmp stat_exp stat_out
+'
+
+test_expect_success "files chmod sets the mode" '
+  echo data | ipfs files write --create /file &&
+  ipfs files chmod 0644 /file &&
+  ipfs files stat --format="<mode>" /file > stat_out &&
+  echo 0644 > stat_exp &&
+  test_cmp stat_exp stat_out
+'
+
+test_expect_success "files chmod refuses invalid modes" '
+  test_must_fail ipfs files chmod 99 /file
+'
+
+test_expect_success "files touch sets the mtime and keeps the mode" '
+  ipfs files touch --mtime=1000000000 /file &&
+  ipfs files stat --format="<mode> <mtime>" /file > stat_out &&
+  echo "0644 2001-09-09T01:46:40Z" > stat_exp &&
+  test_cmp stat_exp stat_out
+'
+
+test_expect_success "files touch creates missing files" '
+  ipfs files touch /new &&
+  ipfs files stat --format="<size>" /new > stat_out &&
+  echo 0 > stat_exp &&
+  test_cmp stat_exp stat_out
+'
+
+test_done
@@ -0,0 +1,120 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="Test unpacking archives with add and writing them with get"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "create an archive" '
+  mkdir -p src/sub &&
+  echo hello > src/file &&
+  echo tool > src/sub/tool &&
+  chmod 750 src/sub/tool &&
+  chmod 700 src/sub &&
+  ln src/file src/sub/hard &&
+  ln -s ../file src/sub/link &&
+  touch -d @1000000000 src/file src/sub/tool src/sub &&
+  tar -C src -cf src.tar . &&
+  tar -C src -czf src.tar.gz .
+'
+
+test_expect_success "add --from-tar unpacks the archive" '
+  HASH=$(ipfs add -Q --from-tar src.tar) &&
+  ipfs ls $HASH/sub > ls_out &&
+  grep -q "hard$" ls_out &&
+  grep -q "link$" ls_out &&
+  grep -q "tool$" ls_out
+'
+
+test_expect_success "add --from-tar reads compressed archives" '
+  test "$(ipfs add -Q --from-tar src.tar.gz)" = "$HASH"
+'
+
+test_expect_success "add --from-tar reads the standard input" '
+  test "$(ipfs add -Q --from-tar < src.tar)" = "$HASH"
+'
+
+test_expect_success "add --from-tar names the events after the archive" '
+  ipfs add --from-tar src.tar > add_out &&
+  grep -q "added $HASH src$" add_out
+'
+
+test_expect_success "add --from-tar keeps the metadata" '
+  ipfs files stat --format="<mode> <mtime>" /ipfs/$HASH/sub/tool > stat_out &&
+  echo "0750 2001-09-09T01:46:40Z" > stat_exp &&
+  test_cmp stat_exp stat_out &&
+  ipfs files stat --format="<mode>" /ipfs/$HASH/sub > stat_out &&
+  echo 0700 > stat_exp &&
+  test_cmp stat_exp stat_out
+'
+
+test_expect_success "hard links point to the same file" '
+  test "$(ipfs resolve -r /ipfs/$HASH/sub/hard)" = "$(ipfs resolve -r /ipfs/$HASH/file)"
+'
+
+test_expect_success "add --from-tar refuses --nocopy and -w" '
+  test_must_fail ipfs add --from-tar --nocopy src.tar &&
+  test_must_fail ipfs add --from-tar -w src.tar
+'
+
+test_expect_success "get --to-tar writes the archive" '
+  ipfs get --to-tar $HASH > out.tar &&
+  tar -tf out.tar > tar_out &&
+  grep -q "^sub/tool$" tar_out &&
+  mkdir out &&
+  tar -C out -xf out.tar &&
+  test_cmp src/sub/tool out/sub/tool &&
+  test "$(stat -c "%a %Y" out/sub/tool)" = "750 1000000000" &&
+  test "$(stat -c "%h" out/file)" = 1 &&
+  test_cmp out/file out/sub/hard &&
+  test "$(readlink out/sub/link)" = "../file"
+'
+
+test_expect_success "get --to-tar writes to the output path" '
+  ipfs get --to-tar -o out2.tar $HASH &&
+  test_cmp out.tar out2.tar
+'
+
+test_expect_success "archives written by get --to-tar add the same" '
+  test "$(ipfs add -Q --from-tar out.tar)" = "$HASH"
+'
+
+test_expect_success "add --unpack=tgz reads compressed archives" '
+  test "$(ipfs add -Q --unpack=tgz src.tar.gz)" = "$HASH"
+'
+
+test_expect_success "add --unpack refuses unknown formats" '
+  test_must_fail ipfs add --unpack=rar src.tar 2> unpack_err &&
+  grep -q "unknown archive format" unpack_err
+'
+
+test_expect_success "get --archive-format=zip writes a zip archive" '
+  ipfs get --archive-format=zip -o src $HASH &&
+  test -f src.zip
+'
+
+test_expect_success UNZIP "the zip archive holds the files" '
+  mkdir unzipped &&
+  (cd unzipped && unzip -q ../src.zip) &&
+  test_cmp src/sub/tool unzipped/$HASH/sub/tool &&
+  test "$(stat -c "%a" unzipped/$HASH/sub/tool)" = 750 &&
+  test "$(readlink unzipped/$HASH/sub/link)" = "../file"
+'
+
+test_expect_success "add --unpack=zip unpacks the archive" '
+  ZIPHASH=$(ipfs add -Q --unpack=zip src.zip) &&
+  test "$(ipfs resolve -r /ipfs/$ZIPHASH/$HASH/sub/tool)" = "$(ipfs resolve -r /ipfs/$HASH/sub/tool)" &&
+  ipfs files stat --format="<mode> <mtime>" /ipfs/$ZIPHASH/$HASH/sub > stat_out &&
+  echo "0700 2001-09-09T01:46:40Z" > stat_exp &&
+  test_cmp stat_exp stat_out
+'
+
+test_expect_success "get refuses unknown archive formats" '
+  test_must_fail ipfs get --archive-format=rar $HASH
+'
+
+test_done
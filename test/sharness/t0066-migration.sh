@@ -11,13 +11,15 @@ test_description="Test migrations auto update prompt"
 test_init_ipfs
 
 MIGRATION_START=7
+# The migrations from EMBEDDED_START on are compiled into ipfs.
+EMBEDDED_START=10
 IPFS_REPO_VER=$(<.ipfs/version)
 
 # Generate mock migration binaries
 gen_mock_migrations() {
   mkdir bin
   i=$((MIGRATION_START))
-  until [ $i -ge $IPFS_REPO_VER ]
+  until [ $i -ge $EMBEDDED_START ]
   do
     j=$((i+1))
     echo "#!/bin/bash" > bin/fs-repo-${i}-to-${j}
@@ -31,10 +33,16 @@ gen_mock_migrations() {
 check_migration_output() {
   out_file="$1"
   i=$((MIGRATION_START))
+  until [ $i -ge $EMBEDDED_START ]
+  do
+    j=$((i+1))
+    grep "applying ${i}-to-${j} repo migration" "$out_file" > /dev/null || return 1
+    ((i++))
+  done
   until [ $i -ge $IPFS_REPO_VER ]
   do
     j=$((i+1))
-    grep "applying ${i}-to-${j} repo migration" "$out_file" > /dev/null
+    grep "Running embedded migration fs-repo-${i}-to-${j}" "$out_file" > /dev/null || return 1
     ((i++))
   done
 }
@@ -44,7 +52,7 @@ check_migration_output() {
 test_expect_success "setup mock migrations" '
   gen_mock_migrations &&
   find bin -name "fs-repo-*-to-*" | wc -l > mock_count &&
-  echo $((IPFS_REPO_VER-MIGRATION_START)) > expect_mock_count &&
+  echo $((EMBEDDED_START-MIGRATION_START)) > expect_mock_count &&
   export PATH="$(pwd)/bin":$PATH &&
   test_cmp mock_count expect_mock_count
 '
@@ -61,17 +69,17 @@ test_expect_success "output looks good" '
   grep "Please get fs-repo-migrations from https://dist.ipfs.io" false_out
 '
 
-# The migrations will succeed, but the daemon will still exit with 1 because
-# the fake migrations do not update the repo version number.
-#
-# If run with real migrations, the daemon continues running and must be killed.
-test_expect_success "ipfs daemon --migrate=true runs migration" '
-  test_expect_code 1 ipfs daemon --migrate=true > true_out
+test_expect_success "ipfs daemon --migrate-dry-run changes nothing" '
+  ipfs daemon --migrate-dry-run > dry_out &&
+  echo "$MIGRATION_START" > expect_version &&
+  test_cmp expect_version "$IPFS_PATH"/version
 '
 
 test_expect_success "output looks good" '
-  check_migration_output true_out &&
-  grep "Success: fs-repo migrated to version $IPFS_REPO_VER" true_out > /dev/null
+  grep "Would run: .*fs-repo-${MIGRATION_START}-to-" dry_out > /dev/null &&
+  grep "No pinsets to convert" dry_out > /dev/null &&
+  grep "Dry run: fs-repo would be migrated to version $IPFS_REPO_VER" dry_out > /dev/null &&
+  grep "Not starting the daemon" dry_out > /dev/null
 '
 
 test_expect_success "'ipfs daemon' prompts to auto migrate" '
@@ -84,4 +92,17 @@ test_expect_success "output looks good" '
   grep "Please get fs-repo-migrations from https://dist.ipfs.io" daemon_out > /dev/null
 '
 
+# The mock migrations don't change the repo, the embedded ones bring it to
+# the current version, and the daemon starts.
+test_launch_ipfs_daemon_without_network --migrate=true
+
+test_expect_success "output looks good" '
+  check_migration_output actual_daemon &&
+  grep "Success: fs-repo migrated to version $IPFS_REPO_VER" actual_daemon > /dev/null &&
+  echo "$IPFS_REPO_VER" > expect_version &&
+  test_cmp expect_version "$IPFS_PATH"/version
+'
+
+test_kill_ipfs_daemon
+
 test_done
@@ -0,0 +1,69 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="Test ipfs repo backup and restore"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "add some data" '
+  random 1000000 41 > afile &&
+  HASH=$(ipfs add -q afile | tail -n1) &&
+  echo "mfs" | ipfs files write --create /file &&
+  ipfs key gen --type=ed25519 backupkey > /dev/null &&
+  PEERID=$(ipfs config Identity.PeerID)
+'
+
+test_launch_ipfs_daemon --offline
+
+test_expect_success "back up the repo while the daemon runs" '
+  ipfs repo backup backup > backup_out &&
+  grep "backed up" backup_out &&
+  test -f "$IPFS_PATH/backups/backup/manifest.json" &&
+  test -f "$IPFS_PATH/backups/backup/blocks.car" &&
+  mv "$IPFS_PATH/backups/backup" backup
+'
+
+test_expect_success "the daemon only writes backups to the repo" '
+  test_must_fail ipfs repo backup "$(pwd)/elsewhere" &&
+  test_must_fail ipfs repo backup ../elsewhere &&
+  test_must_fail test -e elsewhere
+'
+
+test_expect_success "backing up to an existing directory fails" '
+  mkdir -p "$IPFS_PATH/backups/existing" &&
+  test_must_fail ipfs repo backup existing
+'
+
+test_expect_success "restoring with the daemon running fails" '
+  test_must_fail ipfs repo restore backup
+'
+
+test_kill_ipfs_daemon
+
+test_expect_success "restore the backup" '
+  IPFS_PATH="$(pwd)/restored" ipfs repo restore backup > restore_out &&
+  grep "restored" restore_out
+'
+
+test_expect_success "the restored repo has the data" '
+  export IPFS_PATH="$(pwd)/restored" &&
+  test "$(ipfs config Identity.PeerID)" = "$PEERID" &&
+  ipfs key list | grep backupkey &&
+  ipfs pin ls --type=recursive | grep $HASH &&
+  ipfs cat $HASH > afile_out &&
+  test_cmp afile afile_out &&
+  ipfs files read /file > mfs_out &&
+  echo "mfs" > mfs_expected &&
+  test_cmp mfs_expected mfs_out &&
+  ipfs repo verify
+'
+
+test_expect_success "restoring over a repo fails" '
+  IPFS_PATH="$(pwd)/restored" test_must_fail ipfs repo restore backup
+'
+
+test_done
@@ -0,0 +1,54 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="Test ipfs repo convert"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "add some data" '
+  random 1000000 41 > afile &&
+  HASH=$(ipfs add -q afile)
+'
+
+test_expect_success "converting to the same datastore fails" '
+  test_must_fail ipfs repo convert --to=flatfs 2> convert_err &&
+  grep "doesn'"'"'t change the datastore" convert_err
+'
+
+test_launch_ipfs_daemon --offline
+
+test_expect_success "convert the datastore while the daemon runs" '
+  ipfs repo convert --to=badgerds > convert_out &&
+  grep "converted the datastore" convert_out &&
+  grep "badgerds" "$IPFS_PATH/datastore_spec"
+'
+
+test_expect_success "add data after the conversion" '
+  random 100000 42 > bfile &&
+  HASH2=$(ipfs add -q bfile)
+'
+
+test_kill_ipfs_daemon
+
+test_expect_success "the previous datastore can be removed" '
+  rm -r "$IPFS_PATH/blocks" "$IPFS_PATH/datastore" &&
+  ipfs cat $HASH > afile_out &&
+  test_cmp afile afile_out &&
+  ipfs cat $HASH2 > bfile_out &&
+  test_cmp bfile bfile_out &&
+  ipfs repo verify
+'
+
+test_expect_success "convert the datastore offline" '
+  ipfs repo convert --to=flatfs > convert_out &&
+  grep "flatfs" "$IPFS_PATH/datastore_spec" &&
+  rm -r "$IPFS_PATH/badgerds" &&
+  ipfs cat $HASH > afile_out &&
+  test_cmp afile afile_out
+'
+
+test_done
@@ -123,6 +123,12 @@ test_expect_success "/p2p addresses work" '
   [ $(ipfsi 0 swarm peers | wc -l) -eq 1 ]
 '
 
+test_expect_success "swarm peers --verbose explains connection priorities" '
+  ipfsi 0 swarm peers --verbose >peers_verbose &&
+  test_should_contain "priority: value" peers_verbose &&
+  test_should_contain "kept: below low water" peers_verbose
+'
+
 test_expect_success "ipfs id is consistent for node 0" '
   ipfsi 1 id "$(iptb attr get 0 id)" > 1see0 &&
   ipfsi 0 id > 0see0 &&
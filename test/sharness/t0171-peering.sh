@@ -120,6 +120,28 @@ sleep 30
 
 check_peers
 
+test_expect_success 'peering ls lists the configured peers' '
+  ipfsi 1 swarm peering ls > peering_ls_1 &&
+  grep -E "$(peer_id 0) +connected +static" peering_ls_1 &&
+  grep -E "$(peer_id 2) +connected +static" peering_ls_1
+'
+
+test_expect_success 'peering rm removes a peer from the config' '
+  ipfsi 1 swarm peering rm "$(peer_id 2)" &&
+  ipfsi 1 swarm peering ls > peering_ls_1 &&
+  test_must_fail grep "$(peer_id 2)" peering_ls_1 &&
+  ipfsi 1 config Peering.Peers > peering_cfg_1 &&
+  test_must_fail grep "$(peer_id 2)" peering_cfg_1
+'
+
+test_expect_success 'peering add adds a peer back' '
+  ipfsi 1 swarm peering add "$(ipfsi 2 config Addresses.Swarm --json | tr -d "[] \"\n")/p2p/$(peer_id 2)" &&
+  ipfsi 1 config Peering.Peers > peering_cfg_1 &&
+  grep "$(peer_id 2)" peering_cfg_1
+'
+
+check_peers
+
 test_expect_success "stop testbed" '
   iptb stop
 '
@@ -98,6 +98,32 @@ EOF
   test_cmp expected stat_out_human
 '
 
+test_expect_success "'ipfs bitswap sessions' succeeds" '
+  ipfs bitswap sessions >sessions_out
+'
+
+test_expect_success "'ipfs bitswap sessions' output is empty" '
+  test_must_be_empty sessions_out
+'
+
+test_expect_success "'ipfs bitswap sessions' lists a running fetch" '
+  MISSING=$(echo "not on this node" | ipfs add -q --only-hash) &&
+  { ipfs block get "$MISSING" >/dev/null 2>&1 & FETCH_PID=$!; } &&
+  go-sleep 1s &&
+  ipfs bitswap sessions --wanted >sessions_out &&
+  kill "$FETCH_PID" &&
+  grep "(active, " sessions_out &&
+  grep "root: $MISSING" sessions_out &&
+  grep "wantlist \[1 keys\]" sessions_out &&
+  grep -E "^[[:space:]]+$MISSING\$" sessions_out
+'
+
+test_expect_success "'ipfs bitswap sessions' drops the fetch once it is canceled" '
+  go-sleep 1s &&
+  ipfs bitswap sessions >sessions_out &&
+  test_must_be_empty sessions_out
+'
+
 test_kill_ipfs_daemon
 
 test_done
@@ -0,0 +1,65 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="test snapshots of the unix files api"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "create files" '
+  ipfs files mkdir /dir &&
+  echo "foo" | ipfs files write --create /dir/foo &&
+  echo "bar" | ipfs files write --create /bar
+'
+
+test_expect_success "take a snapshot" '
+  ipfs files snapshot create first > create_out &&
+  grep "created snapshot first" create_out
+'
+
+test_expect_success "snapshot names are unique" '
+  test_must_fail ipfs files snapshot create first
+'
+
+test_expect_success "snapshot is listed" '
+  ipfs files snapshot ls > ls_out &&
+  grep "^first" ls_out
+'
+
+test_expect_success "snapshot survives gc" '
+  ipfs files rm -r /dir &&
+  ipfs files rm /bar &&
+  ipfs repo gc &&
+  test_must_fail ipfs files stat /dir
+'
+
+test_expect_success "restore a single path" '
+  ipfs files snapshot restore first /dir/foo &&
+  ipfs files read /dir/foo > foo_out &&
+  echo "foo" > foo_exp &&
+  test_cmp foo_exp foo_out &&
+  test_must_fail ipfs files stat /bar
+'
+
+test_expect_success "restore the whole tree" '
+  ipfs files snapshot restore first &&
+  ipfs files read /bar > bar_out &&
+  echo "bar" > bar_exp &&
+  test_cmp bar_exp bar_out
+'
+
+test_expect_success "restoring saves the previous state" '
+  ipfs files snapshot ls > ls_out &&
+  grep "^before-restore-" ls_out
+'
+
+test_expect_success "remove the snapshot" '
+  ipfs files snapshot rm first &&
+  ipfs files snapshot ls > ls_out &&
+  test_must_fail grep "^first" ls_out
+'
+
+test_done
@@ -0,0 +1,64 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="test the journal of the unix files api"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "make changes" '
+  echo "foo" | ipfs files write --create /foo &&
+  ipfs files mkdir /dir &&
+  ipfs files snapshot create before &&
+  ipfs files mv /foo /dir &&
+  ipfs files cp /dir/foo /bar &&
+  ipfs files rm /bar
+'
+
+test_expect_success "changes are logged" '
+  ipfs files log > log_out &&
+  test_line_count = 5 log_out &&
+  grep "cli write /foo - -> " log_out &&
+  grep "mv /dir/foo (from /foo)" log_out &&
+  grep "rm /bar .* -> -$" log_out
+'
+
+test_expect_success "log of a path" '
+  ipfs files log /dir > log_out &&
+  test_line_count = 3 log_out
+'
+
+test_expect_success "log with time filters" '
+  ipfs files log --since 1h > log_out &&
+  test_line_count = 5 log_out &&
+  ipfs files log --until 1h > log_out &&
+  test_line_count = 0 log_out &&
+  test_must_fail ipfs files log --since yesterday
+'
+
+test_launch_ipfs_daemon
+
+test_expect_success "changes through the API log the client" '
+  ipfs files mkdir /api &&
+  ipfs files log /api > log_out &&
+  grep "api:127.0.0.1:[0-9]* mkdir /api" log_out
+'
+
+test_kill_ipfs_daemon
+
+test_expect_success "diff against a snapshot" '
+  ipfs files diff before > diff_out &&
+  grep "^+ .* \"dir/foo\"" diff_out &&
+  grep "^- .* \"foo\"" diff_out
+'
+
+test_expect_success "diff a path against a CID" '
+  ROOT=$(ipfs files snapshot ls | awk "/^before/ { print \$2 }") &&
+  ipfs files diff $ROOT /dir > diff_out &&
+  grep "^+ .* \"foo\"" diff_out
+'
+
+test_done
@@ -0,0 +1,66 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="test batches of the unix files api"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "create a file" '
+  echo "foo" | ipfs files write --create /foo &&
+  ROOT=$(ipfs files stat --hash /)
+'
+
+test_expect_success "apply a batch" '
+  echo "{\"Op\": \"mkdir\", \"Path\": \"/dir\"}" > ops &&
+  echo "{\"Op\": \"cp\", \"Src\": \"/foo\", \"Dst\": \"/dir/\"}" >> ops &&
+  echo "{\"Op\": \"rm\", \"Path\": \"/foo\"}" >> ops &&
+  ipfs files batch --expect-root $ROOT < ops > batch_out &&
+  grep "applied 3 operations" batch_out &&
+  ipfs files ls / > ls_out &&
+  echo "dir" > ls_exp &&
+  test_cmp ls_exp ls_out &&
+  ipfs files read /dir/foo
+'
+
+test_expect_success "a stale root is a conflict" '
+  echo "{\"Op\": \"rm\", \"Path\": \"/dir/foo\"}" > ops &&
+  test_must_fail ipfs files batch --expect-root $ROOT < ops 2> batch_err &&
+  grep "conflict" batch_err &&
+  ipfs files read /dir/foo
+'
+
+test_expect_success "a failed batch changes nothing" '
+  NEW_ROOT=$(ipfs files stat --hash /) &&
+  echo "{\"Op\": \"rm\", \"Path\": \"/dir/foo\"}" > ops &&
+  echo "{\"Op\": \"rm\", \"Path\": \"/missing\"}" >> ops &&
+  test_must_fail ipfs files batch < ops &&
+  ipfs files stat --hash / > root_out &&
+  echo $NEW_ROOT > root_exp &&
+  test_cmp root_exp root_out
+'
+
+test_launch_ipfs_daemon_without_network
+
+test_expect_success "files write does not lock the MFS root while reading its data" '
+  mkfifo slow &&
+  { ipfs files write --create /slow < slow & } &&
+  exec 3>slow &&
+  echo "part" >&3 &&
+  echo "{\"Op\": \"mkdir\", \"Path\": \"/during\"}" > ops &&
+  timeout 10 ipfs files batch < ops;
+  status=$? &&
+  exec 3>&- &&
+  wait &&
+  test $status = 0 &&
+  ipfs files read /slow > slow_out &&
+  echo "part" > slow_exp &&
+  test_cmp slow_exp slow_out
+'
+
+test_kill_ipfs_daemon
+
+test_done
@@ -0,0 +1,87 @@
+#!/usr/bin/env bash
+#
+# MIT Licensed; see the LICENSE file in this repository.
+#
+
+test_description="test synchronizing local directories with the unix files api"
+
+. lib/test-lib.sh
+
+test_init_ipfs
+
+test_expect_success "create a local directory" '
+  mkdir -p src/sub &&
+  echo "a" > src/a &&
+  echo "b" > src/sub/b &&
+  echo "hidden" > src/.hidden
+'
+
+test_expect_success "push the directory" '
+  ipfs files sync src /synced > sync_out &&
+  grep "write /synced/a" sync_out &&
+  grep "write /synced/sub/b" sync_out &&
+  test_must_fail ipfs files stat /synced/.hidden
+'
+
+test_expect_success "nothing to do when nothing changed" '
+  ipfs files sync src /synced > sync_out &&
+  test_must_be_empty sync_out
+'
+
+test_expect_success "only changes are pushed" '
+  echo "changed" > src/a &&
+  rm -r src/sub &&
+  ipfs files sync --delete src /synced > sync_out &&
+  test_line_count = 2 sync_out &&
+  grep "write /synced/a" sync_out &&
+  grep "rm /synced/sub" sync_out &&
+  ipfs files read /synced/a > a_out &&
+  test_cmp src/a a_out
+'
+
+test_expect_success "pushed changes are logged" '
+  ipfs files log /synced > log_out &&
+  grep "rm /synced/sub" log_out
+'
+
+test_expect_success "pull the directory" '
+  ipfs files sync --pull dst /synced &&
+  test_cmp src/a dst/a &&
+  echo "extra" > dst/extra &&
+  ipfs files sync --pull dst /synced &&
+  test -f dst/extra &&
+  ipfs files sync --pull --delete dst /synced &&
+  test_must_fail test -f dst/extra
+'
+
+test_launch_ipfs_daemon
+
+test_expect_success "the client syncs through the daemon" '
+  echo "c" > src/c &&
+  ipfs files sync src /synced > sync_out &&
+  test_line_count = 1 sync_out &&
+  grep "write /synced/c" sync_out &&
+  ipfs files read /synced/c > c_out &&
+  test_cmp src/c c_out
+'
+
+test_expect_success "changes pushed through the daemon are logged" '
+  ipfs files log /synced/c > log_out &&
+  grep "cp /synced/c" log_out
+'
+
+test_expect_success "the client pulls through the daemon" '
+  ipfs files sync --pull dst /synced > sync_out &&
+  test_line_count = 1 sync_out &&
+  test_cmp src/c dst/c
+'
+
+test_expect_success "the daemon refuses to sync its own directories" '
+  curl -s -X POST "http://$API_ADDR/api/v0/files/sync?arg=$(pwd)/src&arg=/api" > curl_out &&
+  grep "only runs in the ipfs command" curl_out &&
+  test_must_fail ipfs files stat /api
+'
+
+test_kill_ipfs_daemon
+
+test_done
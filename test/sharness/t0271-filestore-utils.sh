@@ -167,6 +167,48 @@ test_filestore_dups() {
   '
 }
 
+test_filestore_repair() {
+  test_filestore_state
+
+  test_expect_success "move, modify and remove files" '
+    mkdir moved &&
+    mv somedir/file3 moved/file3.moved &&
+    random 10000 4 > somedir/file2 &&
+    rm somedir/file1 &&
+    FILE2_NEW=$($IPFS_CMD add -q --only-hash --raw-leaves somedir/file2)
+  '
+
+  test_expect_success "'$IPFS_CMD filestore repair --dry-run' changes nothing" '
+    $IPFS_CMD filestore repair --dry-run --search-path=moved > repair_actual &&
+    grep "^moved   somedir/file3 .*/moved/file3.moved (4 blocks)$" repair_actual &&
+    test_must_fail $IPFS_CMD cat $FILE3_HASH
+  '
+
+  test_expect_success "'$IPFS_CMD filestore repair' output looks good" '
+    $IPFS_CMD filestore repair --search-path=moved > repair_actual &&
+    grep "^removed somedir/file1 (1 blocks)$" repair_actual &&
+    grep "^readded somedir/file2 $FILE2_NEW (1 blocks)$" repair_actual &&
+    grep "^moved   somedir/file3 .*/moved/file3.moved (4 blocks)$" repair_actual
+  '
+
+  test_expect_success "repaired files can be retrieved" '
+    $IPFS_CMD cat $FILE3_HASH > file3.data &&
+    test_cmp moved/file3.moved file3.data &&
+    $IPFS_CMD cat $FILE2_NEW > file2.data &&
+    test_cmp somedir/file2 file2.data
+  '
+
+  test_expect_success "'$IPFS_CMD filestore verify' shows no broken objects" '
+    $IPFS_CMD filestore verify > verify_actual &&
+    test_must_fail grep -v "^ok" verify_actual &&
+    test_must_fail grep somedir/file1 verify_actual
+  '
+
+  test_expect_success "clean up" '
+    rm -r moved
+  '
+}
+
 #
 # No daemon
 #
@@ -179,6 +221,8 @@ test_filestore_verify
 
 test_filestore_dups
 
+test_filestore_repair
+
 #
 # With daemon
 #
@@ -195,6 +239,8 @@ test_filestore_verify
 
 test_filestore_dups
 
+test_filestore_repair
+
 test_kill_ipfs_daemon
 
 ##
@@ -45,7 +45,8 @@ test_urlstore() {
   test_kill_ipfs_daemon
   
   test_expect_success "enable urlstore" '
-    ipfs config --json Experimental.UrlstoreEnabled true
+    ipfs config --json Experimental.UrlstoreEnabled true &&
+    ipfs config --json Urlstore "{\"RetryDelay\": \"10ms\"}"
   '
   
   test_launch_ipfs_daemon_without_network
@@ -129,6 +130,17 @@ EOF
     test_must_fail ipfs cat $HASH1 > /dev/null &&
     test_must_fail ipfs cat $HASH2 > /dev/null
   '
+
+  test_expect_success "ipfs urlstore verify reports the broken blocks" '
+    ipfs urlstore verify > urlstore_verify &&
+    test $(grep -c "^failed" urlstore_verify) -eq 2
+  '
+
+  test_expect_success "ipfs urlstore health shows the failing URL" '
+    ipfs urlstore health > urlstore_health &&
+    grep "/ipfs/$HASH2a " urlstore_health &&
+    grep "blocks failed" urlstore_health
+  '
   
   test_expect_success "remove broken files" '
     ipfs pin rm $HASH2 &&